@@ -0,0 +1,34 @@
+package authy
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Default of Config.IsAPIRequest: requests asking for JSON or sent by XMLHttpRequest come from scripts that can't
+// follow a redirect to the login page
+func IsAPIRequest(r *http.Request) bool {
+	if r.Header.Get("X-Requested-With") != "" {
+		return true
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer API clients that need to log in with a 401 and a JSON body giving them the login URL
+func WriteLoginRequired(w http.ResponseWriter, loginURL string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":     "login_required",
+		"login_url": loginURL,
+	})
+}
@@ -0,0 +1,29 @@
+package authy_test
+
+import (
+	"github.com/christopherobin/authy"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+)
+
+func TestIsAPIRequest(t *testing.T) {
+	Convey("Tell API clients from browsers", t, func() {
+		request := func(headers map[string]string) *http.Request {
+			r, _ := http.NewRequest("GET", "http://localhost/profile", nil)
+			for name, value := range headers {
+				r.Header.Set(name, value)
+			}
+			return r
+		}
+
+		So(authy.IsAPIRequest(request(map[string]string{
+			"Accept": "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		})), ShouldBeFalse)
+		So(authy.IsAPIRequest(request(nil)), ShouldBeFalse)
+
+		So(authy.IsAPIRequest(request(map[string]string{"Accept": "application/json"})), ShouldBeTrue)
+		So(authy.IsAPIRequest(request(map[string]string{"Accept": "application/vnd.api+json; q=0.9"})), ShouldBeTrue)
+		So(authy.IsAPIRequest(request(map[string]string{"X-Requested-With": "XMLHttpRequest"})), ShouldBeTrue)
+	})
+}
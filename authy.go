@@ -4,16 +4,22 @@
 // Middlewares:
 //
 // * Martini: https://github.com/christopherobin/authy/martini
+// * net/http: https://github.com/christopherobin/authy/nethttp
+// * Gin: https://github.com/christopherobin/authy/gin
+// * chi: https://github.com/christopherobin/authy/chi
 //
 // For a full guide visit https://github.com/christopherobin/authy
 package authy
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"github.com/christopherobin/authy/oauth2"
 	"github.com/christopherobin/authy/provider"
+	"io"
 	"net/http"
+	"sort"
 	"strings"
 )
 
@@ -21,46 +27,251 @@ import (
 type Authy struct {
 	config    Config
 	providers map[string]provider.ProviderConfig
+	// signs the return paths carried in the state
+	stateKey []byte
+	// tokens reused by CachedClientToken
+	tokenCache TokenCache
+	// client tokens being fetched by CachedClientToken, shared by the copies of the instance
+	clientTokens *clientTokenCalls
 }
 
 // Parse the configuration and build the list of providers, return an Authy instance
 func NewAuthy(config Config) (Authy, error) {
 	var availableProviders = map[string]provider.ProviderConfig{}
+	var configErrors []error
 
-	// load all providers
-	for providerName, providerConfig := range config.Providers {
-		providerData, err := provider.GetProvider(providerName)
+	// load all providers, every misconfigured provider is reported at once
+	providerNames := make([]string, 0, len(config.Providers))
+	for providerName := range config.Providers {
+		providerNames = append(providerNames, providerName)
+	}
+	sort.Strings(providerNames)
+
+	for _, providerName := range providerNames {
+		// the middlewares would take the provider's login route for the logout route
+		if providerName == LogoutSegment {
+			configErrors = append(configErrors, fmt.Errorf("provider %s: name is reserved for the logout route", providerName))
+			continue
+		}
+
+		providerConfig := config.Providers[providerName]
+		if providerConfig.Logger == nil {
+			providerConfig.Logger = config.Logger
+		}
+		if providerConfig.Retry == nil {
+			providerConfig.Retry = config.Retry
+		}
+		providerConfig.CallbackSegment = config.CallbackSegment
+		providerConfig.Scope = oauth2.CleanScopes(providerConfig.Scope)
+
+		providerConfig, err := loadProvider(providerName, providerConfig)
 		if err != nil {
-			return Authy{}, err
+			configErrors = append(configErrors, fmt.Errorf("provider %s: %w", providerName, err))
+			continue
 		}
-		providerConfig.Provider = providerData
+
 		availableProviders[providerName] = providerConfig
 	}
 
+	// don't change the caller's config when resolving the key
+	if config.StateCookie != nil {
+		stateCookie, err := loadStateCookie(*config.StateCookie)
+		if err != nil {
+			configErrors = append(configErrors, fmt.Errorf("state cookie: %w", err))
+		}
+		config.StateCookie = &stateCookie
+	}
+
+	if config.StateLength == 0 {
+		config.StateLength = oauth2.DefaultStateLength
+	} else if config.StateLength < oauth2.MinStateLength {
+		configErrors = append(configErrors, fmt.Errorf("state length must be at least %d bytes", oauth2.MinStateLength))
+	}
+
+	stateKey, err := loadStateKey(config)
+	if err != nil {
+		configErrors = append(configErrors, fmt.Errorf("state key: %w", err))
+	}
+
+	if len(configErrors) > 0 {
+		return Authy{}, errors.Join(configErrors...)
+	}
+
+	tokenCache := config.TokenCache
+	if tokenCache == nil {
+		tokenCache = NewMemoryTokenCache(DefaultTokenCacheTTL)
+	}
+
 	return Authy{
-		config:    config,
-		providers: availableProviders,
+		config:       config,
+		providers:    availableProviders,
+		stateKey:     stateKey,
+		tokenCache:   tokenCache,
+		clientTokens: &clientTokenCalls{calls: map[string]*clientTokenCall{}},
 	}, nil
 }
 
+// Resolve the provider definition and credentials of a provider config and check that nothing required is missing
+func loadProvider(providerName string, providerConfig provider.ProviderConfig) (provider.ProviderConfig, error) {
+	var err error
+	if providerConfig.Inline != nil {
+		providerData := *providerConfig.Inline
+		if providerData.Name == "" {
+			providerData.Name = providerName
+		}
+		if providerData.ScopeDelimiter == "" {
+			providerData.ScopeDelimiter = ","
+		}
+		providerConfig.Provider = providerData
+	} else {
+		providerConfig.Provider, err = provider.GetProvider(providerName)
+		if err != nil {
+			return providerConfig, err
+		}
+	}
+
+	if err = providerConfig.Provider.Validate(); err != nil {
+		return providerConfig, err
+	}
+	if err = providerConfig.ValidateScopes(); err != nil {
+		return providerConfig, err
+	}
+	if err = providerConfig.ValidateResources(); err != nil {
+		return providerConfig, err
+	}
+
+	// read credentials from the environment if needed
+	if providerConfig.Key, err = resolveEnv(providerConfig.Key); err != nil {
+		return providerConfig, err
+	}
+	if providerConfig.Secret, err = resolveEnv(providerConfig.Secret); err != nil {
+		return providerConfig, err
+	}
+	if providerConfig.PrivateKey, err = resolveEnv(providerConfig.PrivateKey); err != nil {
+		return providerConfig, err
+	}
+
+	var missing []string
+	if providerConfig.Key == "" {
+		missing = append(missing, "key")
+	}
+	// public clients using PKCE or the implicit flow don't have a secret, clients signing assertions use a key instead
+	if providerConfig.Provider.ClientAuthMethod == provider.ClientAuthPrivateKeyJWT ||
+		providerConfig.Provider.ClientAuthMethod == provider.ClientAuthGeneratedSecret {
+		if providerConfig.PrivateKey == "" {
+			missing = append(missing, "private key")
+		} else if _, err := oauth2.ParsePrivateKey(providerConfig.PrivateKey); err != nil {
+			return providerConfig, err
+		}
+	} else if providerConfig.Secret == "" && !providerConfig.Provider.PKCE &&
+		providerConfig.Provider.ResponseType != provider.ResponseTypeToken {
+		missing = append(missing, "secret")
+	}
+	if providerConfig.Provider.Subdomain && providerConfig.Subdomain == "" {
+		missing = append(missing, "subdomain")
+	}
+	if len(missing) > 0 {
+		return providerConfig, errors.New(fmt.Sprintf("missing %s", strings.Join(missing, ", ")))
+	}
+
+	// fill [subdomain], [realm], [base_url] and [tenant] once and for all
+	if providerConfig.Provider, err = providerConfig.ExpandURLs(); err != nil {
+		return providerConfig, err
+	}
+
+	return providerConfig, nil
+}
+
+// Source of the random values of the authorizations, see Config.Rand
+func (a Authy) random() io.Reader {
+	if a.config.Rand != nil {
+		return a.config.Rand
+	}
+	return rand.Reader
+}
+
+// Whether the given provider is part of the current configuration
+func (a Authy) HasProvider(providerName string) bool {
+	_, ok := a.providers[providerName]
+	return ok
+}
+
 // Generate a CSRF token and store it in the provided session object, return the authorisation URL
 // It should be noted that the session object should prevent the user from seeing the sum generated
-func (a Authy) Authorize(providerName string, session Session, r *http.Request) (string, error) {
+func (a Authy) Authorize(providerName string, session Session, r *http.Request, opts ...AuthorizeOption) (string, error) {
+	return a.authorize(providerName, sessionBackend{a, session}, r, opts)
+}
+
+// Same as Authorize with request scoped parameters (a login_hint prefilling the email, prompt=select_account, ...), see
+// WithParams
+func (a Authy) AuthorizeWithParams(providerName string, session Session, r *http.Request, params map[string]string) (string, error) {
+	return a.Authorize(providerName, session, r, WithParams(params))
+}
+
+func (a Authy) authorize(providerName string, backend stateBackend, r *http.Request, opts []AuthorizeOption) (string, error) {
 	providerConfig, ok := a.providers[providerName]
 	if ok != true {
-		return "", errors.New(fmt.Sprintf("unknown provider %s", providerName))
+		return "", fmt.Errorf("%w %s", ErrUnknownProvider, providerName)
+	}
+
+	options := newAuthorizeOptions(opts)
+	if options.returnTo != "" && !validReturnTo(options.returnTo) {
+		return "", ErrInvalidReturnTo
+	}
+	if options.scopeDelimiter != "" {
+		providerConfig.Provider.ScopeDelimiter = options.scopeDelimiter
+	}
+	if options.scope != nil {
+		scope := oauth2.CleanScopes(options.scope)
+		if err := providerConfig.Provider.ValidateScopes(scope); err != nil {
+			return "", err
+		}
+		providerConfig.Scope = scope
+	}
+	providerConfig.Scope = refreshScope(providerConfig)
+	if options.params != nil {
+		params, err := mergeParams(providerConfig, options.params)
+		if err != nil {
+			return "", err
+		}
+		providerConfig.CustomParameters = params
 	}
 
 	if providerConfig.Provider.OAuth == 2 {
-		state, err := oauth2.NewState()
+		state, err := oauth2.NewStateFrom(a.random(), a.config.StateLength)
 		if err != nil {
 			return "", err
 		}
+		if options.returnTo != "" {
+			state = a.embedReturnTo(state, options.returnTo)
+		}
 
-		// save authentication state in session
-		session.Set("authy."+providerName+".state", state)
-		session.Set("authy."+state+".scope", strings.Join(providerConfig.Scope, ","))
 		providerConfig.State = state
+		providerConfig.RedirectURI = oauth2.CallbackURL(providerConfig, r)
+		data := stateData{Scope: providerConfig.Scope, RedirectURI: providerConfig.RedirectURI}
+
+		if providerConfig.Provider.PKCE == true {
+			verifier, err := oauth2.NewCodeVerifierFrom(a.random())
+			if err != nil {
+				return "", err
+			}
+			data.Verifier = verifier
+			providerConfig.CodeVerifier = verifier
+		}
+
+		if isOpenID(providerConfig.Scope) {
+			nonce, err := oauth2.NewNonceFrom(a.random(), a.config.StateLength)
+			if err != nil {
+				return "", err
+			}
+			data.Nonce = nonce
+			providerConfig.Nonce = nonce
+		}
+
+		// save authentication state in session (or the state cookie), the rest goes in the state store
+		if err := backend.save(providerName, state, data); err != nil {
+			return "", err
+		}
 
 		// generate authorisation URL
 		redirectUrl, err := oauth2.AuthorizeURL(providerConfig, r)
@@ -72,60 +283,266 @@ func (a Authy) Authorize(providerName string, session Session, r *http.Request)
 		return redirectUrl, nil
 	}
 
-	return "", errors.New("Not Implemented")
+	if providerConfig.Provider.OAuth == 1 {
+		return a.authorizeOAuth1(providerName, providerConfig, backend, r, options.returnTo)
+	}
+
+	return "", ErrNotImplemented
+}
+
+// Same as Authorize but request the given scopes instead of the configured ones for this authorization only
+func (a Authy) AuthorizeWithScopes(providerName string, session Session, r *http.Request, scopes []string) (string, error) {
+	return a.Authorize(providerName, session, r, WithScopes(scopes...))
+}
+
+// Generate the authorization URL of every configured provider at once, handy to render a login page with one button
+// per provider. Each provider gets its own CSRF token, callback URLs are built from the configured base path
+func (a Authy) AuthorizeAll(session Session, r *http.Request) (map[string]string, error) {
+	basePath := a.config.BasePath
+	if basePath == "" {
+		basePath = "/authy"
+	}
+
+	authorizeUrls := map[string]string{}
+	for providerName := range a.providers {
+		// pretend the request was made on the provider's route so that the callback URL matches
+		providerUrl := *r.URL
+		providerUrl.Path = basePath + "/" + providerName
+		providerRequest := *r
+		providerRequest.URL = &providerUrl
+
+		authorizeUrl, err := a.Authorize(providerName, session, &providerRequest)
+		if err != nil {
+			return nil, err
+		}
+		authorizeUrls[providerName] = authorizeUrl
+	}
+
+	return authorizeUrls, nil
 }
 
 // Check the CSRF token then query the distant provider for an access token using the code that was provided by the
 // authorization API
 func (a Authy) Access(providerName string, session Session, r *http.Request) (*Token, string, error) {
+	return a.access(providerName, sessionBackend{a, session}, r)
+}
+
+func (a Authy) access(providerName string, backend stateBackend, r *http.Request) (*Token, string, error) {
 	providerConfig, ok := a.providers[providerName]
 	if ok != true {
-		return nil, "", errors.New(fmt.Sprintf("unknown provider %s", providerName))
+		return nil, "", fmt.Errorf("%w %s", ErrUnknownProvider, providerName)
+	}
+
+	if providerConfig.Provider.OAuth == 1 {
+		return a.accessOAuth1(providerName, providerConfig, backend, r)
 	}
 
 	if providerConfig.Provider.OAuth == 2 {
-		// check the state parameter against CSRF
-		state := session.Get("authy." + providerName + ".state")
-		if state == nil {
-			return nil, "", errors.New("state token is not set in session, possible CSRF")
+		params := oauth2.CallbackParams(providerConfig, r)
+
+		// check the state parameter against CSRF and retrieve what we saved when redirecting the user
+		state, data, err := backend.verify(providerName, params.Get("state"))
+		if err != nil {
+			return nil, "", err
 		}
 
-		stateParam := r.URL.Query().Get("state")
-		if stateParam != state.(string) {
-			return nil, "", errors.New("invalid state param provided, possible CSRF")
+		// the state is single use, forget it before anything else can fail so failed callbacks don't leave it behind
+		if err := backend.delete(providerName, state); err != nil {
+			return nil, "", err
+		}
+
+		// OpenID Connect nonce, the scopes of the authorization request tell whether one was sent
+		if isOpenID(data.Scope) && data.Nonce == "" {
+			return nil, "", errors.New("nonce was not saved with the state")
+		}
+		providerConfig.Nonce = data.Nonce
+
+		// reuse the redirect URI of the authorization request, states saved by older versions don't have it
+		if data.RedirectURI != "" {
+			providerConfig.RedirectURI = data.RedirectURI
+		}
+
+		var token oauth2.Token
+		if providerConfig.Provider.ResponseType == provider.ResponseTypeToken {
+			// implicit flow, the token is in the callback URL
+			token, err = oauth2.ParseImplicitResponse(providerConfig, r)
+			if err != nil {
+				return nil, "", err
+			}
+		} else {
+			// the user denied the authorization or the provider failed, keep the reason it gave
+			if _, ok := params["error"]; ok == true {
+				return nil, "", oauth2.NewError(params)
+			}
+
+			code := params.Get("code")
+			if code == "" {
+				return nil, "", ErrMissingCode
+			}
+
+			// PKCE code verifier
+			if providerConfig.Provider.PKCE == true {
+				if data.Verifier == "" {
+					return nil, "", errors.New("code verifier was not saved with the state")
+				}
+				providerConfig.CodeVerifier = data.Verifier
+			}
+
+			// retrieve access token from provider
+			// give up on the provider if the user went away
+			done := a.observe(providerName, OperationExchange)
+			token, err = oauth2.GetAccessTokenContext(r.Context(), providerConfig, r)
+			done(err)
+			if err != nil {
+				return nil, "", err
+			}
 		}
 
-		// retrieve the original scope
-		originalScope := strings.Split(session.Get("authy."+state.(string)+".scope").(string), ",")
+		// make sure the id_token was issued for this authorization
+		if providerConfig.Nonce != "" {
+			if token.IDToken == "" {
+				return nil, "", errors.New("provider did not return an id_token")
+			}
+			if providerConfig.Provider.JWKSURL != "" {
+				_, err = token.VerifyContext(r.Context(), providerConfig)
+			} else {
+				err = token.ValidateNonce(providerConfig.Nonce)
+			}
+			if err != nil {
+				return nil, "", err
+			}
+		}
 
-		code := r.URL.Query().Get("code")
-		if code == "" {
-			return nil, "", errors.New("code was not found in the query parameters")
+		if providerConfig.WantRefresh && token.RefreshToken == "" {
+			return nil, "", ErrMissingRefreshToken
+		}
+
+		// some providers only tell which scopes were granted on the callback
+		if len(token.Scope) == 0 {
+			token.Scope = oauth2.SplitScopes(params.Get("scope"), providerConfig.Provider.ScopeDelimiter)
 		}
 
-		// retrieve access token from provider
-		token, err := oauth2.GetAccessToken(providerConfig, r)
+		returnTo, err := a.extractReturnTo(state)
 		if err != nil {
 			return nil, "", err
 		}
 
-		// we don't need session info anymore
-		session.Delete("authy." + providerName + ".state")
-		session.Delete("authy." + state.(string) + ".scope")
+		authyToken := tokenFromOAuth2(a, providerName, token)
+		authyToken.setRequestedScope(data.Scope)
 
-		// provide the proper callback URL
-		redirectUrl := a.config.Callback
-		if providerConfig.Callback != "" {
-			redirectUrl = providerConfig.Callback
+		// Sign in with Apple only sends the name and email of the user on their first login
+		if user := params.Get("user"); user != "" {
+			if authyToken.Profile, err = callbackProfile(user, token); err != nil {
+				return nil, "", err
+			}
 		}
 
-		if len(token.Scope) == 0 {
-			token.Scope = originalScope
+		return a.complete(providerConfig, authyToken, r, returnTo)
+	}
+
+	return nil, "", ErrNotImplemented
+}
+
+// Pick where to send the user once they got a token
+func (a Authy) complete(providerConfig provider.ProviderConfig, token *Token, r *http.Request, returnTo string) (*Token, string, error) {
+	// provide the proper callback URL
+	redirectUrl := a.config.Callback
+	if providerConfig.Callback != "" {
+		redirectUrl = providerConfig.Callback
+	}
+	if returnTo != "" {
+		redirectUrl = returnTo
+	}
+
+	// let the application pick where to send the user
+	if a.config.OnSuccess != nil {
+		successUrl, err := a.config.OnSuccess(token, r)
+		if err != nil {
+			return nil, "", err
+		}
+		if successUrl != "" {
+			redirectUrl = successUrl
 		}
+	}
+
+	// return the token
+	return token, redirectUrl, nil
+}
 
-		// return the token
-		return tokenFromOAuth2(a, providerName, token), redirectUrl, nil
+// Add the scope the provider wants before issuing refresh tokens when the config wants one
+func refreshScope(providerConfig provider.ProviderConfig) []string {
+	extra := providerConfig.Provider.RefreshScope
+	if !providerConfig.WantRefresh || extra == "" {
+		return providerConfig.Scope
 	}
+	for _, scope := range providerConfig.Scope {
+		if scope == extra {
+			return providerConfig.Scope
+		}
+	}
+	return append(append([]string(nil), providerConfig.Scope...), extra)
+}
+
+// Custom parameters of the provider config overridden by the given ones, which must be whitelisted by the provider.
+// The config is shared by every request, the parameters are copied
+func mergeParams(providerConfig provider.ProviderConfig, params map[string]string) (map[string]string, error) {
+	merged := map[string]string{}
+	for name, value := range providerConfig.CustomParameters {
+		merged[name] = value
+	}
+
+	for name, value := range params {
+		if !hasParameter(providerConfig.Provider.CustomParameters, name) {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownParameter, name)
+		}
+		merged[name] = value
+	}
+	return merged, nil
+}
+
+func hasParameter(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenID Connect authorizations are the ones requesting the openid scope
+func isOpenID(scopes []string) bool {
+	for _, scope := range scopes {
+		if scope == "openid" {
+			return true
+		}
+	}
+	return false
+}
+
+// Get a token for the application itself (machine to machine) using the client credentials grant, no user is involved.
+// The returned token cannot be refreshed, call AuthorizeClient again once it expired
+func (a Authy) AuthorizeClient(providerName string) (*Token, error) {
+	providerConfig, ok := a.providers[providerName]
+	if ok != true {
+		return nil, fmt.Errorf("%w %s", ErrUnknownProvider, providerName)
+	}
+
+	if providerConfig.Provider.OAuth != 2 {
+		return nil, ErrNotImplemented
+	}
+
+	done := a.observe(providerName, OperationClientCredentials)
+	token, err := oauth2.ClientCredentials(providerConfig)
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+
+	// the spec forbids refresh tokens for this grant, don't trust providers that send one anyway
+	token.RefreshToken = ""
+
+	authyToken := tokenFromOAuth2(a, providerName, token)
+	authyToken.setRequestedScope(providerConfig.Scope)
 
-	return nil, "", errors.New("Not Implemented")
+	return authyToken, nil
 }
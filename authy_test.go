@@ -1,11 +1,27 @@
 package authy_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/authytest"
+	"github.com/christopherobin/authy/oauth2"
 	"github.com/christopherobin/authy/provider"
 	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 var config = authy.Config{
@@ -34,14 +50,41 @@ func TestAuthy(t *testing.T) {
 		So(err, ShouldNotEqual, nil)
 	})
 
+	Convey("Report every misconfigured provider", t, func() {
+		provider.RegisterProvider(provider.New("tenant", "https://[subdomain].example.com/authorize", "https://[subdomain].example.com/token", provider.WithSubdomain()))
+
+		_, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"github":  provider.ProviderConfig{Key: "my-key", Secret: "my-secret"},
+				"google":  provider.ProviderConfig{Key: "my-key"},
+				"tenant":  provider.ProviderConfig{Key: "my-key", Secret: "my-secret"},
+				"invalid": provider.ProviderConfig{Key: "my-key", Secret: "my-secret"},
+			},
+		})
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldNotContainSubstring, "provider github")
+		So(err.Error(), ShouldContainSubstring, "provider google: missing secret")
+		So(err.Error(), ShouldContainSubstring, "provider tenant: missing subdomain")
+		So(err.Error(), ShouldContainSubstring, "provider invalid: unknown provider")
+	})
+
+	Convey("The logout route can't be taken by a provider", t, func() {
+		logout := provider.New("", "https://sso.example.com/authorize", "https://sso.example.com/token")
+		_, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				authy.LogoutSegment: provider.ProviderConfig{Inline: &logout, Key: "my-key", Secret: "my-secret"},
+			},
+		})
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldContainSubstring, "provider logout: name is reserved for the logout route")
+	})
+
 	Convey("Instanciate Authy", t, func() {
 		a, err := authy.NewAuthy(config)
 		So(err, ShouldEqual, nil)
 
 		// create a fake session
-		session := &FakeSession{
-			items: map[interface{}]interface{}{},
-		}
+		session := authytest.NewSession()
 
 		// and a fake oauth
 		server := MockOAuthServer(t)
@@ -63,11 +106,11 @@ func TestAuthy(t *testing.T) {
 		})
 
 		Convey("Get authorization url for provider", func() {
-			_, err := a.Authorize("github", session, MockHttpRequest("http://localhost:2000/authy/github"))
+			authorizeURL, err := a.Authorize("github", session, MockHttpRequest("http://localhost:2000/authy/github"))
 			So(err, ShouldEqual, nil)
 
 			Convey("Get access token from provider", func() {
-				_, _, err := a.Access("github", session, MockHttpRequest("http://localhost:2000/authy/github/callback?code=auth_test&state="+url.QueryEscape(session.Get("authy.github.state").(string))))
+				_, _, err := a.Access("github", session, MockHttpRequest("http://localhost:2000/authy/github/callback?code=auth_test&state="+url.QueryEscape(StateFromURL(authorizeURL))))
 				So(err, ShouldEqual, nil)
 
 				Convey("State was deleted so second call should fail", func() {
@@ -81,3 +124,1268 @@ func TestAuthy(t *testing.T) {
 
 	})
 }
+
+func TestAuthorizeOptions(t *testing.T) {
+	Convey("Authorize with a scope delimiter override", t, func() {
+		a, err := authy.NewAuthy(config)
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		Convey("Provider delimiter is used by default", func() {
+			authURL, err := a.Authorize("github", session, MockHttpRequest("http://localhost:2000/authy/github"))
+			So(err, ShouldEqual, nil)
+
+			parsedURL, _ := url.Parse(authURL)
+			So(parsedURL.Query().Get("scope"), ShouldEqual, "repo,user:mail")
+		})
+
+		Convey("Per-call delimiter wins over the provider one", func() {
+			authURL, err := a.Authorize("github", session, MockHttpRequest("http://localhost:2000/authy/github"), authy.WithScopeDelimiter(" "))
+			So(err, ShouldEqual, nil)
+
+			parsedURL, _ := url.Parse(authURL)
+			So(parsedURL.Query().Get("scope"), ShouldEqual, "repo user:mail")
+		})
+	})
+}
+
+func TestPredictableState(t *testing.T) {
+	Convey("Assert the state of authorize URLs with a predictable random source", t, func() {
+		predictable := config
+		predictable.Rand = bytes.NewReader(make([]byte, 16))
+
+		a, err := authy.NewAuthy(predictable)
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+		authorizeURL, err := a.Authorize("github", session, MockHttpRequest("http://localhost:2000/authy/github"))
+		So(err, ShouldEqual, nil)
+		So(StateFromURL(authorizeURL), ShouldEqual, strings.Repeat("0", 32))
+	})
+}
+
+func TestStateLength(t *testing.T) {
+	Convey("Use longer states", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		config := MockConfig("long", server.URL+"/oauth2", server.URL+"/oauth2/offline")
+		config.StateLength = 32
+		a, err := authy.NewAuthy(config)
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+		authorizeURL, err := a.Authorize("long", session, MockHttpRequest("http://localhost:2000/authy/long"))
+		So(err, ShouldEqual, nil)
+		So(len(StateFromURL(authorizeURL)), ShouldEqual, 64)
+
+		Convey("The callback accepts them", func() {
+			token, _, err := MockLogin(a, "long", session)
+			So(err, ShouldEqual, nil)
+			So(token.Value, ShouldNotEqual, "")
+		})
+	})
+
+	Convey("Reject states too short to be safe", t, func() {
+		config := MockConfig("short", "http://localhost/oauth2", "http://localhost/oauth2")
+		config.StateLength = 4
+		_, err := authy.NewAuthy(config)
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
+func TestAuthorizeWithScopes(t *testing.T) {
+	Convey("Request extra scopes for a single authorization", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		config := MockConfig("incremental", server.URL+"/oauth2", server.URL+"/oauth2")
+		providerConfig := config.Providers["incremental"]
+		providerConfig.Scope = []string{"profile"}
+		config.Providers["incremental"] = providerConfig
+		a, err := authy.NewAuthy(config)
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		authorizeURL, err := a.AuthorizeWithScopes("incremental", session, MockHttpRequest("http://localhost:2000/authy/incremental"), []string{"profile", "drive.file"})
+		So(err, ShouldEqual, nil)
+
+		parsedURL, _ := url.Parse(authorizeURL)
+		So(parsedURL.Query().Get("scope"), ShouldEqual, "profile,drive.file")
+
+		token, _, err := a.Access("incremental", session, MockHttpRequest("http://localhost:2000/authy/incremental/callback?code=auth_test&state="+url.QueryEscape(StateFromURL(authorizeURL))))
+		So(err, ShouldEqual, nil)
+		So(token.Scope, ShouldResemble, []string{"profile", "drive.file"})
+
+		Convey("The configured scopes are used again afterwards", func() {
+			token, _, err := MockLogin(a, "incremental", session)
+			So(err, ShouldEqual, nil)
+			So(token.Scope, ShouldResemble, []string{"profile"})
+		})
+	})
+}
+
+func TestRedirectURIPersisted(t *testing.T) {
+	Convey("The token request reuses the redirect URI of the authorization", t, func() {
+		var redirectURI string
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			redirectURI = r.PostForm.Get("redirect_uri")
+			rw.Write([]byte("access_token=fakeaccesstoken&token_type=example"))
+		}))
+		Reset(server.Close)
+
+		a, err := MockAuthy("redirect", server.URL, server.URL)
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		authorizeRequest := MockHttpRequest("http://app.example.com/authy/redirect")
+		authorizeRequest.Host = "app.example.com"
+		authorizeURL, err := a.Authorize("redirect", session, authorizeRequest)
+		So(err, ShouldEqual, nil)
+
+		// the callback went through a proxy rewriting the host
+		callbackRequest := MockHttpRequest("http://localhost:8080/authy/redirect/callback?code=auth_test&state=" + url.QueryEscape(StateFromURL(authorizeURL)))
+		callbackRequest.Host = "localhost:8080"
+		_, _, err = a.Access("redirect", session, callbackRequest)
+		So(err, ShouldEqual, nil)
+		So(redirectURI, ShouldEqual, "http://app.example.com/authy/redirect/callback")
+	})
+}
+
+func TestGrantedScope(t *testing.T) {
+	Convey("Tell the requested scopes from the granted ones", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+
+		p := server.Provider("granted")
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"granted": provider.ProviderConfig{Inline: &p, Key: "my-key", Secret: "my-secret", Scope: []string{"read", "write"}},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+		login := func() (*authy.Token, error) {
+			authorizeURL, err := a.Authorize("granted", session, MockHttpRequest("http://localhost:2000/authy/granted"))
+			if err != nil {
+				return nil, err
+			}
+			callback, err := server.Callback(authorizeURL)
+			if err != nil {
+				return nil, err
+			}
+			token, _, err := a.Access("granted", session, callback)
+			return token, err
+		}
+
+		Convey("The provider granted fewer scopes", func() {
+			server.SetToken(map[string]string{"scope": "read"})
+
+			token, err := login()
+			So(err, ShouldEqual, nil)
+			So(token.Scope, ShouldResemble, []string{"read"})
+			So(token.GrantedScope, ShouldResemble, []string{"read"})
+			So(token.RequestedScope, ShouldResemble, []string{"read", "write"})
+		})
+
+		Convey("The provider didn't return the scopes", func() {
+			token, err := login()
+			So(err, ShouldEqual, nil)
+			So(token.Scope, ShouldResemble, []string{"read", "write"})
+			So(token.GrantedScope, ShouldBeEmpty)
+			So(token.RequestedScope, ShouldResemble, []string{"read", "write"})
+		})
+	})
+}
+
+func TestEmptyScope(t *testing.T) {
+	Convey("Authorizations without scope don't get an empty one", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+
+		p := server.Provider("noscope")
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"noscope": provider.ProviderConfig{Inline: &p, Key: "my-key", Secret: "my-secret", Scope: []string{""}},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+		login := func(opts ...authy.AuthorizeOption) (*authy.Token, error) {
+			authorizeURL, err := a.Authorize("noscope", session, MockHttpRequest("http://localhost:2000/authy/noscope"), opts...)
+			if err != nil {
+				return nil, err
+			}
+			callback, err := server.Callback(authorizeURL)
+			if err != nil {
+				return nil, err
+			}
+			token, _, err := a.Access("noscope", session, callback)
+			return token, err
+		}
+
+		Convey("No scope parameter and no scope on the token", func() {
+			server.SetToken(map[string]string{"scope": ""})
+
+			token, err := login()
+			So(err, ShouldEqual, nil)
+			_, sent := server.AuthorizeRequests()[0]["scope"]
+			So(sent, ShouldBeFalse)
+			So(token.Scope, ShouldBeEmpty)
+			So(token.RequestedScope, ShouldBeEmpty)
+			So(token.GrantedScope, ShouldBeEmpty)
+
+			serialized, err := token.Serialize()
+			So(err, ShouldEqual, nil)
+			restored, err := a.TokenFromSerialized(serialized)
+			So(err, ShouldEqual, nil)
+			So(restored.Scope, ShouldBeEmpty)
+			So(restored.HasScope(""), ShouldBeFalse)
+		})
+
+		Convey("Blank scopes are dropped from the overrides and the response", func() {
+			server.SetToken(map[string]string{"scope": " read  "})
+
+			token, err := login(authy.WithScopeDelimiter(" "), authy.WithScopes("", "read", " "))
+			So(err, ShouldEqual, nil)
+			So(server.AuthorizeRequests()[0].Get("scope"), ShouldEqual, "read")
+			So(token.Scope, ShouldResemble, []string{"read"})
+			So(token.RequestedScope, ShouldResemble, []string{"read"})
+		})
+	})
+}
+
+func TestEnvCredentials(t *testing.T) {
+	Convey("Read provider credentials from the environment", t, func() {
+		envConfig := authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"github": provider.ProviderConfig{
+					Key:    "${AUTHY_TEST_KEY}",
+					Secret: "${AUTHY_TEST_SECRET}",
+				},
+			},
+		}
+
+		session := authytest.NewSession()
+
+		Convey("Referenced variables are resolved", func() {
+			os.Setenv("AUTHY_TEST_KEY", "key-from-env")
+			os.Setenv("AUTHY_TEST_SECRET", "secret-from-env")
+			Reset(func() {
+				os.Unsetenv("AUTHY_TEST_KEY")
+				os.Unsetenv("AUTHY_TEST_SECRET")
+			})
+
+			a, err := authy.NewAuthy(envConfig)
+			So(err, ShouldEqual, nil)
+
+			authURL, err := a.Authorize("github", session, MockHttpRequest("http://localhost:2000/authy/github"))
+			So(err, ShouldEqual, nil)
+
+			parsedURL, _ := url.Parse(authURL)
+			So(parsedURL.Query().Get("client_id"), ShouldEqual, "key-from-env")
+		})
+
+		Convey("Unset variables are an error", func() {
+			os.Setenv("AUTHY_TEST_KEY", "key-from-env")
+			Reset(func() {
+				os.Unsetenv("AUTHY_TEST_KEY")
+			})
+
+			_, err := authy.NewAuthy(envConfig)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "AUTHY_TEST_SECRET")
+		})
+
+		Convey("Literal values are left untouched", func() {
+			a, err := authy.NewAuthy(config)
+			So(err, ShouldEqual, nil)
+
+			authURL, err := a.Authorize("github", session, MockHttpRequest("http://localhost:2000/authy/github"))
+			So(err, ShouldEqual, nil)
+
+			parsedURL, _ := url.Parse(authURL)
+			So(parsedURL.Query().Get("client_id"), ShouldEqual, "my-key")
+		})
+	})
+}
+
+func TestOnSuccess(t *testing.T) {
+	Convey("Pick the redirect URL after a successful login", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		// pretend we have a user database
+		knownUsers := map[string]bool{}
+
+		successConfig := MockConfig("onsuccess", server.URL+"/oauth2", server.URL+"/oauth2")
+		successConfig.Callback = "/dashboard"
+		successConfig.OnSuccess = func(token *authy.Token, r *http.Request) (string, error) {
+			if knownUsers[token.Value] {
+				return "", nil
+			}
+			knownUsers[token.Value] = true
+			return "/onboarding", nil
+		}
+
+		a, err := authy.NewAuthy(successConfig)
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		_, redirectUrl, err := MockLogin(a, "onsuccess", session)
+		So(err, ShouldEqual, nil)
+		So(redirectUrl, ShouldEqual, "/onboarding")
+
+		Convey("Returning users get the default callback", func() {
+			_, redirectUrl, err := MockLogin(a, "onsuccess", session)
+			So(err, ShouldEqual, nil)
+			So(redirectUrl, ShouldEqual, "/dashboard")
+		})
+	})
+}
+
+func TestWantRefresh(t *testing.T) {
+	Convey("Require a refresh token from the provider", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		session := authytest.NewSession()
+
+		Convey("Provider issued a refresh token", func() {
+			refreshConfig := MockConfig("wantrefresh", server.URL+"/oauth2", server.URL+"/oauth2/offline")
+			providerConfig := refreshConfig.Providers["wantrefresh"]
+			providerConfig.WantRefresh = true
+			refreshConfig.Providers["wantrefresh"] = providerConfig
+
+			a, err := authy.NewAuthy(refreshConfig)
+			So(err, ShouldEqual, nil)
+
+			token, _, err := MockLogin(a, "wantrefresh", session)
+			So(err, ShouldEqual, nil)
+			So(token.RefreshToken, ShouldEqual, "fakerefreshtoken")
+		})
+
+		Convey("Provider didn't issue a refresh token", func() {
+			refreshConfig := MockConfig("wantrefresh", server.URL+"/oauth2", server.URL+"/oauth2")
+			providerConfig := refreshConfig.Providers["wantrefresh"]
+			providerConfig.WantRefresh = true
+			refreshConfig.Providers["wantrefresh"] = providerConfig
+
+			a, err := authy.NewAuthy(refreshConfig)
+			So(err, ShouldEqual, nil)
+
+			token, _, err := MockLogin(a, "wantrefresh", session)
+			So(err, ShouldEqual, authy.ErrMissingRefreshToken)
+			So(token, ShouldBeNil)
+		})
+	})
+}
+
+func TestAuthorizeAll(t *testing.T) {
+	Convey("Generate the authorization URL of every provider", t, func() {
+		provider.RegisterProvider(provider.New("other", "https://other.example.com/authorize", "https://other.example.com/token"))
+
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"github": provider.ProviderConfig{Key: "my-key", Secret: "my-secret"},
+				"other":  provider.ProviderConfig{Key: "my-key", Secret: "my-secret"},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		request := MockHttpRequest("http://localhost:2000/login")
+		request.Host = "localhost:2000"
+		authorizeUrls, err := a.AuthorizeAll(session, request)
+		So(err, ShouldEqual, nil)
+		So(authorizeUrls, ShouldHaveLength, 2)
+
+		states := map[string]bool{}
+		for providerName, authorizeUrl := range authorizeUrls {
+			parsedUrl, _ := url.Parse(authorizeUrl)
+			state := parsedUrl.Query().Get("state")
+			So(state, ShouldNotEqual, "")
+			So(session.Get("authy."+providerName+".state"), ShouldNotBeNil)
+			So(parsedUrl.Query().Get("redirect_uri"), ShouldEqual, "http://localhost:2000/authy/"+providerName+"/callback")
+			states[state] = true
+		}
+		So(states, ShouldHaveLength, 2)
+	})
+}
+
+func TestPKCE(t *testing.T) {
+	Convey("Use PKCE for the authorization code flow", t, func() {
+		var received url.Values
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			received = r.PostForm
+			rw.Write([]byte("access_token=fakeaccesstoken&token_type=example"))
+		}))
+		Reset(server.Close)
+
+		pkceProvider := provider.New("pkce", server.URL+"/authorize", server.URL+"/token")
+		pkceProvider.PKCE = true
+		provider.RegisterProvider(pkceProvider)
+
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"pkce": provider.ProviderConfig{Key: "my-key", Secret: "my-secret"},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		authURL, err := a.Authorize("pkce", session, MockHttpRequest("http://localhost:2000/authy/pkce"))
+		So(err, ShouldEqual, nil)
+
+		state := StateFromURL(authURL)
+
+		parsedURL, _ := url.Parse(authURL)
+		So(parsedURL.Query().Get("code_challenge_method"), ShouldEqual, "S256")
+		So(parsedURL.Query().Get("code_challenge"), ShouldNotEqual, "")
+
+		Convey("Verifier is sent with the token request", func() {
+			_, _, err := a.Access("pkce", session, MockHttpRequest("http://localhost:2000/authy/pkce/callback?code=auth_test&state="+url.QueryEscape(state)))
+			So(err, ShouldEqual, nil)
+			So(oauth2.CodeChallenge(received.Get("code_verifier")), ShouldEqual, parsedURL.Query().Get("code_challenge"))
+			So(session.Get("authy."+state), ShouldBeNil)
+		})
+	})
+}
+
+func TestNonce(t *testing.T) {
+	Convey("Bind the id_token to the authorization with a nonce", t, func() {
+		var idToken string
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			values := url.Values{}
+			values.Set("access_token", "fakeaccesstoken")
+			values.Set("token_type", "example")
+			values.Set("id_token", idToken)
+			rw.Write([]byte(values.Encode()))
+		}))
+		Reset(server.Close)
+
+		nonceConfig := MockConfig("oidc", server.URL+"/authorize", server.URL+"/token")
+		providerConfig := nonceConfig.Providers["oidc"]
+		providerConfig.Scope = []string{"openid", "email"}
+		nonceConfig.Providers["oidc"] = providerConfig
+
+		a, err := authy.NewAuthy(nonceConfig)
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		authURL, err := a.Authorize("oidc", session, MockHttpRequest("http://localhost:2000/authy/oidc"))
+		So(err, ShouldEqual, nil)
+
+		state := StateFromURL(authURL)
+
+		parsedURL, _ := url.Parse(authURL)
+		nonce := parsedURL.Query().Get("nonce")
+		So(nonce, ShouldNotEqual, "")
+
+		callback := MockHttpRequest("http://localhost:2000/authy/oidc/callback?code=auth_test&state=" + url.QueryEscape(state))
+		mockIDToken := func(claims string) string {
+			return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".signature"
+		}
+
+		Convey("Matching nonce", func() {
+			idToken = mockIDToken(`{"sub":"1234","nonce":"` + nonce + `"}`)
+			token, _, err := a.Access("oidc", session, callback)
+			So(err, ShouldEqual, nil)
+			So(token.IDToken, ShouldEqual, idToken)
+			So(session.Get("authy."+state), ShouldBeNil)
+		})
+
+		Convey("Mismatched nonce", func() {
+			idToken = mockIDToken(`{"sub":"1234","nonce":"replayed"}`)
+			_, _, err := a.Access("oidc", session, callback)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Missing nonce", func() {
+			idToken = mockIDToken(`{"sub":"1234"}`)
+			_, _, err := a.Access("oidc", session, callback)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Missing id_token", func() {
+			idToken = ""
+			_, _, err := a.Access("oidc", session, callback)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Authorization without the openid scope", func() {
+			authURL, err := a.Authorize("oidc", session, MockHttpRequest("http://localhost:2000/authy/oidc"),
+				authy.WithScopes("email"))
+			So(err, ShouldEqual, nil)
+			parsedURL, _ := url.Parse(authURL)
+			So(parsedURL.Query(), ShouldNotContainKey, "nonce")
+
+			idToken = ""
+			_, _, err = a.Access("oidc", session, MockHttpRequest(
+				"http://localhost:2000/authy/oidc/callback?code=auth_test&state="+url.QueryEscape(StateFromURL(authURL))))
+			So(err, ShouldEqual, nil)
+		})
+	})
+
+	Convey("Check the nonce when openid is only requested for one authorization", t, func() {
+		var idToken string
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			values := url.Values{}
+			values.Set("access_token", "fakeaccesstoken")
+			values.Set("token_type", "bearer")
+			values.Set("id_token", idToken)
+			rw.Write([]byte(values.Encode()))
+		}))
+		Reset(server.Close)
+
+		a, err := MockAuthy("oidc", server.URL+"/authorize", server.URL+"/token")
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		authURL, err := a.Authorize("oidc", session, MockHttpRequest("http://localhost:2000/authy/oidc"),
+			authy.WithScopes("openid"))
+		So(err, ShouldEqual, nil)
+		parsedURL, _ := url.Parse(authURL)
+		So(parsedURL.Query().Get("nonce"), ShouldNotEqual, "")
+
+		idToken = "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1234","nonce":"replayed"}`)) +
+			".signature"
+		_, _, err = a.Access("oidc", session, MockHttpRequest(
+			"http://localhost:2000/authy/oidc/callback?code=auth_test&state="+url.QueryEscape(StateFromURL(authURL))))
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
+func TestAuthorizeClient(t *testing.T) {
+	Convey("Get a token with the client credentials grant", t, func() {
+		var received url.Values
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			received = r.PostForm
+			rw.Write([]byte("access_token=fakeaccesstoken&token_type=example&refresh_token=shouldnotbehere"))
+		}))
+		Reset(server.Close)
+
+		clientConfig := MockConfig("machine", server.URL+"/authorize", server.URL+"/token")
+		providerConfig := clientConfig.Providers["machine"]
+		providerConfig.Scope = []string{"read", "write"}
+		clientConfig.Providers["machine"] = providerConfig
+
+		a, err := authy.NewAuthy(clientConfig)
+		So(err, ShouldEqual, nil)
+
+		token, err := a.AuthorizeClient("machine")
+		So(err, ShouldEqual, nil)
+		So(received.Get("grant_type"), ShouldEqual, "client_credentials")
+		So(received.Get("client_secret"), ShouldEqual, "my-secret")
+		So(received.Get("scope"), ShouldEqual, "read,write")
+		So(token.Value, ShouldEqual, "fakeaccesstoken")
+		So(token.Scope, ShouldResemble, []string{"read", "write"})
+		So(token.IsRefreshable(), ShouldBeFalse)
+	})
+}
+
+func TestAuthyErrors(t *testing.T) {
+	Convey("Errors can be told apart with errors.Is", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		a, err := MockAuthy("errors", server.URL+"/oauth2", server.URL+"/oauth2")
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		Convey("Unknown provider", func() {
+			_, err := a.Authorize("nope", session, MockHttpRequest("http://localhost:2000/authy/nope"))
+			So(errors.Is(err, authy.ErrUnknownProvider), ShouldBeTrue)
+			So(err.Error(), ShouldEqual, "unknown provider nope")
+		})
+
+		Convey("No state in session", func() {
+			_, _, err := a.Access("errors", session, MockHttpRequest("http://localhost:2000/authy/errors/callback?code=auth_test&state=abc"))
+			So(errors.Is(err, authy.ErrStateMissing), ShouldBeTrue)
+			So(err, ShouldEqual, authy.ErrNoSession)
+		})
+
+		Convey("After authorizing", func() {
+			authorizeURL, err := a.Authorize("errors", session, MockHttpRequest("http://localhost:2000/authy/errors"))
+			So(err, ShouldEqual, nil)
+
+			Convey("State mismatch", func() {
+				_, _, err := a.Access("errors", session, MockHttpRequest("http://localhost:2000/authy/errors/callback?code=auth_test&state=forged"))
+				So(errors.Is(err, authy.ErrStateMismatch), ShouldBeTrue)
+			})
+
+			Convey("Missing code", func() {
+				_, _, err := a.Access("errors", session, MockHttpRequest("http://localhost:2000/authy/errors/callback?state="+url.QueryEscape(StateFromURL(authorizeURL))))
+				So(errors.Is(err, authy.ErrMissingCode), ShouldBeTrue)
+			})
+
+			Convey("User denied the authorization", func() {
+				_, _, err := a.Access("errors", session, MockHttpRequest("http://localhost:2000/authy/errors/callback?error=access_denied&error_description=The+user+said+no&state="+url.QueryEscape(StateFromURL(authorizeURL))))
+				So(errors.Is(err, oauth2.ErrAccessDenied), ShouldBeTrue)
+				So(errors.Is(err, authy.ErrMissingCode), ShouldBeFalse)
+				So(err.Error(), ShouldEqual, "access_denied: The user said no")
+			})
+
+			Convey("Session without state", func() {
+				session.Delete("authy.errors.state")
+				_, _, err := a.Access("errors", session, MockHttpRequest("http://localhost:2000/authy/errors/callback?code=auth_test&state=abc"))
+				So(err, ShouldEqual, authy.ErrStateMissing)
+			})
+		})
+	})
+}
+
+func TestInlineProvider(t *testing.T) {
+	Convey("Use a provider defined in the config", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		inline := provider.New("", server.URL+"/oauth2", server.URL+"/oauth2")
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"inline": provider.ProviderConfig{Inline: &inline, Key: "my-key", Secret: "my-secret"},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		token, _, err := MockLogin(a, "inline", session)
+		So(err, ShouldEqual, nil)
+		So(token.Value, ShouldEqual, "fakeaccesstoken")
+
+		Convey("Reject incomplete inline providers", func() {
+			_, err := authy.NewAuthy(authy.Config{
+				Providers: map[string]provider.ProviderConfig{
+					"inline": provider.ProviderConfig{Inline: &provider.Provider{OAuth: 2, AuthorizeURL: server.URL}},
+				},
+			})
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Fill the issuer of self hosted providers", func() {
+			hosted := provider.Generic("[base_url]/oauth2", "[base_url]/oauth2", ",", provider.ClientAuthBody)
+			a, err := authy.NewAuthy(authy.Config{
+				Providers: map[string]provider.ProviderConfig{
+					"hosted": provider.ProviderConfig{Inline: &hosted, Key: "my-key", Secret: "my-secret", BaseURL: server.URL},
+				},
+			})
+			So(err, ShouldEqual, nil)
+
+			token, _, err := MockLogin(a, "hosted", session)
+			So(err, ShouldEqual, nil)
+			So(token.Value, ShouldEqual, "fakeaccesstoken")
+
+			_, err = authy.NewAuthy(authy.Config{
+				Providers: map[string]provider.ProviderConfig{
+					"hosted": provider.ProviderConfig{Inline: &hosted, Key: "my-key", Secret: "my-secret"},
+				},
+			})
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestAccessContext(t *testing.T) {
+	Convey("Stop talking to the provider once the user went away", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+
+		p := server.Provider("cancelled")
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"cancelled": provider.ProviderConfig{Inline: &p, Key: "my-key", Secret: "my-secret"},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+		authorizeURL, err := a.Authorize("cancelled", session, MockHttpRequest("http://localhost:2000/authy/cancelled"))
+		So(err, ShouldEqual, nil)
+		callback, err := server.Callback(authorizeURL)
+		So(err, ShouldEqual, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, _, err = a.Access("cancelled", session, callback.WithContext(ctx))
+		So(errors.Is(err, context.Canceled), ShouldBeTrue)
+		So(server.TokenRequests(), ShouldBeEmpty)
+	})
+}
+
+func TestReturnTo(t *testing.T) {
+	Convey("Carry the return path through the provider", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+
+		p := server.Provider("returning")
+		a, err := authy.NewAuthy(authy.Config{
+			Callback: "/home",
+			Providers: map[string]provider.ProviderConfig{
+				"returning": provider.ProviderConfig{Inline: &p, Key: "my-key", Secret: "my-secret"},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+		login := func(opts ...authy.AuthorizeOption) (string, error) {
+			authorizeURL, err := a.Authorize("returning", session, MockHttpRequest("http://localhost:2000/authy/returning"), opts...)
+			if err != nil {
+				return "", err
+			}
+			callback, err := server.Callback(authorizeURL)
+			if err != nil {
+				return "", err
+			}
+			_, redirectURL, err := a.Access("returning", session, callback)
+			return redirectURL, err
+		}
+
+		Convey("Without a return path", func() {
+			redirectURL, err := login()
+			So(err, ShouldEqual, nil)
+			So(redirectURL, ShouldEqual, "/home")
+		})
+
+		Convey("With a return path", func() {
+			redirectURL, err := login(authy.WithReturnTo("/profile?tab=keys"))
+			So(err, ShouldEqual, nil)
+			So(redirectURL, ShouldEqual, "/profile?tab=keys")
+			So(server.AuthorizeRequests()[0].Get("state"), ShouldNotContainSubstring, "/profile")
+		})
+
+		Convey("Return path from the next parameter of the login route", func() {
+			redirectURL, err := login(authy.ReturnTo(MockHttpRequest("http://localhost:2000/authy/returning?next=%2Fprofile"))...)
+			So(err, ShouldEqual, nil)
+			So(redirectURL, ShouldEqual, "/profile")
+
+			So(authy.ReturnTo(MockHttpRequest("http://localhost:2000/authy/returning")), ShouldBeEmpty)
+		})
+
+		Convey("Reject paths leading to other websites", func() {
+			for _, returnTo := range []string{"https://evil.example.com", "//evil.example.com", "/\\evil.example.com", "profile"} {
+				_, err := login(authy.WithReturnTo(returnTo))
+				So(err, ShouldEqual, authy.ErrInvalidReturnTo)
+			}
+		})
+
+		Convey("Reject short state keys", func() {
+			_, err := authy.NewAuthy(authy.Config{StateKey: "short"})
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestMicrosoft(t *testing.T) {
+	Convey("Log in with the Microsoft identity platform", t, func() {
+		microsoftConfig := authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"microsoft": provider.ProviderConfig{Key: "my-key", Secret: "my-secret", Scope: []string{"openid", "email"}},
+			},
+		}
+
+		_, err := authy.NewAuthy(microsoftConfig)
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldContainSubstring, "tenant")
+
+		microsoftConfig.Providers["microsoft"] = provider.ProviderConfig{Key: "my-key", Secret: "my-secret",
+			Scope: []string{"openid", "email"}, Tenant: "organizations", WantRefresh: true}
+		a, err := authy.NewAuthy(microsoftConfig)
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+		authorizeURL, err := a.Authorize("microsoft", session, MockHttpRequest("http://localhost:2000/authy/microsoft"))
+		So(err, ShouldEqual, nil)
+
+		location, _ := url.Parse(authorizeURL)
+		So(location.Host+location.Path, ShouldEqual, "login.microsoftonline.com/organizations/oauth2/v2.0/authorize")
+		So(location.Query().Get("scope"), ShouldEqual, "openid email offline_access")
+	})
+}
+
+func TestMicrosoftIDToken(t *testing.T) {
+	Convey("Verify the id_tokens of the Microsoft identity platform", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+
+		// the microsoft provider, sent to the mock server
+		microsoft, err := provider.GetProvider("microsoft")
+		So(err, ShouldEqual, nil)
+		microsoft.AuthorizeURL = server.URL + "/authorize"
+		microsoft.AccessURL = server.URL + "/token"
+		microsoft.JWKSURL = server.URL + "/jwks"
+
+		login := func(tenant string, claims map[string]interface{}) (*authy.Token, error) {
+			a, err := authy.NewAuthy(authy.Config{
+				Providers: map[string]provider.ProviderConfig{
+					"microsoft": provider.ProviderConfig{Inline: &microsoft, Key: "my-key", Secret: "my-secret",
+						Scope: []string{"openid", "email"}, Tenant: tenant},
+				},
+			})
+			So(err, ShouldEqual, nil)
+
+			session := authytest.NewSession()
+			authorizeURL, err := a.Authorize("microsoft", session, MockHttpRequest("http://localhost:2000/authy/microsoft"))
+			So(err, ShouldEqual, nil)
+
+			location, _ := url.Parse(authorizeURL)
+			claims["aud"] = "my-key"
+			claims["exp"] = time.Now().Add(time.Hour).Unix()
+			claims["nonce"] = location.Query().Get("nonce")
+			server.SetToken(map[string]string{"id_token": server.SignIDToken(claims)})
+
+			callback, err := server.Callback(authorizeURL)
+			So(err, ShouldEqual, nil)
+			token, _, err := a.Access("microsoft", session, callback)
+			return token, err
+		}
+
+		userTenant := "9188040d-6c67-4c5b-b112-36a304b66dad"
+		otherTenant := "72f988bf-86f1-41af-91ab-2d7cd011db47"
+
+		Convey("Single tenant", func() {
+			token, err := login(userTenant, map[string]interface{}{
+				"iss": "https://login.microsoftonline.com/" + userTenant + "/v2.0",
+				"tid": userTenant,
+			})
+			So(err, ShouldEqual, nil)
+			So(token.IDToken, ShouldNotEqual, "")
+
+			Convey("Users of other tenants are rejected", func() {
+				_, err := login(userTenant, map[string]interface{}{
+					"iss": "https://login.microsoftonline.com/" + otherTenant + "/v2.0",
+					"tid": otherTenant,
+				})
+				So(err, ShouldNotEqual, nil)
+				So(err.Error(), ShouldContainSubstring, "issuer")
+			})
+		})
+
+		Convey("Multi-tenant logins are issued by the tenant of the user", func() {
+			for _, tenant := range []string{"common", "organizations", "consumers"} {
+				_, err := login(tenant, map[string]interface{}{
+					"iss": "https://login.microsoftonline.com/" + userTenant + "/v2.0",
+					"tid": userTenant,
+				})
+				So(err, ShouldEqual, nil)
+			}
+
+			Convey("The issuer must match the tid claim", func() {
+				_, err := login("common", map[string]interface{}{
+					"iss": "https://login.microsoftonline.com/" + otherTenant + "/v2.0",
+					"tid": userTenant,
+				})
+				So(err, ShouldNotEqual, nil)
+
+				_, err = login("common", map[string]interface{}{
+					"iss": "https://login.microsoftonline.com/" + userTenant + "/v2.0",
+				})
+				So(err, ShouldNotEqual, nil)
+			})
+		})
+	})
+}
+
+func TestDiscord(t *testing.T) {
+	Convey("Log in with Discord", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+		server.SetJSON(true)
+
+		// the discord provider, sent to the mock server
+		discord, err := provider.GetProvider("discord")
+		So(err, ShouldEqual, nil)
+		discord.AuthorizeURL = server.URL + "/authorize"
+		discord.AccessURL = server.URL + "/token"
+
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"discord": provider.ProviderConfig{Inline: &discord, Key: "my-key", Secret: "my-secret",
+					Scope: []string{"identify", "email", "guilds"}, CustomParameters: map[string]string{"prompt": "none"}},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+		authorizeURL, err := a.Authorize("discord", session, MockHttpRequest("http://localhost:2000/authy/discord"))
+		So(err, ShouldEqual, nil)
+
+		callback, err := server.Callback(authorizeURL)
+		So(err, ShouldEqual, nil)
+		So(server.AuthorizeRequests()[0].Get("scope"), ShouldEqual, "identify email guilds")
+		So(server.AuthorizeRequests()[0].Get("prompt"), ShouldEqual, "none")
+
+		token, _, err := a.Access("discord", session, callback)
+		So(err, ShouldEqual, nil)
+		So(token.Provider, ShouldEqual, "discord")
+		So(token.Value, ShouldEqual, authytest.AccessToken)
+		So(token.RequestedScope, ShouldResemble, []string{"identify", "email", "guilds"})
+	})
+}
+
+func TestApple(t *testing.T) {
+	Convey("Sign in with Apple", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+		claims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"001234.abcd","email":"jane@example.com"}`))
+		server.SetToken(map[string]string{"id_token": "e30." + claims + ".c2ln"})
+
+		// the apple provider, sent to the mock server
+		apple, err := provider.GetProvider("apple")
+		So(err, ShouldEqual, nil)
+		apple.AuthorizeURL = server.URL + "/authorize"
+		apple.AccessURL = server.URL + "/token"
+
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		der, _ := x509.MarshalPKCS8PrivateKey(key)
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"apple": provider.ProviderConfig{Inline: &apple, Key: "com.example.web", KeyID: "ABC123DEFG",
+					AssertionIssuer: "TEAM123456", Scope: []string{"name", "email"},
+					PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+		authorizeURL, err := a.Authorize("apple", session, MockHttpRequest("http://localhost:2000/authy/apple"))
+		So(err, ShouldEqual, nil)
+
+		callback, err := server.Callback(authorizeURL)
+		So(err, ShouldEqual, nil)
+		So(server.AuthorizeRequests()[0].Get("response_mode"), ShouldEqual, "form_post")
+		So(server.AuthorizeRequests()[0].Get("scope"), ShouldEqual, "name email")
+		So(callback.Method, ShouldEqual, "POST")
+		So(callback.URL.RawQuery, ShouldEqual, "")
+
+		Convey("First login comes with the user", func() {
+			callback.ParseForm()
+			form := callback.PostForm
+			form.Set("user", `{"name":{"firstName":"Jane","lastName":"Doe"},"email":"jane@example.com"}`)
+			callback = httptest.NewRequest("POST", callback.URL.String(), strings.NewReader(form.Encode()))
+			callback.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			token, _, err := a.Access("apple", session, callback)
+			So(err, ShouldEqual, nil)
+			So(token.Value, ShouldEqual, authytest.AccessToken)
+			So(token.Profile, ShouldNotEqual, nil)
+			So(token.Profile.ID, ShouldEqual, "001234.abcd")
+			So(token.Profile.Name, ShouldEqual, "Jane Doe")
+			So(token.Profile.Email, ShouldEqual, "jane@example.com")
+
+			// the client secret is a JWT signed with the key of the team
+			secret := server.TokenRequests()[0].Get("client_secret")
+			secretClaims, err := oauth2.DecodeClaims(secret)
+			So(err, ShouldEqual, nil)
+			So(secretClaims["iss"], ShouldEqual, "TEAM123456")
+			So(secretClaims["sub"], ShouldEqual, "com.example.web")
+			So(secretClaims["aud"], ShouldEqual, "https://appleid.apple.com")
+			So(server.TokenRequests()[0].Get("code"), ShouldEqual, authytest.Code)
+
+			serialized, err := token.Serialize()
+			So(err, ShouldEqual, nil)
+			restored, err := a.TokenFromSerialized(serialized)
+			So(err, ShouldEqual, nil)
+			So(restored.Profile.Name, ShouldEqual, "Jane Doe")
+		})
+
+		Convey("Later logins don't", func() {
+			token, _, err := a.Access("apple", session, callback)
+			So(err, ShouldEqual, nil)
+			So(token.Profile, ShouldEqual, nil)
+		})
+
+		Convey("Malformed user", func() {
+			callback.ParseForm()
+			form := callback.PostForm
+			form.Set("user", `{"name":`)
+			callback = httptest.NewRequest("POST", callback.URL.String(), strings.NewReader(form.Encode()))
+			callback.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			_, _, err := a.Access("apple", session, callback)
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestSpotify(t *testing.T) {
+	Convey("Log in with Spotify", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+		server.SetJSON(true)
+
+		spotify, err := provider.GetProvider("spotify")
+		So(err, ShouldEqual, nil)
+		So(spotify.ClientAuthMethod, ShouldEqual, provider.ClientAuthBasic)
+		spotify.AuthorizeURL = server.URL + "/authorize"
+		spotify.AccessURL = server.URL + "/token"
+
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"spotify": provider.ProviderConfig{Inline: &spotify, Key: "my-key", Secret: "my-secret",
+					Scope: []string{"user-read-email"}, CustomParameters: map[string]string{"show_dialog": "true"}},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+		authorizeURL, err := a.Authorize("spotify", session, MockHttpRequest("http://localhost:2000/authy/spotify"))
+		So(err, ShouldEqual, nil)
+
+		callback, err := server.Callback(authorizeURL)
+		So(err, ShouldEqual, nil)
+		So(server.AuthorizeRequests()[0].Get("show_dialog"), ShouldEqual, "true")
+
+		token, _, err := a.Access("spotify", session, callback)
+		So(err, ShouldEqual, nil)
+		So(token.Value, ShouldEqual, authytest.AccessToken)
+
+		// Spotify only accepts the credentials through HTTP Basic
+		So(server.TokenRequestHeaders()[0].Get("Authorization"), ShouldEqual,
+			"Basic "+base64.StdEncoding.EncodeToString([]byte("my-key:my-secret")))
+		So(server.TokenRequestBodies()[0], ShouldNotContainKey, "client_secret")
+	})
+}
+
+func TestGitLab(t *testing.T) {
+	Convey("Log in with GitLab", t, func() {
+		gitlabConfig := authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"gitlab": provider.ProviderConfig{Key: "my-key", Secret: "my-secret", Scope: []string{"read_user", "api"}},
+			},
+		}
+		session := authytest.NewSession()
+
+		Convey("On gitlab.com", func() {
+			a, err := authy.NewAuthy(gitlabConfig)
+			So(err, ShouldEqual, nil)
+
+			authorizeURL, err := a.Authorize("gitlab", session, MockHttpRequest("http://localhost:2000/authy/gitlab"))
+			So(err, ShouldEqual, nil)
+
+			location, _ := url.Parse(authorizeURL)
+			So(location.Host+location.Path, ShouldEqual, "gitlab.com/oauth/authorize")
+			So(location.Query().Get("scope"), ShouldEqual, "read_user api")
+			So(location.Query().Get("code_challenge"), ShouldNotEqual, "")
+			So(location.Query().Get("code_challenge_method"), ShouldEqual, "S256")
+		})
+
+		Convey("On a self hosted instance", func() {
+			gitlabConfig.Providers["gitlab"] = provider.ProviderConfig{Key: "my-key", Secret: "my-secret",
+				Scope: []string{"read_user", "api"}, BaseURL: "https://gitlab.example.com/"}
+			a, err := authy.NewAuthy(gitlabConfig)
+			So(err, ShouldEqual, nil)
+
+			authorizeURL, err := a.Authorize("gitlab", session, MockHttpRequest("http://localhost:2000/authy/gitlab"))
+			So(err, ShouldEqual, nil)
+
+			location, _ := url.Parse(authorizeURL)
+			So(location.Host+location.Path, ShouldEqual, "gitlab.example.com/oauth/authorize")
+			So(location.Query().Get("code_challenge"), ShouldNotEqual, "")
+		})
+	})
+}
+
+func TestAuthorizeWithParams(t *testing.T) {
+	Convey("Add request scoped parameters to the authorization URL", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+
+		p := server.Provider("hinted", provider.WithCustomParameters("login_hint", "prompt"))
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"hinted": provider.ProviderConfig{Inline: &p, Key: "my-key", Secret: "my-secret",
+					CustomParameters: map[string]string{"prompt": "consent"}},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+		authorizeURL, err := a.AuthorizeWithParams("hinted", session, MockHttpRequest("http://localhost:2000/authy/hinted"),
+			map[string]string{"login_hint": "user@example.com", "prompt": "select_account"})
+		So(err, ShouldEqual, nil)
+
+		location, _ := url.Parse(authorizeURL)
+		So(location.Query().Get("login_hint"), ShouldEqual, "user@example.com")
+		So(location.Query().Get("prompt"), ShouldEqual, "select_account")
+
+		Convey("The configured parameters are left alone", func() {
+			authorizeURL, err := a.Authorize("hinted", session, MockHttpRequest("http://localhost:2000/authy/hinted"))
+			So(err, ShouldEqual, nil)
+
+			location, _ := url.Parse(authorizeURL)
+			So(location.Query().Get("login_hint"), ShouldEqual, "")
+			So(location.Query().Get("prompt"), ShouldEqual, "consent")
+		})
+
+		Convey("Parameters must be whitelisted by the provider", func() {
+			_, err := a.AuthorizeWithParams("hinted", session, MockHttpRequest("http://localhost:2000/authy/hinted"),
+				map[string]string{"redirect_uri": "https://evil.example.com"})
+			So(errors.Is(err, authy.ErrUnknownParameter), ShouldBeTrue)
+		})
+	})
+}
+
+func TestGenericProvider(t *testing.T) {
+	Convey("Log in against a server Authy doesn't know about", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+
+		p := provider.Generic(server.URL+"/authorize", server.URL+"/token", " ", provider.ClientAuthBasic)
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"sso": provider.ProviderConfig{Inline: &p, Key: "my-key", Secret: "my-secret", Scope: []string{"profile", "email"}},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+		authorizeURL, err := a.Authorize("sso", session, MockHttpRequest("http://localhost:2000/authy/sso"))
+		So(err, ShouldEqual, nil)
+		So(server.AuthorizeRequests(), ShouldHaveLength, 0)
+
+		callback, err := server.Callback(authorizeURL)
+		So(err, ShouldEqual, nil)
+		So(server.AuthorizeRequests()[0].Get("scope"), ShouldEqual, "profile email")
+
+		token, _, err := a.Access("sso", session, callback)
+		So(err, ShouldEqual, nil)
+		So(token.Provider, ShouldEqual, "sso")
+		So(token.Value, ShouldEqual, authytest.AccessToken)
+
+		// credentials went through HTTP Basic
+		So(server.TokenRequests()[0].Get("client_secret"), ShouldEqual, "my-secret")
+	})
+}
+
+func TestPrivateKeyJWT(t *testing.T) {
+	Convey("Authenticate with a private key instead of a secret", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+
+		p := provider.Generic(server.URL+"/authorize", server.URL+"/token", " ", provider.ClientAuthPrivateKeyJWT)
+		providerConfig := provider.ProviderConfig{Inline: &p, Key: "my-key"}
+
+		Convey("The key is required", func() {
+			_, err := authy.NewAuthy(authy.Config{Providers: map[string]provider.ProviderConfig{"sso": providerConfig}})
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "missing private key")
+		})
+
+		Convey("Invalid keys are reported at startup", func() {
+			providerConfig.PrivateKey = "not a key"
+			_, err := authy.NewAuthy(authy.Config{Providers: map[string]provider.ProviderConfig{"sso": providerConfig}})
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Log in without a secret", func() {
+			key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			der, _ := x509.MarshalPKCS8PrivateKey(key)
+			providerConfig.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+			a, err := authy.NewAuthy(authy.Config{Providers: map[string]provider.ProviderConfig{"sso": providerConfig}})
+			So(err, ShouldEqual, nil)
+
+			session := authytest.NewSession()
+			authorizeURL, err := a.Authorize("sso", session, MockHttpRequest("http://localhost:2000/authy/sso"))
+			So(err, ShouldEqual, nil)
+			callback, err := server.Callback(authorizeURL)
+			So(err, ShouldEqual, nil)
+
+			_, _, err = a.Access("sso", session, callback)
+			So(err, ShouldEqual, nil)
+			So(server.TokenRequests()[0].Get("client_assertion_type"), ShouldEqual, oauth2.ClientAssertionType)
+			So(server.TokenRequests()[0].Get("client_assertion"), ShouldNotEqual, "")
+		})
+	})
+}
+
+func TestOAuth1(t *testing.T) {
+	Convey("Log in with an OAuth1 provider", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/request_token":
+				rw.Write([]byte("oauth_token=requesttoken&oauth_token_secret=requestsecret&oauth_callback_confirmed=true"))
+			case "/access_token":
+				rw.Write([]byte("oauth_token=accesstoken&oauth_token_secret=accesssecret"))
+			case "/api":
+				if !strings.Contains(r.Header.Get("Authorization"), `oauth_token="accesstoken"`) {
+					rw.WriteHeader(http.StatusUnauthorized)
+				}
+			}
+		}))
+		Reset(server.Close)
+
+		provider.RegisterProvider(provider.New("oauth1", server.URL+"/authorize", server.URL+"/access_token",
+			provider.WithRequestURL(server.URL+"/request_token")))
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"oauth1": provider.ProviderConfig{Key: "my-key", Secret: "my-secret"},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		authorizeURL, err := a.Authorize("oauth1", session, MockHttpRequest("http://localhost:2000/authy/oauth1"))
+		So(err, ShouldEqual, nil)
+		So(authorizeURL, ShouldEqual, server.URL+"/authorize?oauth_token=requesttoken")
+
+		Convey("Reject a callback for another request token", func() {
+			_, _, err := a.Access("oauth1", session, MockHttpRequest("http://localhost:2000/authy/oauth1/callback?oauth_token=other&oauth_verifier=verifier"))
+			So(errors.Is(err, authy.ErrStateMismatch), ShouldBeTrue)
+		})
+
+		Convey("Exchange the request token", func() {
+			token, _, err := a.Access("oauth1", session, MockHttpRequest("http://localhost:2000/authy/oauth1/callback?oauth_token=requesttoken&oauth_verifier=verifier"))
+			So(err, ShouldEqual, nil)
+			So(token.Version, ShouldEqual, 1)
+			So(token.Value, ShouldEqual, "accesstoken")
+			So(token.Secret, ShouldEqual, "accesssecret")
+
+			resp, err := token.Client().Get(server.URL + "/api")
+			So(err, ShouldEqual, nil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		})
+	})
+}
+
+func TestImplicitFlow(t *testing.T) {
+	Convey("Read the token from the callback of the implicit flow", t, func() {
+		provider.RegisterProvider(provider.New("implicit", "https://implicit.example.com/authorize", "", provider.WithImplicitFlow()))
+
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"implicit": provider.ProviderConfig{Key: "my-key", Scope: []string{"read"}},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		authorizeURL, err := a.Authorize("implicit", session, MockHttpRequest("http://localhost:2000/authy/implicit"))
+		So(err, ShouldEqual, nil)
+		state := StateFromURL(authorizeURL)
+
+		token, _, err := a.Access("implicit", session, MockHttpRequest("http://localhost:2000/authy/implicit/callback?access_token=fakeaccesstoken&token_type=bearer&state="+url.QueryEscape(state)))
+		So(err, ShouldEqual, nil)
+		So(token.Value, ShouldEqual, "fakeaccesstoken")
+		So(token.Scope, ShouldResemble, []string{"read"})
+	})
+}
@@ -0,0 +1,317 @@
+// Package authytest provides a fake OAuth2 provider to test login flows without network access
+//
+//	server := authytest.NewServer()
+//	defer server.Close()
+//
+//	p := server.Provider("fake")
+//	a, _ := authy.NewAuthy(authy.Config{
+//		Providers: map[string]provider.ProviderConfig{
+//			"fake": provider.ProviderConfig{Inline: &p, Key: "key", Secret: "secret"},
+//		},
+//	})
+//
+//	authorizeURL, _ := a.Authorize("fake", session, r)
+//	callback, _ := server.Callback(authorizeURL)
+//	token, _, _ := a.Access("fake", session, callback)
+package authytest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/christopherobin/authy/provider"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Values issued by the server unless told otherwise
+const (
+	Code         = "authytest-code"
+	AccessToken  = "authytest-access-token"
+	RefreshToken = "authytest-refresh-token"
+	// kid of the key signing the id_tokens
+	KeyID = "authytest-key"
+)
+
+// A fake OAuth2 provider, the authorization endpoint approves every request and sends the user straight back to the
+// redirect URI with a code
+type Server struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// values of the token response
+	token map[string]string
+	// OAuth2 error returned by the token endpoint instead of the token
+	err map[string]string
+	// answer with JSON instead of a form encoded body
+	json bool
+	// what the endpoints received
+	authorizeRequests []url.Values
+	tokenRequests     []url.Values
+	tokenBodies       []url.Values
+	tokenHeaders      []http.Header
+	// signs the id_tokens, created on first use
+	keyOnce sync.Once
+	key     *rsa.PrivateKey
+}
+
+// Start a fake provider, close it once done
+func NewServer() *Server {
+	s := &Server{json: true}
+	s.SetToken(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", s.authorize)
+	mux.HandleFunc("/token", s.tokenEndpoint)
+	mux.HandleFunc("/jwks", s.jwks)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Provider pointing at the server, use it inline in a ProviderConfig or register it
+func (s *Server) Provider(name string, opts ...provider.Option) provider.Provider {
+	opts = append([]provider.Option{provider.WithScopeDelimiter(" ")}, opts...)
+	return provider.New(name, s.URL+"/authorize", s.URL+"/token", opts...)
+}
+
+// Set the values returned by the token endpoint, they are merged with the default bearer token (AccessToken, valid for
+// an hour with RefreshToken). Set a value to "" to leave it out of the response
+func (s *Server) SetToken(values map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = map[string]string{
+		"access_token":  AccessToken,
+		"token_type":    "bearer",
+		"expires_in":    "3600",
+		"refresh_token": RefreshToken,
+	}
+	for name, value := range values {
+		if value == "" {
+			delete(s.token, name)
+		} else {
+			s.token[name] = value
+		}
+	}
+}
+
+// Make the token endpoint fail with the given OAuth2 error code, an empty code restores the normal behavior
+func (s *Server) SetError(code string, description string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if code == "" {
+		s.err = nil
+		return
+	}
+	s.err = map[string]string{"error": code, "error_description": description}
+}
+
+// Answer token requests with JSON (the default) or a form encoded body like older providers
+func (s *Server) SetJSON(useJSON bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.json = useJSON
+}
+
+// Query parameters of every request received by the authorization endpoint
+func (s *Server) AuthorizeRequests() []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]url.Values(nil), s.authorizeRequests...)
+}
+
+// Form of every request received by the token endpoint, client credentials sent with HTTP Basic are added as
+// client_id and client_secret
+func (s *Server) TokenRequests() []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]url.Values(nil), s.tokenRequests...)
+}
+
+// Form of every request received by the token endpoint as sent, without the credentials of HTTP Basic
+func (s *Server) TokenRequestBodies() []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]url.Values(nil), s.tokenBodies...)
+}
+
+// Headers of every request received by the token endpoint
+func (s *Server) TokenRequestHeaders() []http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]http.Header(nil), s.tokenHeaders...)
+}
+
+// Follow an authorization URL like a browser would and return the request the provider sends the user back with, pass
+// it to Access. The parameters are POSTed as a form when the authorization asked for response_mode=form_post
+func (s *Server) Callback(authorizeURL string) (*http.Request, error) {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(authorizeURL)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	location, err := resp.Location()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("authorization endpoint returned %s without redirecting", resp.Status))
+	}
+
+	if parsed, err := url.Parse(authorizeURL); err == nil && parsed.Query().Get("response_mode") == "form_post" {
+		body := location.Query().Encode()
+		location.RawQuery = ""
+		callback := httptest.NewRequest("POST", location.String(), strings.NewReader(body))
+		callback.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return callback, nil
+	}
+
+	return httptest.NewRequest("GET", location.String(), nil), nil
+}
+
+// Sign the claims as a RS256 id_token, set the JWKSURL of the provider to the /jwks endpoint of the server to verify
+// them
+func (s *Server) SignIDToken(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": KeyID})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.signingKey(), crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (s *Server) signingKey() *rsa.PrivateKey {
+	s.keyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		s.key = key
+	})
+	return s.key
+}
+
+func (s *Server) jwks(rw http.ResponseWriter, r *http.Request) {
+	public := s.signingKey().PublicKey
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": KeyID,
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+	}}})
+}
+
+func (s *Server) authorize(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	s.authorizeRequests = append(s.authorizeRequests, query)
+	s.mu.Unlock()
+
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("redirect_uri") == "" {
+		http.Error(rw, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	values := redirectURI.Query()
+	values.Set("code", Code)
+	if state := query.Get("state"); state != "" {
+		values.Set("state", state)
+	}
+	redirectURI.RawQuery = values.Encode()
+
+	http.Redirect(rw, r, redirectURI.String(), http.StatusFound)
+}
+
+func (s *Server) tokenEndpoint(rw http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	sent := url.Values{}
+	for name, values := range r.PostForm {
+		sent[name] = append([]string(nil), values...)
+	}
+	form := r.PostForm
+	if username, password, ok := r.BasicAuth(); ok == true {
+		username, _ = url.QueryUnescape(username)
+		password, _ = url.QueryUnescape(password)
+		form.Set("client_id", username)
+		form.Set("client_secret", password)
+	}
+
+	s.mu.Lock()
+	s.tokenRequests = append(s.tokenRequests, form)
+	s.tokenBodies = append(s.tokenBodies, sent)
+	s.tokenHeaders = append(s.tokenHeaders, r.Header.Clone())
+	response := s.token
+	useJSON := s.json
+	status := http.StatusOK
+	failing := s.err != nil
+	if failing {
+		response = s.err
+		status = http.StatusBadRequest
+	}
+	s.mu.Unlock()
+
+	switch form.Get("grant_type") {
+	case "authorization_code":
+		if !failing && form.Get("code") != Code {
+			response = map[string]string{"error": "invalid_grant", "error_description": "unknown code"}
+			status = http.StatusBadRequest
+		}
+	case "refresh_token", "client_credentials":
+	default:
+		response = map[string]string{"error": "unsupported_grant_type"}
+		status = http.StatusBadRequest
+	}
+
+	if useJSON {
+		// numbers are sent as such like real providers do
+		body := map[string]interface{}{}
+		for name, value := range response {
+			if number, err := strconv.Atoi(value); err == nil && name == "expires_in" {
+				body[name] = number
+			} else {
+				body[name] = value
+			}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		json.NewEncoder(rw).Encode(body)
+		return
+	}
+
+	values := url.Values{}
+	for name, value := range response {
+		values.Set(name, value)
+	}
+	rw.Header().Set("Content-Type", "application/x-www-form-urlencoded")
+	rw.WriteHeader(status)
+	rw.Write([]byte(values.Encode()))
+}
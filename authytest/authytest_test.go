@@ -0,0 +1,80 @@
+package authytest_test
+
+import (
+	"errors"
+	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/authytest"
+	"github.com/christopherobin/authy/oauth2"
+	"github.com/christopherobin/authy/provider"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	Convey("Log in against the fake provider", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+
+		p := server.Provider("fake")
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"fake": provider.ProviderConfig{Inline: &p, Key: "my-key", Secret: "my-secret", Scope: []string{"read", "write"}},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+		login := func() (*authy.Token, error) {
+			authorizeURL, err := a.Authorize("fake", session, httptest.NewRequest("GET", "http://localhost:2000/authy/fake", nil))
+			if err != nil {
+				return nil, err
+			}
+
+			callback, err := server.Callback(authorizeURL)
+			if err != nil {
+				return nil, err
+			}
+
+			token, _, err := a.Access("fake", session, callback)
+			return token, err
+		}
+
+		Convey("Get the default token", func() {
+			token, err := login()
+			So(err, ShouldEqual, nil)
+			So(token.Value, ShouldEqual, authytest.AccessToken)
+			So(token.RefreshToken, ShouldEqual, authytest.RefreshToken)
+			So(token.Expires, ShouldNotEqual, nil)
+
+			So(server.AuthorizeRequests(), ShouldHaveLength, 1)
+			So(server.AuthorizeRequests()[0].Get("scope"), ShouldEqual, "read write")
+			So(server.TokenRequests(), ShouldHaveLength, 1)
+			So(server.TokenRequests()[0].Get("client_secret"), ShouldEqual, "my-secret")
+
+			Convey("And refresh it", func() {
+				server.SetToken(map[string]string{"access_token": "refreshed", "refresh_token": ""})
+				So(token.Refresh(), ShouldEqual, nil)
+				So(token.Value, ShouldEqual, "refreshed")
+				So(server.TokenRequests()[1].Get("grant_type"), ShouldEqual, "refresh_token")
+			})
+		})
+
+		Convey("Use form encoded responses", func() {
+			server.SetJSON(false)
+			server.SetToken(map[string]string{"expires_in": ""})
+
+			token, err := login()
+			So(err, ShouldEqual, nil)
+			So(token.Value, ShouldEqual, authytest.AccessToken)
+			So(token.Expires, ShouldEqual, nil)
+		})
+
+		Convey("Return errors", func() {
+			server.SetError(oauth2.CodeAccessDenied, "nope")
+
+			_, err := login()
+			So(errors.Is(err, oauth2.ErrAccessDenied), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,53 @@
+package authytest
+
+import (
+	"sync"
+)
+
+// In memory authy.Session, safe for concurrent use. Embed it to implement the session interface of a web framework
+type Session struct {
+	mu     sync.Mutex
+	values map[interface{}]interface{}
+}
+
+// Start an empty session
+func NewSession() *Session {
+	return &Session{values: map[interface{}]interface{}{}}
+}
+
+func (s *Session) Get(key interface{}) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key]
+}
+
+func (s *Session) Set(key interface{}, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+}
+
+func (s *Session) Delete(key interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// Remove everything from the session
+func (s *Session) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = map[interface{}]interface{}{}
+}
+
+// Copy of what the session holds, to check what was written to it
+func (s *Session) Values() map[interface{}]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := make(map[interface{}]interface{}, len(s.values))
+	for key, value := range s.values {
+		values[key] = value
+	}
+	return values
+}
@@ -0,0 +1,136 @@
+package authy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Keeps tokens that can be reused until they expire, such as the ones of the client credentials grant. Keys are made of
+// the provider name and the subject of the token: <provider>:<subject>
+type TokenCache interface {
+	// Return the token cached under the given key, nil if there is none or if it expired
+	Get(key string) (*Token, error)
+	// Cache the token under the given key, replacing any previous one
+	Set(key string, token *Token) error
+}
+
+// How long MemoryTokenCache keeps the tokens without an expiry date when used by default
+var DefaultTokenCacheTTL = time.Hour
+
+// In memory TokenCache, entries expire with their token or after the TTL for tokens without an expiry date
+type MemoryTokenCache struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	tokens map[string]cachedToken
+}
+
+type cachedToken struct {
+	token   *Token
+	expires time.Time
+}
+
+type clientTokenCalls struct {
+	sync.Mutex
+	calls map[string]*clientTokenCall
+}
+
+type clientTokenCall struct {
+	done  chan struct{}
+	token *Token
+	err   error
+}
+
+// Create an empty cache, tokens without an expiry date are kept for ttl
+func NewMemoryTokenCache(ttl time.Duration) *MemoryTokenCache {
+	return &MemoryTokenCache{
+		ttl:    ttl,
+		tokens: map[string]cachedToken{},
+	}
+}
+
+// Return the token cached under key, nil if there is none or if it expires within ExpirySkew
+func (m *MemoryTokenCache) Get(key string) (*Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok := m.tokens[key]
+	if ok != true || time.Now().After(value.expires) {
+		return nil, nil
+	}
+	return value.token, nil
+}
+
+// Cache the token under key until it expires, the expired tokens are dropped at the same time
+func (m *MemoryTokenCache) Set(key string, token *Token) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// drop the expired tokens
+	now := time.Now()
+	for k, value := range m.tokens {
+		if now.After(value.expires) {
+			delete(m.tokens, k)
+		}
+	}
+
+	// stop serving the token before it expires so that callers have time to use it
+	expires := now.Add(m.ttl)
+	if token.Expires != nil {
+		expires = token.Expires.Add(-ExpirySkew)
+	}
+
+	m.tokens[key] = cachedToken{token: token, expires: expires}
+	return nil
+}
+
+// Same as AuthorizeClient but the token is reused until it expires, see Config.TokenCache. Concurrent calls missing the
+// cache share the same request to the provider
+func (a Authy) CachedClientToken(providerName string) (*Token, error) {
+	providerConfig, ok := a.providers[providerName]
+	if ok != true {
+		return nil, fmt.Errorf("%w %s", ErrUnknownProvider, providerName)
+	}
+
+	// the application is the subject of client tokens
+	key := providerName + ":" + providerConfig.Key
+
+	token, err := a.tokenCache.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if token.Valid() {
+		return token, nil
+	}
+
+	return a.fetchClientToken(providerName, key)
+}
+
+// Run the client credentials grant and cache the token, callers asking for the same key in the meantime wait for that
+// call instead of sending their own
+func (a Authy) fetchClientToken(providerName string, key string) (*Token, error) {
+	a.clientTokens.Lock()
+	if call, ok := a.clientTokens.calls[key]; ok == true {
+		a.clientTokens.Unlock()
+		<-call.done
+		return call.token, call.err
+	}
+	call := &clientTokenCall{done: make(chan struct{})}
+	a.clientTokens.calls[key] = call
+	a.clientTokens.Unlock()
+
+	call.token, call.err = a.AuthorizeClient(providerName)
+	if call.err == nil {
+		call.err = a.tokenCache.Set(key, call.token)
+	}
+	if call.err != nil {
+		call.token = nil
+	}
+
+	a.clientTokens.Lock()
+	delete(a.clientTokens.calls, key)
+	a.clientTokens.Unlock()
+	close(call.done)
+
+	return call.token, call.err
+}
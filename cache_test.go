@@ -0,0 +1,105 @@
+package authy_test
+
+import (
+	"fmt"
+	"github.com/christopherobin/authy"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachedClientToken(t *testing.T) {
+	Convey("Reuse client tokens until they expire", t, func() {
+		var requests int32
+		expiresIn := int32(3600)
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			count := atomic.AddInt32(&requests, 1)
+			rw.Write([]byte(fmt.Sprintf("access_token=token%d&token_type=bearer&expires_in=%d", count, atomic.LoadInt32(&expiresIn))))
+		}))
+		Reset(server.Close)
+
+		a, err := authy.NewAuthy(MockConfig("machine", server.URL+"/authorize", server.URL+"/token"))
+		So(err, ShouldEqual, nil)
+
+		token, err := a.CachedClientToken("machine")
+		So(err, ShouldEqual, nil)
+		So(token.Value, ShouldEqual, "token1")
+
+		token, err = a.CachedClientToken("machine")
+		So(err, ShouldEqual, nil)
+		So(token.Value, ShouldEqual, "token1")
+		So(atomic.LoadInt32(&requests), ShouldEqual, 1)
+
+		Convey("Fetch a new token once expired", func() {
+			atomic.StoreInt32(&expiresIn, 30)
+			other, err := authy.NewAuthy(MockConfig("machine", server.URL+"/authorize", server.URL+"/token"))
+			So(err, ShouldEqual, nil)
+
+			// expires within ExpirySkew, never served from the cache
+			token, err := other.CachedClientToken("machine")
+			So(err, ShouldEqual, nil)
+			token, err = other.CachedClientToken("machine")
+			So(err, ShouldEqual, nil)
+			So(token.Value, ShouldEqual, "token3")
+		})
+
+		Convey("Concurrent misses share one request", func() {
+			release := make(chan struct{})
+			var slowRequests int32
+			slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&slowRequests, 1)
+				<-release
+				rw.Write([]byte("access_token=shared&token_type=bearer&expires_in=3600"))
+			}))
+			Reset(slow.Close)
+
+			other, err := authy.NewAuthy(MockConfig("machine", slow.URL+"/authorize", slow.URL+"/token"))
+			So(err, ShouldEqual, nil)
+
+			var wg sync.WaitGroup
+			values := make([]string, 10)
+			for i := range values {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if token, err := other.CachedClientToken("machine"); err == nil {
+						values[i] = token.Value
+					}
+				}(i)
+			}
+
+			// let the callers pile up behind the first request
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			So(atomic.LoadInt32(&slowRequests), ShouldEqual, 1)
+			for _, value := range values {
+				So(value, ShouldEqual, "shared")
+			}
+		})
+
+		Convey("Unknown provider", func() {
+			_, err := a.CachedClientToken("nope")
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+
+	Convey("Expire tokens without expiry date after the TTL", t, func() {
+		cache := authy.NewMemoryTokenCache(10 * time.Millisecond)
+		So(cache.Set("machine:my-key", &authy.Token{Value: "token"}), ShouldEqual, nil)
+
+		token, err := cache.Get("machine:my-key")
+		So(err, ShouldEqual, nil)
+		So(token.Value, ShouldEqual, "token")
+
+		time.Sleep(20 * time.Millisecond)
+		token, err = cache.Get("machine:my-key")
+		So(err, ShouldEqual, nil)
+		So(token, ShouldBeNil)
+	})
+}
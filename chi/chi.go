@@ -0,0 +1,34 @@
+// Helpers to mount the net/http handlers of Authy on a chi router
+//
+//	handler, err := nethttp.Handler(config)
+//	if err != nil {
+//		panic(err)
+//	}
+//
+//	r := chi.NewRouter()
+//	r.Route("/authy", func(r chi.Router) {
+//		authychi.Mount(r, handler)
+//	})
+//	r.With(handler.RequireToken).Get("/api/me", me)
+package chi
+
+import (
+	"github.com/christopherobin/authy/nethttp"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+)
+
+// Read the provider name from the given chi URL parameter
+func URLParam(name string) nethttp.ProviderFunc {
+	return func(r *http.Request) string {
+		return chi.URLParam(r, name)
+	}
+}
+
+// Mount the authorization and callback handlers on /{provider} and /{provider}/callback (see Config.CallbackSegment),
+// and the logout handler on /logout
+func Mount(r chi.Router, handler *nethttp.Authy) {
+	r.Handle("/logout", handler.LogoutHandler())
+	r.Handle("/{provider}", handler.AuthorizeHandler(URLParam("provider")))
+	r.Handle("/{provider}/"+handler.CallbackSegment(), handler.CallbackHandler(URLParam("provider")))
+}
@@ -0,0 +1,70 @@
+package chi_test
+
+import (
+	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/authytest"
+	authychi "github.com/christopherobin/authy/chi"
+	"github.com/christopherobin/authy/nethttp"
+	"github.com/christopherobin/authy/provider"
+	"github.com/go-chi/chi/v5"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestMount(t *testing.T) {
+	Convey("Log in through a chi router", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+		mock := server.Provider("mock")
+
+		handler, err := nethttp.Handler(nethttp.Config{
+			Config: authy.Config{
+				Callback: "/api/me",
+				Providers: map[string]provider.ProviderConfig{
+					"mock": provider.ProviderConfig{Inline: &mock, Key: "my-key", Secret: "my-secret"},
+				},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		r := chi.NewRouter()
+		r.Route("/auth", func(r chi.Router) {
+			authychi.Mount(r, handler)
+		})
+		r.With(handler.RequireToken).Get("/api/me", func(w http.ResponseWriter, r *http.Request) {
+			token, _ := nethttp.TokenFromContext(r.Context())
+			w.Write([]byte(token.Value))
+		})
+
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/auth/mock", nil)
+		r.ServeHTTP(rw, req)
+		So(rw.Code, ShouldEqual, http.StatusFound)
+		cookies := rw.Result().Cookies()
+
+		location, _ := url.Parse(rw.Header().Get("Location"))
+		So(location.Query().Get("redirect_uri"), ShouldEqual, "http://localhost/auth/mock/callback")
+
+		rw = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "http://localhost/auth/mock/callback?code="+authytest.Code+"&state="+url.QueryEscape(location.Query().Get("state")), nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		r.ServeHTTP(rw, req)
+		So(rw.Code, ShouldEqual, http.StatusFound)
+		So(rw.Header().Get("Location"), ShouldEqual, "/api/me")
+		// the session got a new id once logged in
+		cookies = rw.Result().Cookies()
+
+		rw = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "http://localhost/api/me", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		r.ServeHTTP(rw, req)
+		So(rw.Body.String(), ShouldEqual, authytest.AccessToken)
+	})
+}
@@ -0,0 +1,71 @@
+package authy
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Codec serializes tokens, for example to store them in a session
+type Codec interface {
+	Encode(token *Token) ([]byte, error)
+	Decode(data []byte, token *Token) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(token *Token) ([]byte, error) {
+	return json.Marshal(token)
+}
+
+func (jsonCodec) Decode(data []byte, token *Token) error {
+	return json.Unmarshal(data, token)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Encode(token *Token) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(token); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec) Decode(data []byte, token *Token) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(token)
+}
+
+// Available codecs, JSON is used by Serialize and TokenFromSerialized
+var (
+	JSONCodec Codec = jsonCodec{}
+	GobCodec  Codec = gobCodec{}
+)
+
+// Serialize the token with the given codec
+func (t *Token) SerializeWith(codec Codec) ([]byte, error) {
+	return codec.Encode(t)
+}
+
+// Deserialize a token encoded with the given codec
+func (a Authy) TokenFromCodec(codec Codec, data []byte) (*Token, error) {
+	var t Token
+	if err := codec.Decode(data, &t); err != nil {
+		return nil, err
+	}
+
+	// assign authy
+	t.authy = a
+	t.refresh = &refreshState{}
+	return &t, nil
+}
+
+// Serialize the token using encoding/gob, more compact than JSON
+func (t *Token) SerializeGob() ([]byte, error) {
+	return t.SerializeWith(GobCodec)
+}
+
+// Deserialize a token serialized with SerializeGob
+func (a Authy) TokenFromGob(data []byte) (*Token, error) {
+	return a.TokenFromCodec(GobCodec, data)
+}
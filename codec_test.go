@@ -0,0 +1,58 @@
+package authy_test
+
+import (
+	"github.com/christopherobin/authy"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestCodec(t *testing.T) {
+	Convey("Serialize tokens with the different codecs", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		a, err := MockAuthy("codec", server.URL+"/oauth2", server.URL+"/oauth2")
+		So(err, ShouldEqual, nil)
+
+		expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+		token := &authy.Token{
+			Version:      2,
+			Provider:     "codec",
+			Value:        "abc",
+			Scope:        []string{"user", "repo"},
+			Type:         "bearer",
+			Expires:      &expires,
+			RefreshToken: "def",
+			Extra:        map[string]string{"X-Request-Id": "1234"},
+		}
+
+		for name, codec := range map[string]authy.Codec{"JSON": authy.JSONCodec, "gob": authy.GobCodec} {
+			Convey(name, func() {
+				data, err := token.SerializeWith(codec)
+				So(err, ShouldEqual, nil)
+
+				decoded, err := a.TokenFromCodec(codec, data)
+				So(err, ShouldEqual, nil)
+				So(decoded.Value, ShouldEqual, "abc")
+				So(decoded.Scope, ShouldResemble, []string{"user", "repo"})
+				So(decoded.Expires.Equal(expires), ShouldBeTrue)
+				So(decoded.RefreshToken, ShouldEqual, "def")
+				So(decoded.Extra["X-Request-Id"], ShouldEqual, "1234")
+
+				// the Authy instance is attached back so the token can be refreshed
+				So(decoded.Refresh(), ShouldEqual, nil)
+				So(decoded.Value, ShouldEqual, "fakeaccesstoken")
+			})
+		}
+
+		Convey("Gob helpers", func() {
+			data, err := token.SerializeGob()
+			So(err, ShouldEqual, nil)
+
+			decoded, err := a.TokenFromGob(data)
+			So(err, ShouldEqual, nil)
+			So(decoded.Value, ShouldEqual, "abc")
+		})
+	})
+}
@@ -1,7 +1,14 @@
 package authy
 
 import (
+	"fmt"
 	"github.com/christopherobin/authy/provider"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
 )
 
 // Configuration for authy, is already mapped for being parsed by encoding/json
@@ -13,11 +20,13 @@ import (
 //     "providers": {
 //       "github": {
 //         "key": "be148a4abf2796b3a8e1",
-//         "secret": "1bbf884bbf79ef21fef03410389eb451300abd84",
+//         "secret": "${GITHUB_CLIENT_SECRET}",
 //         "scope": ["repo", "email"]
 //       }
 //    }
 //  }
+//
+// Provider keys and secrets of the form ${NAME} are read from the environment variable NAME when calling NewAuthy
 type Config struct {
 	// Where to redirect the user for login if supported by the middleware (defaults to /login)
 	PathLogin string `json:"login"`
@@ -25,6 +34,77 @@ type Config struct {
 	BasePath string `json:"base_path"`
 	// Where the user is redirected by default after a successful auth
 	Callback string `json:"callback"`
+	// Last segment of the callback route, the provider sends the user back to <base path>/<provider>/<segment>
+	// (defaults to callback)
+	CallbackSegment string `json:"callback_segment"`
+	// Where the user is redirected by default after logging out (defaults to /)
+	PostLogoutRedirect string `json:"post_logout_redirect"`
+	// Revoke the tokens of the user on the providers having a revocation endpoint when they log out
+	RevokeOnLogout bool `json:"revoke_on_logout"`
+	// Also log the user out of the provider they logged in with if it supports OpenID Connect RP-initiated logout,
+	// see Authy.LogoutURL
+	ProviderLogout bool `json:"provider_logout"`
 	// A list of providers
 	Providers map[string]provider.ProviderConfig `json:"providers"`
+	// Called once a user successfully authenticated, if it returns a non empty URL the user is redirected there
+	// instead of the configured callback (for example to send first time users to an onboarding page)
+	OnSuccess func(token *Token, r *http.Request) (string, error) `json:"-"`
+	// Tell API clients from browsers, LoginRequired answers API clients with a 401 and a JSON body instead of redirecting
+	// them to the login page. Defaults to IsAPIRequest, use a function returning false to always redirect
+	IsAPIRequest func(r *http.Request) bool `json:"-"`
+	// Where the data of pending authorizations is kept, defaults to the user session
+	StateStore StateStore `json:"-"`
+	// Where CachedClientToken keeps the client tokens, defaults to an in memory cache
+	TokenCache TokenCache `json:"-"`
+	// Keep the CSRF state in a signed cookie instead of the session, the middlewares use it when set. See StateCookie
+	StateCookie *StateCookie `json:"state_cookie"`
+	// Key signing the return paths carried in the state (see WithReturnTo), defaults to the key of the state cookie. A
+	// random key is generated when neither is set, set one when running several instances of the application
+	StateKey string `json:"state_key"`
+	// How long the user has to authorize the application on the provider's website (defaults to 10 minutes), older
+	// callbacks are rejected
+	StateMaxAge time.Duration `json:"-"`
+	// Number of random bytes of the states and OpenID Connect nonces (defaults to 16, that is 128 bits of entropy), at
+	// least 8. Set it to 32 where 256 bits are required, the values are hex encoded so twice as long in the URLs
+	StateLength int `json:"state_length"`
+	// Source of the random states, nonces and PKCE verifiers, defaults to crypto/rand. Set a predictable reader in tests
+	// to assert the authorization URLs
+	Rand io.Reader `json:"-"`
+	// Logger used by the providers that don't have their own, see provider.ProviderConfig.Logger
+	Logger *slog.Logger `json:"-"`
+	// Retry policy of the token requests for the providers that don't have their own, see provider.ProviderConfig.Retry
+	Retry *provider.RetryPolicy `json:"retry"`
+	// Notified of the duration and outcome of the requests made to the providers (token exchanges, refreshes, user
+	// info, ...), nothing is measured if nil
+	Observer Observer `json:"-"`
+}
+
+// Print the config with the state key masked, the providers and the state cookie mask their own secrets
+func (config Config) String() string {
+	// same fields without the String method
+	type plainConfig Config
+	redacted := plainConfig(config)
+	redacted.StateKey = provider.Redact(config.StateKey)
+	return fmt.Sprintf("%+v", redacted)
+}
+
+func (config Config) GoString() string {
+	return "authy.Config" + config.String()
+}
+
+var envReferenceRe = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// Resolve a ${NAME} reference to the value of the environment variable NAME, other values are returned as is
+func resolveEnv(value string) (string, error) {
+	matches := envReferenceRe.FindStringSubmatch(value)
+	if matches == nil {
+		return value, nil
+	}
+
+	resolved, ok := os.LookupEnv(matches[1])
+	if ok != true {
+		return "", fmt.Errorf("environment variable %s is not set", matches[1])
+	}
+
+	return resolved, nil
 }
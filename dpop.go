@@ -0,0 +1,106 @@
+package authy
+
+import (
+	"github.com/christopherobin/authy/oauth2"
+	"github.com/christopherobin/authy/provider"
+	"net/http"
+	"strings"
+)
+
+// Token transport for DPoP bound tokens (RFC 9449), every request carries a proof signed with the key the token is
+// bound to. Tokens the provider issued as regular bearer tokens are sent as such
+type DPoPTransport struct {
+	*TokenTransport
+	Key provider.DPoPSigner
+}
+
+// The key must be the one set as DPoP in the provider config when the token was issued, see oauth2.NewDPoPKey
+func NewDPoPTransport(t *Token, key provider.DPoPSigner, base http.RoundTripper) *DPoPTransport {
+	return &DPoPTransport{
+		TokenTransport: NewTokenTransport(t, base),
+		Key:            key,
+	}
+}
+
+// Same as Client but the requests are sent through a DPoPTransport
+func (t *Token) DPoPClient(key provider.DPoPSigner) *http.Client {
+	return &http.Client{
+		Transport: NewDPoPTransport(t, key, t.baseTransport()),
+	}
+}
+
+// Same as TokenTransport.RoundTrip, the observation covers the retry with the nonce of the server
+func (dt *DPoPTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if !dt.unobserved {
+		done := dt.token.authy.observe(dt.token.Provider, OperationAPI)
+		defer func() { done(err) }()
+	}
+
+	return dt.roundTripDPoP(req)
+}
+
+func (dt *DPoPTransport) roundTripDPoP(req *http.Request) (*http.Response, error) {
+	if dt.token.Version == 1 {
+		return dt.roundTripOAuth1(req)
+	}
+
+	if err := dt.refreshExpired(req.Context()); err != nil {
+		return nil, err
+	}
+
+	if !dt.token.isDPoP() {
+		return dt.TokenTransport.roundTrip(req)
+	}
+
+	resp, err := dt.send(req, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// the server wants a nonce in the proof, retry once if the body can be sent again
+	if oauth2.IsDPoPNonceChallenge(resp) && (req.Body == nil || req.GetBody != nil) {
+		resp.Body.Close()
+		return dt.send(req, true)
+	}
+
+	return resp, nil
+}
+
+// Send the request with a fresh proof, the first attempt sends the body of req (closed by the inner transport) and the
+// retry a new one from GetBody
+func (dt *DPoPTransport) send(req *http.Request, retry bool) (*http.Response, error) {
+	value := dt.token.value()
+	proof, err := dt.Key.Proof(req.Method, req.URL.String(), value)
+	if err != nil {
+		if !retry && req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	// make a copy of the request object (requested by RoundTripper interface)
+	newReq := req.Clone(req.Context())
+	if retry && req.Body != nil {
+		if newReq.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	newReq.Header.Set("Authorization", oauth2.TokenTypeDPoP+" "+value)
+	newReq.Header.Set("DPoP", proof)
+
+	resp, err := dt.transport.RoundTrip(newReq)
+	if err != nil {
+		return nil, err
+	}
+
+	dt.Key.SetNonce(req.URL.String(), resp.Header.Get("DPoP-Nonce"))
+	return resp, nil
+}
+
+func (t *Token) isDPoP() bool {
+	state := t.state()
+	state.Lock()
+	defer state.Unlock()
+
+	return strings.EqualFold(t.Type, oauth2.TokenTypeDPoP)
+}
@@ -0,0 +1,106 @@
+package authy_test
+
+import (
+	"github.com/christopherobin/authy/oauth2"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// request body remembering whether it was closed
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestDPoPTransport(t *testing.T) {
+	Convey("Send DPoP proofs along bound tokens", t, func() {
+		key, err := oauth2.NewDPoPKey()
+		So(err, ShouldEqual, nil)
+
+		var proofs []string
+		var bodies []string
+		api := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			proof := r.Header.Get("DPoP")
+			proofs = append(proofs, proof)
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+
+			if proof != "" {
+				claims, _ := oauth2.DecodeClaims(proof)
+				if claims["nonce"] != "api-nonce" {
+					rw.Header().Set("DPoP-Nonce", "api-nonce")
+					rw.Header().Set("WWW-Authenticate", `DPoP error="use_dpop_nonce"`)
+					rw.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+			}
+
+			rw.Write([]byte(r.Header.Get("Authorization")))
+		}))
+		Reset(api.Close)
+
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		a, err := MockAuthy("dpop", server.URL+"/oauth2", server.URL+"/oauth2")
+		So(err, ShouldEqual, nil)
+
+		Convey("Bound tokens use the DPoP scheme and retry with the nonce of the server", func() {
+			token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"dpop","value":"abc","type":"DPoP"}`))
+			So(err, ShouldEqual, nil)
+
+			resp, err := token.DPoPClient(key).Post(api.URL+"/items?page=2", "text/plain", strings.NewReader("item"))
+			So(err, ShouldEqual, nil)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			So(string(body), ShouldEqual, "DPoP abc")
+			So(bodies, ShouldResemble, []string{"item", "item"})
+
+			So(len(proofs), ShouldEqual, 2)
+			claims, err := oauth2.DecodeClaims(proofs[1])
+			So(err, ShouldEqual, nil)
+			So(claims["htm"], ShouldEqual, "POST")
+			So(claims["htu"], ShouldEqual, api.URL+"/items")
+			So(claims["ath"], ShouldNotEqual, nil)
+		})
+
+		Convey("The body of the request is sent first and closed, the retry reads a new one", func() {
+			token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"dpop","value":"abc","type":"DPoP"}`))
+			So(err, ShouldEqual, nil)
+
+			original := &closeRecorder{Reader: strings.NewReader("item")}
+			req, _ := http.NewRequest("POST", api.URL+"/items", original)
+			req.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader("item")), nil
+			}
+
+			resp, err := token.DPoPClient(key).Do(req)
+			So(err, ShouldEqual, nil)
+			resp.Body.Close()
+			So(original.closed, ShouldBeTrue)
+			So(bodies, ShouldResemble, []string{"item", "item"})
+		})
+
+		Convey("Bearer tokens are sent without proof", func() {
+			token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"dpop","value":"abc","type":"bearer"}`))
+			So(err, ShouldEqual, nil)
+
+			resp, err := token.DPoPClient(key).Get(api.URL + "/items")
+			So(err, ShouldEqual, nil)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			So(string(body), ShouldEqual, "Bearer abc")
+			So(proofs, ShouldResemble, []string{""})
+		})
+	})
+}
@@ -0,0 +1,125 @@
+package authy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/christopherobin/authy/oauth2"
+	"net/http"
+)
+
+// Returned when the provider is not part of the configuration
+var ErrUnknownProvider = errors.New("unknown provider")
+
+// Returned by Access when the session has no CSRF state for the provider, either the user didn't go through Authorize
+// or it is a forged callback
+var ErrStateMissing = errors.New("state token is not set in session, possible CSRF")
+
+// Returned by Access when the callback came without the session (or state cookie) Authorize wrote to, most of the time
+// because the session cookie is SameSite=Strict: browsers don't send those on the redirect coming from the provider,
+// use SameSite=Lax instead (SameSite=None for providers POSTing the callback). This is a special case of
+// ErrStateMissing
+var ErrNoSession = fmt.Errorf("%w, no session was found on the callback (is the session cookie SameSite=Strict?)", ErrStateMissing)
+
+// Returned by Access when the state parameter doesn't match the one in session
+var ErrStateMismatch = errors.New("invalid state param provided, possible CSRF")
+
+// Returned by Access when the authorization is older than Config.StateMaxAge
+var ErrStateExpired = errors.New("state token expired, please try to log in again")
+
+// Returned by Authorize when the path given to WithReturnTo would send the user to another website
+var ErrInvalidReturnTo = errors.New("return path must be local to the application")
+
+// Returned by Authorize when a parameter given to WithParams is not whitelisted by the provider
+var ErrUnknownParameter = errors.New("parameter is not accepted by the provider")
+
+// Returned when a value Authy wrote in the session came back with an unexpected type, the session backend or another
+// part of the application changed it
+var ErrInvalidSessionData = errors.New("invalid authy data in session")
+
+// Returned by Access when the callback has no code parameter
+var ErrMissingCode = errors.New("code was not found in the query parameters")
+
+// Returned for OAuth versions that are not supported
+var ErrNotImplemented = errors.New("Not Implemented")
+
+// Returned when a token cannot be used anymore and the user has to go through the authorization flow again
+var ErrReauthRequired = errors.New("user needs to re-authenticate")
+
+// Returned when the user revoked the application's access on the provider's side, this is a special case of
+// ErrReauthRequired so checking for the latter with errors.Is is enough if you don't need to tell them apart
+var ErrConsentRevoked = fmt.Errorf("%w, consent was revoked", ErrReauthRequired)
+
+// Returned when refreshing an OAuth1 token, OAuth1 has no refresh mechanism and its tokens don't expire
+var ErrRefreshNotSupported = errors.New("refresh not supported for OAuth1")
+
+// Returned by Access when the provider config has WantRefresh set but no refresh token was issued, most providers only
+// issue one the first time the user consents so send them through the consent screen again (prompt=consent)
+var ErrMissingRefreshToken = errors.New("provider did not issue a refresh token")
+
+// HTTP status to answer an error of the authorization flow with, failed callbacks are usually the user's fault: 404 for
+// unknown providers, 403 when the user denied the authorization, 400 for callbacks failing the CSRF check and 500 for
+// anything else
+func ErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnknownProvider):
+		return http.StatusNotFound
+	case errors.Is(err, oauth2.ErrAccessDenied):
+		return http.StatusForbidden
+	case errors.Is(err, ErrStateMissing), errors.Is(err, ErrStateMismatch), errors.Is(err, ErrStateExpired),
+		errors.Is(err, ErrMissingCode), errors.Is(err, ErrInvalidReturnTo):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// OAuth2 error codes returned by providers when the grant doesn't exist anymore, most of them use invalid_grant when
+// the user revoked the application but some return access_denied or invalid_token instead
+var consentRevokedCodes = map[string]bool{
+	oauth2.CodeInvalidGrant: true,
+	oauth2.CodeAccessDenied: true,
+	oauth2.CodeInvalidToken: true,
+}
+
+// OpenID Connect error codes that require the user to go back through the provider's UI
+var reauthCodes = map[string]bool{
+	"login_required":       true,
+	"consent_required":     true,
+	"interaction_required": true,
+}
+
+// Map errors returned by the provider on a refresh to our reauth errors, the original error is kept in the chain
+func refreshError(err error) error {
+	var oauthErr oauth2.Error
+	if !errors.As(err, &oauthErr) {
+		return err
+	}
+
+	if consentRevokedCodes[oauthErr.Code] {
+		return fmt.Errorf("%w (%w)", ErrConsentRevoked, err)
+	}
+
+	if reauthCodes[oauthErr.Code] {
+		return fmt.Errorf("%w (%w)", ErrReauthRequired, err)
+	}
+
+	return err
+}
+
+// Whether an error of Revalidate means the token will never be usable again: it expired without a refresh token, the
+// session data is broken or the provider rejected the refresh. Transport errors and temporary outages of the provider
+// say nothing about the token
+func tokenUnusable(err error) bool {
+	if errors.Is(err, ErrReauthRequired) || errors.Is(err, ErrInvalidSessionData) {
+		return true
+	}
+
+	var oauthErr oauth2.Error
+	if !errors.As(err, &oauthErr) {
+		return false
+	}
+	switch oauthErr.Code {
+	case oauth2.CodeServerError, oauth2.CodeTemporarilyUnavailable, oauth2.CodeInvalidResponse:
+		return false
+	}
+	return true
+}
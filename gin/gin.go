@@ -0,0 +1,227 @@
+// Implements several middlewares for using Authy with Gin
+//
+//	package main
+//
+//	import (
+//		"github.com/christopherobin/authy/gin"
+//		"github.com/christopherobin/authy/provider"
+//		"github.com/gin-contrib/sessions"
+//		"github.com/gin-contrib/sessions/cookie"
+//		"github.com/gin-gonic/gin"
+//	)
+//
+//	func main() {
+//		r := gin.Default()
+//
+//		// the session need to be set for the CSRF token system to work
+//		r.Use(sessions.Sessions("authy", cookie.NewStore([]byte("no one will guess this passphrase"))))
+//		r.Use(authy.Authy(authy.Config{
+//			Callback: "/profile",
+//			Providers: map[string]provider.ProviderConfig{
+//				"github": provider.ProviderConfig{Key: "my-key", Secret: "my-secret"},
+//			},
+//		}))
+//
+//		r.GET("/profile", authy.LoginRequired(), func(c *gin.Context) {
+//			token, _ := authy.GetToken(c)
+//			c.String(200, "logged in with "+token.Provider)
+//		})
+//
+//		r.Run(":8080")
+//	}
+package authy
+
+import (
+	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/oauth2"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+type Config authy.Config
+
+// Keys used in the Gin context
+const (
+	configKey = "authy.config"
+	tokenKey  = "authy.token"
+	tokensKey = "authy.tokens"
+)
+
+// Takes an Authy config and returns a middleware handling the /authy/:provider and /authy/:provider/callback routes
+// (see Config.CallbackSegment), the token of logged in users is available through GetToken
+func Authy(config Config) gin.HandlerFunc {
+	baseRoute := "/authy"
+	if config.BasePath != "" {
+		baseRoute = config.BasePath
+	}
+
+	if config.PathLogin == "" {
+		config.PathLogin = "/login"
+	}
+
+	if config.IsAPIRequest == nil {
+		config.IsAPIRequest = authy.IsAPIRequest
+	}
+
+	logoutRoute := baseRoute + "/" + authy.LogoutSegment
+	callbackSegment := oauth2.DefaultCallbackSegment
+	if config.CallbackSegment != "" {
+		callbackSegment = config.CallbackSegment
+	}
+
+	authRoute := regexp.MustCompile("^" + regexp.QuoteMeta(baseRoute) + "/([^/#?]+)$")
+	callbackRoute := regexp.MustCompile("^" + regexp.QuoteMeta(baseRoute) + "/([^/]+)/" +
+		regexp.QuoteMeta(callbackSegment) + "$")
+	// the instance below shadows the package
+	returnTo := authy.ReturnTo
+	authy, err := authy.NewAuthy(authy.Config(config))
+
+	// same as martini, a broken config should be caught when the application starts
+	if err != nil {
+		panic(err)
+	}
+
+	return func(c *gin.Context) {
+		c.Set(configKey, config)
+		session := sessions.Default(c)
+
+		// refresh the tokens that expired, the ones that can't be used anymore are removed from the session. Logged
+		// in users can still go through the routes below to link other providers
+		tokens, changed := authy.RevalidateAllContext(c.Request.Context(), session)
+		if changed {
+			session.Save()
+		}
+		setTokens(c, tokens)
+
+		// logout before the authorization route, which would take it for a provider
+		if c.Request.URL.Path == logoutRoute {
+			// a GET would let any website log the user out with an image
+			if c.Request.Method != http.MethodPost {
+				c.Writer.Header().Set("Allow", http.MethodPost)
+				c.AbortWithStatus(http.StatusMethodNotAllowed)
+				return
+			}
+
+			redirectUrl, err := authy.LogoutContext(c.Request.Context(), session, c.Request)
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			if err := session.Save(); err != nil {
+				abortWithError(c, err)
+				return
+			}
+
+			c.Redirect(http.StatusFound, redirectUrl)
+			c.Abort()
+			return
+		}
+
+		// match access URL
+		if matches := callbackRoute.FindStringSubmatch(c.Request.URL.Path); matches != nil {
+			token, redirectUrl, err := authy.AccessRequest(matches[1], session, c.Writer, c.Request)
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+
+			// save token in session, next to the tokens of the other providers
+			if err := authy.SaveToken(session, token); err != nil {
+				abortWithError(c, err)
+				return
+			}
+			if err := session.Save(); err != nil {
+				abortWithError(c, err)
+				return
+			}
+
+			c.Redirect(http.StatusFound, redirectUrl)
+			c.Abort()
+			return
+		}
+
+		// match authorization URL
+		if matches := authRoute.FindStringSubmatch(c.Request.URL.Path); matches != nil {
+			redirectUrl, err := authy.AuthorizeRequest(matches[1], session, c.Writer, c.Request, returnTo(c.Request)...)
+			if err != nil {
+				abortWithError(c, err)
+				return
+			}
+			if err := session.Save(); err != nil {
+				abortWithError(c, err)
+				return
+			}
+
+			// redirect user to oauth website
+			c.Redirect(http.StatusFound, redirectUrl)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Set the tokens of the session in the context, GetToken returns the one of the first provider in alphabetical order
+func setTokens(c *gin.Context, tokens map[string]*authy.Token) {
+	c.Set(tokensKey, tokens)
+	if token, ok := authy.PickToken(tokens); ok == true {
+		c.Set(tokenKey, token)
+	}
+}
+
+// Use this middleware on the routes where you need the user to be logged in, with every given provider if any. GetToken
+// returns the token of the first given provider on those routes
+func LoginRequired(providers ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, _ := c.Get(tokensKey)
+		tokens, _ := value.(map[string]*authy.Token)
+		if token, ok := authy.PickToken(tokens, providers...); ok == true {
+			c.Set(tokenKey, token)
+			c.Next()
+			return
+		}
+
+		pathLogin := "/login"
+		isAPIRequest := authy.IsAPIRequest
+		if config, ok := c.MustGet(configKey).(Config); ok == true {
+			pathLogin = config.PathLogin
+			isAPIRequest = config.IsAPIRequest
+		}
+
+		loginURL := pathLogin + "?next=" + url.QueryEscape(c.Request.URL.RequestURI())
+		if isAPIRequest(c.Request) {
+			authy.WriteLoginRequired(c.Writer, loginURL)
+			c.Abort()
+			return
+		}
+		c.Redirect(http.StatusFound, loginURL)
+		c.Abort()
+	}
+}
+
+// Token of the logged in user
+func GetToken(c *gin.Context) (*authy.Token, bool) {
+	value, ok := c.Get(tokenKey)
+	if ok != true {
+		return nil, false
+	}
+	token, ok := value.(*authy.Token)
+	return token, ok
+}
+
+// Token of the given provider if the user linked it
+func GetProviderToken(c *gin.Context, providerName string) (*authy.Token, bool) {
+	value, _ := c.Get(tokensKey)
+	tokens, _ := value.(map[string]*authy.Token)
+	token, ok := tokens[providerName]
+	return token, ok
+}
+
+// Abort with the status matching the error, see authy.ErrorStatus
+func abortWithError(c *gin.Context, err error) {
+	c.AbortWithError(authy.ErrorStatus(err), err)
+}
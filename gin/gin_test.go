@@ -0,0 +1,120 @@
+package authy_test
+
+import (
+	"github.com/christopherobin/authy/authytest"
+	"github.com/christopherobin/authy/gin"
+	"github.com/christopherobin/authy/provider"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// authytest session with the rest of the gin session interface
+type FakeSession struct {
+	*authytest.Session
+}
+
+func (f FakeSession) ID() string {
+	return "fake"
+}
+
+func (f FakeSession) AddFlash(value interface{}, vars ...string) {}
+
+func (f FakeSession) Flashes(vars ...string) []interface{} {
+	return nil
+}
+
+func (f FakeSession) Options(sessions.Options) {}
+
+func (f FakeSession) Save() error {
+	return nil
+}
+
+// build a gin engine using the given session and authy config, /profile requires to be logged in
+func MockGin(session sessions.Session, config authy.Config) *gin.Engine {
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set(sessions.DefaultKey, session)
+	})
+	r.Use(authy.Authy(config))
+	r.GET("/profile", authy.LoginRequired(), func(c *gin.Context) {
+		token, _ := authy.GetToken(c)
+		c.String(http.StatusOK, token.Value)
+	})
+	return r
+}
+
+func serve(r *gin.Engine, target string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", target, nil)
+	r.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestMiddleware(t *testing.T) {
+	Convey("Log in through the Gin middleware", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+		mock := server.Provider("mock")
+
+		session := FakeSession{authytest.NewSession()}
+
+		r := MockGin(session, authy.Config{
+			Callback: "/profile",
+			Providers: map[string]provider.ProviderConfig{
+				"mock": provider.ProviderConfig{Inline: &mock, Key: "my-key", Secret: "my-secret"},
+			},
+		})
+
+		Convey("Anonymous users are sent to the login page", func() {
+			rw := serve(r, "http://localhost/profile")
+			So(rw.Code, ShouldEqual, http.StatusFound)
+			So(rw.Header().Get("Location"), ShouldEqual, "/login?next=%2Fprofile")
+		})
+
+		Convey("API clients get a 401 instead", func() {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://localhost/profile", nil)
+			req.Header.Set("X-Requested-With", "XMLHttpRequest")
+			r.ServeHTTP(rw, req)
+			So(rw.Code, ShouldEqual, http.StatusUnauthorized)
+			So(rw.Body.String(), ShouldContainSubstring, `"error":"login_required"`)
+		})
+
+		Convey("Full login", func() {
+			rw := serve(r, "http://localhost/authy/mock")
+			So(rw.Code, ShouldEqual, http.StatusFound)
+
+			location, _ := url.Parse(rw.Header().Get("Location"))
+			state := location.Query().Get("state")
+
+			Convey("Forged callback", func() {
+				rw := serve(r, "http://localhost/authy/mock/callback?code="+authytest.Code+"&state=forged")
+				So(rw.Code, ShouldEqual, http.StatusBadRequest)
+			})
+
+			Convey("Valid callback", func() {
+				rw := serve(r, "http://localhost/authy/mock/callback?code="+authytest.Code+"&state="+url.QueryEscape(state))
+				So(rw.Code, ShouldEqual, http.StatusFound)
+				So(rw.Header().Get("Location"), ShouldEqual, "/profile")
+				So(session.Get("authy.token.mock"), ShouldNotBeNil)
+
+				rw = serve(r, "http://localhost/profile")
+				So(rw.Code, ShouldEqual, http.StatusOK)
+				So(rw.Body.String(), ShouldEqual, authytest.AccessToken)
+			})
+		})
+
+		Convey("Token for a provider that was removed from the config", func() {
+			session.Set("authy.token", []byte(`{"version":2,"provider":"bitbucket","value":"abc"}`))
+
+			rw := serve(r, "http://localhost/profile")
+			So(rw.Code, ShouldEqual, http.StatusFound)
+			So(session.Get("authy.token"), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,154 @@
+package authy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/christopherobin/authy/oauth2"
+	"github.com/christopherobin/authy/provider"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// Last segment of the logout route of the middlewares (/authy/logout), no provider can be named after it. The route
+// only accepts POST requests so that another website cannot log users out with a link or an image
+const LogoutSegment = "logout"
+
+// Returns where to send the user once the session was cleared. For providers supporting OpenID Connect
+// RP-initiated logout this is the provider's end session URL, which will redirect to the post logout URL itself,
+// idTokenHint is optional but some providers require it to skip their confirmation page. The provider needs an absolute
+// post logout URL, a relative one is resolved against the host of r
+func (a Authy) LogoutURL(providerName string, r *http.Request, idTokenHint string) (string, error) {
+	providerConfig, ok := a.providers[providerName]
+	if ok != true {
+		return "", fmt.Errorf("%w %s", ErrUnknownProvider, providerName)
+	}
+
+	redirectUrl := a.postLogoutRedirect(providerConfig)
+	if providerConfig.Provider.EndSessionURL == "" {
+		return redirectUrl, nil
+	}
+
+	endSessionUrl, err := url.Parse(providerConfig.Provider.EndSessionURL)
+	if err != nil {
+		return "", err
+	}
+
+	redirectUrl, err = absoluteURL(redirectUrl, r)
+	if err != nil {
+		return "", err
+	}
+
+	values := endSessionUrl.Query()
+	values.Set("client_id", providerConfig.Key)
+	values.Set("post_logout_redirect_uri", redirectUrl)
+	if idTokenHint != "" {
+		values.Set("id_token_hint", idTokenHint)
+	}
+	endSessionUrl.RawQuery = values.Encode()
+
+	return endSessionUrl.String(), nil
+}
+
+func (a Authy) postLogoutRedirect(providerConfig provider.ProviderConfig) string {
+	if providerConfig.PostLogoutRedirect != "" {
+		return providerConfig.PostLogoutRedirect
+	}
+	if a.config.PostLogoutRedirect != "" {
+		return a.config.PostLogoutRedirect
+	}
+	return "/"
+}
+
+// Resolve a relative URL against the scheme and host of the request
+func absoluteURL(rawUrl string, r *http.Request) (string, error) {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	if parsedUrl.IsAbs() {
+		return rawUrl, nil
+	}
+	if r == nil {
+		return "", errors.New(fmt.Sprintf("post logout redirect %s is relative and there is no request to resolve it", rawUrl))
+	}
+
+	origin := oauth2.RequestOrigin(r)
+	return origin.ResolveReference(parsedUrl).String(), nil
+}
+
+// Revoke the token on the provider, its refresh token if it has one since revoking it also invalidates the access
+// tokens on most providers
+func (a Authy) Revoke(token *Token) error {
+	return a.RevokeContext(context.Background(), token)
+}
+
+// Same as Revoke, the context controls the revocation request
+func (a Authy) RevokeContext(ctx context.Context, token *Token) error {
+	providerConfig, ok := a.providers[token.Provider]
+	if ok != true {
+		return fmt.Errorf("%w %s", ErrUnknownProvider, token.Provider)
+	}
+
+	if providerConfig.Provider.OAuth != 2 {
+		return ErrNotImplemented
+	}
+
+	done := a.observe(token.Provider, OperationRevoke)
+	var err error
+	if token.RefreshToken != "" {
+		err = oauth2.RevokeContext(ctx, providerConfig, token.RefreshToken, oauth2.TokenTypeHintRefreshToken)
+	} else {
+		err = oauth2.RevokeContext(ctx, providerConfig, token.value(), oauth2.TokenTypeHintAccessToken)
+	}
+	done(err)
+	return err
+}
+
+// Log the user out: the tokens of every provider are removed from the session, and revoked if Config.RevokeOnLogout
+// is set. Returns where to send the user, the end session URL of the provider they logged in with when
+// Config.ProviderLogout is set (see LogoutURL) or the post logout redirect
+func (a Authy) Logout(session Session, r *http.Request) (string, error) {
+	return a.LogoutContext(context.Background(), session, r)
+}
+
+// Same as Logout, the context controls the revocation requests
+func (a Authy) LogoutContext(ctx context.Context, session Session, r *http.Request) (string, error) {
+	a.migrateToken(session)
+
+	providerNames := make([]string, 0, len(a.providers))
+	for providerName := range a.providers {
+		providerNames = append(providerNames, providerName)
+	}
+	sort.Strings(providerNames)
+
+	var loggedOut []*Token
+	for _, providerName := range providerNames {
+		token, err := a.LoadToken(session, providerName)
+		a.DeleteToken(session, providerName)
+		if err != nil || token == nil {
+			continue
+		}
+		loggedOut = append(loggedOut, token)
+
+		// the user is logged out whatever the provider says, a failed revocation only means the token lives until
+		// it expires
+		if a.config.RevokeOnLogout && a.providers[providerName].Provider.RevokeURL != "" {
+			a.RevokeContext(ctx, token)
+		}
+	}
+
+	if a.config.ProviderLogout {
+		for _, token := range loggedOut {
+			if a.providers[token.Provider].Provider.EndSessionURL != "" {
+				return a.LogoutURL(token.Provider, r, token.IDToken)
+			}
+		}
+	}
+
+	if len(loggedOut) > 0 {
+		return a.postLogoutRedirect(a.providers[loggedOut[0].Provider]), nil
+	}
+	return a.postLogoutRedirect(provider.ProviderConfig{}), nil
+}
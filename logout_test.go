@@ -0,0 +1,149 @@
+package authy_test
+
+import (
+	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/authytest"
+	"github.com/christopherobin/authy/provider"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestLogoutURL(t *testing.T) {
+	Convey("Pick where to send the user after logout", t, func() {
+		provider.RegisterProvider(provider.New("oidc", "https://oidc.example.com/authorize", "https://oidc.example.com/token"))
+		oidc := provider.New("oidc-logout", "https://oidc.example.com/authorize", "https://oidc.example.com/token")
+		oidc.EndSessionURL = "https://oidc.example.com/logout"
+		provider.RegisterProvider(oidc)
+
+		a, err := authy.NewAuthy(authy.Config{
+			PostLogoutRedirect: "/bye",
+			Providers: map[string]provider.ProviderConfig{
+				"github": provider.ProviderConfig{Key: "my-key", Secret: "my-secret"},
+				"oidc":   provider.ProviderConfig{Key: "my-key", Secret: "my-secret", PostLogoutRedirect: "/see-you"},
+				"oidc-logout": provider.ProviderConfig{
+					Key:                "my-key",
+					Secret:             "my-secret",
+					PostLogoutRedirect: "https://app.example.com/see-you",
+				},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		r, _ := http.NewRequest("POST", "http://app.example.com/authy/logout", nil)
+
+		Convey("Global default", func() {
+			logoutUrl, err := a.LogoutURL("github", r, "")
+			So(err, ShouldEqual, nil)
+			So(logoutUrl, ShouldEqual, "/bye")
+		})
+
+		Convey("Per provider redirect wins", func() {
+			logoutUrl, err := a.LogoutURL("oidc", r, "")
+			So(err, ShouldEqual, nil)
+			So(logoutUrl, ShouldEqual, "/see-you")
+		})
+
+		Convey("Redirect is passed to the end session endpoint", func() {
+			logoutUrl, err := a.LogoutURL("oidc-logout", r, "my-id-token")
+			So(err, ShouldEqual, nil)
+
+			parsedUrl, _ := url.Parse(logoutUrl)
+			So(parsedUrl.Host, ShouldEqual, "oidc.example.com")
+			So(parsedUrl.Path, ShouldEqual, "/logout")
+			So(parsedUrl.Query().Get("post_logout_redirect_uri"), ShouldEqual, "https://app.example.com/see-you")
+			So(parsedUrl.Query().Get("id_token_hint"), ShouldEqual, "my-id-token")
+		})
+
+		Convey("Relative redirect is resolved against the request", func() {
+			a, err := authy.NewAuthy(authy.Config{
+				PostLogoutRedirect: "/bye",
+				Providers: map[string]provider.ProviderConfig{
+					"oidc-logout": provider.ProviderConfig{Key: "my-key", Secret: "my-secret"},
+				},
+			})
+			So(err, ShouldEqual, nil)
+
+			logoutUrl, err := a.LogoutURL("oidc-logout", r, "")
+			So(err, ShouldEqual, nil)
+
+			parsedUrl, _ := url.Parse(logoutUrl)
+			So(parsedUrl.Query().Get("post_logout_redirect_uri"), ShouldEqual, "http://app.example.com/bye")
+
+			Convey("Unless there is no request", func() {
+				_, err := a.LogoutURL("oidc-logout", nil, "")
+				So(err, ShouldNotEqual, nil)
+			})
+		})
+	})
+}
+
+func TestLogout(t *testing.T) {
+	Convey("Log the user out", t, func() {
+		var mu sync.Mutex
+		var revoked []url.Values
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			mu.Lock()
+			revoked = append(revoked, r.PostForm)
+			mu.Unlock()
+		}))
+		Reset(server.Close)
+
+		p := provider.Generic(server.URL+"/authorize", server.URL+"/token", " ", provider.ClientAuthBody)
+		p.RevokeURL = server.URL + "/revoke"
+		p.EndSessionURL = server.URL + "/logout"
+
+		config := authy.Config{
+			PostLogoutRedirect: "/bye",
+			Providers: map[string]provider.ProviderConfig{
+				"sso": provider.ProviderConfig{Inline: &p, Key: "my-key", Secret: "my-secret"},
+			},
+		}
+
+		r := httptest.NewRequest("POST", "http://app.example.com/authy/logout", nil)
+		session := authytest.NewSession()
+		session.Set("authy.token.sso", []byte(`{"version":2,"provider":"sso","value":"abc","refresh_token":"def","id_token":"ghi"}`))
+
+		Convey("Tokens are removed from the session", func() {
+			a, err := authy.NewAuthy(config)
+			So(err, ShouldEqual, nil)
+
+			redirectUrl, err := a.Logout(session, r)
+			So(err, ShouldEqual, nil)
+			So(redirectUrl, ShouldEqual, "/bye")
+			So(session.Get("authy.token.sso"), ShouldBeNil)
+			So(revoked, ShouldHaveLength, 0)
+		})
+
+		Convey("Revoke the tokens", func() {
+			config.RevokeOnLogout = true
+			a, err := authy.NewAuthy(config)
+			So(err, ShouldEqual, nil)
+
+			_, err = a.Logout(session, r)
+			So(err, ShouldEqual, nil)
+			So(revoked, ShouldHaveLength, 1)
+			So(revoked[0].Get("token"), ShouldEqual, "def")
+			So(revoked[0].Get("token_type_hint"), ShouldEqual, "refresh_token")
+			So(revoked[0].Get("client_id"), ShouldEqual, "my-key")
+		})
+
+		Convey("Log out of the provider too", func() {
+			config.ProviderLogout = true
+			a, err := authy.NewAuthy(config)
+			So(err, ShouldEqual, nil)
+
+			redirectUrl, err := a.Logout(session, r)
+			So(err, ShouldEqual, nil)
+
+			location, _ := url.Parse(redirectUrl)
+			So(location.Path, ShouldEqual, "/logout")
+			So(location.Query().Get("id_token_hint"), ShouldEqual, "ghi")
+			So(location.Query().Get("post_logout_redirect_uri"), ShouldEqual, "http://app.example.com/bye")
+		})
+	})
+}
@@ -2,8 +2,8 @@ package authy_test
 
 import (
 	"github.com/go-martini/martini"
-	"github.com/gophergala/authy/martini"
-	"github.com/gophergala/authy/provider"
+	"github.com/christopherobin/authy/martini"
+	"github.com/christopherobin/authy/provider"
 	"github.com/martini-contrib/render"
 	"github.com/martini-contrib/sessions"
 )
@@ -3,6 +3,7 @@ package authy
 
 import (
 	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/oauth2"
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/sessions"
 	"net/http"
@@ -11,16 +12,28 @@ import (
 )
 
 type Config authy.Config
+
+// Called instead of answering with an error status when something goes wrong, for example to render an error page
+type ErrorHandler func(c martini.Context, w http.ResponseWriter, r *http.Request, err error)
+
 type Token authy.Token
 
-func (t Token) Client() *http.Client {
-	return authy.Token(t).Client()
+func (t *Token) Client() *http.Client {
+	return (*authy.Token)(t).Client()
 }
 
+// Tokens of the providers the user is logged in with, by provider name
+type Tokens map[string]Token
+
 // Takes an Authy config and returns a middleware to use with martini
 // See examples below
-// TODO: add error handler in config that allows the use to retrieve the context+error
 func Authy(config Config) martini.Handler {
+	return AuthyWithErrorHandler(config, nil)
+}
+
+// Same as Authy but errors are handed to the given handler, nil answers with the status matching the error (see
+// authy.ErrorStatus)
+func AuthyWithErrorHandler(config Config, errorHandler ErrorHandler) martini.Handler {
 	baseRoute := "/authy"
 	if config.BasePath != "" {
 		baseRoute = config.BasePath
@@ -31,11 +44,23 @@ func Authy(config Config) martini.Handler {
 		config.PathLogin = "/login"
 	}
 
-	authRoute := regexp.MustCompile("^" + baseRoute + "/([^/#?]+)")
-	callbackRoute := regexp.MustCompile("^" + baseRoute + "/([^/]+)/callback")
+	if config.IsAPIRequest == nil {
+		config.IsAPIRequest = authy.IsAPIRequest
+	}
+
+	logoutRoute := baseRoute + "/" + authy.LogoutSegment
+	callbackSegment := oauth2.DefaultCallbackSegment
+	if config.CallbackSegment != "" {
+		callbackSegment = config.CallbackSegment
+	}
+
+	authRoute := regexp.MustCompile("^" + baseRoute + "/([^/#?]+)$")
+	callbackRoute := regexp.MustCompile("^" + baseRoute + "/([^/]+)/" + regexp.QuoteMeta(callbackSegment) + "$")
+	// the instance below shadows the package
+	returnTo := authy.ReturnTo
 	authy, err := authy.NewAuthy(authy.Config(config))
 
-	// due to the way middleware are used, it's the cleanest? way to deal with this?
+	// same as gin, a broken config should be caught when the application starts
 	if err != nil {
 		panic(err)
 	}
@@ -43,23 +68,37 @@ func Authy(config Config) martini.Handler {
 	return func(s sessions.Session, c martini.Context, w http.ResponseWriter, r *http.Request) {
 		c.Map(config)
 
-		// if we are already logged, ignore login route matching
-		if serializedToken := s.Get("authy.token"); serializedToken != nil {
-			token, err := authy.TokenFromSerialized(serializedToken.([]byte))
-			// TODO: implement refresh here
+		// refresh the tokens that expired, the ones that can't be used anymore are removed from the session. Logged
+		// in users can still go through the routes below to link other providers
+		tokens, _ := authy.RevalidateAllContext(r.Context(), s)
+		mapTokens(c, tokens)
+
+		// logout before the authorization route, which would take it for a provider
+		if r.URL.Path == logoutRoute {
+			// a GET would let any website log the user out with an image
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+
+			redirectUrl, err := authy.LogoutContext(r.Context(), s, r)
 			if err != nil {
-				panic(err)
+				handleError(errorHandler, c, w, r, err)
+				return
 			}
-			c.Map(Token(*token))
+
+			http.Redirect(w, r, redirectUrl, http.StatusFound)
 			return
 		}
 
 		// match authorization URL
 		matches := authRoute.FindStringSubmatch(r.URL.Path)
 		if len(matches) > 0 && matches[0] == r.URL.Path {
-			redirectUrl, err := authy.Authorize(matches[1], s, r)
+			redirectUrl, err := authy.AuthorizeRequest(matches[1], s, w, r, returnTo(r)...)
 			if err != nil {
-				panic(err)
+				handleError(errorHandler, c, w, r, err)
+				return
 			}
 
 			// redirect user to oauth website
@@ -70,17 +109,17 @@ func Authy(config Config) martini.Handler {
 		// match access URL
 		matches = callbackRoute.FindStringSubmatch(r.URL.Path)
 		if len(matches) > 0 && matches[0] == r.URL.Path {
-			token, redirectUrl, err := authy.Access(matches[1], s, r)
+			token, redirectUrl, err := authy.AccessRequest(matches[1], s, w, r)
 			if err != nil {
-				panic(err)
+				handleError(errorHandler, c, w, r, err)
+				return
 			}
 
 			// save token in session
-			serializedToken, err := token.Serialize()
-			if err != nil {
-				panic(err)
+			if err := authy.SaveToken(s, token); err != nil {
+				handleError(errorHandler, c, w, r, err)
+				return
 			}
-			s.Set("authy.token", serializedToken)
 
 			http.Redirect(w, r, redirectUrl, http.StatusFound)
 			return
@@ -88,12 +127,50 @@ func Authy(config Config) martini.Handler {
 	}
 }
 
-// Use this middleware on the routes where you need the user to be logged in
-func LoginRequired() martini.Handler {
-	return func(config Config, s sessions.Session, w http.ResponseWriter, r *http.Request) {
-		if tokenValue := s.Get("authy.token"); tokenValue == nil {
-			next := url.QueryEscape(r.URL.RequestURI())
-			http.Redirect(w, r, config.PathLogin+"?next="+next, http.StatusFound)
+// Map the tokens of the session, handlers asking for a Token get the one of the first provider in alphabetical order
+func mapTokens(c martini.Context, tokens map[string]*authy.Token) {
+	mapped := Tokens{}
+	for providerName, token := range tokens {
+		mapped[providerName] = Token(*token)
+	}
+	c.Map(mapped)
+
+	if token, ok := authy.PickToken(tokens); ok == true {
+		c.Map(Token(*token))
+	}
+}
+
+// Hand the error to the error handler, or answer with the status matching the error
+func handleError(errorHandler ErrorHandler, c martini.Context, w http.ResponseWriter, r *http.Request, err error) {
+	if errorHandler != nil {
+		errorHandler(c, w, r, err)
+		return
+	}
+
+	status := authy.ErrorStatus(err)
+	http.Error(w, http.StatusText(status), status)
+}
+
+// Use this middleware on the routes where you need the user to be logged in, with every given provider if any. The
+// Token of the route is the one of the first given provider
+func LoginRequired(providers ...string) martini.Handler {
+	return func(config Config, tokens Tokens, c martini.Context, w http.ResponseWriter, r *http.Request) {
+		byProvider := map[string]*authy.Token{}
+		for providerName, token := range tokens {
+			token := authy.Token(token)
+			byProvider[providerName] = &token
+		}
+
+		token, ok := authy.PickToken(byProvider, providers...)
+		if ok != true {
+			loginURL := config.PathLogin + "?next=" + url.QueryEscape(r.URL.RequestURI())
+			if config.IsAPIRequest != nil && config.IsAPIRequest(r) {
+				authy.WriteLoginRequired(w, loginURL)
+				return
+			}
+			http.Redirect(w, r, loginURL, http.StatusFound)
+			return
 		}
+		c.Map(Token(*token))
 	}
 }
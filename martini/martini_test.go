@@ -0,0 +1,182 @@
+package authy_test
+
+import (
+	"errors"
+	core "github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/authytest"
+	"github.com/christopherobin/authy/martini"
+	"github.com/christopherobin/authy/provider"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/sessions"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// authytest session with the rest of the martini session interface
+type FakeSession struct {
+	*authytest.Session
+}
+
+func (f FakeSession) AddFlash(value interface{}, vars ...string) {}
+
+func (f FakeSession) Flashes(vars ...string) []interface{} {
+	return nil
+}
+
+func (f FakeSession) Options(sessions.Options) {}
+
+// build a martini instance using the given session and authy config, /profile requires to be logged in
+func MockMartini(session sessions.Session, config authy.Config) *martini.ClassicMartini {
+	m := martini.Classic()
+	m.Use(func(c martini.Context) {
+		c.MapTo(session, (*sessions.Session)(nil))
+	})
+	m.Use(authy.Authy(config))
+	m.Get("/profile", authy.LoginRequired(), func() string {
+		return "profile"
+	})
+	return m
+}
+
+func TestMiddleware(t *testing.T) {
+	Convey("Session holds a token for a provider that was removed from the config", t, func() {
+		session := FakeSession{authytest.NewSession()}
+		session.Set("authy.token", []byte(`{"version":2,"provider":"bitbucket","value":"abc"}`))
+
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/profile", nil)
+		MockMartini(session, config).ServeHTTP(rw, req)
+
+		So(session.Get("authy.token"), ShouldBeNil)
+		So(rw.Code, ShouldEqual, http.StatusFound)
+		So(rw.Header().Get("Location"), ShouldStartWith, "/login")
+	})
+}
+
+func TestOnSuccess(t *testing.T) {
+	Convey("Redirect returned by OnSuccess is used after the callback", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+		mock := server.Provider("mock")
+
+		session := FakeSession{authytest.NewSession()}
+
+		m := MockMartini(session, authy.Config{
+			Callback: "/dashboard",
+			Providers: map[string]provider.ProviderConfig{
+				"mock": provider.ProviderConfig{Inline: &mock, Key: "my-key", Secret: "my-secret"},
+			},
+			OnSuccess: func(token *core.Token, r *http.Request) (string, error) {
+				return "/onboarding", nil
+			},
+		})
+
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/authy/mock", nil)
+		m.ServeHTTP(rw, req)
+		So(rw.Code, ShouldEqual, http.StatusFound)
+
+		location, _ := url.Parse(rw.Header().Get("Location"))
+		state := location.Query().Get("state")
+		rw = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "http://localhost/authy/mock/callback?code="+authytest.Code+"&state="+url.QueryEscape(state), nil)
+		m.ServeHTTP(rw, req)
+
+		So(rw.Code, ShouldEqual, http.StatusFound)
+		So(rw.Header().Get("Location"), ShouldEqual, "/onboarding")
+		So(session.Get("authy.token.mock"), ShouldNotBeNil)
+	})
+}
+
+func TestErrorHandler(t *testing.T) {
+	Convey("Errors are handed to the error handler", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+		mock := server.Provider("mock")
+
+		session := FakeSession{authytest.NewSession()}
+
+		errorConfig := authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"mock": provider.ProviderConfig{Inline: &mock, Key: "my-key", Secret: "my-secret"},
+			},
+		}
+
+		Convey("Default handler answers with the status matching the error", func() {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://localhost/authy/mock/callback?code="+authytest.Code+"&state=forged", nil)
+			MockMartini(session, errorConfig).ServeHTTP(rw, req)
+
+			So(rw.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Custom handler", func() {
+			var handled error
+			m := martini.Classic()
+			m.Use(func(c martini.Context) {
+				c.MapTo(session, (*sessions.Session)(nil))
+			})
+			m.Use(authy.AuthyWithErrorHandler(errorConfig, func(c martini.Context, w http.ResponseWriter, r *http.Request, err error) {
+				handled = err
+				w.WriteHeader(http.StatusTeapot)
+			}))
+
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://localhost/authy/mock/callback?code="+authytest.Code+"&state=forged", nil)
+			m.ServeHTTP(rw, req)
+
+			So(rw.Code, ShouldEqual, http.StatusTeapot)
+			So(errors.Is(handled, core.ErrStateMissing), ShouldBeTrue)
+		})
+
+		Convey("Invalid configurations are caught when the application starts", func() {
+			errorConfig.Providers = map[string]provider.ProviderConfig{"invalid": provider.ProviderConfig{}}
+			So(func() { authy.Authy(errorConfig) }, ShouldPanic)
+		})
+	})
+}
+
+func TestRefresh(t *testing.T) {
+	Convey("Expired tokens are refreshed by the middleware", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+		mock := server.Provider("mock")
+
+		session := FakeSession{authytest.NewSession()}
+
+		refreshConfig := authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"mock": provider.ProviderConfig{Inline: &mock, Key: "my-key", Secret: "my-secret"},
+			},
+		}
+
+		Convey("Refreshable token", func() {
+			session.Set("authy.token", []byte(`{"version":2,"provider":"mock","value":"abc","refresh_token":"def","expires":"2000-01-01T00:00:00Z"}`))
+
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/profile", nil)
+			MockMartini(session, refreshConfig).ServeHTTP(rw, req)
+
+			So(rw.Code, ShouldEqual, http.StatusOK)
+			// tokens stored by older versions are moved under their provider's key
+			So(session.Get("authy.token"), ShouldBeNil)
+			So(string(session.Get("authy.token.mock").([]byte)), ShouldContainSubstring, `"value":"`+authytest.AccessToken+`"`)
+		})
+
+		Convey("Token without refresh token", func() {
+			session.Set("authy.token", []byte(`{"version":2,"provider":"mock","value":"abc","expires":"2000-01-01T00:00:00Z"}`))
+
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/profile", nil)
+			MockMartini(session, refreshConfig).ServeHTTP(rw, req)
+
+			So(session.Get("authy.token"), ShouldBeNil)
+			So(session.Get("authy.token.mock"), ShouldBeNil)
+			So(rw.Code, ShouldEqual, http.StatusFound)
+			So(rw.Header().Get("Location"), ShouldStartWith, "/login")
+		})
+	})
+}
@@ -1,6 +1,8 @@
 package authy_test
 
 import (
+	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/provider"
 	"github.com/gorilla/mux"
 	"net/http"
 	"net/http/httptest"
@@ -8,21 +10,25 @@ import (
 	"testing"
 )
 
-// a fake session object
-type FakeSession struct {
-	items map[interface{}]interface{}
+// a fake token store
+type FakeTokenStore struct {
+	tokens map[string]*authy.Token
 }
 
-func (f *FakeSession) Get(key interface{}) interface{} {
-	return f.items[key]
+func (f *FakeTokenStore) Load(key string) (*authy.Token, error) {
+	return f.tokens[key], nil
 }
 
-func (f *FakeSession) Set(key interface{}, val interface{}) {
-	f.items[key] = val
+func (f *FakeTokenStore) Save(key string, token *authy.Token) error {
+	f.tokens[key] = token
+	return nil
 }
 
-func (f *FakeSession) Delete(key interface{}) {
-	delete(f.items, key)
+// adapter to use a function as a http.RoundTripper
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
 }
 
 // generate a fake http request
@@ -33,6 +39,44 @@ func MockHttpRequest(requestUrl string) *http.Request {
 	}
 }
 
+// register an oauth2 provider pointing at the given urls and return a config using it
+func MockConfig(providerName string, authorizeURL string, accessURL string) authy.Config {
+	provider.RegisterProvider(provider.Provider{
+		Name:         providerName,
+		AuthorizeURL: authorizeURL,
+		AccessURL:    accessURL,
+		OAuth:        2,
+	})
+
+	return authy.Config{
+		Providers: map[string]provider.ProviderConfig{
+			providerName: provider.ProviderConfig{Key: "my-key", Secret: "my-secret"},
+		},
+	}
+}
+
+// same as MockConfig but return an Authy instance directly
+func MockAuthy(providerName string, authorizeURL string, accessURL string) (authy.Authy, error) {
+	return authy.NewAuthy(MockConfig(providerName, authorizeURL, accessURL))
+}
+
+// go through both legs of the authorization flow
+func MockLogin(a authy.Authy, providerName string, session authy.Session) (*authy.Token, string, error) {
+	authorizeURL, err := a.Authorize(providerName, session, MockHttpRequest("http://localhost:2000/authy/"+providerName))
+	if err != nil {
+		return nil, "", err
+	}
+
+	state := StateFromURL(authorizeURL)
+	return a.Access(providerName, session, MockHttpRequest("http://localhost:2000/authy/"+providerName+"/callback?code=auth_test&state="+url.QueryEscape(state)))
+}
+
+// state parameter of an authorization URL
+func StateFromURL(authorizeURL string) string {
+	parsedUrl, _ := url.Parse(authorizeURL)
+	return parsedUrl.Query().Get("state")
+}
+
 // fake oauth2 service
 func MockOAuthServer(t *testing.T) (s *httptest.Server) {
 	r := mux.NewRouter()
@@ -42,8 +86,35 @@ func MockOAuthServer(t *testing.T) (s *httptest.Server) {
 
 		values.Set("access_token", "fakeaccesstoken")
 		values.Set("scope", r.URL.Query().Get("scope"))
-		values.Set("token_type", "example")
+		values.Set("token_type", "bearer")
+
+		rw.Write([]byte(values.Encode()))
+	})
+
+	// same but also issues a refresh token
+	r.HandleFunc("/oauth2/offline", func(rw http.ResponseWriter, r *http.Request) {
+		values := url.Values{}
+
+		values.Set("access_token", "fakeaccesstoken")
+		values.Set("refresh_token", "fakerefreshtoken")
+		values.Set("token_type", "bearer")
+
+		rw.Write([]byte(values.Encode()))
+	})
+
+	// fake api, echoes the Authorization header
+	r.HandleFunc("/api", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(r.Header.Get("Authorization")))
+	})
+
+	// behaves like a provider on which the user revoked the application
+	r.HandleFunc("/oauth2/revoked", func(rw http.ResponseWriter, r *http.Request) {
+		values := url.Values{}
+
+		values.Set("error", "invalid_grant")
+		values.Set("error_description", "Token has been expired or revoked.")
 
+		rw.WriteHeader(http.StatusBadRequest)
 		rw.Write([]byte(values.Encode()))
 	})
 
@@ -0,0 +1,43 @@
+package nethttp_test
+
+import (
+	"fmt"
+	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/nethttp"
+	"github.com/christopherobin/authy/provider"
+	"net/http"
+)
+
+var config = nethttp.Config{
+	Config: authy.Config{
+		PathLogin: "/login",
+		Callback:  "/profile",
+		Providers: map[string]provider.ProviderConfig{
+			"github": provider.ProviderConfig{
+				Key:    "my-key",
+				Secret: "my-secret",
+				Scope:  []string{"repo", "user:mail"},
+			},
+		},
+	},
+}
+
+func ExampleHandler() {
+	handler, err := nethttp.Handler(config)
+	if err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+
+	// handles /authy/github and /authy/github/callback
+	mux.Handle("/authy/", handler)
+
+	// use LoginRequired to redirect the user to the login page if not logged in
+	mux.Handle("/profile", handler.LoginRequired(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := nethttp.TokenFromContext(r.Context())
+		fmt.Fprintf(w, "logged in with %s", token.Provider)
+	})))
+
+	http.ListenAndServe(":8080", mux)
+}
@@ -0,0 +1,341 @@
+// Implements Authy as net/http handlers, usable with any router built on the standard library
+package nethttp
+
+import (
+	"context"
+	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/oauth2"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+type Config struct {
+	authy.Config
+	// Where sessions are kept, defaults to an in memory store
+	Sessions SessionStore
+}
+
+// Handles the authorization and callback routes of every provider, mount it on the base path (/authy/ by default)
+type Authy struct {
+	config          Config
+	authy           authy.Authy
+	authRoute       *regexp.Regexp
+	callbackRoute   *regexp.Regexp
+	callbackSegment string
+	logoutRoute     string
+}
+
+type contextKey struct{}
+
+// What LoginRequired stores in the request context
+type contextTokens struct {
+	// token of the first required provider
+	token *authy.Token
+	// every usable token of the session, by provider
+	tokens map[string]*authy.Token
+}
+
+// Parse the configuration and return the handler
+func Handler(config Config) (*Authy, error) {
+	baseRoute := "/authy"
+	if config.BasePath != "" {
+		baseRoute = config.BasePath
+	}
+
+	if config.PathLogin == "" {
+		config.PathLogin = "/login"
+	}
+
+	if config.Sessions == nil {
+		config.Sessions = NewMemorySessionStore()
+	}
+
+	if config.IsAPIRequest == nil {
+		config.IsAPIRequest = authy.IsAPIRequest
+	}
+
+	callbackSegment := oauth2.DefaultCallbackSegment
+	if config.CallbackSegment != "" {
+		callbackSegment = config.CallbackSegment
+	}
+
+	core, err := authy.NewAuthy(config.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	callbackRoute := "^" + regexp.QuoteMeta(baseRoute) + "/([^/]+)/" + regexp.QuoteMeta(callbackSegment) + "$"
+
+	return &Authy{
+		config:          config,
+		authy:           core,
+		authRoute:       regexp.MustCompile("^" + regexp.QuoteMeta(baseRoute) + "/([^/#?]+)$"),
+		callbackRoute:   regexp.MustCompile(callbackRoute),
+		callbackSegment: callbackSegment,
+		logoutRoute:     baseRoute + "/" + authy.LogoutSegment,
+	}, nil
+}
+
+func (a *Authy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// logout before the authorization route, which would take it for a provider
+	if r.URL.Path == a.logoutRoute {
+		a.logout(w, r)
+		return
+	}
+
+	// match access URL first, the authorization route would match it too otherwise
+	if matches := a.callbackRoute.FindStringSubmatch(r.URL.Path); matches != nil {
+		a.callback(w, r, matches[1])
+		return
+	}
+
+	// match authorization URL
+	if matches := a.authRoute.FindStringSubmatch(r.URL.Path); matches != nil {
+		a.authorize(w, r, matches[1])
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+// Last segment of the callback routes, mount CallbackHandler on the authorization path followed by it
+func (a *Authy) CallbackSegment() string {
+	return a.callbackSegment
+}
+
+// Returns the name of the provider to use for the request
+type ProviderFunc func(r *http.Request) string
+
+// Always use the given provider
+func Provider(name string) ProviderFunc {
+	return func(r *http.Request) string {
+		return name
+	}
+}
+
+// Redirect the user to the provider's authorization page, the callback handler must be mounted on the same path
+// followed by the callback segment (/callback by default)
+func (a *Authy) AuthorizeHandler(provider ProviderFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.authorize(w, r, provider(r))
+	})
+}
+
+// Exchange the code for a token, save it in session and redirect the user to the configured callback
+func (a *Authy) CallbackHandler(provider ProviderFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.callback(w, r, provider(r))
+	})
+}
+
+// Remove the tokens from the session and redirect the user to the post logout URL, see authy.Authy.Logout. Only
+// answers POST requests
+func (a *Authy) LogoutHandler() http.Handler {
+	return http.HandlerFunc(a.logout)
+}
+
+func (a *Authy) authorize(w http.ResponseWriter, r *http.Request, providerName string) {
+	// the state cookie doesn't need a session
+	if a.config.StateCookie != nil {
+		redirectUrl, err := a.authy.AuthorizeWithCookie(providerName, w, r, authy.ReturnTo(r)...)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		http.Redirect(w, r, redirectUrl, http.StatusFound)
+		return
+	}
+
+	session, err := a.config.Sessions.Get(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	redirectUrl, err := a.authy.Authorize(providerName, session, r, authy.ReturnTo(r)...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := a.config.Sessions.Save(w, r, session); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// redirect user to oauth website
+	http.Redirect(w, r, redirectUrl, http.StatusFound)
+}
+
+func (a *Authy) callback(w http.ResponseWriter, r *http.Request, providerName string) {
+	session, err := a.config.Sessions.Get(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	token, redirectUrl, err := a.authy.AccessRequest(providerName, session, w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// save token in session, next to the tokens of the other providers
+	if err := a.authy.SaveToken(session, token); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// the user just logged in, an id planted before the login must not give access to the session
+	if renewer, ok := a.config.Sessions.(SessionRenewer); ok == true {
+		if err := renewer.Renew(w, r, session); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	if err := a.config.Sessions.Save(w, r, session); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, redirectUrl, http.StatusFound)
+}
+
+func (a *Authy) logout(w http.ResponseWriter, r *http.Request) {
+	// a GET would let any website log the user out with an image
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := a.config.Sessions.Get(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	redirectUrl, err := a.authy.LogoutContext(r.Context(), session, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := a.config.Sessions.Save(w, r, session); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, redirectUrl, http.StatusFound)
+}
+
+// Redirect the user to the login page if not logged in, otherwise the token is available through TokenFromContext.
+// Expired tokens are refreshed when possible
+func (a *Authy) LoginRequired(next http.Handler) http.Handler {
+	return a.LoginRequiredFor()(next)
+}
+
+// Same as LoginRequired but the user must be logged in with every given provider, TokenFromContext returns the token
+// of the first one and ProviderTokenFromContext the others
+func (a *Authy) LoginRequiredFor(providers ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return a.loginRequired(next, providers)
+	}
+}
+
+func (a *Authy) loginRequired(next http.Handler, providers []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := a.config.Sessions.Get(w, r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		tokens, _ := a.authy.RevalidateAllContext(r.Context(), session)
+		token, ok := authy.PickToken(tokens, providers...)
+		if ok != true {
+			if err := a.config.Sessions.Save(w, r, session); err != nil {
+				writeError(w, err)
+				return
+			}
+
+			loginURL := a.config.PathLogin + "?next=" + url.QueryEscape(r.URL.RequestURI())
+			if a.config.IsAPIRequest(r) {
+				authy.WriteLoginRequired(w, loginURL)
+				return
+			}
+			http.Redirect(w, r, loginURL, http.StatusFound)
+			return
+		}
+
+		if err := a.config.Sessions.Save(w, r, session); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, contextTokens{token, tokens})))
+	})
+}
+
+// Same as LoginRequired but answers with a 401 instead of redirecting, for APIs
+func (a *Authy) RequireToken(next http.Handler) http.Handler {
+	return a.RequireTokenFor()(next)
+}
+
+// Same as RequireToken but the user must be logged in with every given provider
+func (a *Authy) RequireTokenFor(providers ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return a.requireToken(next, providers)
+	}
+}
+
+func (a *Authy) requireToken(next http.Handler, providers []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := a.config.Sessions.Get(w, r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		tokens, _ := a.authy.RevalidateAllContext(r.Context(), session)
+		if err := a.config.Sessions.Save(w, r, session); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		token, ok := authy.PickToken(tokens, providers...)
+		if ok != true {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, contextTokens{token, tokens})))
+	})
+}
+
+// Token of the logged in user, set by LoginRequired
+func TokenFromContext(ctx context.Context) (*authy.Token, bool) {
+	value, ok := ctx.Value(contextKey{}).(contextTokens)
+	if ok != true {
+		return nil, false
+	}
+	return value.token, true
+}
+
+// Token of the given provider if the user linked it, set by LoginRequired
+func ProviderTokenFromContext(ctx context.Context, providerName string) (*authy.Token, bool) {
+	value, ok := ctx.Value(contextKey{}).(contextTokens)
+	if ok != true {
+		return nil, false
+	}
+	token, ok := value.tokens[providerName]
+	return token, ok
+}
+
+// Answer with the status matching the error, see authy.ErrorStatus
+func writeError(w http.ResponseWriter, err error) {
+	status := authy.ErrorStatus(err)
+	http.Error(w, http.StatusText(status), status)
+}
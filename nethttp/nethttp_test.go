@@ -0,0 +1,379 @@
+package nethttp_test
+
+import (
+	"crypto/tls"
+	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/authytest"
+	"github.com/christopherobin/authy/nethttp"
+	"github.com/christopherobin/authy/provider"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// mux with the authy routes and a /profile page requiring a login
+func MockMux(config nethttp.Config) *http.ServeMux {
+	handler, err := nethttp.Handler(config)
+	if err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/authy/", handler)
+	mux.Handle("/profile", handler.LoginRequired(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := nethttp.TokenFromContext(r.Context())
+		w.Write([]byte(token.Value))
+	})))
+	return mux
+}
+
+// send a request with the given cookies and return the response
+func Serve(handler http.Handler, target string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	return ServeMethod(handler, "GET", target, cookies)
+}
+
+// same as Serve with another method
+func ServeMethod(handler http.Handler, method string, target string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, target, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	handler.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestHandler(t *testing.T) {
+	Convey("Log in through the net/http handlers", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+		mock := server.Provider("mock")
+
+		mux := MockMux(nethttp.Config{
+			Config: authy.Config{
+				Callback: "/profile",
+				Providers: map[string]provider.ProviderConfig{
+					"mock": provider.ProviderConfig{Inline: &mock, Key: "my-key", Secret: "my-secret"},
+				},
+			},
+		})
+
+		Convey("Anonymous users are sent to the login page", func() {
+			rw := Serve(mux, "http://localhost/profile", nil)
+			So(rw.Code, ShouldEqual, http.StatusFound)
+			So(rw.Header().Get("Location"), ShouldEqual, "/login?next=%2Fprofile")
+			// nothing was written to the session, it is not kept
+			So(rw.Result().Cookies(), ShouldBeEmpty)
+		})
+
+		Convey("API clients get a 401 instead", func() {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://localhost/profile", nil)
+			req.Header.Set("Accept", "application/json")
+			mux.ServeHTTP(rw, req)
+			So(rw.Code, ShouldEqual, http.StatusUnauthorized)
+			So(rw.Header().Get("Content-Type"), ShouldEqual, "application/json")
+			So(rw.Body.String(), ShouldContainSubstring, `"login_url":"/login?next=%2Fprofile"`)
+		})
+
+		Convey("Unknown provider", func() {
+			rw := Serve(mux, "http://localhost/authy/nope", nil)
+			So(rw.Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Full login", func() {
+			rw := Serve(mux, "http://localhost/authy/mock", nil)
+			So(rw.Code, ShouldEqual, http.StatusFound)
+			cookies := rw.Result().Cookies()
+			So(cookies, ShouldHaveLength, 1)
+
+			location, _ := url.Parse(rw.Header().Get("Location"))
+			state := location.Query().Get("state")
+
+			Convey("Forged callback", func() {
+				rw := Serve(mux, "http://localhost/authy/mock/callback?code="+authytest.Code+"&state=forged", cookies)
+				So(rw.Code, ShouldEqual, http.StatusBadRequest)
+			})
+
+			Convey("User denied the authorization", func() {
+				rw := Serve(mux, "http://localhost/authy/mock/callback?error=access_denied&state="+url.QueryEscape(state), cookies)
+				So(rw.Code, ShouldEqual, http.StatusForbidden)
+			})
+
+			Convey("Return to the page the user asked for", func() {
+				rw := Serve(mux, "http://localhost/authy/mock?next=%2Fprofile%3Ftab%3Dkeys", cookies)
+				location, _ := url.Parse(rw.Header().Get("Location"))
+
+				rw = Serve(mux, "http://localhost/authy/mock/callback?code="+authytest.Code+"&state="+url.QueryEscape(location.Query().Get("state")), cookies)
+				So(rw.Code, ShouldEqual, http.StatusFound)
+				So(rw.Header().Get("Location"), ShouldEqual, "/profile?tab=keys")
+			})
+
+			Convey("Valid callback", func() {
+				rw := Serve(mux, "http://localhost/authy/mock/callback?code="+authytest.Code+"&state="+url.QueryEscape(state), cookies)
+				So(rw.Code, ShouldEqual, http.StatusFound)
+				So(rw.Header().Get("Location"), ShouldEqual, "/profile")
+
+				// the session id changes once logged in, the one known before the login is worthless
+				loggedIn := rw.Result().Cookies()
+				So(loggedIn, ShouldHaveLength, 1)
+				So(loggedIn[0].Value, ShouldNotEqual, cookies[0].Value)
+				rw = Serve(mux, "http://localhost/profile", cookies)
+				So(rw.Code, ShouldEqual, http.StatusFound)
+				cookies = loggedIn
+
+				rw = Serve(mux, "http://localhost/profile", cookies)
+				So(rw.Code, ShouldEqual, http.StatusOK)
+				So(rw.Body.String(), ShouldEqual, authytest.AccessToken)
+
+				Convey("Log out", func() {
+					// links and images can't log the user out
+					rw := Serve(mux, "http://localhost/authy/logout", cookies)
+					So(rw.Code, ShouldEqual, http.StatusMethodNotAllowed)
+					So(rw.Header().Get("Allow"), ShouldEqual, "POST")
+					rw = Serve(mux, "http://localhost/profile", cookies)
+					So(rw.Code, ShouldEqual, http.StatusOK)
+
+					rw = ServeMethod(mux, "POST", "http://localhost/authy/logout", cookies)
+					So(rw.Code, ShouldEqual, http.StatusFound)
+					So(rw.Header().Get("Location"), ShouldEqual, "/")
+
+					rw = Serve(mux, "http://localhost/profile", cookies)
+					So(rw.Code, ShouldEqual, http.StatusFound)
+				})
+			})
+		})
+	})
+}
+
+func TestCallbackSegment(t *testing.T) {
+	Convey("Use another callback segment", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+		mock := server.Provider("mock")
+
+		mux := MockMux(nethttp.Config{
+			Config: authy.Config{
+				Callback:        "/profile",
+				CallbackSegment: "done",
+				Providers: map[string]provider.ProviderConfig{
+					"mock": provider.ProviderConfig{Inline: &mock, Key: "my-key", Secret: "my-secret"},
+				},
+			},
+		})
+
+		rw := Serve(mux, "http://localhost/authy/mock", nil)
+		So(rw.Code, ShouldEqual, http.StatusFound)
+		cookies := rw.Result().Cookies()
+
+		location, _ := url.Parse(rw.Header().Get("Location"))
+		So(location.Query().Get("redirect_uri"), ShouldEqual, "http://localhost/authy/mock/done")
+
+		rw = Serve(mux, "http://localhost/authy/mock/done?code="+authytest.Code+"&state="+url.QueryEscape(location.Query().Get("state")), cookies)
+		So(rw.Code, ShouldEqual, http.StatusFound)
+		So(rw.Header().Get("Location"), ShouldEqual, "/profile")
+		cookies = rw.Result().Cookies()
+
+		rw = Serve(mux, "http://localhost/profile", cookies)
+		So(rw.Body.String(), ShouldEqual, authytest.AccessToken)
+	})
+}
+
+func TestDiscreteHandlers(t *testing.T) {
+	Convey("Mount the handlers on custom routes", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+		mock := server.Provider("mock")
+
+		handler, err := nethttp.Handler(nethttp.Config{
+			Config: authy.Config{
+				Callback: "/api/me",
+				Providers: map[string]provider.ProviderConfig{
+					"mock": provider.ProviderConfig{Inline: &mock, Key: "my-key", Secret: "my-secret"},
+				},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		mux := http.NewServeMux()
+		mux.Handle("/login/mock", handler.AuthorizeHandler(nethttp.Provider("mock")))
+		mux.Handle("/login/mock/callback", handler.CallbackHandler(nethttp.Provider("mock")))
+		mux.Handle("/api/me", handler.RequireToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, _ := nethttp.TokenFromContext(r.Context())
+			w.Write([]byte(token.Value))
+		})))
+
+		Convey("APIs answer 401 without a token", func() {
+			rw := Serve(mux, "http://localhost/api/me", nil)
+			So(rw.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Full login", func() {
+			rw := Serve(mux, "http://localhost/login/mock", nil)
+			So(rw.Code, ShouldEqual, http.StatusFound)
+			cookies := rw.Result().Cookies()
+
+			location, _ := url.Parse(rw.Header().Get("Location"))
+			So(location.Query().Get("redirect_uri"), ShouldEqual, "http://localhost/login/mock/callback")
+
+			rw = Serve(mux, "http://localhost/login/mock/callback?code="+authytest.Code+"&state="+url.QueryEscape(location.Query().Get("state")), cookies)
+			So(rw.Code, ShouldEqual, http.StatusFound)
+			cookies = rw.Result().Cookies()
+
+			rw = Serve(mux, "http://localhost/api/me", cookies)
+			So(rw.Code, ShouldEqual, http.StatusOK)
+			So(rw.Body.String(), ShouldEqual, authytest.AccessToken)
+		})
+	})
+}
+
+func TestLinkedProviders(t *testing.T) {
+	Convey("Require tokens from several providers", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+		mock := server.Provider("mock")
+
+		linked := server.Provider("linked")
+		handler, err := nethttp.Handler(nethttp.Config{
+			Config: authy.Config{
+				Callback: "/api/both",
+				Providers: map[string]provider.ProviderConfig{
+					"mock":   provider.ProviderConfig{Inline: &mock, Key: "my-key", Secret: "my-secret"},
+					"linked": provider.ProviderConfig{Inline: &linked, Key: "my-key", Secret: "my-secret"},
+				},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		mux := http.NewServeMux()
+		mux.Handle("/authy/", handler)
+		mux.Handle("/api/both", handler.RequireTokenFor("mock", "linked")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, _ := nethttp.ProviderTokenFromContext(r.Context(), "linked")
+			w.Write([]byte(token.Provider))
+		})))
+
+		login := func(providerName string, cookies []*http.Cookie) []*http.Cookie {
+			rw := Serve(mux, "http://localhost/authy/"+providerName, cookies)
+			location, _ := url.Parse(rw.Header().Get("Location"))
+			if len(rw.Result().Cookies()) > 0 {
+				cookies = rw.Result().Cookies()
+			}
+
+			rw = Serve(mux, "http://localhost/authy/"+providerName+"/callback?code="+authytest.Code+"&state="+url.QueryEscape(location.Query().Get("state")), cookies)
+			if len(rw.Result().Cookies()) > 0 {
+				cookies = rw.Result().Cookies()
+			}
+			return cookies
+		}
+
+		cookies := login("mock", nil)
+
+		Convey("One token is not enough", func() {
+			rw := Serve(mux, "http://localhost/api/both", cookies)
+			So(rw.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Link the second provider", func() {
+			cookies = login("linked", cookies)
+
+			rw := Serve(mux, "http://localhost/api/both", cookies)
+			So(rw.Code, ShouldEqual, http.StatusOK)
+			So(rw.Body.String(), ShouldEqual, "linked")
+		})
+	})
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	Convey("Keep sessions in memory", t, func() {
+		store := nethttp.NewMemorySessionStore()
+
+		serve := func(cookies []*http.Cookie, write func(session authy.Session)) *httptest.ResponseRecorder {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://localhost/", nil)
+			for _, cookie := range cookies {
+				req.AddCookie(cookie)
+			}
+			session, err := store.Get(rw, req)
+			So(err, ShouldEqual, nil)
+			write(session)
+			So(store.Save(rw, req, session), ShouldEqual, nil)
+			return rw
+		}
+
+		rw := serve(nil, func(session authy.Session) {
+			session.Set("key", "value")
+		})
+		cookies := rw.Result().Cookies()
+		So(cookies, ShouldHaveLength, 1)
+
+		Convey("Sessions are found with their cookie", func() {
+			serve(cookies, func(session authy.Session) {
+				So(session.Get("key"), ShouldEqual, "value")
+			})
+		})
+
+		Convey("Unused sessions expire", func() {
+			store.TTL = 0
+			time.Sleep(time.Millisecond)
+			serve(cookies, func(session authy.Session) {
+				So(session.Get("key"), ShouldBeNil)
+			})
+		})
+
+		Convey("Renewed sessions get a new id", func() {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://localhost/", nil)
+			req.AddCookie(cookies[0])
+			session, _ := store.Get(rw, req)
+			So(store.Renew(rw, req, session), ShouldEqual, nil)
+			So(store.Save(rw, req, session), ShouldEqual, nil)
+
+			renewed := rw.Result().Cookies()
+			So(renewed, ShouldHaveLength, 1)
+			So(renewed[0].Value, ShouldNotEqual, cookies[0].Value)
+			serve(renewed, func(session authy.Session) {
+				So(session.Get("key"), ShouldEqual, "value")
+			})
+			serve(cookies, func(session authy.Session) {
+				So(session.Get("key"), ShouldBeNil)
+			})
+		})
+
+		Convey("Cookies are Secure over TLS", func() {
+			So(cookies[0].Secure, ShouldBeFalse)
+
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "https://localhost/", nil)
+			req.TLS = &tls.ConnectionState{}
+			session, _ := store.Get(rw, req)
+			session.Set("key", "value")
+			So(store.Save(rw, req, session), ShouldEqual, nil)
+			So(rw.Result().Cookies()[0].Secure, ShouldBeTrue)
+
+			// behind a proxy terminating TLS
+			rw = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "http://localhost/", nil)
+			req.Header.Set("X-HTTPS", "1")
+			session, _ = store.Get(rw, req)
+			session.Set("key", "value")
+			So(store.Save(rw, req, session), ShouldEqual, nil)
+			So(rw.Result().Cookies()[0].Secure, ShouldBeTrue)
+
+			store.Secure = func(r *http.Request) bool { return true }
+			rw = serve(nil, func(session authy.Session) {
+				session.Set("key", "value")
+			})
+			So(rw.Result().Cookies()[0].Secure, ShouldBeTrue)
+		})
+
+		Convey("Emptied sessions are dropped", func() {
+			rw := serve(cookies, func(session authy.Session) {
+				session.Delete("key")
+			})
+			So(rw.Result().Cookies()[0].MaxAge, ShouldBeLessThan, 0)
+		})
+	})
+}
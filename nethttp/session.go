@@ -0,0 +1,180 @@
+package nethttp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/oauth2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Gives access to the session of a request, implement it on top of your session library of choice
+type SessionStore interface {
+	// Get the session of the request, creating it if needed
+	Get(w http.ResponseWriter, r *http.Request) (authy.Session, error)
+	// Persist the changes made to the session, called before the response is written
+	Save(w http.ResponseWriter, r *http.Request, session authy.Session) error
+}
+
+// Implemented by the session stores able to change the id of a session. The callback renews the session once the user
+// logged in, so that an id planted in their browser before the login is worthless (session fixation)
+type SessionRenewer interface {
+	// Give the session a new id, the old one must not be usable anymore. Save is called afterwards
+	Renew(w http.ResponseWriter, r *http.Request, session authy.Session) error
+}
+
+// Name of the cookie holding the session id of MemorySessionStore
+const sessionCookie = "authy_session"
+
+// How long MemorySessionStore keeps the sessions that are not used when created with NewMemorySessionStore
+var DefaultSessionTTL = 24 * time.Hour
+
+// Keeps sessions in memory and identifies them with a cookie, only suitable when running a single instance of the
+// application. Sessions are only stored once something was written to them and are dropped after being unused for TTL
+type MemorySessionStore struct {
+	// How long a session is kept after its last use
+	TTL time.Duration
+	// Whether the session cookie gets the Secure flag, defaults to the requests received over TLS or with the X-HTTPS
+	// header set by a proxy terminating TLS
+	Secure   func(r *http.Request) bool
+	mu       sync.Mutex
+	sessions map[string]*memorySession
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		TTL:      DefaultSessionTTL,
+		sessions: map[string]*memorySession{},
+	}
+}
+
+// Get the session of the request, requests without a known session get a new one that is only stored by Save if
+// something was written to it
+func (m *MemorySessionStore) Get(w http.ResponseWriter, r *http.Request) (authy.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if session, ok := m.sessions[cookie.Value]; ok == true {
+			if now.Sub(session.lastUsed) <= m.TTL {
+				session.lastUsed = now
+				return session, nil
+			}
+			delete(m.sessions, cookie.Value)
+		}
+	}
+
+	return &memorySession{items: map[interface{}]interface{}{}, lastUsed: now}, nil
+}
+
+// Store new sessions that are not empty and drop the ones that were emptied, the session cookie is set accordingly
+func (m *MemorySessionStore) Save(w http.ResponseWriter, r *http.Request, session authy.Session) error {
+	memory, ok := session.(*memorySession)
+	if ok != true {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if memory.empty() {
+		if memory.id != "" {
+			delete(m.sessions, memory.id)
+			memory.id = ""
+			m.setCookie(w, r, "", -1)
+		}
+		return nil
+	}
+
+	if memory.id != "" {
+		return nil
+	}
+
+	// drop the expired sessions
+	now := time.Now()
+	for id, stored := range m.sessions {
+		if now.Sub(stored.lastUsed) > m.TTL {
+			delete(m.sessions, id)
+		}
+	}
+
+	rawId := make([]byte, 16)
+	if _, err := rand.Read(rawId); err != nil {
+		return err
+	}
+	memory.id = hex.EncodeToString(rawId)
+	memory.lastUsed = now
+	m.sessions[memory.id] = memory
+
+	m.setCookie(w, r, memory.id, 0)
+	return nil
+}
+
+// Forget the id of the session, Save stores it under a new one
+func (m *MemorySessionStore) Renew(w http.ResponseWriter, r *http.Request, session authy.Session) error {
+	memory, ok := session.(*memorySession)
+	if ok != true {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if memory.id != "" {
+		delete(m.sessions, memory.id)
+		memory.id = ""
+	}
+	return nil
+}
+
+func (m *MemorySessionStore) setCookie(w http.ResponseWriter, r *http.Request, id string, maxAge int) {
+	secure := oauth2.RequestOrigin(r).Scheme == "https"
+	if m.Secure != nil {
+		secure = m.Secure(r)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+type memorySession struct {
+	mu    sync.Mutex
+	items map[interface{}]interface{}
+	// set once stored, guarded by the store
+	id       string
+	lastUsed time.Time
+}
+
+func (s *memorySession) Get(key interface{}) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.items[key]
+}
+
+func (s *memorySession) Set(key interface{}, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[key] = value
+}
+
+func (s *memorySession) Delete(key interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, key)
+}
+
+func (s *memorySession) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items) == 0
+}
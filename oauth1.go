@@ -0,0 +1,49 @@
+package authy
+
+import (
+	"github.com/christopherobin/authy/oauth1"
+	"github.com/christopherobin/authy/oauth2"
+	"github.com/christopherobin/authy/provider"
+	"net/http"
+)
+
+// Get temporary credentials from the provider and return the URL where the user approves them, the temporary token
+// doubles as the CSRF state
+func (a Authy) authorizeOAuth1(providerName string, providerConfig provider.ProviderConfig, backend stateBackend, r *http.Request, returnTo string) (string, error) {
+	providerConfig.RedirectURI = oauth2.CallbackURL(providerConfig, r)
+
+	requestToken, err := oauth1.RequestTokenContext(r.Context(), providerConfig)
+	if err != nil {
+		return "", err
+	}
+
+	// the state is chosen by the provider, the return path is kept with the data instead
+	data := stateData{Scope: providerConfig.Scope, TokenSecret: requestToken.Secret, ReturnTo: returnTo}
+	if err := backend.save(providerName, requestToken.Token, data); err != nil {
+		return "", err
+	}
+
+	return oauth1.AuthorizeURL(providerConfig, requestToken)
+}
+
+// Exchange the temporary credentials approved by the user for a token
+func (a Authy) accessOAuth1(providerName string, providerConfig provider.ProviderConfig, backend stateBackend, r *http.Request) (*Token, string, error) {
+	state, data, err := backend.verify(providerName, oauth2.CallbackParams(providerConfig, r).Get("oauth_token"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	// the temporary credentials are single use, forget them whatever the provider answers
+	if err := backend.delete(providerName, state); err != nil {
+		return nil, "", err
+	}
+
+	done := a.observe(providerName, OperationExchange)
+	token, err := oauth1.GetAccessTokenContext(r.Context(), providerConfig, r, oauth1.Token{Token: state, Secret: data.TokenSecret})
+	done(err)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return a.complete(providerConfig, tokenFromOAuth1(a, providerName, token, data.Scope), r, data.ReturnTo)
+}
@@ -0,0 +1,308 @@
+// This package implements OAuth 1.0a for Authy
+package oauth1
+
+// see http://tools.ietf.org/html/rfc5849
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/christopherobin/authy/oauth2"
+	"github.com/christopherobin/authy/provider"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Token credentials (or temporary credentials during the authorization), both values are needed to sign requests
+type Token struct {
+	Token  string
+	Secret string
+	// Other values returned with the token (user_id, screen_name, ...)
+	Extra map[string]string
+}
+
+// Returned when the provider answers with a non 2xx status, OAuth1 doesn't define an error format
+type Error struct {
+	StatusCode int
+	Status     string
+	// Beginning of the response body, for debugging
+	Body string
+}
+
+func (err Error) Error() string {
+	return fmt.Sprintf("oauth1 endpoint returned %s: %s", err.Status, err.Body)
+}
+
+// how much of an unexpected response body is kept in an Error
+const maxBodySnippet = 512
+
+// Used for requests to the provider when the provider config doesn't have its own client
+var DefaultClient = &http.Client{Timeout: 30 * time.Second}
+
+func client(config provider.ProviderConfig) *http.Client {
+	if config.HTTPClient != nil {
+		return config.HTTPClient
+	}
+	return DefaultClient
+}
+
+// Ask the provider for temporary credentials, the user is then sent to AuthorizeURL to approve them. The callback is
+// the config's RedirectURI, out of band if empty
+func RequestToken(config provider.ProviderConfig) (token Token, err error) {
+	return RequestTokenContext(context.Background(), config)
+}
+
+// Same as RequestToken, the request to the provider is aborted if the context is cancelled
+func RequestTokenContext(ctx context.Context, config provider.ProviderConfig) (token Token, err error) {
+	callback := config.RedirectURI
+	if callback == "" {
+		callback = "oob"
+	}
+
+	values, err := postSigned(ctx, config, config.Provider.RequestURL, Token{}, map[string]string{
+		"oauth_callback": callback,
+	})
+	if err != nil {
+		return
+	}
+
+	// the callback must have been registered, see http://tools.ietf.org/html/rfc5849#section-2.1
+	if values.Get("oauth_callback_confirmed") != "true" {
+		err = errors.New("provider did not confirm the callback")
+		return
+	}
+
+	return parseToken(values)
+}
+
+// Generates the URL where the user approves the temporary credentials
+func AuthorizeURL(config provider.ProviderConfig, requestToken Token) (dest string, err error) {
+	authUrl, err := url.Parse(config.Provider.AuthorizeURL)
+	if err != nil {
+		return
+	}
+
+	values := authUrl.Query()
+	values.Set("oauth_token", requestToken.Token)
+
+	// custom parameters
+	for _, name := range config.Provider.CustomParameters {
+		if value, ok := config.CustomParameters[name]; ok == true {
+			values.Set(name, value)
+		}
+	}
+
+	authUrl.RawQuery = values.Encode()
+	dest = authUrl.String()
+	return
+}
+
+// Exchange the approved temporary credentials for token credentials using the verifier of the callback request
+func GetAccessToken(config provider.ProviderConfig, r *http.Request, requestToken Token) (token Token, err error) {
+	return GetAccessTokenContext(context.Background(), config, r, requestToken)
+}
+
+// Same as GetAccessToken, the request to the provider is aborted if the context is cancelled
+func GetAccessTokenContext(ctx context.Context, config provider.ProviderConfig, r *http.Request, requestToken Token) (token Token, err error) {
+	// the verifier comes in the query string or, when the callback is POSTed, in the body
+	verifier := oauth2.CallbackParams(config, r).Get("oauth_verifier")
+	if verifier == "" {
+		err = errors.New("oauth_verifier was not found in the callback parameters")
+		return
+	}
+
+	values, err := postSigned(ctx, config, config.Provider.AccessURL, requestToken, map[string]string{
+		"oauth_verifier": verifier,
+	})
+	if err != nil {
+		return
+	}
+
+	return parseToken(values)
+}
+
+func parseToken(values url.Values) (token Token, err error) {
+	token.Token = values.Get("oauth_token")
+	token.Secret = values.Get("oauth_token_secret")
+
+	if token.Token == "" || token.Secret == "" {
+		err = errors.New("the response returned by the server couldn't be parsed by Authy")
+		return
+	}
+
+	for name := range values {
+		if name == "oauth_token" || name == "oauth_token_secret" || name == "oauth_callback_confirmed" {
+			continue
+		}
+		if token.Extra == nil {
+			token.Extra = map[string]string{}
+		}
+		token.Extra[name] = values.Get(name)
+	}
+
+	return
+}
+
+// POST a signed request without body to one of the provider's endpoints and decode the form encoded response
+func postSigned(ctx context.Context, config provider.ProviderConfig, endpoint string, token Token, extra map[string]string) (values url.Values, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, nil)
+	if err != nil {
+		return
+	}
+
+	if err = sign(req, config, token, extra); err != nil {
+		return
+	}
+
+	resp, err := client(config).Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(body) > maxBodySnippet {
+			body = body[:maxBodySnippet]
+		}
+		err = Error{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(body)}
+		return
+	}
+
+	return url.ParseQuery(string(body))
+}
+
+// Sign a request to the provider's API with the token credentials, the Authorization header is replaced
+func Sign(req *http.Request, config provider.ProviderConfig, token Token) error {
+	return sign(req, config, token, nil)
+}
+
+func sign(req *http.Request, config provider.ProviderConfig, token Token, extra map[string]string) error {
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+
+	oauthParams := map[string]string{
+		"oauth_consumer_key":     config.Key,
+		"oauth_nonce":            nonce,
+		"oauth_signature_method": "HMAC-SHA1",
+		"oauth_timestamp":        strconv.FormatInt(time.Now().Unix(), 10),
+		"oauth_version":          "1.0",
+	}
+	if token.Token != "" {
+		oauthParams["oauth_token"] = token.Token
+	}
+	for name, value := range extra {
+		oauthParams[name] = value
+	}
+
+	// the query and form encoded body are part of the signature
+	params := req.URL.Query()
+	if req.Body != nil && strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return err
+		}
+		for name, formValues := range form {
+			params[name] = append(params[name], formValues...)
+		}
+	}
+	for name, value := range oauthParams {
+		params.Set(name, value)
+	}
+
+	oauthParams["oauth_signature"] = Signature(req.Method, req.URL, params, config.Secret, token.Secret)
+
+	names := make([]string, 0, len(oauthParams))
+	for name := range oauthParams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	header := make([]string, len(names))
+	for i, name := range names {
+		header[i] = fmt.Sprintf(`%s="%s"`, name, encode(oauthParams[name]))
+	}
+	req.Header.Set("Authorization", "OAuth "+strings.Join(header, ", "))
+	return nil
+}
+
+// Compute the HMAC-SHA1 signature of a request (http://tools.ietf.org/html/rfc5849#section-3.4), params holds every
+// query, form and oauth_ parameter except oauth_signature
+func Signature(method string, requestUrl *url.URL, params url.Values, consumerSecret string, tokenSecret string) string {
+	// base string URI, without query and default port
+	baseUrl := url.URL{
+		Scheme: strings.ToLower(requestUrl.Scheme),
+		Host:   strings.ToLower(requestUrl.Host),
+		Path:   requestUrl.EscapedPath(),
+	}
+	if (baseUrl.Scheme == "http" && strings.HasSuffix(baseUrl.Host, ":80")) ||
+		(baseUrl.Scheme == "https" && strings.HasSuffix(baseUrl.Host, ":443")) {
+		baseUrl.Host = baseUrl.Host[:strings.LastIndex(baseUrl.Host, ":")]
+	}
+	if baseUrl.Path == "" {
+		baseUrl.Path = "/"
+	}
+
+	// normalized parameters, sorted by name then value once encoded
+	pairs := []string{}
+	for name, values := range params {
+		for _, value := range values {
+			pairs = append(pairs, encode(name)+"="+encode(value))
+		}
+	}
+	sort.Strings(pairs)
+
+	base := strings.ToUpper(method) + "&" + encode(baseUrl.String()) + "&" + encode(strings.Join(pairs, "&"))
+
+	mac := hmac.New(sha1.New, []byte(encode(consumerSecret)+"&"+encode(tokenSecret)))
+	mac.Write([]byte(base))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// percent encoding of http://tools.ietf.org/html/rfc5849#section-3.6, only unreserved characters are kept
+func encode(value string) string {
+	var buffer strings.Builder
+	for _, b := range []byte(value) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '.' || b == '_' || b == '~' {
+			buffer.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buffer, "%%%02X", b)
+		}
+	}
+	return buffer.String()
+}
+
+func newNonce() (string, error) {
+	rawNonce := make([]byte, 16)
+	_, err := rand.Read(rawNonce)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(rawNonce), nil
+}
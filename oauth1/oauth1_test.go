@@ -0,0 +1,158 @@
+package oauth1_test
+
+import (
+	"github.com/christopherobin/authy/oauth1"
+	"github.com/christopherobin/authy/provider"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// parse the oauth_ parameters of an Authorization header
+func parseAuthorization(header string) map[string]string {
+	params := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(header, "OAuth "), ", ") {
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		value, _ := url.PathUnescape(strings.Trim(pair[1], `"`))
+		params[pair[0]] = value
+	}
+	return params
+}
+
+// check the signature of a request made with the my-secret consumer secret
+func verifySignature(r *http.Request, tokenSecret string) bool {
+	oauthParams := parseAuthorization(r.Header.Get("Authorization"))
+
+	r.ParseForm()
+	params := url.Values{}
+	for name, values := range r.Form {
+		params[name] = values
+	}
+	for name, value := range oauthParams {
+		if name != "oauth_signature" {
+			params.Set(name, value)
+		}
+	}
+
+	requestUrl := &url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path}
+	return oauthParams["oauth_signature"] == oauth1.Signature(r.Method, requestUrl, params, "my-secret", tokenSecret)
+}
+
+// fake OAuth1 service
+func MockServer() *httptest.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/request_token", func(rw http.ResponseWriter, r *http.Request) {
+		if !verifySignature(r, "") || parseAuthorization(r.Header.Get("Authorization"))["oauth_callback"] == "" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rw.Write([]byte("oauth_token=requesttoken&oauth_token_secret=requestsecret&oauth_callback_confirmed=true"))
+	})
+
+	mux.HandleFunc("/access_token", func(rw http.ResponseWriter, r *http.Request) {
+		oauthParams := parseAuthorization(r.Header.Get("Authorization"))
+		if !verifySignature(r, "requestsecret") || oauthParams["oauth_token"] != "requesttoken" || oauthParams["oauth_verifier"] != "verifier" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			rw.Write([]byte("invalid signature"))
+			return
+		}
+		rw.Write([]byte("oauth_token=accesstoken&oauth_token_secret=accesssecret&screen_name=authy"))
+	})
+
+	mux.HandleFunc("/api", func(rw http.ResponseWriter, r *http.Request) {
+		if !verifySignature(r, "accesssecret") {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rw.Write([]byte(r.Form.Get("status")))
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func MockConfig(server *httptest.Server) provider.ProviderConfig {
+	return provider.ProviderConfig{
+		Provider: provider.New("oauth1", server.URL+"/authorize", server.URL+"/access_token",
+			provider.WithRequestURL(server.URL+"/request_token")),
+		Key:         "my-key",
+		Secret:      "my-secret",
+		RedirectURI: "http://localhost:2000/authy/oauth1/callback",
+	}
+}
+
+func TestSignature(t *testing.T) {
+	Convey("Sign the example request of the Twitter documentation", t, func() {
+		requestUrl, _ := url.Parse("https://api.twitter.com/1.1/statuses/update.json?include_entities=true")
+		params := requestUrl.Query()
+		params.Set("status", "Hello Ladies + Gentlemen, a signed OAuth request!")
+		params.Set("oauth_consumer_key", "xvz1evFS4wEEPTGEFPHBog")
+		params.Set("oauth_nonce", "kYjzVBB8Y0ZFabxSWbWovY3uYSQ2pTgmZeNu2VS4cg")
+		params.Set("oauth_signature_method", "HMAC-SHA1")
+		params.Set("oauth_timestamp", "1318622958")
+		params.Set("oauth_token", "370773112-GmHxMAgYyLbNEtIKZeRNFsMKPR9EyMZeS9weJAEb")
+		params.Set("oauth_version", "1.0")
+
+		signature := oauth1.Signature("POST", requestUrl, params, "kAcSOqF21Fu85e7zjz7ZN2U4ZRhfV3WpwPAoE3Z7kBw", "LswwdoUaIvS8ltyTt5jkRh4J50vUPVVHtR2YPi5kE")
+		So(signature, ShouldEqual, "hCtSmYh+iHYCEqBWrE7C7hYmtUk=")
+	})
+}
+
+func TestFlow(t *testing.T) {
+	Convey("Go through the three steps of OAuth1", t, func() {
+		server := MockServer()
+		Reset(server.Close)
+
+		config := MockConfig(server)
+
+		requestToken, err := oauth1.RequestToken(config)
+		So(err, ShouldEqual, nil)
+		So(requestToken.Token, ShouldEqual, "requesttoken")
+		So(requestToken.Secret, ShouldEqual, "requestsecret")
+
+		authURL, err := oauth1.AuthorizeURL(config, requestToken)
+		So(err, ShouldEqual, nil)
+		So(authURL, ShouldEqual, server.URL+"/authorize?oauth_token=requesttoken")
+
+		callbackUrl, _ := url.Parse("http://localhost:2000/authy/oauth1/callback?oauth_token=requesttoken&oauth_verifier=verifier")
+		token, err := oauth1.GetAccessToken(config, &http.Request{URL: callbackUrl}, requestToken)
+		So(err, ShouldEqual, nil)
+		So(token.Token, ShouldEqual, "accesstoken")
+		So(token.Secret, ShouldEqual, "accesssecret")
+		So(token.Extra, ShouldResemble, map[string]string{"screen_name": "authy"})
+
+		Convey("Sign API requests with the token", func() {
+			req, _ := http.NewRequest("POST", server.URL+"/api?include_entities=true", strings.NewReader("status=Hello+Ladies+%2B+Gentlemen"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			So(oauth1.Sign(req, config, token), ShouldEqual, nil)
+
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldEqual, nil)
+			defer resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Read the verifier of a POSTed callback", func() {
+			callback := httptest.NewRequest("POST", "http://localhost:2000/authy/oauth1/callback",
+				strings.NewReader("oauth_token=requesttoken&oauth_verifier=verifier"))
+			callback.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			token, err := oauth1.GetAccessToken(config, callback, requestToken)
+			So(err, ShouldEqual, nil)
+			So(token.Token, ShouldEqual, "accesstoken")
+		})
+
+		Convey("Fail with a wrong verifier", func() {
+			callbackUrl, _ := url.Parse("http://localhost:2000/authy/oauth1/callback?oauth_token=requesttoken&oauth_verifier=nope")
+			_, err := oauth1.GetAccessToken(config, &http.Request{URL: callbackUrl}, requestToken)
+			So(err, ShouldHaveSameTypeAs, oauth1.Error{})
+			So(err.(oauth1.Error).StatusCode, ShouldEqual, http.StatusUnauthorized)
+			So(err.Error(), ShouldContainSubstring, "invalid signature")
+		})
+	})
+}
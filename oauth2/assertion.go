@@ -0,0 +1,172 @@
+package oauth2
+
+// see https://datatracker.ietf.org/doc/html/rfc7523#section-2.2
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/christopherobin/authy/provider"
+	"io"
+	"net/url"
+	"time"
+)
+
+// Value of client_assertion_type for JWT client authentication
+const ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// how long a client assertion can be used, a new one is signed for every request
+const clientAssertionLifetime = 5 * time.Minute
+
+// Build the signed JWT authenticating the client on the token endpoint, with the private key of the config
+// (provider.ClientAuthPrivateKeyJWT and provider.ClientAuthGeneratedSecret) or its secret (provider.ClientAuthSecretJWT)
+func ClientAssertion(config provider.ProviderConfig) (string, error) {
+	var key interface{}
+	switch config.Provider.ClientAuthMethod {
+	case provider.ClientAuthPrivateKeyJWT, provider.ClientAuthGeneratedSecret:
+		privateKey, err := ParsePrivateKey(config.PrivateKey)
+		if err != nil {
+			return "", err
+		}
+		key = privateKey
+	case provider.ClientAuthSecretJWT:
+		key = []byte(config.Secret)
+	default:
+		return "", errors.New(fmt.Sprintf("provider %s doesn't use JWT client authentication", config.Provider.Name))
+	}
+
+	jti := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, jti); err != nil {
+		return "", err
+	}
+
+	issuer := config.AssertionIssuer
+	if issuer == "" {
+		issuer = config.Key
+	}
+	audience := config.Provider.AssertionAudience
+	if audience == "" {
+		audience = config.Provider.AccessURL
+	}
+
+	now := time.Now()
+	header := map[string]interface{}{"typ": "JWT"}
+	if config.KeyID != "" {
+		header["kid"] = config.KeyID
+	}
+
+	return signJWT(header, map[string]interface{}{
+		"iss": issuer,
+		"sub": config.Key,
+		"aud": audience,
+		"jti": hex.EncodeToString(jti),
+		"iat": now.Unix(),
+		"exp": now.Add(clientAssertionLifetime).Unix(),
+	}, key)
+}
+
+// Replace the client secret of a token request by a client assertion
+func setClientAssertion(config provider.ProviderConfig, queryValues url.Values) error {
+	assertion, err := ClientAssertion(config)
+	if err != nil {
+		return err
+	}
+
+	queryValues.Del("client_secret")
+	queryValues.Set("client_assertion_type", ClientAssertionType)
+	queryValues.Set("client_assertion", assertion)
+	return nil
+}
+
+// Parse a PEM encoded RSA or P-256 private key (PKCS #8, PKCS #1 or SEC 1)
+func ParsePrivateKey(encoded string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 EC keys are supported")
+		}
+		return key, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported private key type %T", key))
+	}
+}
+
+// Sign a JWT with a P-256 key (ES256), a RSA key (RS256) or a shared secret (HS256), the alg header is set accordingly
+func signJWT(header map[string]interface{}, claims map[string]interface{}, key interface{}) (string, error) {
+	switch key.(type) {
+	case *ecdsa.PrivateKey:
+		header["alg"] = "ES256"
+	case *rsa.PrivateKey:
+		header["alg"] = "RS256"
+	case []byte:
+		header["alg"] = "HS256"
+	default:
+		return "", errors.New(fmt.Sprintf("unsupported signing key type %T", key))
+	}
+
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(encodedHeader) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS uses the raw r || s form, not ASN.1
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			return "", err
+		}
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,134 @@
+package oauth2_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/christopherobin/authy/oauth2"
+	"github.com/christopherobin/authy/provider"
+	. "github.com/smartystreets/goconvey/convey"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// PEM encode a private key the way it's usually distributed
+func EncodePrivateKey(key crypto.Signer) string {
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// check the signature of a client assertion and return its header and claims
+func VerifyClientAssertion(assertion string, key interface{}) (map[string]interface{}, map[string]interface{}) {
+	parts := strings.Split(assertion, ".")
+	So(len(parts), ShouldEqual, 3)
+
+	var header map[string]interface{}
+	rawHeader, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	So(json.Unmarshal(rawHeader, &header), ShouldEqual, nil)
+
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		So(header["alg"], ShouldEqual, "RS256")
+		So(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], signature), ShouldEqual, nil)
+	case *ecdsa.PrivateKey:
+		So(header["alg"], ShouldEqual, "ES256")
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		So(ecdsa.Verify(&key.PublicKey, sum[:], r, s), ShouldBeTrue)
+	case []byte:
+		So(header["alg"], ShouldEqual, "HS256")
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		So(hmac.Equal(mac.Sum(nil), signature), ShouldBeTrue)
+	}
+
+	claims, err := oauth2.DecodeClaims(assertion)
+	So(err, ShouldEqual, nil)
+	return header, claims
+}
+
+func TestClientAssertion(t *testing.T) {
+	Convey("Authenticate the client with a signed assertion", t, func() {
+		var received url.Values
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			received = r.PostForm
+			WriteToken(rw)
+		})
+		Reset(server.Close)
+
+		config := MockConfig(server)
+
+		Convey("private_key_jwt with a RSA key", func() {
+			key, _ := rsa.GenerateKey(rand.Reader, 2048)
+			config.Provider.ClientAuthMethod = provider.ClientAuthPrivateKeyJWT
+			config.PrivateKey = EncodePrivateKey(key)
+			config.KeyID = "key-1"
+			config.Secret = ""
+
+			token, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(token.AccessToken, ShouldEqual, "fakeaccesstoken")
+
+			So(received.Get("client_id"), ShouldEqual, "my-key")
+			So(received, ShouldNotContainKey, "client_secret")
+			So(received.Get("client_assertion_type"), ShouldEqual, oauth2.ClientAssertionType)
+
+			header, claims := VerifyClientAssertion(received.Get("client_assertion"), key)
+			So(header["kid"], ShouldEqual, "key-1")
+			So(claims["iss"], ShouldEqual, "my-key")
+			So(claims["sub"], ShouldEqual, "my-key")
+			So(claims["aud"], ShouldEqual, server.URL+"/token")
+			So(claims["jti"], ShouldNotEqual, "")
+			So(claims["exp"], ShouldBeGreaterThan, claims["iat"])
+		})
+
+		Convey("private_key_jwt with a P-256 key and a custom issuer and audience", func() {
+			key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			der, _ := x509.MarshalECPrivateKey(key)
+			config.Provider.ClientAuthMethod = provider.ClientAuthPrivateKeyJWT
+			config.Provider.AssertionAudience = "https://sso.example.com"
+			config.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+			config.AssertionIssuer = "TEAMID"
+
+			_, err := oauth2.Refresh(config, oauth2.Token{RefreshToken: "fakerefreshtoken"})
+			So(err, ShouldEqual, nil)
+
+			header, claims := VerifyClientAssertion(received.Get("client_assertion"), key)
+			So(header, ShouldNotContainKey, "kid")
+			So(claims["iss"], ShouldEqual, "TEAMID")
+			So(claims["sub"], ShouldEqual, "my-key")
+			So(claims["aud"], ShouldEqual, "https://sso.example.com")
+		})
+
+		Convey("client_secret_jwt", func() {
+			config.Provider.ClientAuthMethod = provider.ClientAuthSecretJWT
+
+			_, err := oauth2.ClientCredentials(config)
+			So(err, ShouldEqual, nil)
+			So(received, ShouldNotContainKey, "client_secret")
+			VerifyClientAssertion(received.Get("client_assertion"), []byte("my-secret"))
+		})
+
+		Convey("Invalid private key", func() {
+			config.Provider.ClientAuthMethod = provider.ClientAuthPrivateKeyJWT
+			config.PrivateKey = "not a key"
+
+			_, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldNotEqual, nil)
+			So(received, ShouldEqual, nil)
+		})
+	})
+}
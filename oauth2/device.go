@@ -0,0 +1,161 @@
+package oauth2
+
+// see http://tools.ietf.org/html/rfc8628
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/christopherobin/authy/provider"
+	"github.com/google/go-querystring/query"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// how much to slow down when the provider asks us to, as mandated by the spec
+const slowDownIncrement = 5 * time.Second
+
+type deviceAuthorizationRequest struct {
+	ClientId     string `url:"client_id"`
+	ClientSecret string `url:"client_secret,omitempty"`
+	Scope        string `url:"scope,omitempty"`
+}
+
+type deviceTokenRequest struct {
+	ClientId     string `url:"client_id"`
+	ClientSecret string `url:"client_secret,omitempty"`
+	GrantType    string `url:"grant_type"`
+	DeviceCode   string `url:"device_code"`
+}
+
+// Returned by DeviceAuthorize, show UserCode and VerificationURI to the user then call DevicePoll with DeviceCode
+type DeviceAuthorization struct {
+	DeviceCode string
+	UserCode   string
+	// Where the user should go to enter the code
+	VerificationURI string
+	// Same as VerificationURI but with the code already filled, not all providers send it
+	VerificationURIComplete string
+	// How long to wait between two polls
+	Interval time.Duration
+	// When the device code expires
+	Expires time.Time
+}
+
+// Start a device authorization, used by devices that cannot open a browser (CLIs, TVs, ...)
+func DeviceAuthorize(config provider.ProviderConfig) (DeviceAuthorization, error) {
+	return DeviceAuthorizeContext(context.Background(), config)
+}
+
+// Same as DeviceAuthorize, the request to the provider is aborted if the context is cancelled
+func DeviceAuthorizeContext(ctx context.Context, config provider.ProviderConfig) (device DeviceAuthorization, err error) {
+	if config.Provider.DeviceURL == "" {
+		err = errors.New(fmt.Sprintf("provider %s doesn't support the device authorization grant", config.Provider.Name))
+		return
+	}
+
+	queryValues, err := query.Values(deviceAuthorizationRequest{
+		ClientId:     config.Key,
+		ClientSecret: config.Secret,
+		Scope:        JoinScopes(config.Scope, config.Provider.ScopeDelimiter),
+	})
+
+	if err != nil {
+		return
+	}
+
+	_, values, err := postForm(ctx, config, config.Provider.DeviceURL, queryValues)
+	if err != nil {
+		return
+	}
+
+	return parseDeviceResponse(values)
+}
+
+func parseDeviceResponse(values url.Values) (device DeviceAuthorization, err error) {
+	device.DeviceCode = values.Get("device_code")
+	device.UserCode = values.Get("user_code")
+	device.VerificationURI = values.Get("verification_uri")
+	device.VerificationURIComplete = values.Get("verification_uri_complete")
+
+	// some providers still use the name from the drafts
+	if device.VerificationURI == "" {
+		device.VerificationURI = values.Get("verification_url")
+	}
+
+	if device.DeviceCode == "" || device.UserCode == "" || device.VerificationURI == "" {
+		err = Error{
+			Code:        CodeInvalidResponse,
+			Description: "The response returned by the server couldn't be parsed by Authy",
+			Raw:         values,
+		}
+		return
+	}
+
+	device.Interval = 5 * time.Second
+	if interval, err := strconv.ParseInt(values.Get("interval"), 10, 32); err == nil && interval > 0 {
+		device.Interval = time.Duration(interval) * time.Second
+	}
+
+	if expiresIn, err := strconv.ParseInt(values.Get("expires_in"), 10, 32); err == nil {
+		device.Expires = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	}
+
+	return
+}
+
+// Poll the token endpoint until the user approved or denied the device, the provider's authorization_pending and
+// slow_down responses are handled here, any other error is returned
+func DevicePoll(config provider.ProviderConfig, deviceCode string, interval time.Duration) (Token, error) {
+	return DevicePollContext(context.Background(), config, deviceCode, interval)
+}
+
+// Same as DevicePoll, stops polling when the context is cancelled
+func DevicePollContext(ctx context.Context, config provider.ProviderConfig, deviceCode string, interval time.Duration) (token Token, err error) {
+	queryValues, err := query.Values(deviceTokenRequest{
+		ClientId:     config.Key,
+		ClientSecret: config.Secret,
+		GrantType:    "urn:ietf:params:oauth:grant-type:device_code",
+		DeviceCode:   deviceCode,
+	})
+
+	if err != nil {
+		return
+	}
+
+	for {
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			err = ctx.Err()
+			return
+		case <-timer.C:
+		}
+
+		// postForm modifies the values when using basic auth, give it a copy
+		pollValues := url.Values{}
+		for key, value := range queryValues {
+			pollValues[key] = value
+		}
+
+		// the polling loop already waits between requests and handles slow_down
+		pollConfig := config
+		pollConfig.Retry = nil
+		token, err = requestToken(ctx, pollConfig, pollValues)
+
+		var oauthErr Error
+		if !errors.As(err, &oauthErr) {
+			return
+		}
+
+		switch oauthErr.Code {
+		case CodeAuthorizationPending:
+		case CodeSlowDown:
+			interval += slowDownIncrement
+		default:
+			return
+		}
+	}
+}
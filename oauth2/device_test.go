@@ -0,0 +1,67 @@
+package oauth2_test
+
+import (
+	"errors"
+	"github.com/christopherobin/authy/oauth2"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeviceFlow(t *testing.T) {
+	Convey("Authorize a device", t, func() {
+		polls := 0
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			rw.Header().Set("Content-Type", "application/json")
+
+			switch r.URL.Path {
+			case "/device":
+				rw.Write([]byte(`{"device_code":"fakedevicecode","user_code":"ABCD-EFGH","verification_uri":"https://example.com/device","interval":1,"expires_in":900}`))
+			case "/token":
+				if r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:device_code" || r.PostForm.Get("device_code") != "fakedevicecode" {
+					rw.WriteHeader(http.StatusBadRequest)
+					rw.Write([]byte(`{"error":"invalid_request"}`))
+					return
+				}
+
+				// the user approves on the third poll
+				polls++
+				if polls < 3 {
+					rw.WriteHeader(http.StatusBadRequest)
+					rw.Write([]byte(`{"error":"authorization_pending"}`))
+					return
+				}
+				rw.Write([]byte(`{"access_token":"fakeaccesstoken","token_type":"bearer"}`))
+			}
+		})
+		Reset(server.Close)
+
+		config := MockConfig(server)
+		config.Provider.DeviceURL = server.URL + "/device"
+
+		device, err := oauth2.DeviceAuthorize(config)
+		So(err, ShouldEqual, nil)
+		So(device.DeviceCode, ShouldEqual, "fakedevicecode")
+		So(device.UserCode, ShouldEqual, "ABCD-EFGH")
+		So(device.VerificationURI, ShouldEqual, "https://example.com/device")
+		So(device.Interval, ShouldEqual, time.Second)
+
+		Convey("Poll until the user approved", func() {
+			token, err := oauth2.DevicePoll(config, device.DeviceCode, 10*time.Millisecond)
+			So(err, ShouldEqual, nil)
+			So(token.AccessToken, ShouldEqual, "fakeaccesstoken")
+			So(polls, ShouldEqual, 3)
+		})
+
+		Convey("Other errors stop the polling", func() {
+			_, err := oauth2.DevicePoll(config, "wrongcode", 10*time.Millisecond)
+			So(err, ShouldNotEqual, nil)
+
+			var oauthErr oauth2.Error
+			So(errors.As(err, &oauthErr), ShouldBeTrue)
+			So(oauthErr.Code, ShouldEqual, "invalid_request")
+		})
+	})
+}
@@ -0,0 +1,156 @@
+package oauth2
+
+// see https://datatracker.ietf.org/doc/html/rfc9449
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token type of DPoP bound tokens, also the scheme of their Authorization header
+const TokenTypeDPoP = "DPoP"
+
+// Ephemeral P-256 key signing DPoP proofs (ES256), implements provider.DPoPSigner
+type DPoPKey struct {
+	key *ecdsa.PrivateKey
+	jwk map[string]string
+
+	mu     sync.Mutex
+	nonces map[string]string
+}
+
+// Generate a new key, keep it for as long as the tokens bound to it are used
+func NewDPoPKey() (*DPoPKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DPoPKey{
+		key: key,
+		jwk: map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		},
+		nonces: map[string]string{},
+	}, nil
+}
+
+// Public part of the key as a JWK
+func (k *DPoPKey) PublicJWK() map[string]string {
+	jwk := make(map[string]string, len(k.jwk))
+	for name, value := range k.jwk {
+		jwk[name] = value
+	}
+	return jwk
+}
+
+// JWK thumbprint (RFC 7638) of the key, the jkt the provider binds the tokens to
+func (k *DPoPKey) Thumbprint() string {
+	// members in lexicographic order, no whitespace
+	canonical := `{"crv":"` + k.jwk["crv"] + `","kty":"` + k.jwk["kty"] + `","x":"` + k.jwk["x"] +
+		`","y":"` + k.jwk["y"] + `"}`
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Sign a proof for a request, the ath claim binds it to the access token when there is one
+func (k *DPoPKey) Proof(method string, requestURL string, accessToken string) (string, error) {
+	htu, err := dpopTarget(requestURL)
+	if err != nil {
+		return "", err
+	}
+
+	jti := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, jti); err != nil {
+		return "", err
+	}
+
+	claims := map[string]interface{}{
+		"jti": hex.EncodeToString(jti),
+		"htm": method,
+		"htu": htu,
+		"iat": time.Now().Unix(),
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	if nonce := k.nonce(requestURL); nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	return signJWT(map[string]interface{}{"typ": "dpop+jwt", "jwk": k.jwk}, claims, k.key)
+}
+
+// Remember the nonce of the server of requestURL, nonces are kept per origin
+func (k *DPoPKey) SetNonce(requestURL string, nonce string) {
+	origin, err := dpopOrigin(requestURL)
+	if err != nil || nonce == "" {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.nonces[origin] = nonce
+}
+
+func (k *DPoPKey) nonce(requestURL string) string {
+	origin, err := dpopOrigin(requestURL)
+	if err != nil {
+		return ""
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.nonces[origin]
+}
+
+// the htu claim is the request URL without its query and fragment
+func dpopTarget(requestURL string) (string, error) {
+	target, err := url.Parse(requestURL)
+	if err != nil {
+		return "", err
+	}
+
+	target.RawQuery = ""
+	target.Fragment = ""
+	return target.String(), nil
+}
+
+func dpopOrigin(requestURL string) (string, error) {
+	target, err := url.Parse(requestURL)
+	if err != nil {
+		return "", err
+	}
+
+	return target.Scheme + "://" + target.Host, nil
+}
+
+// Whether a response asks for the request to be sent again with the nonce it carries, resource servers answer with a
+// 401 and a WWW-Authenticate header while token endpoints use a regular OAuth2 error
+func IsDPoPNonceChallenge(resp *http.Response) bool {
+	if resp == nil || resp.Header.Get("DPoP-Nonce") == "" || resp.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+
+	for _, challenge := range resp.Header.Values("WWW-Authenticate") {
+		if strings.HasPrefix(strings.ToLower(challenge), "dpop") && strings.Contains(challenge, CodeUseDPoPNonce) {
+			return true
+		}
+	}
+
+	return false
+}
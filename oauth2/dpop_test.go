@@ -0,0 +1,138 @@
+package oauth2_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/christopherobin/authy/oauth2"
+	. "github.com/smartystreets/goconvey/convey"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// check the signature of a proof against the key in its header and return its claims
+func VerifyDPoPProof(proof string) (map[string]string, map[string]interface{}) {
+	parts := strings.Split(proof, ".")
+	So(len(parts), ShouldEqual, 3)
+
+	var header struct {
+		Typ string            `json:"typ"`
+		Alg string            `json:"alg"`
+		JWK map[string]string `json:"jwk"`
+	}
+	rawHeader, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	So(json.Unmarshal(rawHeader, &header), ShouldEqual, nil)
+	So(header.Typ, ShouldEqual, "dpop+jwt")
+	So(header.Alg, ShouldEqual, "ES256")
+
+	x, _ := base64.RawURLEncoding.DecodeString(header.JWK["x"])
+	y, _ := base64.RawURLEncoding.DecodeString(header.JWK["y"])
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	So(len(signature), ShouldEqual, 64)
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	So(ecdsa.Verify(key, sum[:], r, s), ShouldBeTrue)
+
+	claims, err := oauth2.DecodeClaims(proof)
+	So(err, ShouldEqual, nil)
+
+	return header.JWK, claims
+}
+
+func TestDPoPProof(t *testing.T) {
+	Convey("Sign DPoP proofs", t, func() {
+		key, err := oauth2.NewDPoPKey()
+		So(err, ShouldEqual, nil)
+
+		Convey("Proof for a token request", func() {
+			proof, err := key.Proof("POST", "https://example.com/token?foo=bar#frag", "")
+			So(err, ShouldEqual, nil)
+
+			jwk, claims := VerifyDPoPProof(proof)
+			So(jwk["kty"], ShouldEqual, "EC")
+			So(jwk["crv"], ShouldEqual, "P-256")
+			So(claims["htm"], ShouldEqual, "POST")
+			So(claims["htu"], ShouldEqual, "https://example.com/token")
+			So(claims["jti"], ShouldNotEqual, "")
+			So(claims["ath"], ShouldEqual, nil)
+			So(claims["nonce"], ShouldEqual, nil)
+		})
+
+		Convey("Proof bound to an access token", func() {
+			proof, err := key.Proof("GET", "https://api.example.com/me", "fakeaccesstoken")
+			So(err, ShouldEqual, nil)
+
+			_, claims := VerifyDPoPProof(proof)
+			sum := sha256.Sum256([]byte("fakeaccesstoken"))
+			So(claims["ath"], ShouldEqual, base64.RawURLEncoding.EncodeToString(sum[:]))
+		})
+
+		Convey("Nonces are kept per origin", func() {
+			key.SetNonce("https://api.example.com/me", "server-nonce")
+
+			proof, _ := key.Proof("GET", "https://api.example.com/other", "")
+			_, claims := VerifyDPoPProof(proof)
+			So(claims["nonce"], ShouldEqual, "server-nonce")
+
+			proof, _ = key.Proof("GET", "https://example.com/token", "")
+			_, claims = VerifyDPoPProof(proof)
+			So(claims["nonce"], ShouldEqual, nil)
+		})
+
+		Convey("Each key has its own thumbprint", func() {
+			other, err := oauth2.NewDPoPKey()
+			So(err, ShouldEqual, nil)
+			So(key.Thumbprint(), ShouldNotEqual, other.Thumbprint())
+			So(len(key.Thumbprint()), ShouldEqual, 43)
+		})
+	})
+}
+
+func TestDPoPTokenRequest(t *testing.T) {
+	Convey("Bind tokens to the DPoP key", t, func() {
+		key, err := oauth2.NewDPoPKey()
+		So(err, ShouldEqual, nil)
+
+		var requests int32
+		var lastProof string
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			lastProof = r.Header.Get("DPoP")
+
+			claims, _ := oauth2.DecodeClaims(lastProof)
+			if claims["nonce"] != "server-nonce" {
+				rw.Header().Set("DPoP-Nonce", "server-nonce")
+				rw.WriteHeader(http.StatusBadRequest)
+				rw.Write([]byte("error=use_dpop_nonce"))
+				return
+			}
+
+			rw.Write([]byte("access_token=fakeaccesstoken&token_type=DPoP"))
+		})
+		Reset(server.Close)
+
+		config := MockConfig(server)
+		config.DPoP = key
+
+		token, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+		So(err, ShouldEqual, nil)
+		So(token.Type, ShouldEqual, "DPoP")
+		So(atomic.LoadInt32(&requests), ShouldEqual, 2)
+
+		_, claims := VerifyDPoPProof(lastProof)
+		So(claims["htu"], ShouldEqual, server.URL+"/token")
+
+		Convey("The nonce is reused for the next requests", func() {
+			_, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 3)
+		})
+	})
+}
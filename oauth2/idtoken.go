@@ -0,0 +1,287 @@
+package oauth2
+
+// see http://openid.net/specs/openid-connect-core-1_0.html
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/christopherobin/authy/provider"
+	"hash"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Decode the claims of a JWT without verifying its signature
+func DecodeClaims(jwt string) (map[string]interface{}, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT, expected 3 parts")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// Verify the signature of an id_token against the keys published by the provider (see Provider.JWKSURL) then check its
+// iss, aud, exp and nonce claims, the claims are only returned if the token is valid
+func VerifyIDToken(config provider.ProviderConfig, idToken string) (map[string]interface{}, error) {
+	_, claims, err := verifyIDToken(context.Background(), config, idToken)
+	return claims, err
+}
+
+// Same as VerifyIDToken for the id_token of the token, the at_hash claim is also checked against the access token
+func (t Token) Verify(config provider.ProviderConfig) (map[string]interface{}, error) {
+	return t.VerifyContext(context.Background(), config)
+}
+
+// Same as Verify, the context controls the request fetching the provider's keys
+func (t Token) VerifyContext(ctx context.Context, config provider.ProviderConfig) (map[string]interface{}, error) {
+	if t.IDToken == "" {
+		return nil, errors.New("token has no id_token")
+	}
+
+	alg, claims, err := verifyIDToken(ctx, config, t.IDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ValidateAtHash(claims, alg, t.AccessToken); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func verifyIDToken(ctx context.Context, config provider.ProviderConfig, idToken string) (alg string, claims map[string]interface{}, err error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return "", nil, errors.New("malformed JWT, expected 3 parts")
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", nil, err
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return "", nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, err
+	}
+
+	key, err := publicKey(ctx, config, header.Kid)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return "", nil, err
+	}
+
+	claims, err = DecodeClaims(idToken)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := validateClaims(config, claims); err != nil {
+		return "", nil, err
+	}
+
+	return header.Alg, claims, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	if len(alg) != 5 {
+		return errors.New(fmt.Sprintf("unsupported id_token algorithm %s", alg))
+	}
+
+	var hashType crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hashType = crypto.SHA256
+	case "384":
+		hashType = crypto.SHA384
+	case "512":
+		hashType = crypto.SHA512
+	default:
+		return errors.New(fmt.Sprintf("unsupported id_token algorithm %s", alg))
+	}
+
+	h := hashType.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if ok != true {
+			return errors.New(fmt.Sprintf("key type doesn't match algorithm %s", alg))
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, hashType, digest, signature); err != nil {
+			return errors.New("invalid id_token signature")
+		}
+		return nil
+	case "ES":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if ok != true {
+			return errors.New(fmt.Sprintf("key type doesn't match algorithm %s", alg))
+		}
+		// JWS uses the raw r || s encoding of the signature
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid id_token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return errors.New("invalid id_token signature")
+		}
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf("unsupported id_token algorithm %s", alg))
+}
+
+func validateClaims(config provider.ProviderConfig, claims map[string]interface{}) error {
+	issuer := config.Provider.Issuer
+	// multi-tenant logins are issued by the tenant of the user, see provider.Provider.MultiTenants
+	if tenant, _ := claims["tid"].(string); tenant != "" {
+		issuer = strings.Replace(issuer, provider.PlaceholderTenant, tenant, -1)
+	}
+	if iss, _ := claims["iss"].(string); iss != issuer || iss == "" {
+		return errors.New(fmt.Sprintf("id_token issuer %q doesn't match provider issuer %q", iss, issuer))
+	}
+
+	// aud is either a single string or an array of strings
+	audience := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = aud == config.Key
+	case []interface{}:
+		for _, value := range aud {
+			if value == config.Key {
+				audience = true
+			}
+		}
+	}
+	if !audience {
+		return errors.New("id_token was not issued for this client")
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if ok != true {
+		return errors.New("id_token has no exp claim")
+	}
+	if time.Now().After(time.Unix(int64(exp), 0)) {
+		return errors.New("id_token is expired")
+	}
+
+	if config.Nonce != "" {
+		return validateNonce(claims, config.Nonce)
+	}
+
+	return nil
+}
+
+func validateNonce(claims map[string]interface{}, expected string) error {
+	nonce, ok := claims["nonce"].(string)
+	if ok != true {
+		return errors.New("id_token has no nonce claim")
+	}
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(expected)) != 1 {
+		return errors.New("id_token nonce doesn't match")
+	}
+	return nil
+}
+
+// Check the nonce claim of the id_token without verifying its signature, use Verify instead when the provider
+// publishes its keys
+func (t Token) ValidateNonce(nonce string) error {
+	claims, err := t.Claims()
+	if err != nil {
+		return err
+	}
+	return validateNonce(claims, nonce)
+}
+
+// Claims of the id_token, the signature is NOT verified so don't use them for anything security related
+func (t Token) Claims() (map[string]interface{}, error) {
+	if t.IDToken == "" {
+		return nil, errors.New("token has no id_token")
+	}
+	return DecodeClaims(t.IDToken)
+}
+
+// Compute the at_hash value of an access token for an id_token signed with the given JWS algorithm (RS256, ES384, ...)
+func AtHash(accessToken string, alg string) (string, error) {
+	var h hash.Hash
+	switch {
+	case alg == "EdDSA":
+		h = sha512.New()
+	case strings.HasSuffix(alg, "256"):
+		h = sha256.New()
+	case strings.HasSuffix(alg, "384"):
+		h = sha512.New384()
+	case strings.HasSuffix(alg, "512"):
+		h = sha512.New()
+	default:
+		return "", errors.New(fmt.Sprintf("unsupported id_token algorithm %s", alg))
+	}
+
+	h.Write([]byte(accessToken))
+	sum := h.Sum(nil)
+
+	// the claim is the left-most half of the hash
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]), nil
+}
+
+// Check that the at_hash claim of an id_token matches the access token it was issued with, this detects an access
+// token being swapped for another one. Claims without an at_hash are accepted since the claim is optional
+func ValidateAtHash(claims map[string]interface{}, alg string, accessToken string) error {
+	rawClaim, ok := claims["at_hash"]
+	if ok != true {
+		return nil
+	}
+
+	claim, ok := rawClaim.(string)
+	if ok != true {
+		return errors.New("at_hash claim is not a string")
+	}
+
+	expected, err := AtHash(accessToken, alg)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(claim), []byte(expected)) != 1 {
+		return errors.New("at_hash claim doesn't match the access token")
+	}
+
+	return nil
+}
@@ -0,0 +1,251 @@
+package oauth2_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"github.com/christopherobin/authy/oauth2"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAtHash(t *testing.T) {
+	Convey("Validate the at_hash claim", t, func() {
+		// values from the OpenID Connect core specification examples
+		accessToken := "jHkWEdUXMU1BwAsC4vtUsZwnNvTIxEl0z9K3vx5KF0Y"
+
+		Convey("Matching at_hash", func() {
+			claims := map[string]interface{}{"at_hash": "77QmUPtjPfzWtF2AnpK9RQ"}
+			So(oauth2.ValidateAtHash(claims, "RS256", accessToken), ShouldEqual, nil)
+		})
+
+		Convey("Tampered at_hash", func() {
+			claims := map[string]interface{}{"at_hash": "77QmUPtjPfzWtF2AnpK9RR"}
+			So(oauth2.ValidateAtHash(claims, "RS256", accessToken), ShouldNotEqual, nil)
+		})
+
+		Convey("Access token was swapped", func() {
+			claims := map[string]interface{}{"at_hash": "77QmUPtjPfzWtF2AnpK9RQ"}
+			So(oauth2.ValidateAtHash(claims, "RS256", "some-other-token"), ShouldNotEqual, nil)
+		})
+
+		Convey("Missing at_hash is accepted", func() {
+			So(oauth2.ValidateAtHash(map[string]interface{}{}, "RS256", accessToken), ShouldEqual, nil)
+		})
+	})
+}
+
+func TestIDToken(t *testing.T) {
+	Convey("Read the id_token from the token response", t, func() {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"1"}`))
+		payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1234","email":"john@example.com"}`))
+		idToken := header + "." + payload + ".signature"
+
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Write([]byte(`{"access_token":"fakeaccesstoken","token_type":"bearer","id_token":"` + idToken + `"}`))
+		})
+		Reset(server.Close)
+
+		token, err := oauth2.GetAccessToken(MockConfig(server), MockCallbackRequest())
+		So(err, ShouldEqual, nil)
+		So(token.IDToken, ShouldEqual, idToken)
+
+		claims, err := token.Claims()
+		So(err, ShouldEqual, nil)
+		So(claims["sub"], ShouldEqual, "1234")
+		So(claims["email"], ShouldEqual, "john@example.com")
+
+		Convey("Malformed id_token", func() {
+			_, err := oauth2.Token{IDToken: "not-a-jwt"}.Claims()
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	Convey("Verify the id_token against the provider keys", t, func() {
+		rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+		ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		keys := map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey}
+		fetches := 0
+
+		jwks := MockJWKSServer(keys, &fetches)
+		Reset(jwks.Close)
+
+		config := MockConfig(jwks)
+		config.Provider.Issuer = "https://issuer.example.com"
+		config.Provider.JWKSURL = jwks.URL
+
+		claims := map[string]interface{}{
+			"iss": "https://issuer.example.com",
+			"aud": "my-key",
+			"sub": "1234",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+
+		Convey("RS256 signature", func() {
+			verified, err := oauth2.VerifyIDToken(config, SignIDToken(rsaKey, "rsa", claims))
+			So(err, ShouldEqual, nil)
+			So(verified["sub"], ShouldEqual, "1234")
+		})
+
+		Convey("ES256 signature", func() {
+			verified, err := oauth2.VerifyIDToken(config, SignIDToken(ecKey, "ec", claims))
+			So(err, ShouldEqual, nil)
+			So(verified["sub"], ShouldEqual, "1234")
+		})
+
+		Convey("Keys are cached", func() {
+			oauth2.VerifyIDToken(config, SignIDToken(rsaKey, "rsa", claims))
+			oauth2.VerifyIDToken(config, SignIDToken(ecKey, "ec", claims))
+			So(fetches, ShouldEqual, 1)
+		})
+
+		Convey("Tampered signature", func() {
+			otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+			_, err := oauth2.VerifyIDToken(config, SignIDToken(otherKey, "rsa", claims))
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Wrong audience", func() {
+			claims["aud"] = []interface{}{"someone-else"}
+			_, err := oauth2.VerifyIDToken(config, SignIDToken(rsaKey, "rsa", claims))
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Audience array", func() {
+			claims["aud"] = []interface{}{"someone-else", "my-key"}
+			_, err := oauth2.VerifyIDToken(config, SignIDToken(rsaKey, "rsa", claims))
+			So(err, ShouldEqual, nil)
+		})
+
+		Convey("Wrong issuer", func() {
+			claims["iss"] = "https://evil.example.com"
+			_, err := oauth2.VerifyIDToken(config, SignIDToken(rsaKey, "rsa", claims))
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Expired", func() {
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+			_, err := oauth2.VerifyIDToken(config, SignIDToken(rsaKey, "rsa", claims))
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Nonce", func() {
+			config.Nonce = "my-nonce"
+
+			_, err := oauth2.VerifyIDToken(config, SignIDToken(rsaKey, "rsa", claims))
+			So(err, ShouldNotEqual, nil)
+
+			claims["nonce"] = "my-nonce"
+			_, err = oauth2.VerifyIDToken(config, SignIDToken(rsaKey, "rsa", claims))
+			So(err, ShouldEqual, nil)
+		})
+
+		Convey("Unknown kid right after a fetch", func() {
+			_, err := oauth2.VerifyIDToken(config, SignIDToken(rsaKey, "rsa", claims))
+			So(err, ShouldEqual, nil)
+
+			rotatedKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+			keys["rotated"] = rotatedKey
+
+			// keys were fetched too recently, the unknown kid is rejected without fetching again
+			_, err = oauth2.VerifyIDToken(config, SignIDToken(rotatedKey, "rotated", claims))
+			So(err, ShouldNotEqual, nil)
+			So(fetches, ShouldEqual, 1)
+		})
+
+		Convey("at_hash is checked against the access token", func() {
+			atHash, _ := oauth2.AtHash("fakeaccesstoken", "RS256")
+			claims["at_hash"] = atHash
+			idToken := SignIDToken(rsaKey, "rsa", claims)
+
+			_, err := oauth2.Token{AccessToken: "fakeaccesstoken", IDToken: idToken}.Verify(config)
+			So(err, ShouldEqual, nil)
+
+			_, err = oauth2.Token{AccessToken: "swapped", IDToken: idToken}.Verify(config)
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestJWKSFetches(t *testing.T) {
+	Convey("Fetch key sets without holding up the other providers", t, func() {
+		rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+		keys := map[string]crypto.Signer{"rsa": rsaKey}
+		claims := map[string]interface{}{
+			"iss": "https://issuer.example.com",
+			"aud": "my-key",
+			"sub": "1234",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		idToken := SignIDToken(rsaKey, "rsa", claims)
+
+		// the slow endpoint answers once released
+		var slowFetches int32
+		release := make(chan struct{})
+		fetches := 0
+		jwks := MockJWKSServer(keys, &fetches)
+		Reset(jwks.Close)
+		slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&slowFetches, 1)
+			<-release
+			jwks.Config.Handler.ServeHTTP(rw, r)
+		}))
+		Reset(slow.Close)
+
+		slowConfig := MockConfig(slow)
+		slowConfig.Provider.Issuer = "https://issuer.example.com"
+		slowConfig.Provider.JWKSURL = slow.URL
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 5)
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := oauth2.VerifyIDToken(slowConfig, idToken)
+				errs <- err
+			}()
+		}
+		for atomic.LoadInt32(&slowFetches) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		fastFetches := 0
+		fast := MockJWKSServer(keys, &fastFetches)
+		Reset(fast.Close)
+		fastConfig := MockConfig(fast)
+		fastConfig.Provider.Issuer = "https://issuer.example.com"
+		fastConfig.Provider.JWKSURL = fast.URL
+
+		verified := make(chan error, 1)
+		go func() {
+			_, err := oauth2.VerifyIDToken(fastConfig, idToken)
+			verified <- err
+		}()
+		select {
+		case err := <-verified:
+			So(err, ShouldEqual, nil)
+		case <-time.After(5 * time.Second):
+			t.Fatal("verification waited for the key set of another provider")
+		}
+
+		close(release)
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			So(err, ShouldEqual, nil)
+		}
+		So(atomic.LoadInt32(&slowFetches), ShouldEqual, 1)
+	})
+}
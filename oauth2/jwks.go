@@ -0,0 +1,203 @@
+package oauth2
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/christopherobin/authy/provider"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// how long fetched keys are trusted before fetching the key set again
+const jwksTTL = time.Hour
+
+// minimum delay between two fetches of the same key set, so tokens with random kids can't make us hammer the provider
+const jwksMinRefresh = time.Minute
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type keySet struct {
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// a fetch of a key set in flight, the other callers needing the same key set wait for it
+type keySetFetch struct {
+	done chan struct{}
+	keys map[string]crypto.PublicKey
+	err  error
+}
+
+// the lock is not held during fetches so a slow JWKS endpoint only holds up the tokens of its provider
+var jwksCache = struct {
+	sync.Mutex
+	sets    map[string]*keySet
+	fetches map[string]*keySetFetch
+}{sets: map[string]*keySet{}, fetches: map[string]*keySetFetch{}}
+
+// Find the public key with the given kid in the provider's key set, the key set is cached and fetched again when it
+// expired or doesn't contain the key (providers rotate their keys)
+func publicKey(ctx context.Context, config provider.ProviderConfig, kid string) (crypto.PublicKey, error) {
+	jwksURL := config.Provider.JWKSURL
+	if jwksURL == "" {
+		return nil, errors.New(fmt.Sprintf("provider %s has no JWKS URL", config.Provider.Name))
+	}
+
+	jwksCache.Lock()
+
+	set, ok := jwksCache.sets[jwksURL]
+	if ok == true && time.Since(set.fetched) < jwksTTL {
+		if key, ok := set.keys[kid]; ok == true {
+			jwksCache.Unlock()
+			return key, nil
+		}
+		if time.Since(set.fetched) < jwksMinRefresh {
+			jwksCache.Unlock()
+			return nil, errors.New(fmt.Sprintf("unknown key id %s", kid))
+		}
+	}
+
+	// another goroutine is already fetching the key set, wait for it
+	if fetch, ok := jwksCache.fetches[jwksURL]; ok == true {
+		jwksCache.Unlock()
+		select {
+		case <-fetch.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return lookupKey(fetch, kid)
+	}
+
+	fetch := &keySetFetch{done: make(chan struct{})}
+	jwksCache.fetches[jwksURL] = fetch
+	jwksCache.Unlock()
+
+	fetch.keys, fetch.err = fetchKeySet(ctx, config, jwksURL)
+
+	jwksCache.Lock()
+	delete(jwksCache.fetches, jwksURL)
+	if fetch.err == nil {
+		jwksCache.sets[jwksURL] = &keySet{keys: fetch.keys, fetched: time.Now()}
+	}
+	jwksCache.Unlock()
+	close(fetch.done)
+
+	return lookupKey(fetch, kid)
+}
+
+func lookupKey(fetch *keySetFetch, kid string) (crypto.PublicKey, error) {
+	if fetch.err != nil {
+		return nil, fetch.err
+	}
+	if key, ok := fetch.keys[kid]; ok == true {
+		return key, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown key id %s", kid))
+}
+
+func fetchKeySet(ctx context.Context, config provider.ProviderConfig, jwksURL string) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := providerClient(config)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("fetching JWKS returned status %d", resp.StatusCode))
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		// skip encryption keys and key types we don't support
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New(fmt.Sprintf("unsupported curve %s", jwk.Crv))
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("unsupported key type %s", jwk.Kty))
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
@@ -0,0 +1,54 @@
+package oauth2
+
+import (
+	"fmt"
+	"github.com/christopherobin/authy/provider"
+	"net/url"
+)
+
+// parameters of token requests that must never end up in logs
+var sensitiveParams = map[string]bool{
+	"client_secret":    true,
+	"client_assertion": true,
+	"code":             true,
+	"code_verifier":    true,
+	"device_code":      true,
+	"refresh_token":    true,
+	"password":         true,
+}
+
+// Emit a debug event on the logger of the provider config, does nothing if there is none
+func debug(config provider.ProviderConfig, msg string, args ...interface{}) {
+	if config.Logger == nil {
+		return
+	}
+	config.Logger.Debug(msg, append([]interface{}{"provider", config.Provider.Name}, args...)...)
+}
+
+// Encode the parameters of a request with the secrets masked
+func redactParams(values url.Values) string {
+	redacted := url.Values{}
+	for name, value := range values {
+		if sensitiveParams[name] {
+			redacted[name] = []string{"REDACTED"}
+		} else {
+			redacted[name] = value
+		}
+	}
+	return redacted.Encode()
+}
+
+// Print the token with its secrets masked so that it can be logged safely, the fields still hold the raw values
+func (t Token) String() string {
+	expires := "never"
+	if t.Expires != nil {
+		expires = t.Expires.String()
+	}
+	return fmt.Sprintf("{AccessToken:%s Scope:%v Type:%s Expires:%s RefreshToken:%s IDToken:%s Extra:%v}",
+		provider.Redact(t.AccessToken), t.Scope, t.Type, expires, provider.Redact(t.RefreshToken),
+		provider.Redact(t.IDToken), t.Extra)
+}
+
+func (t Token) GoString() string {
+	return "oauth2.Token" + t.String()
+}
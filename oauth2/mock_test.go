@@ -0,0 +1,113 @@
+package oauth2_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/christopherobin/authy/provider"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+)
+
+// fake token endpoint using the given handler
+func MockTokenServer(handler func(rw http.ResponseWriter, r *http.Request)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(handler))
+}
+
+// write a successful form encoded token response
+func WriteToken(rw http.ResponseWriter) {
+	values := url.Values{}
+	values.Set("access_token", "fakeaccesstoken")
+	values.Set("token_type", "bearer")
+	rw.Write([]byte(values.Encode()))
+}
+
+// provider config pointing at the fake server
+func MockConfig(server *httptest.Server) provider.ProviderConfig {
+	return provider.ProviderConfig{
+		Provider: provider.Provider{
+			Name:           "mock",
+			AuthorizeURL:   server.URL + "/authorize",
+			AccessURL:      server.URL + "/token",
+			OAuth:          2,
+			ScopeDelimiter: ",",
+		},
+		Key:    "my-key",
+		Secret: "my-secret",
+	}
+}
+
+// request as received on the callback route
+func MockCallbackRequest() *http.Request {
+	parsedUrl, _ := url.Parse("http://localhost:2000/authy/mock/callback?code=auth_test")
+	return &http.Request{
+		Host: "localhost:2000",
+		URL:  parsedUrl,
+	}
+}
+
+// adapter to use a function as a http.RoundTripper
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// publish the given keys on a fake JWKS endpoint, keys can be swapped while the server runs to simulate a rotation
+func MockJWKSServer(keys map[string]crypto.Signer, fetches *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		*fetches++
+		jwks := []map[string]string{}
+		for kid, key := range keys {
+			switch pub := key.Public().(type) {
+			case *rsa.PublicKey:
+				jwks = append(jwks, map[string]string{
+					"kty": "RSA",
+					"kid": kid,
+					"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+				})
+			case *ecdsa.PublicKey:
+				jwks = append(jwks, map[string]string{
+					"kty": "EC",
+					"kid": kid,
+					"crv": "P-256",
+					"x":   base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+					"y":   base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32))),
+				})
+			}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]interface{}{"keys": jwks})
+	}))
+}
+
+// sign the claims as a RS256 or ES256 JWT
+func SignIDToken(key crypto.Signer, kid string, claims map[string]interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, k, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
@@ -4,13 +4,20 @@ package oauth2
 // see http://tools.ietf.org/html/rfc6749
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/christopherobin/authy/provider"
 	"github.com/google/go-querystring/query"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -21,24 +28,42 @@ import (
 
 // used to generate requests to the distant server
 type authorizationRequest struct {
-	ClientId     string `url:"client_id"`
-	ResponseType string `url:"response_type"`
-	RedirectURI  string `url:"redirect_uri,omitempty"`
-	Scope        string `url:"scope,omitempty"`
-	State        string `url:"state,omitempty"`
+	ClientId            string   `url:"client_id"`
+	ResponseType        string   `url:"response_type"`
+	RedirectURI         string   `url:"redirect_uri,omitempty"`
+	Scope               string   `url:"scope,omitempty"`
+	State               string   `url:"state,omitempty"`
+	Nonce               string   `url:"nonce,omitempty"`
+	Resource            []string `url:"resource,omitempty"`
+	CodeChallenge       string   `url:"code_challenge,omitempty"`
+	CodeChallengeMethod string   `url:"code_challenge_method,omitempty"`
+	ResponseMode        string   `url:"response_mode,omitempty"`
 }
 
 type accessTokenRequest struct {
-	ClientId     string `url:"client_id"`
-	ClientSecret string `url:"client_secret"`
-	GrantType    string `url:"grant_type"`
-	Code         string `url:"code"`
-	RedirectURI  string `url:"redirect_uri,omitempty"`
+	ClientId     string   `url:"client_id"`
+	ClientSecret string   `url:"client_secret"`
+	GrantType    string   `url:"grant_type"`
+	Code         string   `url:"code"`
+	RedirectURI  string   `url:"redirect_uri,omitempty"`
+	Resource     []string `url:"resource,omitempty"`
+	CodeVerifier string   `url:"code_verifier,omitempty"`
+}
+
+type clientCredentialsRequest struct {
+	ClientId     string   `url:"client_id"`
+	ClientSecret string   `url:"client_secret"`
+	GrantType    string   `url:"grant_type"`
+	Scope        string   `url:"scope,omitempty"`
+	Resource     []string `url:"resource,omitempty"`
 }
 
 type refreshTokenRequest struct {
-	GrantType    string `url:"grant_type"`
-	RefreshToken string `url:"refresh_token"`
+	ClientId     string   `url:"client_id"`
+	ClientSecret string   `url:"client_secret"`
+	GrantType    string   `url:"grant_type"`
+	RefreshToken string   `url:"refresh_token"`
+	Resource     []string `url:"resource,omitempty"`
 }
 
 type Token struct {
@@ -47,6 +72,10 @@ type Token struct {
 	Type         string
 	Expires      *time.Time
 	RefreshToken string
+	// OpenID Connect id_token, only returned when the openid scope was requested
+	IDToken string
+	// Values of the response headers listed in the provider config's CaptureHeaders
+	Extra map[string]string
 }
 
 // standard oauth2 error (http://tools.ietf.org/html/rfc6749#section-5.2)
@@ -56,8 +85,58 @@ type Error struct {
 	URI         string
 	// We also pass the raw error in case the server does something funky with it's error output
 	Raw map[string][]string
+	// Body of the token endpoint response the error was read from, empty for errors sent to the callback
+	Body string
+	// HTTP status of the token endpoint response, 0 for errors sent to the callback
+	Status int
 }
 
+// Error codes defined by the specs
+const (
+	// token endpoint errors (http://tools.ietf.org/html/rfc6749#section-5.2)
+	CodeInvalidRequest       = "invalid_request"
+	CodeInvalidClient        = "invalid_client"
+	CodeInvalidGrant         = "invalid_grant"
+	CodeUnauthorizedClient   = "unauthorized_client"
+	CodeUnsupportedGrantType = "unsupported_grant_type"
+	CodeInvalidScope         = "invalid_scope"
+	// authorization endpoint errors (http://tools.ietf.org/html/rfc6749#section-4.1.2.1)
+	CodeAccessDenied            = "access_denied"
+	CodeUnsupportedResponseType = "unsupported_response_type"
+	CodeServerError             = "server_error"
+	CodeTemporarilyUnavailable  = "temporarily_unavailable"
+	// device authorization grant errors (http://tools.ietf.org/html/rfc8628#section-3.5)
+	CodeAuthorizationPending = "authorization_pending"
+	CodeSlowDown             = "slow_down"
+	CodeExpiredToken         = "expired_token"
+	// bearer token errors (http://tools.ietf.org/html/rfc6750#section-3.1)
+	CodeInvalidToken = "invalid_token"
+	// DPoP errors (https://datatracker.ietf.org/doc/html/rfc9449#section-8)
+	CodeUseDPoPNonce = "use_dpop_nonce"
+	// set by Authy when the response could not be parsed
+	CodeInvalidResponse = "invalid_response"
+)
+
+// Errors to use with errors.Is, an Error matches them if it has the same code
+var (
+	ErrInvalidRequest          = Error{Code: CodeInvalidRequest}
+	ErrInvalidClient           = Error{Code: CodeInvalidClient}
+	ErrInvalidGrant            = Error{Code: CodeInvalidGrant}
+	ErrUnauthorizedClient      = Error{Code: CodeUnauthorizedClient}
+	ErrUnsupportedGrantType    = Error{Code: CodeUnsupportedGrantType}
+	ErrInvalidScope            = Error{Code: CodeInvalidScope}
+	ErrAccessDenied            = Error{Code: CodeAccessDenied}
+	ErrUnsupportedResponseType = Error{Code: CodeUnsupportedResponseType}
+	ErrServerError             = Error{Code: CodeServerError}
+	ErrTemporarilyUnavailable  = Error{Code: CodeTemporarilyUnavailable}
+	ErrAuthorizationPending    = Error{Code: CodeAuthorizationPending}
+	ErrSlowDown                = Error{Code: CodeSlowDown}
+	ErrExpiredToken            = Error{Code: CodeExpiredToken}
+	ErrInvalidToken            = Error{Code: CodeInvalidToken}
+	ErrUseDPoPNonce            = Error{Code: CodeUseDPoPNonce}
+	ErrInvalidResponse         = Error{Code: CodeInvalidResponse}
+)
+
 // utility function to retrieve the value of a specific entry in a decoded query string
 
 var errorTextRe = regexp.MustCompile("[[:^print:]]|[\\\\]")
@@ -67,7 +146,7 @@ func NewError(response url.Values) (err Error) {
 	err.Raw = response
 	err.Code = errorTextRe.ReplaceAllString(response.Get("error"), "")
 	if err.Code == "" {
-		err.Code = "invalid_response"
+		err.Code = CodeInvalidResponse
 		err.Description = "The response generated by the server could not be parsed by Authy"
 		return
 	}
@@ -85,45 +164,164 @@ func (err Error) Error() string {
 	if err.URI != "" {
 		msg += " (see " + err.URI + ")"
 	}
+	if err.Status != 0 {
+		msg += fmt.Sprintf(" [HTTP %d]", err.Status)
+	}
 	return msg
 }
 
-func genCallbackURL(config provider.ProviderConfig, r *http.Request) string {
-	var redirectURI = url.URL{
-		Host: r.Host,
-		Path: r.URL.Path + "/callback",
+// Errors match any Error with the same code, so errors.Is(err, ErrInvalidGrant) works whatever the description is
+func (err Error) Is(target error) bool {
+	targetErr, ok := target.(Error)
+	return ok == true && targetErr.Code == err.Code
+}
+
+// Returned by AuthorizeURL when the provider is hosted on a per customer subdomain and the config doesn't have one
+type ErrMissingSubdomain struct {
+	Provider string
+}
+
+func (err ErrMissingSubdomain) Error() string {
+	return fmt.Sprintf("provider %s expects the config to contain your subdomain", err.Provider)
+}
+
+// Last segment of the generated redirect URIs when the config doesn't set one
+const DefaultCallbackSegment = "callback"
+
+// Redirect URI sent to the provider, either the configured one or the current URL followed by the callback segment
+// (/callback by default)
+func CallbackURL(config provider.ProviderConfig, r *http.Request) string {
+	if config.RedirectURI != "" {
+		return config.RedirectURI
 	}
 
-	if _, ok := r.Header["X-HTTPS"]; r.TLS != nil || ok == true {
-		redirectURI.Scheme = "https"
-	} else {
-		redirectURI.Scheme = "http"
+	segment := config.CallbackSegment
+	if segment == "" {
+		segment = DefaultCallbackSegment
 	}
 
+	redirectURI := RequestOrigin(r)
+	redirectURI.Path = r.URL.Path + "/" + segment
+
 	return redirectURI.String()
 }
 
+// Scheme and host the request was sent to, https when served over TLS or behind a proxy setting X-HTTPS
+func RequestOrigin(r *http.Request) url.URL {
+	origin := url.URL{Scheme: "http", Host: r.Host}
+	// servers store the header as X-Https, requests built by hand may use the raw name
+	if _, ok := r.Header["X-HTTPS"]; r.TLS != nil || ok == true || r.Header.Get("X-HTTPS") != "" {
+		origin.Scheme = "https"
+	}
+	return origin
+}
+
+// Drop the empty entries of a list of scopes, nil if none is left
+func CleanScopes(scopes []string) []string {
+	var cleaned []string
+	for _, scope := range scopes {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			cleaned = append(cleaned, scope)
+		}
+	}
+	return cleaned
+}
+
+// Value of the scope parameter, empty when no scope is requested so the parameter is left out
+func JoinScopes(scopes []string, delimiter string) string {
+	return strings.Join(CleanScopes(scopes), delimiter)
+}
+
+// Parse a scope sent by a provider, an empty scope gives no scopes instead of a single empty one
+func SplitScopes(scope string, delimiter string) []string {
+	if strings.TrimSpace(delimiter) == "" {
+		return CleanScopes(strings.Fields(scope))
+	}
+	return CleanScopes(strings.Split(scope, delimiter))
+}
+
+// Number of random bytes of the states and nonces, 128 bits hex encoded as 32 characters
+const DefaultStateLength = 16
+
+// Shortest state or nonce accepted by NewStateN and NewNonceN, anything below is too easy to guess
+const MinStateLength = 8
+
 // create a new random token for the CSRF check
 func NewState() (string, error) {
-	rawState := make([]byte, 16)
-	_, err := rand.Read(rawState)
+	return NewStateN(DefaultStateLength)
+}
+
+// create a new random token for the CSRF check from n random bytes, the result is 2n characters long
+func NewStateN(n int) (string, error) {
+	return NewStateFrom(rand.Reader, n)
+}
+
+// Same as NewStateN but read the random bytes from the given source instead of crypto/rand, see authy.Config.Rand
+func NewStateFrom(random io.Reader, n int) (string, error) {
+	return randomHex(random, n)
+}
+
+// create a new random nonce, bound to the id_token by the provider to detect replays
+func NewNonce() (string, error) {
+	return NewNonceN(DefaultStateLength)
+}
+
+// create a new random nonce from n random bytes, see NewStateN
+func NewNonceN(n int) (string, error) {
+	return NewNonceFrom(rand.Reader, n)
+}
+
+// Same as NewNonceN but read the random bytes from the given source instead of crypto/rand
+func NewNonceFrom(random io.Reader, n int) (string, error) {
+	return randomHex(random, n)
+}
+
+func randomHex(random io.Reader, n int) (string, error) {
+	if n < MinStateLength {
+		return "", errors.New(fmt.Sprintf("random values need at least %d bytes, got %d", MinStateLength, n))
+	}
+
+	raw := make([]byte, n)
+	_, err := io.ReadFull(random, raw)
 	if err != nil {
 		return "", err
 	}
 
-	return hex.EncodeToString(rawState), nil
+	return hex.EncodeToString(raw), nil
+}
+
+// create a new random code verifier for PKCE (http://tools.ietf.org/html/rfc7636#section-4.1)
+func NewCodeVerifier() (string, error) {
+	return NewCodeVerifierFrom(rand.Reader)
+}
+
+// Same as NewCodeVerifier but read the random bytes from the given source instead of crypto/rand
+func NewCodeVerifierFrom(random io.Reader) (string, error) {
+	rawVerifier := make([]byte, 32)
+	_, err := io.ReadFull(random, rawVerifier)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(rawVerifier), nil
+}
+
+// derive the S256 code challenge sent in the authorization request from the code verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
 }
 
 // Generates the proper authorization URL for the given service
 func AuthorizeURL(config provider.ProviderConfig, r *http.Request) (dest string, err error) {
-	// subdomain support
+	// subdomain support, Authy fills the other placeholders when loading the config (see ProviderConfig.ExpandURLs)
 	baseUrl := config.Provider.AuthorizeURL
 	if config.Provider.Subdomain == true {
 		if config.Subdomain == "" {
-			err = errors.New(fmt.Sprintf("provider %s expects the config to contain your subdomain", config.Provider.Name))
+			err = ErrMissingSubdomain{Provider: config.Provider.Name}
 			return
 		}
-		baseUrl = strings.Replace(baseUrl, "[subdomain]", config.Subdomain, -1)
+		baseUrl = strings.Replace(baseUrl, provider.PlaceholderSubdomain, config.Subdomain, -1)
 	}
 
 	authUrl, err := url.Parse(baseUrl)
@@ -131,13 +329,32 @@ func AuthorizeURL(config provider.ProviderConfig, r *http.Request) (dest string,
 		return
 	}
 
-	values, err := query.Values(authorizationRequest{
+	responseType := config.Provider.ResponseType
+	if responseType == "" {
+		responseType = provider.ResponseTypeCode
+	}
+
+	authRequest := authorizationRequest{
 		ClientId:     config.Key,
-		ResponseType: "code",
-		RedirectURI:  genCallbackURL(config, r),
-		Scope:        strings.Join(config.Scope, config.Provider.ScopeDelimiter),
+		ResponseType: responseType,
+		RedirectURI:  CallbackURL(config, r),
+		Scope:        JoinScopes(config.Scope, config.Provider.ScopeDelimiter),
 		State:        config.State,
-	})
+		Nonce:        config.Nonce,
+		Resource:     config.Resource,
+		ResponseMode: config.Provider.ResponseMode,
+	}
+
+	if config.Provider.PKCE == true {
+		if config.CodeVerifier == "" {
+			err = errors.New(fmt.Sprintf("provider %s uses PKCE but no code verifier was generated", config.Provider.Name))
+			return
+		}
+		authRequest.CodeChallenge = CodeChallenge(config.CodeVerifier)
+		authRequest.CodeChallengeMethod = "S256"
+	}
+
+	values, err := query.Values(authRequest)
 
 	// custom parameters
 	if len(config.CustomParameters) > 0 {
@@ -154,31 +371,56 @@ func AuthorizeURL(config provider.ProviderConfig, r *http.Request) (dest string,
 
 	authUrl.RawQuery = values.Encode()
 	dest = authUrl.String()
+	debug(config, "authorize URL generated", "url", dest)
 	return
 }
 
+// longest lifetime we accept for an access token, in seconds
+const maxExpiresIn = 365 * 24 * 60 * 60
+
+// name of a field in the token response, providers can override the standard ones
+func tokenField(custom string, standard string) string {
+	if custom != "" {
+		return custom
+	}
+	return standard
+}
+
 func parseTokenResponse(config provider.ProviderConfig, values url.Values) (token Token, err error) {
-	token.AccessToken = values.Get("access_token")
-	token.Type = values.Get("token_type")
-	token.RefreshToken = values.Get("refresh_token")
+	fields := config.Provider.TokenFields
+	token.AccessToken = values.Get(tokenField(fields.AccessToken, "access_token"))
+	token.Type = values.Get(tokenField(fields.TokenType, "token_type"))
+	token.RefreshToken = values.Get(tokenField(fields.RefreshToken, "refresh_token"))
+	token.IDToken = values.Get("id_token")
 
 	if token.AccessToken == "" || token.Type == "" {
+		debug(config, "token response is missing the access token or its type")
 		err = Error{
-			Code:        "invalid_response",
+			Code:        CodeInvalidResponse,
 			Description: "The response returned by the server couldn't be parsed by Authy",
 			Raw:         values,
 		}
 		return
 	}
 
-	// optional stuff
-	if scope := values.Get("scope"); scope != "" {
-		token.Scope = strings.Split(scope, config.Provider.ScopeDelimiter)
+	// optional stuff, JSON responses may use an array for the scope
+	if scopes := values["scope"]; len(scopes) > 1 {
+		token.Scope = CleanScopes(scopes)
+	} else {
+		token.Scope = SplitScopes(values.Get("scope"), config.Provider.ScopeDelimiter)
 	}
 
-	if expires_in := values.Get("expires_in"); expires_in != "" {
-		// silently ignore errors in this case, later we might add a log
-		if to_add, err := strconv.ParseInt(expires_in, 10, 32); err != nil {
+	if expires_in := values.Get(tokenField(fields.ExpiresIn, "expires_in")); expires_in != "" {
+		// ignore errors in this case, the token is considered as never expiring
+		if to_add, err := strconv.ParseInt(expires_in, 10, 64); err != nil {
+			debug(config, "ignoring invalid expires_in", "value", expires_in)
+		} else {
+			// keep nonsensical values within bounds
+			if to_add < 0 {
+				to_add = 0
+			} else if to_add > maxExpiresIn {
+				to_add = maxExpiresIn
+			}
 			expires := time.Now().Add(time.Duration(to_add) * time.Second)
 			token.Expires = &expires
 		}
@@ -187,81 +429,391 @@ func parseTokenResponse(config provider.ProviderConfig, values url.Values) (toke
 	return
 }
 
+// Copy the headers the config asked for from the token endpoint response
+func captureHeaders(config provider.ProviderConfig, resp *http.Response, token *Token) {
+	for _, name := range config.CaptureHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			if token.Extra == nil {
+				token.Extra = map[string]string{}
+			}
+			token.Extra[name] = value
+		}
+	}
+}
+
 // Query the remote service for an access token
 func GetAccessToken(config provider.ProviderConfig, r *http.Request) (token Token, err error) {
+	return GetAccessTokenContext(context.Background(), config, r)
+}
+
+// Parameters the provider sent to the callback, in the query string or in the body of POSTed callbacks
+// (response_mode=form_post), values of the body take precedence
+func CallbackParams(config provider.ProviderConfig, r *http.Request) url.Values {
+	if r.Method != "POST" {
+		return r.URL.Query()
+	}
+
+	if err := r.ParseForm(); err != nil {
+		debug(config, "callback body could not be parsed", "error", err)
+	}
+	return r.Form
+}
+
+// Same as GetAccessToken, the request to the provider is aborted if the context is cancelled
+func GetAccessTokenContext(ctx context.Context, config provider.ProviderConfig, r *http.Request) (token Token, err error) {
+	token, _, err = GetAccessTokenWithResponse(ctx, config, r)
+	return
+}
+
+// Same as GetAccessTokenContext but also return the status and headers of the token endpoint response, they are set
+// on failures too as long as the provider answered
+func GetAccessTokenWithResponse(ctx context.Context, config provider.ProviderConfig, r *http.Request) (token Token, meta *ResponseMeta, err error) {
 	queryValues, err := query.Values(accessTokenRequest{
 		ClientId:     config.Key,
 		ClientSecret: config.Secret,
-		Code:         r.URL.Query().Get("code"),
+		Code:         CallbackParams(config, r).Get("code"),
 		GrantType:    "authorization_code",
-		RedirectURI:  genCallbackURL(config, r),
+		RedirectURI:  CallbackURL(config, r),
+		Resource:     config.Resource,
+		CodeVerifier: config.CodeVerifier,
 	})
 
 	if err != nil {
 		return
 	}
 
-	resp, err := http.PostForm(config.Provider.AccessURL, queryValues)
-	if err != nil {
+	// custom parameters
+	for _, name := range config.Provider.CustomTokenParameters {
+		if value, ok := config.TokenParameters[name]; ok == true {
+			queryValues.Set(name, value)
+		}
+	}
+
+	return requestTokenWithResponse(ctx, config, queryValues)
+}
+
+// Read the token from the callback of the implicit flow. Browsers don't send the URL fragment to the server so the
+// callback page must forward it in the query string, see ImplicitCallbackShim
+func ParseImplicitResponse(config provider.ProviderConfig, r *http.Request) (token Token, err error) {
+	values := CallbackParams(config, r)
+	if _, ok := values["error"]; ok == true {
+		err = NewError(values)
 		return
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	return parseTokenResponse(config, values)
+}
+
+// Page to serve on the callback route of implicit flow providers when the request has no query string, it reloads the
+// page with the fragment moved to the query string so that the server can read the token
+const ImplicitCallbackShim = `<!DOCTYPE html>
+<html>
+<body>
+<script>
+if (window.location.hash.length > 1) {
+	window.location.replace(window.location.pathname + "?" + window.location.hash.substring(1));
+}
+</script>
+</body>
+</html>
+`
+
+// Refresh an access token
+func Refresh(config provider.ProviderConfig, originalToken Token) (token Token, err error) {
+	return RefreshContext(context.Background(), config, originalToken)
+}
+
+// Same as Refresh, the request to the provider is aborted if the context is cancelled
+func RefreshContext(ctx context.Context, config provider.ProviderConfig, originalToken Token) (token Token, err error) {
+	token, _, err = RefreshWithResponse(ctx, config, originalToken)
+	return
+}
+
+// Same as RefreshContext but also return the status and headers of the token endpoint response, see
+// GetAccessTokenWithResponse. The original refresh token is kept when the response doesn't contain a new one
+func RefreshWithResponse(ctx context.Context, config provider.ProviderConfig, originalToken Token) (token Token, meta *ResponseMeta, err error) {
+	queryValues, err := query.Values(refreshTokenRequest{
+		ClientId:     config.Key,
+		ClientSecret: config.Secret,
+		GrantType:    "refresh_token",
+		RefreshToken: originalToken.RefreshToken,
+		Resource:     config.Resource,
+	})
+
 	if err != nil {
 		return
 	}
 
-	values, err := url.ParseQuery(string(body))
+	token, meta, err = requestTokenWithResponse(ctx, config, queryValues)
+	// providers rotating refresh tokens send a new one, the others send none and the current one stays valid
+	if err == nil && token.RefreshToken == "" {
+		token.RefreshToken = originalToken.RefreshToken
+	}
+	return
+}
+
+// Used for token requests when the provider config doesn't have its own client
+var DefaultClient = &http.Client{Timeout: 30 * time.Second}
+
+// Client used to query the token endpoint, enforces certificate pinning if the provider asks for it
+func tokenClient(config provider.ProviderConfig) (*http.Client, error) {
+	client := config.HTTPClient
+	if client == nil {
+		client = DefaultClient
+	}
+
+	if len(config.Provider.PinnedSPKI) > 0 {
+		return pinnedClient(client, config.Provider.PinnedSPKI)
+	}
+
+	return client, nil
+}
+
+// Client used for the other calls made to the provider (revocation, device authorization, JWKS), the one of the
+// provider config or provider.HTTPClient. Certificate pinning applies to them too
+func providerClient(config provider.ProviderConfig) (*http.Client, error) {
+	client := config.Client()
+
+	if len(config.Provider.PinnedSPKI) > 0 {
+		return pinnedClient(client, config.Provider.PinnedSPKI)
+	}
+
+	return client, nil
+}
+
+// Get a token for the application itself using the client credentials grant, there is no user involved so no refresh
+// token either: run the grant again once the token expired
+func ClientCredentials(config provider.ProviderConfig) (token Token, err error) {
+	return ClientCredentialsContext(context.Background(), config)
+}
+
+// Same as ClientCredentials, the request to the provider is aborted if the context is cancelled
+func ClientCredentialsContext(ctx context.Context, config provider.ProviderConfig) (token Token, err error) {
+	queryValues, err := query.Values(clientCredentialsRequest{
+		ClientId:     config.Key,
+		ClientSecret: config.Secret,
+		GrantType:    "client_credentials",
+		Scope:        JoinScopes(config.Scope, config.Provider.ScopeDelimiter),
+		Resource:     config.Resource,
+	})
+
 	if err != nil {
 		return
 	}
 
-	if _, ok := values["error"]; ok == true {
-		err = NewError(values)
+	return requestToken(ctx, config, queryValues)
+}
+
+// Status and headers of a token endpoint response, for the metadata some providers send there (X-RateLimit-*,
+// Retry-After, WWW-Authenticate on failures, ...)
+type ResponseMeta struct {
+	StatusCode int
+	Header     http.Header
+}
+
+// POST the request to the provider's token endpoint and parse the token it returns
+func requestToken(ctx context.Context, config provider.ProviderConfig, queryValues url.Values) (token Token, err error) {
+	token, _, err = requestTokenWithResponse(ctx, config, queryValues)
+	return
+}
+
+// Same as requestToken, the metadata is nil if the provider didn't answer
+func requestTokenWithResponse(ctx context.Context, config provider.ProviderConfig, queryValues url.Values) (token Token, meta *ResponseMeta, err error) {
+	resp, values, err := postFormRetry(ctx, config, config.Provider.AccessURL, queryValues)
+	if resp != nil {
+		meta = &ResponseMeta{StatusCode: resp.StatusCode, Header: resp.Header}
+	}
+	if err != nil {
 		return
 	}
 
 	// everything went A-OK!
 	token, err = parseTokenResponse(config, values)
+	if err != nil {
+		return
+	}
 
+	captureHeaders(config, resp, &token)
 	return
 }
 
-// Refresh an access token
-func Refresh(config provider.ProviderConfig, originalToken Token) (token Token, err error) {
-	queryValues, err := query.Values(refreshTokenRequest{
-		GrantType:    "refresh_token",
-		RefreshToken: token.RefreshToken,
-	})
+// POST an authenticated request to one of the provider's endpoints and decode the response, OAuth2 errors returned by
+// the provider are converted to an Error
+func postForm(ctx context.Context, config provider.ProviderConfig, endpoint string, queryValues url.Values) (resp *http.Response, values url.Values, err error) {
+	resp, values, err = sendForm(ctx, config, endpoint, queryValues)
 
+	// the provider wants a nonce in the DPoP proof, send the request again with the one it gave us
+	if config.DPoP != nil && errors.Is(err, ErrUseDPoPNonce) && resp.Header.Get("DPoP-Nonce") != "" {
+		resp, values, err = sendForm(ctx, config, endpoint, queryValues)
+	}
+
+	return
+}
+
+func sendForm(ctx context.Context, config provider.ProviderConfig, endpoint string, queryValues url.Values) (resp *http.Response, values url.Values, err error) {
+	// move the client credentials to the Authorization header if the provider wants it
+	useBasicAuth := config.Provider.ClientAuthMethod == provider.ClientAuthBasic
+	if useBasicAuth {
+		queryValues.Del("client_id")
+		queryValues.Del("client_secret")
+	}
+
+	// or authenticate with a signed assertion instead of the secret, a new one for every request
+	switch config.Provider.ClientAuthMethod {
+	case provider.ClientAuthPrivateKeyJWT, provider.ClientAuthSecretJWT:
+		if err = setClientAssertion(config, queryValues); err != nil {
+			return
+		}
+	case provider.ClientAuthGeneratedSecret:
+		var secret string
+		if secret, err = ClientAssertion(config); err != nil {
+			return
+		}
+		queryValues.Set("client_secret", secret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(queryValues.Encode()))
 	if err != nil {
 		return
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := http.PostForm(config.Provider.AccessURL, queryValues)
+	if useBasicAuth {
+		// see http://tools.ietf.org/html/rfc6749#section-2.3.1
+		req.SetBasicAuth(url.QueryEscape(config.Key), url.QueryEscape(config.Secret))
+	}
+
+	// bind the tokens to the DPoP key, the other endpoints don't use proofs
+	if config.DPoP != nil && endpoint == config.Provider.AccessURL {
+		proof, err := config.DPoP.Proof("POST", endpoint, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("DPoP", proof)
+	}
+
+	debug(config, "token request sent", "endpoint", endpoint, "params", redactParams(queryValues))
+	client, err := providerClient(config)
+	if endpoint == config.Provider.AccessURL {
+		client, err = tokenClient(config)
+	}
+	if err != nil {
+		return
+	}
+	resp, err = client.Do(req)
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
+	debug(config, "token response received", "endpoint", endpoint, "status", resp.StatusCode)
+
+	if config.DPoP != nil {
+		config.DPoP.SetNonce(endpoint, resp.Header.Get("DPoP-Nonce"))
+	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return
 	}
 
-	values, err := url.ParseQuery(string(body))
+	values, err = decodeTokenResponse(config, resp, body)
 	if err != nil {
-		return
+		debug(config, "token response could not be decoded", "error", err)
 	}
 
-	if _, ok := values["error"]; ok == true {
-		err = NewError(values)
+	// providers should answer errors with a 400 and an OAuth2 error body, use it if there is one
+	if _, ok := values["error"]; err == nil && ok == true {
+		oauthErr := NewError(values)
+		oauthErr.Body = string(body)
+		oauthErr.Status = resp.StatusCode
+		err = oauthErr
 		return
 	}
 
-	// everything went A-OK!
-	token, err = parseTokenResponse(config, values)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: bodySnippet(body)}
+		return
+	}
 
 	return
 }
+
+// how much of an unexpected response body is kept in a StatusError
+const maxBodySnippet = 512
+
+// Returned when the token endpoint answers with a non 2xx status without an OAuth2 error in the body, for example a
+// 500 error page
+type StatusError struct {
+	StatusCode int
+	Status     string
+	// Beginning of the response body, for debugging
+	Body string
+}
+
+func (err StatusError) Error() string {
+	msg := "token endpoint returned " + err.Status
+	if err.Body != "" {
+		msg += ": " + err.Body
+	}
+	return msg
+}
+
+func bodySnippet(body []byte) string {
+	if len(body) > maxBodySnippet {
+		body = body[:maxBodySnippet]
+	}
+	return strings.TrimSpace(errorTextRe.ReplaceAllString(string(body), " "))
+}
+
+// Decode a token endpoint response body, the format is picked from the Content-Type unless the provider forces one.
+// Error bodies looking like a JSON object are decoded as JSON whatever their Content-Type, a lot of providers send
+// their errors as JSON with text/plain or text/html
+func decodeTokenResponse(config provider.ProviderConfig, resp *http.Response, body []byte) (url.Values, error) {
+	format := config.Provider.TokenResponseFormat
+	if format == "" {
+		format = provider.TokenResponseForm
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") ||
+			(resp.StatusCode >= 400 && bytes.HasPrefix(bytes.TrimSpace(body), []byte("{"))) {
+			format = provider.TokenResponseJSON
+		}
+	}
+
+	if format == provider.TokenResponseJSON {
+		return decodeJSONValues(body)
+	}
+
+	return url.ParseQuery(string(body))
+}
+
+// Convert a JSON object to form values so that both formats go through the same parsing, nested objects are flattened
+// using dots in the key (so TokenFields can use "data.access_token") and arrays become multiple values
+func decodeJSONValues(body []byte) (url.Values, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+
+	values := url.Values{}
+	flattenJSON(values, "", object)
+	return values, nil
+}
+
+func flattenJSON(values url.Values, prefix string, object map[string]interface{}) {
+	for key, value := range object {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenJSON(values, prefix+key+".", v)
+		case []interface{}:
+			for _, item := range v {
+				values.Add(prefix+key, fmt.Sprint(item))
+			}
+		case nil:
+		default:
+			values.Set(prefix+key, fmt.Sprint(v))
+		}
+	}
+}
@@ -0,0 +1,727 @@
+package oauth2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/christopherobin/authy/oauth2"
+	"github.com/christopherobin/authy/provider"
+	. "github.com/smartystreets/goconvey/convey"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetAccessToken(t *testing.T) {
+	Convey("Capture configured response headers", t, func() {
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("X-User-Id", "42")
+			rw.Header().Set("X-RateLimit-Remaining", "99")
+			WriteToken(rw)
+		})
+		Reset(server.Close)
+
+		config := MockConfig(server)
+		config.CaptureHeaders = []string{"X-User-Id"}
+
+		token, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+		So(err, ShouldEqual, nil)
+		So(token.Extra, ShouldResemble, map[string]string{"X-User-Id": "42"})
+	})
+
+	Convey("Send whitelisted token parameters", t, func() {
+		var received url.Values
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			received = r.PostForm
+			WriteToken(rw)
+		})
+		Reset(server.Close)
+
+		config := MockConfig(server)
+		config.Provider.CustomTokenParameters = []string{"resource"}
+		config.TokenParameters = map[string]string{
+			"resource":   "https://api.example.com",
+			"grant_type": "password",
+		}
+
+		_, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+		So(err, ShouldEqual, nil)
+		So(received.Get("resource"), ShouldEqual, "https://api.example.com")
+		So(received.Get("grant_type"), ShouldEqual, "authorization_code")
+	})
+}
+
+func TestRedirectURI(t *testing.T) {
+	Convey("An explicit redirect URI is used verbatim", t, func() {
+		var received url.Values
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			received = r.PostForm
+			WriteToken(rw)
+		})
+		Reset(server.Close)
+
+		config := MockConfig(server)
+		config.RedirectURI = "https://example.com/auth/callback"
+
+		authURL, err := oauth2.AuthorizeURL(config, MockCallbackRequest())
+		So(err, ShouldEqual, nil)
+		parsed, _ := url.Parse(authURL)
+		So(parsed.Query().Get("redirect_uri"), ShouldEqual, "https://example.com/auth/callback")
+
+		_, err = oauth2.GetAccessToken(config, MockCallbackRequest())
+		So(err, ShouldEqual, nil)
+		So(received.Get("redirect_uri"), ShouldEqual, "https://example.com/auth/callback")
+	})
+}
+
+func TestLogger(t *testing.T) {
+	Convey("Log the requests made to the provider", t, func() {
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			WriteToken(rw)
+		})
+		Reset(server.Close)
+
+		var output bytes.Buffer
+		config := MockConfig(server)
+		config.Logger = slog.New(slog.NewTextHandler(&output, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+		_, err := oauth2.AuthorizeURL(config, MockCallbackRequest())
+		So(err, ShouldEqual, nil)
+		So(output.String(), ShouldContainSubstring, "authorize URL generated")
+
+		_, err = oauth2.GetAccessToken(config, MockCallbackRequest())
+		So(err, ShouldEqual, nil)
+		So(output.String(), ShouldContainSubstring, "token request sent")
+		So(output.String(), ShouldContainSubstring, "status=200")
+		So(output.String(), ShouldContainSubstring, "client_secret=REDACTED")
+		So(output.String(), ShouldNotContainSubstring, "my-secret")
+	})
+}
+
+func TestTokenString(t *testing.T) {
+	Convey("Printing a token masks the secrets", t, func() {
+		token := oauth2.Token{AccessToken: "supersecretaccesstoken", RefreshToken: "short", Type: "bearer"}
+
+		printed := fmt.Sprintf("%v %+v %#v", token, token, token)
+		So(printed, ShouldNotContainSubstring, "supersecretaccesstoken")
+		So(printed, ShouldNotContainSubstring, "short")
+		So(printed, ShouldContainSubstring, "supe***(22)")
+		So(printed, ShouldContainSubstring, "***(5)")
+	})
+}
+
+func TestTokenFields(t *testing.T) {
+	Convey("Parse a token response using non standard field names", t, func() {
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			values := url.Values{}
+			values.Set("accessToken", "fakeaccesstoken")
+			values.Set("refreshToken", "fakerefreshtoken")
+			values.Set("tokenType", "bearer")
+			rw.Write([]byte(values.Encode()))
+		})
+		Reset(server.Close)
+
+		config := MockConfig(server)
+
+		Convey("Standard field names fail", func() {
+			_, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Provider maps the field names", func() {
+			config.Provider.TokenFields = provider.TokenFields{
+				AccessToken:  "accessToken",
+				RefreshToken: "refreshToken",
+				ExpiresIn:    "expiresIn",
+				TokenType:    "tokenType",
+			}
+
+			token, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(token.AccessToken, ShouldEqual, "fakeaccesstoken")
+			So(token.RefreshToken, ShouldEqual, "fakerefreshtoken")
+			So(token.Type, ShouldEqual, "bearer")
+		})
+	})
+}
+
+func TestScopes(t *testing.T) {
+	Convey("Join and split scopes", t, func() {
+		So(oauth2.JoinScopes(nil, " "), ShouldEqual, "")
+		So(oauth2.JoinScopes([]string{"", " "}, ","), ShouldEqual, "")
+		So(oauth2.JoinScopes([]string{"read", "", "write"}, ","), ShouldEqual, "read,write")
+
+		So(oauth2.SplitScopes("", " "), ShouldBeEmpty)
+		So(oauth2.SplitScopes("", ","), ShouldBeEmpty)
+		So(oauth2.SplitScopes("read  write ", " "), ShouldResemble, []string{"read", "write"})
+		So(oauth2.SplitScopes("read, write,", ","), ShouldResemble, []string{"read", "write"})
+	})
+
+	Convey("Leave the scope out of the authorization URL when there is none", t, func() {
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("access_token=fakeaccesstoken&token_type=bearer&scope="))
+		})
+		Reset(server.Close)
+
+		config := MockConfig(server)
+		config.Scope = []string{""}
+
+		dest, err := oauth2.AuthorizeURL(config, MockCallbackRequest())
+		So(err, ShouldEqual, nil)
+		parsed, _ := url.Parse(dest)
+		_, sent := parsed.Query()["scope"]
+		So(sent, ShouldBeFalse)
+
+		token, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+		So(err, ShouldEqual, nil)
+		So(token.Scope, ShouldBeEmpty)
+	})
+}
+
+func TestResource(t *testing.T) {
+	Convey("Request a token for several resources", t, func() {
+		resources := []string{"https://api.example.com", "https://files.example.com"}
+
+		var receivedResources []string
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			receivedResources = r.PostForm["resource"]
+			WriteToken(rw)
+		})
+		Reset(server.Close)
+
+		config := MockConfig(server)
+		config.Resource = resources
+
+		Convey("Authorize URL contains every resource", func() {
+			authURL, err := oauth2.AuthorizeURL(config, MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+
+			parsedURL, _ := url.Parse(authURL)
+			So(parsedURL.Query()["resource"], ShouldResemble, resources)
+		})
+
+		Convey("Token request contains every resource", func() {
+			_, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(receivedResources, ShouldResemble, resources)
+		})
+
+		Convey("Refresh request contains every resource", func() {
+			_, err := oauth2.Refresh(config, oauth2.Token{RefreshToken: "fakerefreshtoken"})
+			So(err, ShouldEqual, nil)
+			So(receivedResources, ShouldResemble, resources)
+		})
+	})
+}
+
+func TestMissingSubdomain(t *testing.T) {
+	Convey("Authorize URL for a subdomain provider without subdomain", t, func() {
+		config := provider.ProviderConfig{
+			Provider: provider.New("zendesk", "https://[subdomain].zendesk.com/oauth/authorizations/new",
+				"https://[subdomain].zendesk.com/oauth/tokens", provider.WithSubdomain()),
+			Key: "my-key",
+		}
+
+		_, err := oauth2.AuthorizeURL(config, MockCallbackRequest())
+
+		var subdomainErr oauth2.ErrMissingSubdomain
+		So(errors.As(err, &subdomainErr), ShouldBeTrue)
+		So(subdomainErr.Provider, ShouldEqual, "zendesk")
+	})
+}
+
+func TestJSONResponse(t *testing.T) {
+	Convey("Parse JSON token responses", t, func() {
+		contentType := "application/json; charset=utf-8"
+		body := `{"access_token":"fakeaccesstoken","token_type":"bearer","refresh_token":"fakerefreshtoken","expires_in":3600,"scope":"repo,user"}`
+
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", contentType)
+			rw.Write([]byte(body))
+		})
+		Reset(server.Close)
+
+		config := MockConfig(server)
+
+		Convey("Format is detected from the Content-Type", func() {
+			token, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(token.AccessToken, ShouldEqual, "fakeaccesstoken")
+			So(token.Type, ShouldEqual, "bearer")
+			So(token.RefreshToken, ShouldEqual, "fakerefreshtoken")
+			So(token.Scope, ShouldResemble, []string{"repo", "user"})
+		})
+
+		Convey("Scope can be an array", func() {
+			body = `{"access_token":"fakeaccesstoken","token_type":"bearer","scope":["repo","user"]}`
+
+			token, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(token.Scope, ShouldResemble, []string{"repo", "user"})
+		})
+
+		Convey("Nested fields can be mapped", func() {
+			body = `{"data":{"accessToken":"fakeaccesstoken","tokenType":"bearer"}}`
+			config.Provider.TokenFields = provider.TokenFields{
+				AccessToken: "data.accessToken",
+				TokenType:   "data.tokenType",
+			}
+
+			token, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(token.AccessToken, ShouldEqual, "fakeaccesstoken")
+		})
+
+		Convey("Provider can force the format when the Content-Type is wrong", func() {
+			contentType = "text/plain"
+
+			_, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldNotEqual, nil)
+
+			config.Provider.TokenResponseFormat = provider.TokenResponseJSON
+			token, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(token.AccessToken, ShouldEqual, "fakeaccesstoken")
+		})
+	})
+}
+
+func TestExpiresIn(t *testing.T) {
+	Convey("Compute the token expiry date", t, func() {
+		expiresIn := "3600"
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			values := url.Values{}
+			values.Set("access_token", "fakeaccesstoken")
+			values.Set("token_type", "bearer")
+			values.Set("expires_in", expiresIn)
+			rw.Write([]byte(values.Encode()))
+		})
+		Reset(server.Close)
+
+		Convey("Valid expires_in", func() {
+			token, err := oauth2.GetAccessToken(MockConfig(server), MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(token.Expires, ShouldNotBeNil)
+			So(*token.Expires, ShouldHappenWithin, 5*time.Second, time.Now().Add(time.Hour))
+		})
+
+		Convey("Negative expires_in is clamped", func() {
+			expiresIn = "-60"
+
+			token, err := oauth2.GetAccessToken(MockConfig(server), MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(*token.Expires, ShouldHappenWithin, 5*time.Second, time.Now())
+		})
+
+		Convey("Huge expires_in is clamped to a year", func() {
+			expiresIn = "99999999999"
+
+			token, err := oauth2.GetAccessToken(MockConfig(server), MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(token.Expires, ShouldNotBeNil)
+			So(*token.Expires, ShouldHappenWithin, 5*time.Second, time.Now().Add(365*24*time.Hour))
+		})
+
+		Convey("Invalid expires_in is ignored", func() {
+			expiresIn = "soon"
+
+			token, err := oauth2.GetAccessToken(MockConfig(server), MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(token.Expires, ShouldBeNil)
+		})
+	})
+}
+
+func TestRefresh(t *testing.T) {
+	Convey("Refresh a token", t, func() {
+		// echoes back the refresh token it received as the new access token
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			values := url.Values{}
+			values.Set("access_token", "refreshed-with-"+r.PostForm.Get("refresh_token"))
+			values.Set("token_type", "bearer")
+			rw.Write([]byte(values.Encode()))
+		})
+		Reset(server.Close)
+
+		token, err := oauth2.Refresh(MockConfig(server), oauth2.Token{
+			AccessToken:  "fakeaccesstoken",
+			RefreshToken: "fakerefreshtoken",
+		})
+		So(err, ShouldEqual, nil)
+		So(token.AccessToken, ShouldEqual, "refreshed-with-fakerefreshtoken")
+		// no new refresh token in the response, the current one is kept
+		So(token.RefreshToken, ShouldEqual, "fakerefreshtoken")
+	})
+
+	Convey("Refresh a token on a provider rotating refresh tokens", t, func() {
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			values := url.Values{}
+			values.Set("access_token", "fakeaccesstoken")
+			values.Set("refresh_token", "rotated-"+r.PostForm.Get("refresh_token"))
+			values.Set("token_type", "bearer")
+			rw.Write([]byte(values.Encode()))
+		})
+		Reset(server.Close)
+
+		token, err := oauth2.Refresh(MockConfig(server), oauth2.Token{RefreshToken: "fakerefreshtoken"})
+		So(err, ShouldEqual, nil)
+		So(token.RefreshToken, ShouldEqual, "rotated-fakerefreshtoken")
+
+		token, err = oauth2.Refresh(MockConfig(server), token)
+		So(err, ShouldEqual, nil)
+		So(token.RefreshToken, ShouldEqual, "rotated-rotated-fakerefreshtoken")
+	})
+
+	Convey("Refresh requests carry the client credentials", t, func() {
+		var received url.Values
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			received = r.PostForm
+			WriteToken(rw)
+		})
+		Reset(server.Close)
+
+		_, err := oauth2.Refresh(MockConfig(server), oauth2.Token{RefreshToken: "fakerefreshtoken"})
+		So(err, ShouldEqual, nil)
+		So(received.Get("client_id"), ShouldEqual, "my-key")
+		So(received.Get("client_secret"), ShouldEqual, "my-secret")
+		So(received.Get("grant_type"), ShouldEqual, "refresh_token")
+	})
+}
+
+func TestClientAuthMethod(t *testing.T) {
+	Convey("Authenticate on the token endpoint", t, func() {
+		var received url.Values
+		var username, password string
+		var hasBasicAuth bool
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			received = r.PostForm
+			username, password, hasBasicAuth = r.BasicAuth()
+			WriteToken(rw)
+		})
+		Reset(server.Close)
+
+		config := MockConfig(server)
+
+		Convey("Credentials are in the body by default", func() {
+			_, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(hasBasicAuth, ShouldBeFalse)
+			So(received.Get("client_secret"), ShouldEqual, "my-secret")
+		})
+
+		Convey("Credentials use HTTP Basic", func() {
+			config.Provider.ClientAuthMethod = provider.ClientAuthBasic
+
+			_, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(hasBasicAuth, ShouldBeTrue)
+			So(username, ShouldEqual, "my-key")
+			So(password, ShouldEqual, "my-secret")
+			So(received, ShouldNotContainKey, "client_id")
+			So(received, ShouldNotContainKey, "client_secret")
+
+			Convey("Refresh too", func() {
+				_, err := oauth2.Refresh(config, oauth2.Token{RefreshToken: "fakerefreshtoken"})
+				So(err, ShouldEqual, nil)
+				So(hasBasicAuth, ShouldBeTrue)
+				So(received, ShouldNotContainKey, "client_secret")
+			})
+		})
+	})
+}
+
+func TestContext(t *testing.T) {
+	Convey("Token requests honor the context", t, func() {
+		release := make(chan struct{})
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			// hang until the test is over
+			<-release
+			WriteToken(rw)
+		})
+		Reset(func() {
+			close(release)
+			server.Close()
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		Reset(cancel)
+
+		Convey("Access token", func() {
+			_, err := oauth2.GetAccessTokenContext(ctx, MockConfig(server), MockCallbackRequest())
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		})
+
+		Convey("Refresh", func() {
+			_, err := oauth2.RefreshContext(ctx, MockConfig(server), oauth2.Token{RefreshToken: "fakerefreshtoken"})
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		})
+	})
+}
+
+func TestHTTPClient(t *testing.T) {
+	Convey("Use the client from the provider config", t, func() {
+		var requestedURL string
+		config := provider.ProviderConfig{
+			Provider: provider.New("mock", "https://example.com/authorize", "https://example.com/token"),
+			Key:      "my-key",
+			HTTPClient: &http.Client{
+				Transport: RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					requestedURL = r.URL.String()
+					rw := httptest.NewRecorder()
+					WriteToken(rw)
+					return rw.Result(), nil
+				}),
+			},
+		}
+
+		token, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+		So(err, ShouldEqual, nil)
+		So(token.AccessToken, ShouldEqual, "fakeaccesstoken")
+		So(requestedURL, ShouldEqual, "https://example.com/token")
+	})
+}
+
+func TestErrorCodes(t *testing.T) {
+	Convey("Match provider errors with errors.Is", t, func() {
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("error=invalid_grant&error_description=The+code+has+expired"))
+		})
+		Reset(server.Close)
+
+		_, err := oauth2.GetAccessToken(MockConfig(server), MockCallbackRequest())
+		So(errors.Is(err, oauth2.ErrInvalidGrant), ShouldBeTrue)
+		So(errors.Is(err, oauth2.ErrAccessDenied), ShouldBeFalse)
+
+		Convey("Wrapped errors still match", func() {
+			wrapped := fmt.Errorf("login failed: %w", err)
+			So(errors.Is(wrapped, oauth2.ErrInvalidGrant), ShouldBeTrue)
+		})
+
+		Convey("Bearer token errors", func() {
+			So(errors.Is(oauth2.Error{Code: "invalid_token"}, oauth2.ErrInvalidToken), ShouldBeTrue)
+			So(errors.Is(err, oauth2.ErrInvalidToken), ShouldBeFalse)
+		})
+	})
+}
+
+func TestStatusError(t *testing.T) {
+	Convey("Report unexpected statuses from the token endpoint", t, func() {
+		Convey("Server error with an HTML body", func() {
+			server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set("Content-Type", "text/html")
+				rw.WriteHeader(http.StatusInternalServerError)
+				rw.Write([]byte("<html><body>Something went wrong</body></html>"))
+			})
+			Reset(server.Close)
+
+			_, err := oauth2.GetAccessToken(MockConfig(server), MockCallbackRequest())
+
+			var statusErr oauth2.StatusError
+			So(errors.As(err, &statusErr), ShouldBeTrue)
+			So(statusErr.StatusCode, ShouldEqual, http.StatusInternalServerError)
+			So(err.Error(), ShouldContainSubstring, "500 Internal Server Error")
+			So(err.Error(), ShouldContainSubstring, "Something went wrong")
+		})
+
+		Convey("Long bodies are truncated", func() {
+			server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+				rw.WriteHeader(http.StatusBadGateway)
+				rw.Write([]byte(strings.Repeat("a", 4096)))
+			})
+			Reset(server.Close)
+
+			_, err := oauth2.GetAccessToken(MockConfig(server), MockCallbackRequest())
+
+			var statusErr oauth2.StatusError
+			So(errors.As(err, &statusErr), ShouldBeTrue)
+			So(len(statusErr.Body), ShouldBeLessThan, 4096)
+		})
+
+		Convey("OAuth2 errors are still parsed", func() {
+			server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set("Content-Type", "application/json")
+				rw.WriteHeader(http.StatusBadRequest)
+				rw.Write([]byte(`{"error":"invalid_client"}`))
+			})
+			Reset(server.Close)
+
+			_, err := oauth2.GetAccessToken(MockConfig(server), MockCallbackRequest())
+			So(errors.Is(err, oauth2.ErrInvalidClient), ShouldBeTrue)
+		})
+
+		Convey("JSON errors sent with another Content-Type", func() {
+			body := `{"error":"invalid_grant","error_description":"Bad code","error_uri":"https://example.com/errors"}`
+			server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set("Content-Type", "text/plain")
+				rw.WriteHeader(http.StatusBadRequest)
+				rw.Write([]byte(body))
+			})
+			Reset(server.Close)
+
+			_, err := oauth2.GetAccessToken(MockConfig(server), MockCallbackRequest())
+
+			var oauthErr oauth2.Error
+			So(errors.As(err, &oauthErr), ShouldBeTrue)
+			So(oauthErr.Code, ShouldEqual, oauth2.CodeInvalidGrant)
+			So(oauthErr.Description, ShouldEqual, "Bad code")
+			So(oauthErr.URI, ShouldEqual, "https://example.com/errors")
+			So(oauthErr.Body, ShouldEqual, body)
+			So(oauthErr.Status, ShouldEqual, http.StatusBadRequest)
+			So(err.Error(), ShouldEqual, "invalid_grant: Bad code (see https://example.com/errors) [HTTP 400]")
+		})
+
+		Convey("The status tells invalid_client errors apart", func() {
+			server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set("Content-Type", "application/json")
+				rw.WriteHeader(http.StatusUnauthorized)
+				rw.Write([]byte(`{"error":"invalid_client"}`))
+			})
+			Reset(server.Close)
+
+			config := MockConfig(server)
+			_, err := oauth2.Refresh(config, oauth2.Token{RefreshToken: "fakerefreshtoken"})
+
+			var oauthErr oauth2.Error
+			So(errors.As(err, &oauthErr), ShouldBeTrue)
+			So(oauthErr.Status, ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+}
+
+func TestResponseMeta(t *testing.T) {
+	Convey("Return the status and headers of the token endpoint response", t, func() {
+		failing := false
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("X-RateLimit-Remaining", "41")
+			if failing {
+				rw.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+				rw.Header().Set("Content-Type", "application/json")
+				rw.WriteHeader(http.StatusUnauthorized)
+				rw.Write([]byte(`{"error":"invalid_client"}`))
+				return
+			}
+			rw.Write([]byte("access_token=fakeaccesstoken&token_type=bearer&refresh_token=fakerefreshtoken"))
+		})
+		Reset(server.Close)
+
+		token, meta, err := oauth2.GetAccessTokenWithResponse(context.Background(), MockConfig(server), MockCallbackRequest())
+		So(err, ShouldEqual, nil)
+		So(token.AccessToken, ShouldEqual, "fakeaccesstoken")
+		So(meta.StatusCode, ShouldEqual, http.StatusOK)
+		So(meta.Header.Get("X-RateLimit-Remaining"), ShouldEqual, "41")
+
+		Convey("On failures too", func() {
+			failing = true
+
+			_, meta, err := oauth2.RefreshWithResponse(context.Background(), MockConfig(server), token)
+			So(errors.Is(err, oauth2.ErrInvalidClient), ShouldBeTrue)
+			So(meta.StatusCode, ShouldEqual, http.StatusUnauthorized)
+			So(meta.Header.Get("WWW-Authenticate"), ShouldEqual, `Basic realm="token"`)
+		})
+
+		Convey("Not when the provider is unreachable", func() {
+			server.Close()
+
+			_, meta, err := oauth2.GetAccessTokenWithResponse(context.Background(), MockConfig(server), MockCallbackRequest())
+			So(err, ShouldNotEqual, nil)
+			So(meta, ShouldBeNil)
+		})
+	})
+}
+
+func TestImplicit(t *testing.T) {
+	Convey("Use the implicit flow", t, func() {
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {})
+		Reset(server.Close)
+
+		config := MockConfig(server)
+		config.Provider.ResponseType = provider.ResponseTypeToken
+
+		authorizeURL, err := oauth2.AuthorizeURL(config, MockCallbackRequest())
+		So(err, ShouldEqual, nil)
+		parsedURL, _ := url.Parse(authorizeURL)
+		So(parsedURL.Query().Get("response_type"), ShouldEqual, "token")
+
+		Convey("Token forwarded from the fragment", func() {
+			callback, _ := http.NewRequest("GET", "http://localhost:2000/authy/mock/callback?access_token=fakeaccesstoken&token_type=bearer&expires_in=3600&state=abc", nil)
+			token, err := oauth2.ParseImplicitResponse(config, callback)
+			So(err, ShouldEqual, nil)
+			So(token.AccessToken, ShouldEqual, "fakeaccesstoken")
+			So(token.Expires, ShouldNotBeNil)
+		})
+
+		Convey("Error forwarded from the fragment", func() {
+			callback, _ := http.NewRequest("GET", "http://localhost:2000/authy/mock/callback?error=access_denied&state=abc", nil)
+			_, err := oauth2.ParseImplicitResponse(config, callback)
+			So(errors.Is(err, oauth2.ErrAccessDenied), ShouldBeTrue)
+		})
+	})
+}
+
+func TestCallbackParams(t *testing.T) {
+	Convey("Read the callback parameters from the query string or the POSTed form", t, func() {
+		config := provider.ProviderConfig{Provider: provider.New("mock", "https://example.com/authorize", "https://example.com/token")}
+
+		get := httptest.NewRequest("GET", "http://localhost:2000/authy/mock/callback?code=from_query&state=abc", nil)
+		So(oauth2.CallbackParams(config, get).Get("code"), ShouldEqual, "from_query")
+
+		post := httptest.NewRequest("POST", "http://localhost:2000/authy/mock/callback?code=from_query",
+			strings.NewReader("code=from_body&state=abc"))
+		post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		params := oauth2.CallbackParams(config, post)
+		So(params.Get("code"), ShouldEqual, "from_body")
+		So(params.Get("state"), ShouldEqual, "abc")
+	})
+}
+
+func TestRand(t *testing.T) {
+	Convey("Generate predictable values with a custom random source", t, func() {
+		random := bytes.NewReader(bytes.Repeat([]byte{0xab}, 64))
+		state, err := oauth2.NewStateFrom(random, oauth2.DefaultStateLength)
+		So(err, ShouldEqual, nil)
+		So(state, ShouldEqual, strings.Repeat("ab", 16))
+
+		nonce, err := oauth2.NewNonceFrom(random, oauth2.DefaultStateLength)
+		So(err, ShouldEqual, nil)
+		So(nonce, ShouldEqual, strings.Repeat("ab", 16))
+
+		Convey("Longer values", func() {
+			state, err := oauth2.NewStateFrom(random, 32)
+			So(err, ShouldEqual, nil)
+			So(state, ShouldEqual, strings.Repeat("ab", 32))
+
+			// crypto/rand by default
+			state, err = oauth2.NewStateN(32)
+			So(err, ShouldEqual, nil)
+			So(state, ShouldNotEqual, strings.Repeat("ab", 32))
+			So(state, ShouldHaveLength, 64)
+		})
+
+		Convey("Too short values are rejected", func() {
+			_, err := oauth2.NewStateN(oauth2.MinStateLength - 1)
+			So(err, ShouldNotEqual, nil)
+			_, err = oauth2.NewNonceN(4)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Failures of the source are returned", func() {
+			// the 32 bytes left are not enough for two verifiers
+			_, err := oauth2.NewCodeVerifierFrom(random)
+			So(err, ShouldEqual, nil)
+			_, err = oauth2.NewCodeVerifierFrom(random)
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
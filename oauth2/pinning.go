@@ -0,0 +1,90 @@
+package oauth2
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Returned when the provider presented a certificate chain without any of the pinned keys
+var ErrPinMismatch = errors.New("provider certificate doesn't match any pinned key")
+
+// Returned when certificate pinning is asked for on a client whose transport isn't an *http.Transport, only those
+// expose the TLS handshake
+var ErrPinningUnsupported = errors.New("certificate pinning requires an *http.Transport")
+
+type pinnedTransportKey struct {
+	transport *http.Transport
+	pins      string
+}
+
+// pinned copies of the transports, built once so that they keep their connection pool
+var pinnedTransports = struct {
+	sync.Mutex
+	transports map[pinnedTransportKey]*http.Transport
+}{transports: map[pinnedTransportKey]*http.Transport{}}
+
+// Wrap the client's transport so that it checks the pinned keys
+func pinnedClient(client *http.Client, pins []string) (*http.Client, error) {
+	baseTransport := client.Transport
+	if baseTransport == nil {
+		baseTransport = http.DefaultTransport
+	}
+
+	httpTransport, ok := baseTransport.(*http.Transport)
+	if ok != true {
+		return nil, fmt.Errorf("%w, got %T", ErrPinningUnsupported, baseTransport)
+	}
+
+	pinned := *client
+	pinned.Transport = pinnedTransport(httpTransport, pins)
+	return &pinned, nil
+}
+
+func pinnedTransport(base *http.Transport, pins []string) *http.Transport {
+	key := pinnedTransportKey{transport: base, pins: strings.Join(pins, ",")}
+
+	pinnedTransports.Lock()
+	defer pinnedTransports.Unlock()
+
+	if transport, ok := pinnedTransports.transports[key]; ok == true {
+		return transport
+	}
+
+	transport := base.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.VerifyConnection = verifyPins(pins, transport.TLSClientConfig.VerifyConnection)
+	pinnedTransports.transports[key] = transport
+	return transport
+}
+
+// Check that at least one certificate in the chain has a pinned public key, the chain itself is still verified as usual
+// and the VerifyConnection of the base transport, if any, runs first
+func verifyPins(pins []string, previous func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if previous != nil {
+			if err := previous(state); err != nil {
+				return err
+			}
+		}
+
+		for _, cert := range state.PeerCertificates {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			hash := base64.StdEncoding.EncodeToString(sum[:])
+			for _, pin := range pins {
+				if pin == hash {
+					return nil
+				}
+			}
+		}
+
+		return fmt.Errorf("%w (%s)", ErrPinMismatch, state.ServerName)
+	}
+}
@@ -0,0 +1,90 @@
+package oauth2_test
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"github.com/christopherobin/authy/oauth2"
+	. "github.com/smartystreets/goconvey/convey"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPinning(t *testing.T) {
+	Convey("Pin the token endpoint certificate", t, func() {
+		var connections int32
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			WriteToken(rw)
+		}))
+		server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&connections, 1)
+			}
+		}
+		server.StartTLS()
+		Reset(server.Close)
+
+		sum := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+		config := MockConfig(server)
+		// trust the test certificate
+		config.HTTPClient = server.Client()
+
+		Convey("Matching pin", func() {
+			config.Provider.PinnedSPKI = []string{base64.StdEncoding.EncodeToString(sum[:])}
+
+			token, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(token.AccessToken, ShouldEqual, "fakeaccesstoken")
+
+			// the pinned transport is kept with its connections
+			_, err = oauth2.Refresh(config, token)
+			So(err, ShouldEqual, nil)
+			So(atomic.LoadInt32(&connections), ShouldEqual, 1)
+		})
+
+		Convey("Pin mismatch", func() {
+			otherSum := sha256.Sum256([]byte("some other key"))
+			config.Provider.PinnedSPKI = []string{base64.StdEncoding.EncodeToString(otherSum[:])}
+
+			_, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(errors.Is(err, oauth2.ErrPinMismatch), ShouldBeTrue)
+
+			// the other endpoints of the provider are pinned too
+			config.Provider.RevokeURL = server.URL + "/revoke"
+			err = oauth2.Revoke(config, "fakeaccesstoken", "")
+			So(errors.Is(err, oauth2.ErrPinMismatch), ShouldBeTrue)
+
+			config.Provider.JWKSURL = server.URL + "/jwks"
+			header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"pinned"}`))
+			_, err = oauth2.VerifyIDToken(config, header+".e30.c2ln")
+			So(errors.Is(err, oauth2.ErrPinMismatch), ShouldBeTrue)
+		})
+
+		Convey("The checks of the base transport still run", func() {
+			config.Provider.PinnedSPKI = []string{base64.StdEncoding.EncodeToString(sum[:])}
+			transport := server.Client().Transport.(*http.Transport).Clone()
+			transport.TLSClientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+				return errors.New("connection refused by the base transport")
+			}
+			config.HTTPClient = &http.Client{Transport: transport}
+
+			_, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "refused by the base transport")
+		})
+
+		Convey("Transports that can't be pinned are rejected", func() {
+			config.Provider.PinnedSPKI = []string{base64.StdEncoding.EncodeToString(sum[:])}
+			config.HTTPClient = &http.Client{Transport: RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				return server.Client().Transport.RoundTrip(r)
+			})}
+
+			_, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(errors.Is(err, oauth2.ErrPinningUnsupported), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,111 @@
+package oauth2
+
+import (
+	"context"
+	"errors"
+	"github.com/christopherobin/authy/provider"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// defaults of provider.RetryPolicy
+const (
+	defaultRetryBackoff    = time.Second
+	defaultRetryMaxBackoff = 30 * time.Second
+)
+
+// Same as postForm but transient failures are retried according to the retry policy of the provider config
+func postFormRetry(ctx context.Context, config provider.ProviderConfig, endpoint string, queryValues url.Values) (resp *http.Response, values url.Values, err error) {
+	policy := config.Retry
+
+	for attempt := 1; ; attempt++ {
+		resp, values, err = postForm(ctx, config, endpoint, queryValues)
+		if policy == nil || attempt >= policy.MaxAttempts || !shouldRetry(ctx, resp, err) {
+			return
+		}
+
+		delay := retryDelay(policy, attempt, resp)
+		debug(config, "retrying token request", "endpoint", endpoint, "attempt", attempt, "delay", delay, "error", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			err = ctx.Err()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Only network errors, 5xx responses and slow_down are worth trying again
+func shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+
+	if errors.Is(err, ErrSlowDown) {
+		return true
+	}
+
+	// the provider answered
+	if resp != nil {
+		return resp.StatusCode >= 500
+	}
+
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// Exponential backoff unless the provider told us how long to wait with Retry-After
+func retryDelay(policy *provider.RetryPolicy, attempt int, resp *http.Response) time.Duration {
+	maxBackoff := policy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+
+	delay := policy.Backoff
+	if delay <= 0 {
+		delay = defaultRetryBackoff
+	}
+	for i := 1; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+
+	if resp != nil {
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok == true {
+			delay = retryAfter
+		}
+	}
+
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// Retry-After is either a number of seconds or an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 32); err == nil {
+		if seconds < 0 {
+			seconds = 0
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+
+	return 0, false
+}
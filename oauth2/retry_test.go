@@ -0,0 +1,86 @@
+package oauth2_test
+
+import (
+	"errors"
+	"github.com/christopherobin/authy/oauth2"
+	"github.com/christopherobin/authy/provider"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	Convey("Retry transient token endpoint failures", t, func() {
+		var attempts int32
+		var failures int32
+		var failure func(rw http.ResponseWriter)
+		server := MockTokenServer(func(rw http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&attempts, 1) <= atomic.LoadInt32(&failures) {
+				failure(rw)
+				return
+			}
+			WriteToken(rw)
+		})
+		Reset(server.Close)
+
+		unavailable := func(rw http.ResponseWriter) {
+			rw.Header().Set("Retry-After", "0")
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		config := MockConfig(server)
+		config.Retry = &provider.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+
+		Convey("Succeed once the provider is back", func() {
+			failures, failure = 2, unavailable
+
+			token, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldEqual, nil)
+			So(token.AccessToken, ShouldEqual, "fakeaccesstoken")
+			So(attempts, ShouldEqual, 3)
+		})
+
+		Convey("Give up after the last attempt", func() {
+			failures, failure = 5, unavailable
+
+			_, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			var statusErr oauth2.StatusError
+			So(errors.As(err, &statusErr), ShouldBeTrue)
+			So(statusErr.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+			So(attempts, ShouldEqual, 3)
+		})
+
+		Convey("Retry slow_down", func() {
+			failures, failure = 1, func(rw http.ResponseWriter) {
+				rw.WriteHeader(http.StatusBadRequest)
+				rw.Write([]byte("error=slow_down"))
+			}
+
+			_, err := oauth2.Refresh(config, oauth2.Token{RefreshToken: "fakerefreshtoken"})
+			So(err, ShouldEqual, nil)
+			So(attempts, ShouldEqual, 2)
+		})
+
+		Convey("Don't retry client errors", func() {
+			failures, failure = 1, func(rw http.ResponseWriter) {
+				rw.WriteHeader(http.StatusBadRequest)
+				rw.Write([]byte("error=invalid_grant"))
+			}
+
+			_, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(errors.Is(err, oauth2.ErrInvalidGrant), ShouldBeTrue)
+			So(attempts, ShouldEqual, 1)
+		})
+
+		Convey("Don't retry without a policy", func() {
+			failures, failure = 1, unavailable
+			config.Retry = nil
+
+			_, err := oauth2.GetAccessToken(config, MockCallbackRequest())
+			So(err, ShouldNotEqual, nil)
+			So(attempts, ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,52 @@
+package oauth2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/christopherobin/authy/provider"
+	"github.com/google/go-querystring/query"
+)
+
+// Token type hints of the revocation request (http://tools.ietf.org/html/rfc7009#section-2.1)
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+type revocationRequest struct {
+	ClientId      string `url:"client_id"`
+	ClientSecret  string `url:"client_secret"`
+	Token         string `url:"token"`
+	TokenTypeHint string `url:"token_type_hint,omitempty"`
+}
+
+// Revoke a token on the provider's RevokeURL (RFC 7009), tokenTypeHint is optional. Revoking a token that is already
+// invalid is not an error
+func Revoke(config provider.ProviderConfig, token string, tokenTypeHint string) error {
+	return RevokeContext(context.Background(), config, token, tokenTypeHint)
+}
+
+// Same as Revoke, the request to the provider is aborted if the context is cancelled
+func RevokeContext(ctx context.Context, config provider.ProviderConfig, token string, tokenTypeHint string) error {
+	if config.Provider.RevokeURL == "" {
+		return errors.New(fmt.Sprintf("provider %s has no revocation endpoint", config.Provider.Name))
+	}
+
+	queryValues, err := query.Values(revocationRequest{
+		ClientId:      config.Key,
+		ClientSecret:  config.Secret,
+		Token:         token,
+		TokenTypeHint: tokenTypeHint,
+	})
+	if err != nil {
+		return err
+	}
+
+	// the body of successful revocations doesn't matter, most providers send an empty one
+	resp, _, err := postForm(ctx, config, config.Provider.RevokeURL, queryValues)
+	if resp != nil && resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	return err
+}
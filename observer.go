@@ -0,0 +1,63 @@
+package authy
+
+import (
+	"time"
+)
+
+// Kind of request made to a provider, see Observer
+type Operation string
+
+const (
+	// authorization code (or OAuth1 verifier) exchanged for a token on the callback
+	OperationExchange Operation = "exchange"
+	OperationRefresh  Operation = "refresh"
+	// token of the application itself, see AuthorizeClient
+	OperationClientCredentials Operation = "client_credentials"
+	OperationRevoke            Operation = "revoke"
+	OperationUserInfo          Operation = "user_info"
+	// request sent with Token.Client or a TokenTransport, Err is only set when no response came back
+	OperationAPI Operation = "api"
+)
+
+// Outcome of a request made to a provider
+type Observation struct {
+	Provider  string
+	Operation Operation
+	Duration  time.Duration
+	// nil if the request succeeded
+	Err error
+}
+
+// Receives an Observation after every request made to a provider, use it to feed metrics (refresh rate, latency of
+// the token exchanges, failures, ...). Called synchronously, implementations should not block
+type Observer interface {
+	Observe(observation Observation)
+}
+
+// Adapter to use a function as an Observer
+type ObserverFunc func(observation Observation)
+
+func (f ObserverFunc) Observe(observation Observation) {
+	f(observation)
+}
+
+func ignoreObservation(error) {}
+
+// Start observing a request, call the returned function with its error once it's done. Costs nothing without an
+// observer
+func (a Authy) observe(providerName string, operation Operation) func(err error) {
+	observer := a.config.Observer
+	if observer == nil {
+		return ignoreObservation
+	}
+
+	start := time.Now()
+	return func(err error) {
+		observer.Observe(Observation{
+			Provider:  providerName,
+			Operation: operation,
+			Duration:  time.Since(start),
+			Err:       err,
+		})
+	}
+}
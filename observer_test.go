@@ -0,0 +1,116 @@
+package authy_test
+
+import (
+	"errors"
+	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/authytest"
+	"github.com/christopherobin/authy/oauth2"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestObserver(t *testing.T) {
+	Convey("Report the requests made to the providers", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		var observations []authy.Observation
+		config := MockConfig("observed", server.URL+"/oauth2", server.URL+"/oauth2/offline")
+		config.Observer = authy.ObserverFunc(func(observation authy.Observation) {
+			observations = append(observations, observation)
+		})
+		a, err := authy.NewAuthy(config)
+		So(err, ShouldEqual, nil)
+
+		token, _, err := MockLogin(a, "observed", authytest.NewSession())
+		So(err, ShouldEqual, nil)
+		So(len(observations), ShouldEqual, 1)
+		So(observations[0].Provider, ShouldEqual, "observed")
+		So(observations[0].Operation, ShouldEqual, authy.OperationExchange)
+		So(observations[0].Duration, ShouldBeGreaterThan, 0)
+		So(observations[0].Err, ShouldEqual, nil)
+
+		Convey("Refreshes", func() {
+			So(token.Refresh(), ShouldEqual, nil)
+			So(len(observations), ShouldEqual, 2)
+			So(observations[1].Operation, ShouldEqual, authy.OperationRefresh)
+			So(observations[1].Err, ShouldEqual, nil)
+		})
+
+		Convey("Failed calls carry their error", func() {
+			_, err := token.UserInfoFrom(server.URL + "/missing")
+			So(err, ShouldNotEqual, nil)
+			So(len(observations), ShouldEqual, 2)
+			So(observations[1].Operation, ShouldEqual, authy.OperationUserInfo)
+			So(observations[1].Err, ShouldEqual, err)
+		})
+
+		Convey("Requests sent with the token", func() {
+			resp, err := token.Client().Get(server.URL + "/api")
+			So(err, ShouldEqual, nil)
+			resp.Body.Close()
+			So(len(observations), ShouldEqual, 2)
+			So(observations[1].Provider, ShouldEqual, "observed")
+			So(observations[1].Operation, ShouldEqual, authy.OperationAPI)
+			So(observations[1].Err, ShouldEqual, nil)
+
+			server.Close()
+			_, err = token.Client().Get(server.URL + "/api")
+			So(err, ShouldNotEqual, nil)
+			So(len(observations), ShouldEqual, 3)
+			So(observations[2].Err, ShouldNotEqual, nil)
+		})
+
+		Convey("Requests sent with a DPoP bound token, the nonce retry included", func() {
+			var requests int
+			api := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests == 1 {
+					rw.Header().Set("DPoP-Nonce", "api-nonce")
+					rw.Header().Set("WWW-Authenticate", `DPoP error="use_dpop_nonce"`)
+					rw.WriteHeader(http.StatusUnauthorized)
+				}
+			}))
+			Reset(api.Close)
+
+			key, err := oauth2.NewDPoPKey()
+			So(err, ShouldEqual, nil)
+			token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"observed","value":"abc","type":"DPoP"}`))
+			So(err, ShouldEqual, nil)
+
+			resp, err := token.DPoPClient(key).Get(api.URL + "/api")
+			So(err, ShouldEqual, nil)
+			resp.Body.Close()
+			So(requests, ShouldEqual, 2)
+			So(len(observations), ShouldEqual, 2)
+			So(observations[1].Operation, ShouldEqual, authy.OperationAPI)
+			So(observations[1].Err, ShouldEqual, nil)
+		})
+
+		Convey("Client credentials", func() {
+			_, err := a.AuthorizeClient("observed")
+			So(err, ShouldEqual, nil)
+			So(observations[1].Operation, ShouldEqual, authy.OperationClientCredentials)
+		})
+	})
+
+	Convey("Failed token exchanges are reported", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		var observations []authy.Observation
+		config := MockConfig("observed", server.URL+"/oauth2", server.URL+"/oauth2/revoked")
+		config.Observer = authy.ObserverFunc(func(observation authy.Observation) {
+			observations = append(observations, observation)
+		})
+		a, err := authy.NewAuthy(config)
+		So(err, ShouldEqual, nil)
+
+		_, _, err = MockLogin(a, "observed", authytest.NewSession())
+		So(err, ShouldNotEqual, nil)
+		So(len(observations), ShouldEqual, 1)
+		So(errors.Is(observations[0].Err, err), ShouldBeTrue)
+	})
+}
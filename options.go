@@ -0,0 +1,70 @@
+package authy
+
+import (
+	"net/http"
+)
+
+// Optional settings for a single call to Authorize
+type AuthorizeOption func(*authorizeOptions)
+
+type authorizeOptions struct {
+	scopeDelimiter string
+	scope          []string
+	returnTo       string
+	params         map[string]string
+}
+
+// Join the requested scopes with the given delimiter instead of the one from the provider definition, this is mostly
+// an escape hatch to debug providers that changed their behavior without having to edit the provider itself
+func WithScopeDelimiter(delimiter string) AuthorizeOption {
+	return func(o *authorizeOptions) {
+		o.scopeDelimiter = delimiter
+	}
+}
+
+// Request these scopes instead of the configured ones, useful for incremental authorization. The requested scopes are
+// kept with the state so Access reports them if the provider doesn't
+func WithScopes(scopes ...string) AuthorizeOption {
+	return func(o *authorizeOptions) {
+		o.scope = scopes
+	}
+}
+
+// Send the user back to this path once logged in instead of the configured callback, Access returns it as the redirect
+// URL. The path travels in the state parameter, signed so that it cannot be changed on the way, and must be local to
+// the application (/profile?tab=keys)
+func WithReturnTo(path string) AuthorizeOption {
+	return func(o *authorizeOptions) {
+		o.returnTo = path
+	}
+}
+
+// Return path set by the next query parameter of a login route, LoginRequired of the middlewares sends anonymous users
+// there with the page they asked for. Returns no option when the parameter is missing
+func ReturnTo(r *http.Request) []AuthorizeOption {
+	if next := r.URL.Query().Get("next"); next != "" {
+		return []AuthorizeOption{WithReturnTo(next)}
+	}
+	return nil
+}
+
+// Add these parameters to the authorization URL on top of the configured custom parameters (login_hint, prompt, ...),
+// only the parameters whitelisted by the provider are accepted
+func WithParams(params map[string]string) AuthorizeOption {
+	return func(o *authorizeOptions) {
+		if o.params == nil {
+			o.params = map[string]string{}
+		}
+		for name, value := range params {
+			o.params[name] = value
+		}
+	}
+}
+
+func newAuthorizeOptions(opts []AuthorizeOption) authorizeOptions {
+	var options authorizeOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
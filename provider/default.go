@@ -22,6 +22,21 @@ var defaultProviders = map[string]Provider{
 		OAuth:          2,
 		ScopeDelimiter: " ",
 	},
+	"apple": Provider{
+		Name:                "apple",
+		AuthorizeURL:        "https://appleid.apple.com/auth/authorize",
+		AccessURL:           "https://appleid.apple.com/auth/token",
+		Issuer:              "https://appleid.apple.com",
+		JWKSURL:             "https://appleid.apple.com/auth/keys",
+		RevokeURL:           "https://appleid.apple.com/auth/revoke",
+		OAuth:               2,
+		ScopeDelimiter:      " ",
+		KnownScopes:         []string{"name", "email", "openid"},
+		TokenResponseFormat: TokenResponseJSON,
+		ClientAuthMethod:    ClientAuthGeneratedSecret,
+		AssertionAudience:   "https://appleid.apple.com",
+		ResponseMode:        ResponseModeFormPost,
+	},
 	"appnet": Provider{
 		Name:           "appnet",
 		AuthorizeURL:   "https://account.app.net/oauth/authenticate",
@@ -118,6 +133,16 @@ var defaultProviders = map[string]Provider{
 		OAuth:          2,
 		ScopeDelimiter: " ",
 	},
+	"discord": Provider{
+		Name:                "discord",
+		AuthorizeURL:        "https://discord.com/api/oauth2/authorize",
+		AccessURL:           "https://discord.com/api/oauth2/token",
+		UserInfoURL:         "https://discord.com/api/users/@me",
+		OAuth:               2,
+		ScopeDelimiter:      " ",
+		CustomParameters:    []string{"prompt"},
+		TokenResponseFormat: TokenResponseJSON,
+	},
 	"disqus": Provider{
 		Name:         "disqus",
 		AuthorizeURL: "https://disqus.com/api/oauth/2.0/authorize/",
@@ -240,7 +265,21 @@ var defaultProviders = map[string]Provider{
 		Name:         "github",
 		AuthorizeURL: "https://github.com/login/oauth/authorize",
 		AccessURL:    "https://github.com/login/oauth/access_token",
-		OAuth:        2,
+		UserInfoURL:  "https://api.github.com/user",
+		OAuth:        2,
+	},
+	"gitlab": Provider{
+		Name:           "gitlab",
+		AuthorizeURL:   "[base_url]/oauth/authorize",
+		AccessURL:      "[base_url]/oauth/token",
+		Issuer:         "[base_url]",
+		DefaultBaseURL: "https://gitlab.com",
+		JWKSURL:        "[base_url]/oauth/discovery/keys",
+		UserInfoURL:    "[base_url]/oauth/userinfo",
+		RevokeURL:      "[base_url]/oauth/revoke",
+		OAuth:          2,
+		ScopeDelimiter: " ",
+		PKCE:           true,
 	},
 	"gitter": Provider{
 		Name:         "gitter",
@@ -259,9 +298,15 @@ var defaultProviders = map[string]Provider{
 		Name:             "google",
 		AuthorizeURL:     "https://accounts.google.com/o/oauth2/auth",
 		AccessURL:        "https://accounts.google.com/o/oauth2/token",
+		UserInfoURL:      "https://openidconnect.googleapis.com/v1/userinfo",
 		OAuth:            2,
 		ScopeDelimiter:   " ",
 		CustomParameters: []string{"access_type"},
+		// granted scopes are returned as URLs
+		ScopeAliases: map[string]string{
+			"email":   "https://www.googleapis.com/auth/userinfo.email",
+			"profile": "https://www.googleapis.com/auth/userinfo.profile",
+		},
 	},
 	"harvest": Provider{
 		Name:         "harvest",
@@ -328,6 +373,22 @@ var defaultProviders = map[string]Provider{
 		OAuth:          2,
 		ScopeDelimiter: " ",
 	},
+	"microsoft": Provider{
+		Name:             "microsoft",
+		AuthorizeURL:     "https://login.microsoftonline.com/[tenant]/oauth2/v2.0/authorize",
+		AccessURL:        "https://login.microsoftonline.com/[tenant]/oauth2/v2.0/token",
+		Issuer:           "https://login.microsoftonline.com/[tenant]/v2.0",
+		MultiTenants:     []string{"common", "organizations", "consumers"},
+		JWKSURL:          "https://login.microsoftonline.com/[tenant]/discovery/v2.0/keys",
+		UserInfoURL:      "https://graph.microsoft.com/oidc/userinfo",
+		EndSessionURL:    "https://login.microsoftonline.com/[tenant]/oauth2/v2.0/logout",
+		DeviceURL:        "https://login.microsoftonline.com/[tenant]/oauth2/v2.0/devicecode",
+		OAuth:            2,
+		ScopeDelimiter:   " ",
+		CustomParameters: []string{"prompt", "login_hint", "domain_hint"},
+		// no refresh token is issued without it
+		RefreshScope: "offline_access",
+	},
 	"mixcloud": Provider{
 		Name:         "mixcloud",
 		AuthorizeURL: "https://www.mixcloud.com/oauth/authorize",
@@ -427,12 +488,15 @@ var defaultProviders = map[string]Provider{
 		OAuth:        2,
 	},
 	"spotify": Provider{
-		Name:             "spotify",
-		AuthorizeURL:     "https://accounts.spotify.com/authorize",
-		AccessURL:        "https://accounts.spotify.com/api/token",
-		OAuth:            2,
-		ScopeDelimiter:   " ",
-		CustomParameters: []string{"show_dialog"},
+		Name:                "spotify",
+		AuthorizeURL:        "https://accounts.spotify.com/authorize",
+		AccessURL:           "https://accounts.spotify.com/api/token",
+		UserInfoURL:         "https://api.spotify.com/v1/me",
+		OAuth:               2,
+		ScopeDelimiter:      " ",
+		CustomParameters:    []string{"show_dialog"},
+		TokenResponseFormat: TokenResponseJSON,
+		ClientAuthMethod:    ClientAuthBasic,
 	},
 	"stackexchange": Provider{
 		Name:         "stackexchange",
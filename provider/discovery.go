@@ -0,0 +1,133 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Providers already discovered, by issuer
+var discovered = struct {
+	sync.Mutex
+	providers map[string]Provider
+}{providers: map[string]Provider{}}
+
+// The fields of an OpenID Connect discovery document we use
+type discoveryDocument struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	EndSessionEndpoint                string   `json:"end_session_endpoint"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+// Build a provider from the OpenID Connect discovery document of the issuer (<issuer>/.well-known/openid-configuration),
+// use it inline in a ProviderConfig:
+//
+//	p, err := provider.Discover("https://accounts.google.com")
+//	config.Providers["google"] = provider.ProviderConfig{Inline: &p, Key: "key", Secret: "secret", Scope: []string{"openid"}}
+//
+// Documents are fetched once, later calls for the same issuer return the cached provider
+func Discover(issuerURL string) (Provider, error) {
+	return DiscoverContext(context.Background(), issuerURL)
+}
+
+// Same as Discover, the context controls the request fetching the document
+func DiscoverContext(ctx context.Context, issuerURL string) (Provider, error) {
+	issuer := strings.TrimSuffix(issuerURL, "/")
+
+	discovered.Lock()
+	provider, ok := discovered.providers[issuer]
+	discovered.Unlock()
+	if ok == true {
+		return provider, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return Provider{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return Provider{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Provider{}, errors.New(fmt.Sprintf("discovery of %s failed: %s", issuer, resp.Status))
+	}
+
+	var document discoveryDocument
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		return Provider{}, err
+	}
+
+	provider, err = document.provider(issuer)
+	if err != nil {
+		return Provider{}, err
+	}
+
+	discovered.Lock()
+	discovered.providers[issuer] = provider
+	discovered.Unlock()
+
+	return provider, nil
+}
+
+func (document discoveryDocument) provider(issuer string) (Provider, error) {
+	// the document must be the one of the issuer we asked for, id_tokens are checked against it
+	if strings.TrimSuffix(document.Issuer, "/") != issuer {
+		return Provider{}, errors.New(fmt.Sprintf("discovery of %s returned the issuer %s", issuer, document.Issuer))
+	}
+
+	p := New("", document.AuthorizationEndpoint, document.TokenEndpoint, WithScopeDelimiter(" "))
+	p.Issuer = document.Issuer
+	p.JWKSURL = document.JWKSURI
+	p.UserInfoURL = document.UserInfoEndpoint
+	p.RevokeURL = document.RevocationEndpoint
+	p.DeviceURL = document.DeviceAuthorizationEndpoint
+	p.EndSessionURL = document.EndSessionEndpoint
+
+	// client_secret_basic is the default when the provider doesn't say
+	p.ClientAuthMethod = ClientAuthBasic
+	if len(document.TokenEndpointAuthMethodsSupported) > 0 &&
+		!contains(document.TokenEndpointAuthMethodsSupported, "client_secret_basic") &&
+		contains(document.TokenEndpointAuthMethodsSupported, "client_secret_post") {
+		p.ClientAuthMethod = ClientAuthBody
+	}
+
+	if contains(document.CodeChallengeMethodsSupported, "S256") {
+		p.PKCE = true
+	}
+
+	// providers only supporting the implicit flow don't have a token endpoint
+	if document.TokenEndpoint == "" && contains(document.ResponseTypesSupported, ResponseTypeToken) {
+		p.ResponseType = ResponseTypeToken
+	}
+
+	if err := p.Validate(); err != nil {
+		return Provider{}, err
+	}
+	return p, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
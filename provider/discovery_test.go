@@ -0,0 +1,106 @@
+package provider_test
+
+import (
+	"encoding/json"
+	"github.com/christopherobin/authy/provider"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// OpenID Connect provider serving its discovery document, issuer is overridden when not empty
+func MockDiscoveryServer(issuer string, requests *int32) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			http.NotFound(rw, r)
+			return
+		}
+		atomic.AddInt32(requests, 1)
+
+		documentIssuer := server.URL
+		if issuer != "" {
+			documentIssuer = issuer
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"issuer":                                documentIssuer,
+			"authorization_endpoint":                server.URL + "/authorize",
+			"token_endpoint":                        server.URL + "/token",
+			"userinfo_endpoint":                     server.URL + "/userinfo",
+			"jwks_uri":                              server.URL + "/jwks",
+			"revocation_endpoint":                   server.URL + "/revoke",
+			"scopes_supported":                      []string{"openid", "email", "profile"},
+			"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+			"token_endpoint_auth_methods_supported": []string{"client_secret_post"},
+			"code_challenge_methods_supported":      []string{"plain", "S256"},
+		})
+	}))
+	return server
+}
+
+func TestDiscover(t *testing.T) {
+	Convey("Build a provider from its discovery document", t, func() {
+		var requests int32
+		server := MockDiscoveryServer("", &requests)
+		Reset(server.Close)
+
+		p, err := provider.Discover(server.URL + "/")
+		So(err, ShouldEqual, nil)
+		So(p.OAuth, ShouldEqual, 2)
+		So(p.Issuer, ShouldEqual, server.URL)
+		So(p.AuthorizeURL, ShouldEqual, server.URL+"/authorize")
+		So(p.AccessURL, ShouldEqual, server.URL+"/token")
+		So(p.UserInfoURL, ShouldEqual, server.URL+"/userinfo")
+		So(p.JWKSURL, ShouldEqual, server.URL+"/jwks")
+		So(p.RevokeURL, ShouldEqual, server.URL+"/revoke")
+		So(p.ScopeDelimiter, ShouldEqual, " ")
+		So(p.ClientAuthMethod, ShouldEqual, provider.ClientAuthBody)
+		So(p.PKCE, ShouldBeTrue)
+
+		Convey("The document is cached", func() {
+			_, err := provider.Discover(server.URL)
+			So(err, ShouldEqual, nil)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 1)
+		})
+	})
+
+	Convey("Reject documents of another issuer", t, func() {
+		var requests int32
+		server := MockDiscoveryServer("https://evil.example.com", &requests)
+		Reset(server.Close)
+
+		_, err := provider.Discover(server.URL)
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldContainSubstring, "returned the issuer https://evil.example.com")
+	})
+
+	Convey("Give up on hung servers", t, func() {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		Reset(func() {
+			close(release)
+			server.Close()
+		})
+
+		defaultClient := provider.HTTPClient
+		provider.HTTPClient = &http.Client{Timeout: 50 * time.Millisecond}
+		Reset(func() { provider.HTTPClient = defaultClient })
+
+		_, err := provider.Discover(server.URL)
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldContainSubstring, "Client.Timeout")
+	})
+
+	Convey("Report missing documents", t, func() {
+		server := httptest.NewServer(http.NotFoundHandler())
+		Reset(server.Close)
+
+		_, err := provider.Discover(server.URL)
+		So(err, ShouldNotEqual, nil)
+	})
+}
@@ -4,6 +4,11 @@ package provider
 import (
 	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
 // Contains implementation details to be used by Authy
@@ -16,8 +21,110 @@ type Provider struct {
 	ScopeDelimiter   string
 	Subdomain        bool
 	CustomParameters []string
+	// Same as CustomParameters for the token request of the authorization code flow
+	CustomTokenParameters []string
+	// Scopes accepted by the provider, requesting any other scope is a configuration error. Leave empty to skip the check
+	KnownScopes []string
+	// Scopes known under several names, mapped to the name the provider returns in token responses
+	ScopeAliases map[string]string
+	// Scope the provider wants before issuing a refresh token (offline_access), requested along with the configured
+	// scopes when ProviderConfig.WantRefresh is set
+	RefreshScope string
+	// Only needed for providers using non standard field names in their token responses
+	TokenFields TokenFields
+	// OpenID Connect issuer, id_tokens must have a matching iss claim
+	Issuer string
+	// Tenants letting users of any tenant log in (common, organizations and consumers on Microsoft), their id_tokens are
+	// issued by the tenant of the user so the issuer is checked with the tid claim in place of [tenant]
+	MultiTenants []string
+	// Value of the [base_url] placeholder when the config doesn't set one, for services that can also be self hosted
+	DefaultBaseURL string
+	// Where the keys used to sign id_tokens are published
+	JWKSURL string
+	// Endpoint returning the profile of the user, either the OpenID Connect userinfo endpoint or a provider specific one
+	UserInfoURL string
+	// Device authorization endpoint (RFC 8628)
+	DeviceURL string
+	// OpenID Connect RP-initiated logout endpoint (end_session_endpoint)
+	EndSessionURL string
+	// Token revocation endpoint (RFC 7009)
+	RevokeURL string
+	// Base64 encoded SHA-256 hashes of the public keys (SPKI) the certificate chains of the token, revocation, device
+	// and JWKS endpoints must contain, leave empty to disable pinning. The transport of ProviderConfig.HTTPClient must
+	// then be an *http.Transport
+	PinnedSPKI []string
+	// Force the format of token endpoint responses (TokenResponseJSON or TokenResponseForm) for providers sending a
+	// wrong Content-Type, by default it is detected from the Content-Type
+	TokenResponseFormat string
+	// Use PKCE (RFC 7636) on the authorization code flow
+	PKCE bool
+	// How the client authenticates on the token endpoint, ClientAuthBody (the default), ClientAuthBasic,
+	// ClientAuthSecretJWT, ClientAuthPrivateKeyJWT or ClientAuthGeneratedSecret
+	ClientAuthMethod string
+	// Audience of the client assertions (JWT client authentication), defaults to the access URL
+	AssertionAudience string
+	// ResponseTypeCode (the default) for the authorization code flow or ResponseTypeToken for the implicit flow
+	ResponseType string
+	// ResponseModeFormPost for providers POSTing the callback parameters instead of sending them in the query string,
+	// empty for the default of the response type
+	ResponseMode string
 }
 
+// Authorization response types
+const (
+	// authorization code flow, the code is exchanged for a token by the server
+	ResponseTypeCode = "code"
+	// implicit flow, the token is returned in the fragment of the callback URL
+	ResponseTypeToken = "token"
+)
+
+// Authorization response modes
+const (
+	// the callback parameters are POSTed as a form (Sign in with Apple)
+	ResponseModeFormPost = "form_post"
+)
+
+// Placeholders the provider URLs can contain, filled from the provider config by ExpandURLs
+const (
+	PlaceholderSubdomain = "[subdomain]"
+	PlaceholderRealm     = "[realm]"
+	PlaceholderBaseURL   = "[base_url]"
+	PlaceholderTenant    = "[tenant]"
+)
+
+// Client authentication methods on the token endpoint
+const (
+	// client_id and client_secret are sent in the request body
+	ClientAuthBody = "body"
+	// client_id and client_secret are sent using HTTP Basic authentication
+	ClientAuthBasic = "basic"
+	// the client sends a JWT signed with its secret (HS256) instead of the secret itself
+	ClientAuthSecretJWT = "client_secret_jwt"
+	// the client sends a JWT signed with ProviderConfig.PrivateKey, no secret is needed
+	ClientAuthPrivateKeyJWT = "private_key_jwt"
+	// same as ClientAuthBody but the client_secret is a short lived JWT signed with ProviderConfig.PrivateKey (Sign in
+	// with Apple)
+	ClientAuthGeneratedSecret = "generated_secret"
+)
+
+// Token endpoint response formats
+const (
+	TokenResponseJSON = "json"
+	TokenResponseForm = "form"
+)
+
+// Names of the fields in a token endpoint response, empty names default to the ones from the OAuth2 spec
+type TokenFields struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    string
+	TokenType    string
+}
+
+// Client used for the calls made outside of the token endpoint (discovery, JWKS, user info, ...) when the provider
+// config doesn't have its own client. Replace it to go through a proxy or to point the calls at a test server
+var HTTPClient = &http.Client{Timeout: 10 * time.Second}
+
 // Those keys are imported from your config, set the proper ones based on your provider's oauth information
 type ProviderConfig struct {
 	Provider         Provider          `json:"-"`
@@ -28,6 +135,361 @@ type ProviderConfig struct {
 	Callback         string            `json:"callback"`
 	Subdomain        string            `json:"subdomain"`
 	CustomParameters map[string]string `json:"custom_parameters"`
+	// Redirect URI registered at the provider, used as is in both the authorize and token requests. When empty it is
+	// generated from the request's host and path which breaks behind proxies rewriting them
+	RedirectURI string `json:"redirect_uri"`
+	// Appended to the current URL to generate the redirect URI when RedirectURI is empty, set by Authy from its config
+	CallbackSegment string `json:"-"`
+	// Extra parameters sent to the token endpoint, only the ones whitelisted by the provider are used
+	TokenParameters map[string]string `json:"token_parameters"`
+	// Provider defined directly in the config instead of being registered, takes precedence on registered providers
+	Inline *Provider `json:"provider"`
+	// Realm of providers serving several tenants from the same host (Keycloak), replaces [realm] in the provider URLs
+	Realm string `json:"realm"`
+	// Base URL of self hosted providers (Dex, Keycloak, ...), replaces [base_url] in the provider URLs
+	BaseURL string `json:"base_url"`
+	// Directory of multi tenant providers (Microsoft: common, organizations, consumers or a tenant id), replaces
+	// [tenant] in the provider URLs
+	Tenant string `json:"tenant"`
+	// PKCE code verifier of the current authorization, set by Authy
+	CodeVerifier string `json:"-"`
+	// OpenID Connect nonce of the current authorization, set by Authy
+	Nonce string `json:"-"`
+	// Where to send the user after logging out, overrides the global setting
+	PostLogoutRedirect string `json:"post_logout_redirect"`
+	// Resource indicators (RFC 8707) of the APIs the token will be used against, sent in the authorize, token and
+	// refresh requests
+	Resource []string `json:"resource"`
+	// Fail the login if the provider doesn't issue a refresh token, set this when requesting offline access
+	WantRefresh bool `json:"want_refresh"`
+	// Client used for the requests to the provider (proxies, TLS settings, tests, ...), defaults to oauth2.DefaultClient
+	// for the token endpoint and to HTTPClient for the other calls
+	HTTPClient *http.Client `json:"-"`
+	// Headers of the token endpoint response to copy into the token's Extra field (rate limits, user id, ...)
+	CaptureHeaders []string `json:"capture_headers"`
+	// Receives debug events about the requests made to the provider, secrets are redacted. Nothing is logged if nil
+	Logger *slog.Logger `json:"-"`
+	// Retry token requests that failed because of a network error, a 5xx response or slow_down. Not retried if nil
+	Retry *RetryPolicy `json:"retry"`
+	// PEM encoded RSA or P-256 key signing the client assertions of providers using ClientAuthPrivateKeyJWT or
+	// ClientAuthGeneratedSecret
+	PrivateKey string `json:"private_key"`
+	// Sent as the kid of the client assertions so the provider knows which of the registered keys to use
+	KeyID string `json:"key_id"`
+	// iss claim of the client assertions, defaults to the client id (Key). Sign in with Apple wants the team id
+	AssertionIssuer string `json:"assertion_issuer"`
+	// Key the tokens are bound to (DPoP, RFC 9449), token requests carry a proof signed with it. Only set it for
+	// providers supporting DPoP, see oauth2.NewDPoPKey
+	DPoP DPoPSigner `json:"-"`
+}
+
+// Signs the DPoP proofs sent along token and API requests, the nonces sent by servers (DPoP-Nonce header) are kept
+// by the signer and included in the next proofs for the same origin
+type DPoPSigner interface {
+	// Proof for a request, accessToken is empty for token requests
+	Proof(method string, requestURL string, accessToken string) (string, error)
+	// Remember the nonce sent by the server of requestURL
+	SetNonce(requestURL string, nonce string)
+}
+
+// How requests to the token endpoint are retried, the delay doubles on every attempt unless the provider sends a
+// Retry-After header
+type RetryPolicy struct {
+	// Total number of attempts, the request is sent once if 1 or less
+	MaxAttempts int `json:"max_attempts"`
+	// Delay before the first retry (defaults to 1 second)
+	Backoff time.Duration `json:"backoff"`
+	// Longest delay between two attempts, Retry-After included (defaults to 30 seconds)
+	MaxBackoff time.Duration `json:"max_backoff"`
+}
+
+// Optional settings for New
+type Option func(*Provider)
+
+// Build an OAuth2 provider from its authorization and token endpoints, use options to set everything else
+//
+//	provider.RegisterProvider(provider.New("example", "https://example.com/oauth/authorize",
+//	  "https://example.com/oauth/token", provider.WithScopeDelimiter(" ")))
+func New(name string, authorizeURL string, accessURL string, opts ...Option) Provider {
+	provider := Provider{
+		Name:           name,
+		AuthorizeURL:   authorizeURL,
+		AccessURL:      accessURL,
+		OAuth:          2,
+		ScopeDelimiter: ",",
+	}
+
+	for _, opt := range opts {
+		opt(&provider)
+	}
+
+	return provider
+}
+
+// Build a provider for any standards compliant OAuth2 server that Authy doesn't know about (Keycloak, Okta, Gitea,
+// Dex, ...), meant to be used inline in a ProviderConfig which also gives it its name:
+//
+//	p := provider.Generic("https://sso.example.com/authorize", "https://sso.example.com/token", " ", provider.ClientAuthBasic)
+//	config.Providers["sso"] = provider.ProviderConfig{Inline: &p, Key: "key", Secret: "secret"}
+//
+// The scope delimiter defaults to a space and the client authentication to HTTP Basic as the spec requires servers to
+// support both
+func Generic(authorizeURL string, accessURL string, scopeDelimiter string, authMethod string, opts ...Option) Provider {
+	if scopeDelimiter == "" {
+		scopeDelimiter = " "
+	}
+	if authMethod == "" {
+		authMethod = ClientAuthBasic
+	}
+
+	opts = append([]Option{WithScopeDelimiter(scopeDelimiter), WithClientAuthMethod(authMethod)}, opts...)
+	return New("", authorizeURL, accessURL, opts...)
+}
+
+// Set the string used to join scopes in the authorization request
+func WithScopeDelimiter(delimiter string) Option {
+	return func(p *Provider) {
+		p.ScopeDelimiter = delimiter
+	}
+}
+
+// Set the request token URL and switch the provider to OAuth1
+func WithRequestURL(requestURL string) Option {
+	return func(p *Provider) {
+		p.RequestURL = requestURL
+		p.OAuth = 1
+	}
+}
+
+// Mark the URLs as containing a [subdomain] placeholder filled from the provider config
+func WithSubdomain() Option {
+	return func(p *Provider) {
+		p.Subdomain = true
+	}
+}
+
+// Whitelist custom parameters that can be passed to the authorization request
+func WithCustomParameters(names ...string) Option {
+	return func(p *Provider) {
+		p.CustomParameters = append(p.CustomParameters, names...)
+	}
+}
+
+// Whitelist custom parameters that can be passed to the token request
+func WithCustomTokenParameters(names ...string) Option {
+	return func(p *Provider) {
+		p.CustomTokenParameters = append(p.CustomTokenParameters, names...)
+	}
+}
+
+// List the scopes accepted by the provider, see ProviderConfig.ValidateScopes
+func WithKnownScopes(scopes ...string) Option {
+	return func(p *Provider) {
+		p.KnownScopes = append(p.KnownScopes, scopes...)
+	}
+}
+
+// Declare alternative names of scopes, see CanonicalScope
+func WithScopeAliases(aliases map[string]string) Option {
+	return func(p *Provider) {
+		if p.ScopeAliases == nil {
+			p.ScopeAliases = map[string]string{}
+		}
+		for alias, scope := range aliases {
+			p.ScopeAliases[alias] = scope
+		}
+	}
+}
+
+// Set how the client authenticates on the token endpoint (ClientAuthBody, ClientAuthBasic, ClientAuthSecretJWT or
+// ClientAuthPrivateKeyJWT)
+func WithClientAuthMethod(method string) Option {
+	return func(p *Provider) {
+		p.ClientAuthMethod = method
+	}
+}
+
+// Use non standard field names when parsing token responses
+func WithTokenFields(fields TokenFields) Option {
+	return func(p *Provider) {
+		p.TokenFields = fields
+	}
+}
+
+// Set the endpoint returning the profile of the user
+func WithUserInfoURL(userInfoURL string) Option {
+	return func(p *Provider) {
+		p.UserInfoURL = userInfoURL
+	}
+}
+
+// Use the implicit flow, see ResponseTypeToken
+func WithImplicitFlow() Option {
+	return func(p *Provider) {
+		p.ResponseType = ResponseTypeToken
+	}
+}
+
+// Check that the provider has everything needed to run the authorization flow
+func (p Provider) Validate() error {
+	switch p.OAuth {
+	case 1:
+		if p.RequestURL == "" {
+			return errors.New(fmt.Sprintf("provider %s is missing its request URL", p.Name))
+		}
+	case 2:
+	default:
+		return errors.New(fmt.Sprintf("provider %s has an unsupported OAuth version: %d", p.Name, p.OAuth))
+	}
+
+	if p.AuthorizeURL == "" {
+		return errors.New(fmt.Sprintf("provider %s is missing its authorize URL", p.Name))
+	}
+	// the implicit flow never calls the token endpoint
+	if p.AccessURL == "" && p.ResponseType != ResponseTypeToken {
+		return errors.New(fmt.Sprintf("provider %s is missing its access URL", p.Name))
+	}
+	switch p.ClientAuthMethod {
+	case "", ClientAuthBody, ClientAuthBasic, ClientAuthSecretJWT, ClientAuthPrivateKeyJWT, ClientAuthGeneratedSecret:
+	default:
+		return errors.New(fmt.Sprintf("provider %s has an unsupported client authentication method: %s", p.Name, p.ClientAuthMethod))
+	}
+	return nil
+}
+
+// Return the provider with the placeholders of its URLs replaced by the subdomain, realm, base URL and tenant of the
+// config, fails if a URL contains a placeholder the config has no value for. Authy calls it once when loading the config
+func (config ProviderConfig) ExpandURLs() (Provider, error) {
+	p := config.Provider
+	values := map[string]string{
+		PlaceholderSubdomain: config.Subdomain,
+		PlaceholderRealm:     config.Realm,
+		PlaceholderBaseURL:   strings.TrimSuffix(config.BaseURL, "/"),
+		PlaceholderTenant:    config.Tenant,
+	}
+	if config.BaseURL == "" {
+		values[PlaceholderBaseURL] = strings.TrimSuffix(p.DefaultBaseURL, "/")
+	}
+
+	multiTenant := false
+	for _, tenant := range p.MultiTenants {
+		if tenant == config.Tenant {
+			multiTenant = true
+		}
+	}
+
+	var missing []string
+	urls := []*string{&p.RequestURL, &p.AuthorizeURL, &p.AccessURL, &p.Issuer, &p.JWKSURL, &p.UserInfoURL, &p.DeviceURL, &p.EndSessionURL, &p.RevokeURL}
+	for _, placeholder := range []string{PlaceholderSubdomain, PlaceholderRealm, PlaceholderBaseURL, PlaceholderTenant} {
+		used := false
+		for _, u := range urls {
+			if strings.Contains(*u, placeholder) {
+				used = true
+				// filled when validating the id_token, see MultiTenants
+				if placeholder == PlaceholderTenant && u == &p.Issuer && multiTenant {
+					continue
+				}
+				*u = strings.Replace(*u, placeholder, values[placeholder], -1)
+			}
+		}
+		if used && values[placeholder] == "" {
+			missing = append(missing, strings.Trim(placeholder, "[]"))
+		}
+	}
+
+	if len(missing) > 0 {
+		return config.Provider, errors.New(fmt.Sprintf("provider %s expects the config to contain: %s", p.Name, strings.Join(missing, ", ")))
+	}
+	return p, nil
+}
+
+// Client to use for the calls made outside of the token endpoint, the one of the config or HTTPClient
+func (config ProviderConfig) Client() *http.Client {
+	if config.HTTPClient != nil {
+		return config.HTTPClient
+	}
+	return HTTPClient
+}
+
+// Print the config with its secrets masked so that it can be logged safely, the fields still hold the raw values
+func (config ProviderConfig) String() string {
+	// same fields without the String method
+	type plainConfig ProviderConfig
+	redacted := plainConfig(config)
+	redacted.Secret = Redact(config.Secret)
+	redacted.PrivateKey = Redact(config.PrivateKey)
+	redacted.CodeVerifier = Redact(config.CodeVerifier)
+	return fmt.Sprintf("%+v", redacted)
+}
+
+func (config ProviderConfig) GoString() string {
+	return "provider.ProviderConfig" + config.String()
+}
+
+// Mask a secret so that it can be printed: keep its first characters and its length, enough to tell secrets apart when
+// debugging. Secrets of 8 characters or less only keep their length
+func Redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	if len(value) <= 8 {
+		return fmt.Sprintf("***(%d)", len(value))
+	}
+	return fmt.Sprintf("%s***(%d)", value[:4], len(value))
+}
+
+// Name of the scope as returned by the provider, used to compare scopes that have aliases
+func (p Provider) CanonicalScope(scope string) string {
+	if canonical, ok := p.ScopeAliases[scope]; ok == true {
+		return canonical
+	}
+	return scope
+}
+
+// Check that every configured scope is known by the provider, does nothing if the provider doesn't list its scopes
+func (config ProviderConfig) ValidateScopes() error {
+	return config.Provider.ValidateScopes(config.Scope)
+}
+
+// Check that every configured resource indicator is an absolute URI without a fragment, as RFC 8707 requires
+func (config ProviderConfig) ValidateResources() error {
+	var invalid []string
+	for _, resource := range config.Resource {
+		parsed, err := url.Parse(resource)
+		if err != nil || parsed.IsAbs() != true || parsed.Fragment != "" {
+			invalid = append(invalid, resource)
+		}
+	}
+
+	if len(invalid) > 0 {
+		return errors.New(fmt.Sprintf("provider %s has invalid resource indicators: %s", config.Provider.Name,
+			strings.Join(invalid, ", ")))
+	}
+	return nil
+}
+
+// Check that every given scope is known by the provider, does nothing if the provider doesn't list its scopes
+func (p Provider) ValidateScopes(scopes []string) error {
+	if len(p.KnownScopes) == 0 {
+		return nil
+	}
+
+	known := map[string]bool{}
+	for _, scope := range p.KnownScopes {
+		known[scope] = true
+	}
+
+	var unknown []string
+	for _, scope := range scopes {
+		if !known[scope] {
+			unknown = append(unknown, scope)
+		}
+	}
+
+	if len(unknown) > 0 {
+		return errors.New(fmt.Sprintf("provider %s doesn't support the scopes: %s", p.Name, strings.Join(unknown, ", ")))
+	}
+	return nil
 }
 
 var customProviders = map[string]Provider{}
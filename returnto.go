@@ -0,0 +1,80 @@
+package authy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Pick the key signing return paths: the configured one, the one of the state cookie or a random one
+func loadStateKey(config Config) ([]byte, error) {
+	if config.StateKey != "" {
+		key, err := resolveEnv(config.StateKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) < stateCookieKeyLength {
+			return nil, errors.New(fmt.Sprintf("key must be at least %d bytes", stateCookieKeyLength))
+		}
+		return []byte(key), nil
+	}
+
+	if config.StateCookie != nil && config.StateCookie.Key != "" {
+		return []byte(config.StateCookie.Key), nil
+	}
+
+	key := make([]byte, stateCookieKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Only accept paths on the current host, //example.com or /\example.com would send the user to another website
+func validReturnTo(path string) bool {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return false
+	}
+
+	parsed, err := url.Parse(path)
+	return err == nil && parsed.Scheme == "" && parsed.Host == ""
+}
+
+// Append the return path to a random state and sign the result: <state>.<path>.<signature>
+func (a Authy) embedReturnTo(state string, returnTo string) string {
+	value := state + "." + base64.RawURLEncoding.EncodeToString([]byte(returnTo))
+	return value + "." + base64.RawURLEncoding.EncodeToString(a.signState(value))
+}
+
+// Read the return path carried by a state, returns an empty path if there is none
+func (a Authy) extractReturnTo(state string) (string, error) {
+	parts := strings.Split(state, ".")
+	if len(parts) == 1 {
+		return "", nil
+	}
+	if len(parts) != 3 {
+		return "", ErrStateMismatch
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, a.signState(parts[0]+"."+parts[1])) {
+		return "", ErrStateMismatch
+	}
+
+	returnTo, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !validReturnTo(string(returnTo)) {
+		return "", ErrInvalidReturnTo
+	}
+	return string(returnTo), nil
+}
+
+func (a Authy) signState(value string) []byte {
+	mac := hmac.New(sha256.New, a.stateKey)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
@@ -1,5 +1,19 @@
 package authy
 
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// The key under which older versions stored the only token of the session, tokens are now kept per provider
+const legacyTokenSessionKey = "authy.token"
+
+// The key under which middlewares store the serialized token of a provider in the session
+func TokenSessionKey(providerName string) string {
+	return "authy.token." + providerName
+}
+
 // The session object is used to store the CSRF token used by OAuth2
 type Session interface {
 	// Get a key from the session
@@ -9,3 +23,169 @@ type Session interface {
 	// Unset a key from the session
 	Delete(key interface{})
 }
+
+// Retrieve the token of the provider stored in the session, returns nil if there is none
+func (a Authy) LoadToken(session Session, providerName string) (*Token, error) {
+	serializedToken, err := sessionBytes(session, TokenSessionKey(providerName))
+	if err != nil || serializedToken == nil {
+		return nil, err
+	}
+	return a.TokenFromSerialized(serializedToken)
+}
+
+// Read a value Authy serialized in the session, backends encoding the session may give it back as a string. Returns nil
+// if the key is not set
+func sessionBytes(session Session, key string) ([]byte, error) {
+	switch value := session.Get(key).(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return value, nil
+	case string:
+		return []byte(value), nil
+	default:
+		return nil, fmt.Errorf("%w, %s holds a %T", ErrInvalidSessionData, key, value)
+	}
+}
+
+// Serialize the token and store it in the session along with the tokens of the other providers
+func (a Authy) SaveToken(session Session, token *Token) error {
+	serializedToken, err := token.Serialize()
+	if err != nil {
+		return err
+	}
+	session.Set(TokenSessionKey(token.Provider), serializedToken)
+	return nil
+}
+
+// Remove the token of the provider from the session
+func (a Authy) DeleteToken(session Session, providerName string) {
+	session.Delete(TokenSessionKey(providerName))
+}
+
+// Move the token stored by older versions under its provider's key, tokens of providers that are not configured
+// anymore are dropped
+func (a Authy) migrateToken(session Session) {
+	serializedToken, err := sessionBytes(session, legacyTokenSessionKey)
+	if err != nil || serializedToken == nil {
+		return
+	}
+	session.Delete(legacyTokenSessionKey)
+
+	token, err := a.TokenFromSerialized(serializedToken)
+	if err != nil || !a.HasProvider(token.Provider) {
+		return
+	}
+	if session.Get(TokenSessionKey(token.Provider)) == nil {
+		session.Set(TokenSessionKey(token.Provider), serializedToken)
+	}
+}
+
+// Load the token for the given provider from the session, refresh it if it expired and store the refreshed token back
+// in the session. Returns the token (nil if the session has none for that provider) and whether the refresh changed it.
+// An expired token that cannot be refreshed returns an error matching ErrReauthRequired
+func (a Authy) Revalidate(session Session, providerName string) (*Token, bool, error) {
+	return a.RevalidateContext(context.Background(), session, providerName)
+}
+
+// Same as Revalidate, the context controls the refresh request. Middlewares pass the context of the incoming request
+func (a Authy) RevalidateContext(ctx context.Context, session Session, providerName string) (*Token, bool, error) {
+	a.migrateToken(session)
+
+	token, err := a.LoadToken(session, providerName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if token == nil {
+		return nil, false, nil
+	}
+
+	if token.Valid() {
+		return token, false, nil
+	}
+
+	if !token.IsRefreshable() {
+		return nil, false, fmt.Errorf("%w, token for %s expired and cannot be refreshed", ErrReauthRequired, providerName)
+	}
+
+	previous := token.snapshot()
+	if err := token.RefreshContext(ctx); err != nil {
+		return nil, false, err
+	}
+
+	// nothing to write if the provider sent the same token back
+	if previous.Equal(token) {
+		return token, false, nil
+	}
+
+	if err := a.SaveToken(session, token); err != nil {
+		return nil, false, err
+	}
+
+	return token, true, nil
+}
+
+// Revalidate the token of every configured provider found in the session, tokens that can't be used anymore are
+// removed from the session. Tokens failing to refresh because the provider could not be reached are left out of the
+// returned tokens but kept in the session. Returns the usable tokens by provider and whether the session changed
+func (a Authy) RevalidateAll(session Session) (map[string]*Token, bool) {
+	return a.RevalidateAllContext(context.Background(), session)
+}
+
+// Same as RevalidateAll, the context controls the refresh requests
+func (a Authy) RevalidateAllContext(ctx context.Context, session Session) (map[string]*Token, bool) {
+	changed := session.Get(legacyTokenSessionKey) != nil
+	a.migrateToken(session)
+
+	tokens := map[string]*Token{}
+	for providerName := range a.providers {
+		if session.Get(TokenSessionKey(providerName)) == nil {
+			continue
+		}
+
+		token, refreshed, err := a.RevalidateContext(ctx, session, providerName)
+		// the request went away during the refresh, that says nothing about the token
+		if err != nil && ctx.Err() != nil {
+			continue
+		}
+		// keep tokens the provider couldn't be asked about, the next request tries again
+		if err != nil && !tokenUnusable(err) {
+			continue
+		}
+		if err != nil || token == nil {
+			a.DeleteToken(session, providerName)
+			changed = true
+			continue
+		}
+
+		tokens[providerName] = token
+		changed = changed || refreshed
+	}
+
+	return tokens, changed
+}
+
+// Check that there is a valid token for every given provider, or any provider if none is given, and return the token to
+// use by default: the one of the first given provider, or of the first provider in alphabetical order
+func PickToken(tokens map[string]*Token, providers ...string) (*Token, bool) {
+	if len(providers) == 0 {
+		for providerName, token := range tokens {
+			if token.Valid() {
+				providers = append(providers, providerName)
+			}
+		}
+		if len(providers) == 0 {
+			return nil, false
+		}
+		sort.Strings(providers)
+		return tokens[providers[0]], true
+	}
+
+	for _, providerName := range providers {
+		if !tokens[providerName].Valid() {
+			return nil, false
+		}
+	}
+	return tokens[providers[0]], true
+}
@@ -0,0 +1,263 @@
+package authy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How long the user has to go through the provider's authorization page by default, see Config.StateMaxAge
+const defaultStateMaxAge = 10 * time.Minute
+
+// Stores the data of pending authorizations (requested scope, PKCE verifier, ...) keyed by their CSRF state. By default
+// Authy keeps it in the user session, use a server side store to keep cookie based sessions small
+type StateStore interface {
+	// Save the data of the given state, it can be dropped once ttl elapsed
+	Save(state string, data []byte, ttl time.Duration) error
+	// Load the data of the given state, returns nil if there is none or it expired
+	Load(state string) ([]byte, error)
+	// Delete the data of the given state
+	Delete(state string) error
+}
+
+// Set in the session by Authorize, a callback with a session lacking it got a new session instead of the one used to
+// authorize
+const sessionMarkerKey = "authy.session"
+
+// What we need to remember about an authorization between the redirect to the provider and the callback
+type stateData struct {
+	Scope    []string `json:"scope"`
+	Verifier string   `json:"verifier,omitempty"`
+	Nonce    string   `json:"nonce,omitempty"`
+	// the token request must use the exact same redirect URI as the authorization request
+	RedirectURI string `json:"redirect_uri,omitempty"`
+	// secret of the OAuth1 temporary credentials, the state is their token
+	TokenSecret string `json:"token_secret,omitempty"`
+	// return path of OAuth1 authorizations, OAuth2 ones carry it in the state
+	ReturnTo string `json:"return_to,omitempty"`
+}
+
+// The CSRF state of a provider as stored in the session
+type pendingState struct {
+	State   string    `json:"state"`
+	Created time.Time `json:"created"`
+}
+
+// Where a pending authorization is kept between Authorize and Access, the user session or a signed cookie
+type stateBackend interface {
+	save(providerName string, state string, data stateData) error
+	verify(providerName string, stateParam string) (string, *stateData, error)
+	delete(providerName string, state string) error
+}
+
+// Keeps the CSRF state in the session and its data in the configured StateStore
+type sessionBackend struct {
+	a       Authy
+	session Session
+}
+
+func (b sessionBackend) save(providerName string, state string, data stateData) error {
+	// tells Access that the session it got is the one we wrote to
+	b.session.Set(sessionMarkerKey, true)
+	if err := setPendingState(b.session, providerName, state); err != nil {
+		return err
+	}
+	return b.a.saveState(b.session, state, data)
+}
+
+func (b sessionBackend) verify(providerName string, stateParam string) (string, *stateData, error) {
+	return b.a.verifyState(b.session, providerName, stateParam)
+}
+
+func (b sessionBackend) delete(providerName string, state string) error {
+	return b.a.deleteState(b.session, providerName, state)
+}
+
+// Check the state returned by the provider against the pending authorization of the session and load its data
+func (a Authy) verifyState(session Session, providerName string, stateParam string) (string, *stateData, error) {
+	pending, err := getPendingState(session, providerName)
+	if err != nil {
+		// unreadable, drop it so the user can start over
+		session.Delete("authy." + providerName + ".state")
+		return "", nil, err
+	}
+	if pending == nil {
+		// the browser didn't send the session cookie back, or the user never went through Authorize
+		if session.Get(sessionMarkerKey) == nil {
+			return "", nil, ErrNoSession
+		}
+		return "", nil, ErrStateMissing
+	}
+	state := pending.State
+
+	// abandoned or replayed authorization
+	if time.Since(pending.Created) > a.stateMaxAge() {
+		if err := a.deleteState(session, providerName, state); err != nil {
+			return "", nil, err
+		}
+		return "", nil, ErrStateExpired
+	}
+
+	// the pending authorization can't be completed anymore, don't leave it in the session
+	if stateParam != state {
+		if err := a.deleteState(session, providerName, state); err != nil {
+			return "", nil, err
+		}
+		return "", nil, ErrStateMismatch
+	}
+
+	data, err := a.loadState(session, state)
+	if err != nil {
+		if err := a.deleteState(session, providerName, state); err != nil {
+			return "", nil, err
+		}
+		return "", nil, err
+	}
+	if data == nil {
+		if err := a.deleteState(session, providerName, state); err != nil {
+			return "", nil, err
+		}
+		return "", nil, ErrStateExpired
+	}
+
+	return state, data, nil
+}
+
+// Forget a pending authorization once its callback was handled
+func (a Authy) deleteState(session Session, providerName string, state string) error {
+	session.Delete("authy." + providerName + ".state")
+	return a.stateStore(session).Delete(state)
+}
+
+func (a Authy) stateMaxAge() time.Duration {
+	if a.config.StateMaxAge > 0 {
+		return a.config.StateMaxAge
+	}
+	return defaultStateMaxAge
+}
+
+// Store the CSRF state in the session along with its creation date, it's serialized so that sessions encoding their
+// values with encoding/gob don't need the type to be registered
+func setPendingState(session Session, providerName string, state string) error {
+	encoded, err := json.Marshal(pendingState{State: state, Created: time.Now()})
+	if err != nil {
+		return err
+	}
+	session.Set("authy."+providerName+".state", encoded)
+	return nil
+}
+
+// Returns nil if there is no state for the provider in the session
+func getPendingState(session Session, providerName string) (*pendingState, error) {
+	encoded, err := sessionBytes(session, "authy."+providerName+".state")
+	if err != nil || encoded == nil {
+		return nil, err
+	}
+
+	var pending pendingState
+	if err := json.Unmarshal(encoded, &pending); err != nil {
+		return nil, fmt.Errorf("%w, %w", ErrInvalidSessionData, err)
+	}
+	return &pending, nil
+}
+
+// StateStore keeping the data in the user session, used when no store is configured
+type sessionStateStore struct {
+	session Session
+}
+
+func (s sessionStateStore) Save(state string, data []byte, ttl time.Duration) error {
+	s.session.Set("authy."+state, data)
+	return nil
+}
+
+func (s sessionStateStore) Load(state string) ([]byte, error) {
+	return sessionBytes(s.session, "authy."+state)
+}
+
+func (s sessionStateStore) Delete(state string) error {
+	s.session.Delete("authy." + state)
+	return nil
+}
+
+// In memory StateStore, only suitable when running a single instance of the application
+type MemoryStateStore struct {
+	mu     sync.Mutex
+	states map[string]memoryState
+}
+
+type memoryState struct {
+	data    []byte
+	expires time.Time
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		states: map[string]memoryState{},
+	}
+}
+
+func (m *MemoryStateStore) Save(state string, data []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// drop abandoned authorizations
+	now := time.Now()
+	for key, value := range m.states {
+		if now.After(value.expires) {
+			delete(m.states, key)
+		}
+	}
+
+	m.states[state] = memoryState{data: data, expires: now.Add(ttl)}
+	return nil
+}
+
+func (m *MemoryStateStore) Load(state string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok := m.states[state]
+	if ok != true || time.Now().After(value.expires) {
+		return nil, nil
+	}
+	return value.data, nil
+}
+
+func (m *MemoryStateStore) Delete(state string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.states, state)
+	return nil
+}
+
+func (a Authy) stateStore(session Session) StateStore {
+	if a.config.StateStore != nil {
+		return a.config.StateStore
+	}
+	return sessionStateStore{session: session}
+}
+
+func (a Authy) saveState(session Session, state string, data stateData) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return a.stateStore(session).Save(state, encoded, a.stateMaxAge())
+}
+
+// Returns nil if the state is unknown
+func (a Authy) loadState(session Session, state string) (*stateData, error) {
+	encoded, err := a.stateStore(session).Load(state)
+	if err != nil || encoded == nil {
+		return nil, err
+	}
+
+	var data stateData
+	if err := json.Unmarshal(encoded, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
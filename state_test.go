@@ -0,0 +1,201 @@
+package authy_test
+
+import (
+	"errors"
+	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/authytest"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMemoryStateStore(t *testing.T) {
+	Convey("Keep authorization data in memory", t, func() {
+		store := authy.NewMemoryStateStore()
+
+		So(store.Save("abc", []byte("data"), time.Minute), ShouldEqual, nil)
+		data, err := store.Load("abc")
+		So(err, ShouldEqual, nil)
+		So(string(data), ShouldEqual, "data")
+
+		Convey("Unknown state", func() {
+			data, err := store.Load("def")
+			So(err, ShouldEqual, nil)
+			So(data, ShouldBeNil)
+		})
+
+		Convey("Deleted state", func() {
+			So(store.Delete("abc"), ShouldEqual, nil)
+			data, _ := store.Load("abc")
+			So(data, ShouldBeNil)
+		})
+
+		Convey("Expired state", func() {
+			So(store.Save("expired", []byte("data"), -time.Second), ShouldEqual, nil)
+			data, _ := store.Load("expired")
+			So(data, ShouldBeNil)
+		})
+	})
+}
+
+func TestStateStore(t *testing.T) {
+	Convey("Keep authorization data out of the session", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		stateConfig := MockConfig("stated", server.URL+"/oauth2", server.URL+"/oauth2")
+		stateConfig.StateStore = authy.NewMemoryStateStore()
+
+		a, err := authy.NewAuthy(stateConfig)
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		authorizeURL, err := a.Authorize("stated", session, MockHttpRequest("http://localhost:2000/authy/stated"))
+		So(err, ShouldEqual, nil)
+
+		// only the state itself is kept in session, next to the marker telling Access the session is the right one
+		So(session.Values(), ShouldHaveLength, 2)
+		So(session.Values(), ShouldContainKey, "authy.stated.state")
+		state := StateFromURL(authorizeURL)
+
+		data, err := stateConfig.StateStore.Load(state)
+		So(err, ShouldEqual, nil)
+		So(data, ShouldNotBeNil)
+
+		_, _, err = a.Access("stated", session, MockHttpRequest("http://localhost:2000/authy/stated/callback?code=auth_test&state="+url.QueryEscape(state)))
+		So(err, ShouldEqual, nil)
+
+		data, _ = stateConfig.StateStore.Load(state)
+		So(data, ShouldBeNil)
+	})
+}
+
+func TestStateMaxAge(t *testing.T) {
+	Convey("Reject callbacks for old authorizations", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		stateConfig := MockConfig("aging", server.URL+"/oauth2", server.URL+"/oauth2")
+		stateConfig.StateMaxAge = 50 * time.Millisecond
+
+		a, err := authy.NewAuthy(stateConfig)
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		authorizeURL, err := a.Authorize("aging", session, MockHttpRequest("http://localhost:2000/authy/aging"))
+		So(err, ShouldEqual, nil)
+		callback := MockHttpRequest("http://localhost:2000/authy/aging/callback?code=auth_test&state=" + url.QueryEscape(StateFromURL(authorizeURL)))
+
+		Convey("Recent state", func() {
+			_, _, err := a.Access("aging", session, callback)
+			So(err, ShouldEqual, nil)
+		})
+
+		Convey("Expired state is rejected and forgotten", func() {
+			time.Sleep(100 * time.Millisecond)
+
+			_, _, err := a.Access("aging", session, callback)
+			So(err, ShouldNotEqual, nil)
+			So(session.Values(), ShouldResemble, map[interface{}]interface{}{"authy.session": true})
+		})
+	})
+}
+
+func TestFailedCallback(t *testing.T) {
+	Convey("Forget the authorization when its callback fails", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		a, err := authy.NewAuthy(MockConfig("failing", server.URL+"/oauth2", server.URL+"/oauth2/revoked"))
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		authorizeURL, err := a.Authorize("failing", session, MockHttpRequest("http://localhost:2000/authy/failing"))
+		So(err, ShouldEqual, nil)
+		So(session.Values(), ShouldHaveLength, 3)
+		state := StateFromURL(authorizeURL)
+
+		Convey("Mismatched state", func() {
+			_, _, err := a.Access("failing", session, MockHttpRequest("http://localhost:2000/authy/failing/callback?code=auth_test&state=forged"))
+			So(err, ShouldEqual, authy.ErrStateMismatch)
+			So(session.Values(), ShouldResemble, map[interface{}]interface{}{"authy.session": true})
+		})
+
+		Convey("Provider refusing the code", func() {
+			_, _, err := a.Access("failing", session, MockHttpRequest("http://localhost:2000/authy/failing/callback?code=auth_test&state="+url.QueryEscape(state)))
+			So(err, ShouldNotEqual, nil)
+			So(session.Values(), ShouldResemble, map[interface{}]interface{}{"authy.session": true})
+		})
+
+		Convey("Missing code", func() {
+			_, _, err := a.Access("failing", session, MockHttpRequest("http://localhost:2000/authy/failing/callback?error=access_denied&state="+url.QueryEscape(state)))
+			So(err, ShouldNotEqual, nil)
+			So(session.Values(), ShouldResemble, map[interface{}]interface{}{"authy.session": true})
+		})
+	})
+}
+
+func TestMalformedSession(t *testing.T) {
+	Convey("Reject session data of the wrong type instead of panicking", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		a, err := authy.NewAuthy(MockConfig("malformed", server.URL+"/oauth2", server.URL+"/oauth2"))
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		authorizeURL, err := a.Authorize("malformed", session, MockHttpRequest("http://localhost:2000/authy/malformed"))
+		So(err, ShouldEqual, nil)
+		state := StateFromURL(authorizeURL)
+		callback := MockHttpRequest("http://localhost:2000/authy/malformed/callback?code=auth_test&state=" + url.QueryEscape(state))
+
+		Convey("Values given back as strings still work", func() {
+			for key, value := range session.Values() {
+				if encoded, ok := value.([]byte); ok == true {
+					session.Set(key, string(encoded))
+				}
+			}
+
+			token, _, err := a.Access("malformed", session, callback)
+			So(err, ShouldEqual, nil)
+			So(token.Value, ShouldEqual, "fakeaccesstoken")
+		})
+
+		Convey("Pending state of another type", func() {
+			session.Set("authy.malformed.state", 42)
+
+			_, _, err := a.Access("malformed", session, callback)
+			So(errors.Is(err, authy.ErrInvalidSessionData), ShouldBeTrue)
+			So(session.Values(), ShouldNotContainKey, "authy.malformed.state")
+		})
+
+		Convey("Pending state that isn't JSON", func() {
+			session.Set("authy.malformed.state", []byte("garbage"))
+
+			_, _, err := a.Access("malformed", session, callback)
+			So(errors.Is(err, authy.ErrInvalidSessionData), ShouldBeTrue)
+			So(session.Values(), ShouldNotContainKey, "authy.malformed.state")
+		})
+
+		Convey("Authorization data of another type", func() {
+			session.Set("authy."+state, map[string]string{"scope": "read"})
+
+			_, _, err := a.Access("malformed", session, callback)
+			So(errors.Is(err, authy.ErrInvalidSessionData), ShouldBeTrue)
+			So(session.Values(), ShouldNotContainKey, "authy."+state)
+		})
+
+		Convey("Token of another type", func() {
+			session.Set(authy.TokenSessionKey("malformed"), 42)
+
+			token, err := a.LoadToken(session, "malformed")
+			So(token, ShouldEqual, nil)
+			So(errors.Is(err, authy.ErrInvalidSessionData), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,243 @@
+package authy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/christopherobin/authy/oauth2"
+	"github.com/christopherobin/authy/provider"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Minimum length of the key signing state cookies
+const stateCookieKeyLength = 32
+
+// Keep pending authorizations in a short lived signed cookie instead of the session, for applications that don't want
+// a server side session just to go through the OAuth redirect. The cookie is signed, not encrypted, the user can read
+// its content (CSRF state, requested scopes, PKCE verifier) but cannot change it
+type StateCookie struct {
+	// Key used to sign the cookies with HMAC-SHA256, at least 32 bytes. Like provider secrets it can reference an
+	// environment variable: ${AUTHY_STATE_KEY}
+	Key string `json:"key"`
+	// Prefix of the cookie names, the provider name is appended so that users can log in with several providers at once
+	// (defaults to authy_state)
+	Name string `json:"name"`
+	// Path of the cookies (defaults to /)
+	Path string `json:"path"`
+	// Whether the cookies get the Secure flag, defaults to the requests received over TLS or with the X-HTTPS header
+	// of a proxy terminating TLS, like the redirect URIs (see oauth2.RequestOrigin). Cookies of providers POSTing the
+	// callback are always Secure, browsers require it for SameSite=None
+	Secure func(r *http.Request) bool `json:"-"`
+}
+
+// Print the state cookie config with its key masked
+func (stateCookie StateCookie) String() string {
+	// same fields without the String method
+	type plainStateCookie StateCookie
+	redacted := plainStateCookie(stateCookie)
+	redacted.Key = provider.Redact(stateCookie.Key)
+	return fmt.Sprintf("%+v", redacted)
+}
+
+func (stateCookie StateCookie) GoString() string {
+	return "authy.StateCookie" + stateCookie.String()
+}
+
+// What the state cookie holds
+type stateCookiePayload struct {
+	Provider string    `json:"provider"`
+	State    string    `json:"state"`
+	Created  time.Time `json:"created"`
+	Data     stateData `json:"data"`
+}
+
+// Resolve the key of the state cookie and check it's long enough
+func loadStateCookie(stateCookie StateCookie) (StateCookie, error) {
+	var err error
+	if stateCookie.Key, err = resolveEnv(stateCookie.Key); err != nil {
+		return stateCookie, err
+	}
+	if len(stateCookie.Key) < stateCookieKeyLength {
+		return stateCookie, errors.New(fmt.Sprintf("key must be at least %d bytes", stateCookieKeyLength))
+	}
+	if stateCookie.Name == "" {
+		stateCookie.Name = "authy_state"
+	}
+	if stateCookie.Path == "" {
+		stateCookie.Path = "/"
+	}
+	return stateCookie, nil
+}
+
+// Same as Authorize but keep the pending authorization in a signed cookie set on w instead of the session, requires
+// Config.StateCookie. The callback must be handled by AccessWithCookie
+func (a Authy) AuthorizeWithCookie(providerName string, w http.ResponseWriter, r *http.Request, opts ...AuthorizeOption) (string, error) {
+	backend, err := a.cookieBackend(w, r)
+	if err != nil {
+		return "", err
+	}
+	return a.authorize(providerName, backend, r, opts)
+}
+
+// Same as Access but check the callback against the state cookie set by AuthorizeWithCookie, the cookie is deleted
+// once the token was retrieved
+func (a Authy) AccessWithCookie(providerName string, w http.ResponseWriter, r *http.Request) (*Token, string, error) {
+	backend, err := a.cookieBackend(w, r)
+	if err != nil {
+		return nil, "", err
+	}
+	return a.access(providerName, backend, r)
+}
+
+// Start the authorization of a login route, the pending authorization is kept in the state cookie when
+// Config.StateCookie is set and in the session otherwise. The callback must be handled by AccessRequest
+func (a Authy) AuthorizeRequest(providerName string, session Session, w http.ResponseWriter, r *http.Request, opts ...AuthorizeOption) (string, error) {
+	if a.config.StateCookie != nil {
+		return a.AuthorizeWithCookie(providerName, w, r, opts...)
+	}
+	return a.Authorize(providerName, session, r, opts...)
+}
+
+// Handle the callback of an authorization started by AuthorizeRequest, checking it against the state cookie when
+// Config.StateCookie is set and against the session otherwise
+func (a Authy) AccessRequest(providerName string, session Session, w http.ResponseWriter, r *http.Request) (*Token, string, error) {
+	if a.config.StateCookie != nil {
+		return a.AccessWithCookie(providerName, w, r)
+	}
+	return a.Access(providerName, session, r)
+}
+
+func (a Authy) cookieBackend(w http.ResponseWriter, r *http.Request) (cookieBackend, error) {
+	if a.config.StateCookie == nil {
+		return cookieBackend{}, errors.New("state cookie is not configured")
+	}
+	return cookieBackend{a: a, config: *a.config.StateCookie, w: w, r: r}, nil
+}
+
+// Keeps the CSRF state and its data in a cookie
+type cookieBackend struct {
+	a      Authy
+	config StateCookie
+	w      http.ResponseWriter
+	r      *http.Request
+}
+
+func (b cookieBackend) name(providerName string) string {
+	return b.config.Name + "_" + providerName
+}
+
+func (b cookieBackend) save(providerName string, state string, data stateData) error {
+	encoded, err := json.Marshal(stateCookiePayload{
+		Provider: providerName,
+		State:    state,
+		Created:  time.Now(),
+		Data:     data,
+	})
+	if err != nil {
+		return err
+	}
+
+	value := base64.RawURLEncoding.EncodeToString(encoded)
+	value += "." + base64.RawURLEncoding.EncodeToString(b.sign(value))
+
+	b.setCookie(providerName, value, int(b.a.stateMaxAge().Seconds()))
+	return nil
+}
+
+func (b cookieBackend) verify(providerName string, stateParam string) (string, *stateData, error) {
+	state, data, err := b.read(providerName, stateParam)
+	// the cookie can't be used for another callback, drop it
+	if err != nil && err != ErrNoSession {
+		b.delete(providerName, "")
+	}
+	return state, data, err
+}
+
+func (b cookieBackend) read(providerName string, stateParam string) (string, *stateData, error) {
+	cookie, err := b.r.Cookie(b.name(providerName))
+	if err != nil {
+		return "", nil, ErrNoSession
+	}
+
+	// only trust cookies we signed
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 2 {
+		return "", nil, ErrStateMismatch
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, b.sign(parts[0])) {
+		return "", nil, ErrStateMismatch
+	}
+
+	encoded, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", nil, err
+	}
+	var payload stateCookiePayload
+	if err := json.Unmarshal(encoded, &payload); err != nil {
+		return "", nil, err
+	}
+
+	// a cookie copied from another provider
+	if payload.Provider != providerName {
+		return "", nil, ErrStateMismatch
+	}
+
+	// the cookie expires on its own, but don't trust the browser for it
+	if time.Since(payload.Created) > b.a.stateMaxAge() {
+		b.delete(providerName, payload.State)
+		return "", nil, ErrStateExpired
+	}
+
+	if stateParam != payload.State {
+		return "", nil, ErrStateMismatch
+	}
+
+	return payload.State, &payload.Data, nil
+}
+
+func (b cookieBackend) delete(providerName string, state string) error {
+	b.setCookie(providerName, "", -1)
+	return nil
+}
+
+// The callback is a cross site navigation coming from the provider, Lax cookies are sent with it while Strict ones
+// are not. Browsers don't send Lax cookies with cross site POSTs either, providers POSTing the callback need None
+func (b cookieBackend) setCookie(providerName string, value string, maxAge int) {
+	sameSite := http.SameSiteLaxMode
+	secure := oauth2.RequestOrigin(b.r).Scheme == "https"
+	if b.config.Secure != nil {
+		secure = b.config.Secure(b.r)
+	}
+	if providerConfig, ok := b.a.providers[providerName]; ok == true && postsCallback(providerConfig) {
+		sameSite = http.SameSiteNoneMode
+		secure = true
+	}
+
+	http.SetCookie(b.w, &http.Cookie{
+		Name:     b.name(providerName),
+		Value:    value,
+		Path:     b.config.Path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: sameSite,
+	})
+}
+
+// Whether the provider POSTs the callback parameters (response_mode=form_post) instead of redirecting the user
+func postsCallback(providerConfig provider.ProviderConfig) bool {
+	return providerConfig.Provider.ResponseMode == provider.ResponseModeFormPost ||
+		providerConfig.CustomParameters["response_mode"] == provider.ResponseModeFormPost
+}
+
+func (b cookieBackend) sign(value string) []byte {
+	mac := hmac.New(sha256.New, []byte(b.config.Key))
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,217 @@
+package authy_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/authytest"
+	"github.com/christopherobin/authy/oauth2"
+	"github.com/christopherobin/authy/provider"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStateCookie(t *testing.T) {
+	Convey("Keep the state in a signed cookie", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+
+		p := server.Provider("stateless")
+		config := authy.Config{
+			StateCookie: &authy.StateCookie{Key: "0123456789abcdef0123456789abcdef"},
+			Providers: map[string]provider.ProviderConfig{
+				"stateless": provider.ProviderConfig{Inline: &p, Key: "my-key", Secret: "my-secret", Scope: []string{"read"}},
+			},
+		}
+		a, err := authy.NewAuthy(config)
+		So(err, ShouldEqual, nil)
+
+		rw := httptest.NewRecorder()
+		authorizeURL, err := a.AuthorizeWithCookie("stateless", rw, MockHttpRequest("http://localhost:2000/authy/stateless"))
+		So(err, ShouldEqual, nil)
+
+		cookies := rw.Result().Cookies()
+		So(cookies, ShouldHaveLength, 1)
+		So(cookies[0].Name, ShouldEqual, "authy_state_stateless")
+		So(cookies[0].HttpOnly, ShouldBeTrue)
+		// the authorization request came over plain http
+		So(cookies[0].Secure, ShouldBeFalse)
+		So(cookies[0].SameSite, ShouldEqual, http.SameSiteLaxMode)
+		So(cookies[0].MaxAge, ShouldEqual, 600)
+
+		callback, err := server.Callback(authorizeURL)
+		So(err, ShouldEqual, nil)
+
+		Convey("Secure cookies", func() {
+			request := MockHttpRequest("https://localhost:2000/authy/stateless")
+			request.TLS = &tls.ConnectionState{}
+			rw := httptest.NewRecorder()
+			_, err := a.AuthorizeWithCookie("stateless", rw, request)
+			So(err, ShouldEqual, nil)
+			So(rw.Result().Cookies()[0].Secure, ShouldBeTrue)
+
+			// behind a proxy terminating TLS
+			request = MockHttpRequest("http://localhost:2000/authy/stateless")
+			request.Header = http.Header{}
+			request.Header.Set("X-HTTPS", "1")
+			rw = httptest.NewRecorder()
+			_, err = a.AuthorizeWithCookie("stateless", rw, request)
+			So(err, ShouldEqual, nil)
+			So(rw.Result().Cookies()[0].Secure, ShouldBeTrue)
+
+			// or told so by the config
+			config.StateCookie.Secure = func(r *http.Request) bool { return true }
+			a, err := authy.NewAuthy(config)
+			So(err, ShouldEqual, nil)
+			rw = httptest.NewRecorder()
+			_, err = a.AuthorizeWithCookie("stateless", rw, MockHttpRequest("http://localhost:2000/authy/stateless"))
+			So(err, ShouldEqual, nil)
+			So(rw.Result().Cookies()[0].Secure, ShouldBeTrue)
+		})
+
+		Convey("Valid callback", func() {
+			callback.AddCookie(cookies[0])
+			rw := httptest.NewRecorder()
+			token, _, err := a.AccessWithCookie("stateless", rw, callback)
+			So(err, ShouldEqual, nil)
+			So(token.Value, ShouldEqual, authytest.AccessToken)
+			So(token.RequestedScope, ShouldResemble, []string{"read"})
+
+			// the cookie is deleted
+			deleted := rw.Result().Cookies()
+			So(deleted, ShouldHaveLength, 1)
+			So(deleted[0].MaxAge, ShouldBeLessThan, 0)
+		})
+
+		Convey("Missing cookie", func() {
+			_, _, err := a.AccessWithCookie("stateless", httptest.NewRecorder(), callback)
+			So(err, ShouldEqual, authy.ErrNoSession)
+		})
+
+		Convey("Tampered cookie", func() {
+			cookie := *cookies[0]
+			cookie.Value = strings.Replace(cookie.Value, cookie.Value[:8], "AAAAAAAA", 1)
+			callback.AddCookie(&cookie)
+			rw := httptest.NewRecorder()
+			_, _, err := a.AccessWithCookie("stateless", rw, callback)
+			So(err, ShouldEqual, authy.ErrStateMismatch)
+
+			// the cookie is dropped along with the failed callback
+			deleted := rw.Result().Cookies()
+			So(deleted, ShouldHaveLength, 1)
+			So(deleted[0].MaxAge, ShouldBeLessThan, 0)
+		})
+
+		Convey("Cookie signed with another key", func() {
+			config.StateCookie = &authy.StateCookie{Key: "fedcba9876543210fedcba9876543210"}
+			other, err := authy.NewAuthy(config)
+			So(err, ShouldEqual, nil)
+
+			callback.AddCookie(cookies[0])
+			_, _, err = other.AccessWithCookie("stateless", httptest.NewRecorder(), callback)
+			So(err, ShouldEqual, authy.ErrStateMismatch)
+		})
+
+		Convey("Reject short keys", func() {
+			config.StateCookie = &authy.StateCookie{Key: "short"}
+			_, err := authy.NewAuthy(config)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "state cookie: key must be at least 32 bytes")
+		})
+
+		Convey("Require the configuration", func() {
+			config.StateCookie = nil
+			sessionOnly, err := authy.NewAuthy(config)
+			So(err, ShouldEqual, nil)
+
+			_, err = sessionOnly.AuthorizeWithCookie("stateless", httptest.NewRecorder(), MockHttpRequest("http://localhost:2000/authy/stateless"))
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Pick the cookie or the session depending on the configuration", func() {
+			session := authytest.NewSession()
+			rw := httptest.NewRecorder()
+			authorizeURL, err := a.AuthorizeRequest("stateless", session, rw, MockHttpRequest("http://localhost:2000/authy/stateless"))
+			So(err, ShouldEqual, nil)
+			So(rw.Result().Cookies(), ShouldHaveLength, 1)
+			So(session.Values(), ShouldBeEmpty)
+
+			callback, err := server.Callback(authorizeURL)
+			So(err, ShouldEqual, nil)
+			callback.AddCookie(rw.Result().Cookies()[0])
+			token, _, err := a.AccessRequest("stateless", session, httptest.NewRecorder(), callback)
+			So(err, ShouldEqual, nil)
+			So(token.Value, ShouldEqual, authytest.AccessToken)
+
+			config.StateCookie = nil
+			sessionOnly, err := authy.NewAuthy(config)
+			So(err, ShouldEqual, nil)
+
+			rw = httptest.NewRecorder()
+			authorizeURL, err = sessionOnly.AuthorizeRequest("stateless", session, rw, MockHttpRequest("http://localhost:2000/authy/stateless"))
+			So(err, ShouldEqual, nil)
+			So(rw.Result().Cookies(), ShouldBeEmpty)
+			So(session.Values(), ShouldNotBeEmpty)
+
+			callback, err = server.Callback(authorizeURL)
+			So(err, ShouldEqual, nil)
+			token, _, err = sessionOnly.AccessRequest("stateless", session, httptest.NewRecorder(), callback)
+			So(err, ShouldEqual, nil)
+			So(token.Value, ShouldEqual, authytest.AccessToken)
+		})
+	})
+}
+
+func TestFormPostCallback(t *testing.T) {
+	Convey("Read the callback parameters POSTed by the provider", t, func() {
+		server := authytest.NewServer()
+		Reset(server.Close)
+
+		p := server.Provider("formpost", provider.WithCustomParameters("response_mode"))
+		a, err := authy.NewAuthy(authy.Config{
+			StateCookie: &authy.StateCookie{Key: "0123456789abcdef0123456789abcdef"},
+			Providers: map[string]provider.ProviderConfig{
+				"formpost": provider.ProviderConfig{Inline: &p, Key: "my-key", Secret: "my-secret", Scope: []string{"read"},
+					CustomParameters: map[string]string{"response_mode": "form_post"}},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		rw := httptest.NewRecorder()
+		authorizeURL, err := a.AuthorizeWithCookie("formpost", rw, MockHttpRequest("http://localhost:2000/authy/formpost"))
+		So(err, ShouldEqual, nil)
+
+		// browsers only send SameSite=None cookies with cross site POSTs
+		cookies := rw.Result().Cookies()
+		So(cookies, ShouldHaveLength, 1)
+		So(cookies[0].SameSite, ShouldEqual, http.SameSiteNoneMode)
+		So(cookies[0].Secure, ShouldBeTrue)
+
+		callback, err := server.Callback(authorizeURL)
+		So(err, ShouldEqual, nil)
+		So(callback.Method, ShouldEqual, "POST")
+		callback.AddCookie(cookies[0])
+
+		Convey("Code and state come from the body", func() {
+			token, _, err := a.AccessWithCookie("formpost", httptest.NewRecorder(), callback)
+			So(err, ShouldEqual, nil)
+			So(token.Value, ShouldEqual, authytest.AccessToken)
+			So(server.TokenRequests()[0].Get("code"), ShouldEqual, authytest.Code)
+		})
+
+		Convey("Errors come from the body too", func() {
+			callback.ParseForm()
+			form := url.Values{"state": {callback.PostForm.Get("state")}, "error": {"access_denied"}}
+			denied := httptest.NewRequest("POST", callback.URL.String(), strings.NewReader(form.Encode()))
+			denied.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			denied.AddCookie(cookies[0])
+
+			_, _, err := a.AccessWithCookie("formpost", httptest.NewRecorder(), denied)
+			So(errors.Is(err, oauth2.ErrAccessDenied), ShouldBeTrue)
+		})
+	})
+}
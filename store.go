@@ -0,0 +1,10 @@
+package authy
+
+// Stores tokens outside of the user session, for example to share them between several instances of an application or
+// to keep them across restarts
+type TokenStore interface {
+	// Load the token saved under the given key, returns nil if there is none
+	Load(key string) (*Token, error)
+	// Save the token under the given key, replacing any previous one
+	Save(key string, token *Token) error
+}
@@ -1,11 +1,19 @@
 package authy
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/christopherobin/authy/oauth1"
 	"github.com/christopherobin/authy/oauth2"
+	"github.com/christopherobin/authy/provider"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,15 +27,59 @@ type Token struct {
 	Provider string `json:"provider"`
 	// The actual value of the token
 	Value string `json:"value"`
+	// The token secret of OAuth1 tokens, used to sign requests
+	Secret string `json:"secret,omitempty"`
 	// The scopes returned by the provider, some providers may allow the user to change the scope of an auth request
 	// Make sure to check the available scopes before doing queries on their webservices
+	// Same as GrantedScope, or RequestedScope if the provider didn't say what it granted
 	Scope []string `json:"scope"`
+	// The scopes of the authorization request
+	RequestedScope []string `json:"requested_scope,omitempty"`
+	// The scopes the provider said it granted, compare with RequestedScope to detect down-scoping
+	GrantedScope []string `json:"granted_scope,omitempty"`
 	// The type of token
 	Type string `json:"type"`
 	// Expiry date
-	Expires *time.Time `json:"time"`
+	Expires *time.Time `json:"expires"`
 	// The refresh token if one
 	RefreshToken string `json:"refresh_token"`
+	// OpenID Connect id_token if the provider returned one
+	IDToken string `json:"id_token"`
+	// Response headers captured during the token exchange, see ProviderConfig.CaptureHeaders
+	Extra map[string]string `json:"extra"`
+	// Profile the provider sent along the callback, only Sign in with Apple does it and only on the first login of the
+	// user: save it if you need it
+	Profile *UserInfo `json:"profile,omitempty"`
+	// Inner transport of the clients of the token, see SetTransport
+	transport http.RoundTripper
+	// Guards refreshes, shared by the copies of the token
+	refresh *refreshState
+}
+
+type refreshState struct {
+	sync.Mutex
+	// the refresh in flight if any
+	call *refreshCall
+}
+
+type refreshCall struct {
+	done  chan struct{}
+	token oauth2.Token
+	err   error
+}
+
+// protects the lazy creation of the refresh state of tokens built by hand, tokens made by Authy get theirs right away
+// so that every copy shares it
+var refreshStateLock sync.Mutex
+
+func (t *Token) state() *refreshState {
+	refreshStateLock.Lock()
+	defer refreshStateLock.Unlock()
+
+	if t.refresh == nil {
+		t.refresh = &refreshState{}
+	}
+	return t.refresh
 }
 
 func tokenFromOAuth2(a Authy, provider string, t oauth2.Token) *Token {
@@ -37,9 +89,35 @@ func tokenFromOAuth2(a Authy, provider string, t oauth2.Token) *Token {
 		Provider:     provider,
 		Value:        t.AccessToken,
 		Scope:        t.Scope,
+		GrantedScope: t.Scope,
 		Type:         t.Type,
 		Expires:      t.Expires,
 		RefreshToken: t.RefreshToken,
+		IDToken:      t.IDToken,
+		Extra:        t.Extra,
+		refresh:      &refreshState{},
+	}
+}
+
+func tokenFromOAuth1(a Authy, provider string, t oauth1.Token, scope []string) *Token {
+	return &Token{
+		authy:          a,
+		Version:        1,
+		Provider:       provider,
+		Value:          t.Token,
+		Secret:         t.Secret,
+		Scope:          scope,
+		RequestedScope: scope,
+		Extra:          t.Extra,
+		refresh:        &refreshState{},
+	}
+}
+
+// Remember the requested scopes, they are also the token's scopes if the provider didn't return what it granted
+func (t *Token) setRequestedScope(scope []string) {
+	t.RequestedScope = scope
+	if len(t.GrantedScope) == 0 {
+		t.Scope = scope
 	}
 }
 
@@ -51,81 +129,418 @@ func (t *Token) oauth2() oauth2.Token {
 		Type:         t.Type,
 		Expires:      t.Expires,
 		RefreshToken: t.RefreshToken,
+		IDToken:      t.IDToken,
+		Extra:        t.Extra,
 	}
 }
 
+// Decode a JSON token, tokens serialized by older versions stored the expiry date under "time"
+func (t *Token) UnmarshalJSON(data []byte) error {
+	// same fields without the UnmarshalJSON method
+	type plainToken Token
+
+	var decoded struct {
+		plainToken
+		LegacyExpires *time.Time `json:"time"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	*t = Token(decoded.plainToken)
+	if t.Expires == nil {
+		t.Expires = decoded.LegacyExpires
+	}
+	return nil
+}
+
 // Deserialize a token back from its serialized form
 func (a Authy) TokenFromSerialized(data []byte) (*Token, error) {
-	var t Token
-	err := json.Unmarshal(data, &t)
-	if err != nil {
-		return nil, err
+	return a.TokenFromCodec(JSONCodec, data)
+}
+
+// Tokens are considered expired this long before their actual expiry so that they get refreshed before failing in the
+// middle of a request
+var ExpirySkew = time.Minute
+
+// Returns true if token is expired or will expire within ExpirySkew
+func (t *Token) Expired() bool {
+	return t.ExpiredWithin(ExpirySkew)
+}
+
+// Returns true if token is expired or will expire within the given duration
+func (t *Token) ExpiredWithin(d time.Duration) bool {
+	state := t.state()
+	state.Lock()
+	defer state.Unlock()
+
+	return t.expiredWithin(d)
+}
+
+// Returns true if the token can be used as is: it has a value and doesn't expire within ExpirySkew. Nil and zero value
+// tokens are not valid
+func (t *Token) Valid() bool {
+	if t == nil {
+		return false
 	}
 
-	// assign authy
-	t.authy = a
-	return &t, nil
+	state := t.state()
+	state.Lock()
+	defer state.Unlock()
+
+	return t.Value != "" && !t.expiredWithin(ExpirySkew)
 }
 
-// Returns true if token is expired
-func (t *Token) Expired() bool {
+func (t *Token) expiredWithin(d time.Duration) bool {
 	if t.Expires == nil {
 		return false
 	}
-	return time.Now().After(*t.Expires)
+	return time.Now().Add(d).After(*t.Expires)
+}
+
+// Returns a stable identifier derived from the access token that can be used as a cache key or in logs without
+// leaking the token itself (first 128 bits of its SHA-256 sum, hex encoded)
+func (t *Token) Fingerprint() string {
+	sum := sha256.Sum256([]byte(t.Value))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Whether both tokens hold the same credentials: same Version, Provider, Type, Value, RefreshToken, Expires and Scope,
+// the other fields are ignored. Secrets are compared in constant time, safe to call while the tokens are refreshed
+func (t *Token) Equal(other *Token) bool {
+	if t == nil || other == nil {
+		return t == other
+	}
+
+	a, b := t.snapshot(), other.snapshot()
+	if a.Version != b.Version || a.Provider != b.Provider || a.Type != b.Type || len(a.Scope) != len(b.Scope) {
+		return false
+	}
+	for i := range a.Scope {
+		if a.Scope[i] != b.Scope[i] {
+			return false
+		}
+	}
+	if (a.Expires == nil) != (b.Expires == nil) || (a.Expires != nil && !a.Expires.Equal(*b.Expires)) {
+		return false
+	}
+
+	// evaluate both so the time doesn't tell which one differs
+	sameValue := subtle.ConstantTimeCompare([]byte(a.Value), []byte(b.Value))
+	sameRefreshToken := subtle.ConstantTimeCompare([]byte(a.RefreshToken), []byte(b.RefreshToken))
+	return sameValue&sameRefreshToken == 1
+}
+
+// copy of the fields compared by Equal, a refresh updates them together
+func (t *Token) snapshot() Token {
+	state := t.state()
+	state.Lock()
+	defer state.Unlock()
+
+	return Token{
+		Version:      t.Version,
+		Provider:     t.Provider,
+		Value:        t.Value,
+		Scope:        t.Scope,
+		Type:         t.Type,
+		Expires:      t.Expires,
+		RefreshToken: t.RefreshToken,
+	}
+}
+
+// Claims of the OpenID Connect id_token, the signature is NOT verified so don't use them for anything security related
+func (t *Token) Claims() (map[string]interface{}, error) {
+	return t.oauth2().Claims()
+}
+
+// Whether the provider granted the given scope, aliases declared by the provider are taken into account
+func (t *Token) HasScope(scope string) bool {
+	state := t.state()
+	state.Lock()
+	defer state.Unlock()
+
+	definition := t.authy.providers[t.Provider].Provider
+	wanted := definition.CanonicalScope(scope)
+
+	for _, granted := range t.Scope {
+		if definition.CanonicalScope(granted) == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the provider granted all the given scopes, see HasScope
+func (t *Token) HasAllScopes(scopes ...string) bool {
+	for _, scope := range scopes {
+		if !t.HasScope(scope) {
+			return false
+		}
+	}
+	return true
 }
 
 // Whether or not the token can be refreshed via the provider's api
 func (t *Token) IsRefreshable() bool {
-	return t.Version == 2 && t.RefreshToken != ""
+	state := t.state()
+	state.Lock()
+	defer state.Unlock()
+
+	return t.isRefreshable()
 }
 
-// Try to refresh token
+func (t *Token) isRefreshable() bool {
+	switch t.Version {
+	case 2:
+		return t.RefreshToken != ""
+	default:
+		// OAuth1 tokens don't expire and cannot be refreshed
+		return false
+	}
+}
+
+// Try to refresh token, if the provider doesn't accept the refresh token anymore the error will match ErrReauthRequired
+// (and ErrConsentRevoked if the user revoked the application). Safe to call from several goroutines, only one refresh
+// is sent to the provider at a time and the other callers get its result
 func (t *Token) Refresh() error {
-	if !t.IsRefreshable() {
+	return t.RefreshContext(context.Background())
+}
+
+// Same as Refresh, the context controls the request sent to the provider. Callers waiting for a refresh started by
+// another goroutine give up when their context is done
+func (t *Token) RefreshContext(ctx context.Context) error {
+	switch t.Version {
+	case 1:
+		return ErrRefreshNotSupported
+	case 2:
+		return t.refreshOAuth2(ctx)
+	}
+
+	return fmt.Errorf("%w, unknown token version %d", ErrNotImplemented, t.Version)
+}
+
+func (t *Token) refreshOAuth2(ctx context.Context) error {
+	state := t.state()
+	state.Lock()
+
+	// another goroutine is already refreshing, wait for it
+	if call := state.call; call != nil {
+		state.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if call.err != nil {
+			return call.err
+		}
+		state.Lock()
+		t.update(call.token)
+		state.Unlock()
+		return nil
+	}
+
+	if t.RefreshToken == "" {
+		state.Unlock()
 		return errors.New("Token cannot be refreshed")
 	}
 
 	providerConfig, ok := t.authy.providers[t.Provider]
 	if ok != true {
-		return errors.New(fmt.Sprintf("unknown provider %s", t.Provider))
+		state.Unlock()
+		return fmt.Errorf("%w %s", ErrUnknownProvider, t.Provider)
 	}
 
-	if t.Version == 2 {
-		newToken, err := oauth2.Refresh(providerConfig, t.oauth2())
-		if err != nil {
-			return err
-		}
+	call := &refreshCall{done: make(chan struct{})}
+	state.call = call
+	originalToken := t.oauth2()
+	state.Unlock()
+
+	done := t.authy.observe(t.Provider, OperationRefresh)
+	call.token, call.err = oauth2.RefreshContext(ctx, providerConfig, originalToken)
+	if call.err != nil {
+		call.err = refreshError(call.err)
+	}
+	done(call.err)
+
+	state.Lock()
+	if call.err == nil {
+		t.update(call.token)
+	}
+	state.call = nil
+	state.Unlock()
+	close(call.done)
 
+	return call.err
+}
+
+// apply the result of a refresh
+func (t *Token) update(newToken oauth2.Token) {
+	// an empty refresh token means the current one must be kept
+	if newToken.RefreshToken != "" {
 		t.RefreshToken = newToken.RefreshToken
-		t.Value = newToken.AccessToken
-		t.Expires = newToken.Expires
-		t.Type = newToken.Type
 	}
+	t.Value = newToken.AccessToken
+	t.Expires = newToken.Expires
+	t.Type = newToken.Type
+	if newToken.IDToken != "" {
+		t.IDToken = newToken.IDToken
+	}
+	if len(newToken.Scope) > 0 {
+		t.Scope = newToken.Scope
+		t.GrantedScope = newToken.Scope
+	}
+	if newToken.Extra != nil {
+		t.Extra = newToken.Extra
+	}
+}
 
-	return nil
+// Raw access token, safe to call while another goroutine refreshes the token. Printing the token masks it
+func (t *Token) RawValue() string {
+	return t.value()
+}
+
+// Same as oauth2.Token.String, the secret of OAuth1 tokens is masked as well. Use RawValue for the access token
+func (t Token) String() string {
+	expires := "never"
+	if t.Expires != nil {
+		expires = t.Expires.String()
+	}
+	return fmt.Sprintf("{Version:%d Provider:%s Value:%s Secret:%s Scope:%v Type:%s Expires:%s RefreshToken:%s IDToken:%s Extra:%v}",
+		t.Version, t.Provider, provider.Redact(t.Value), provider.Redact(t.Secret), t.Scope, t.Type, expires,
+		provider.Redact(t.RefreshToken), provider.Redact(t.IDToken), t.Extra)
+}
+
+func (t Token) GoString() string {
+	return "authy.Token" + t.String()
+}
+
+// Current access token, safe to call while another goroutine refreshes the token
+func (t *Token) value() string {
+	state := t.state()
+	state.Lock()
+	defer state.Unlock()
+
+	return t.Value
 }
 
 // Serialize a token in a format that Authy can decode later, useful for session storage
-// For now use JSON, maybe switch to encoding/gob or capnproto later if we need more perfs
+// Uses JSON, see SerializeWith for other formats
 func (t *Token) Serialize() ([]byte, error) {
-	return json.Marshal(t)
+	return t.SerializeWith(JSONCodec)
 }
 
-// Quick transport implementation for an oauth client
+// Quick transport implementation for an oauth client, expired tokens are refreshed before sending the request
 type TokenTransport struct {
-	token     Token
+	mu        sync.Mutex
+	token     *Token
 	transport http.RoundTripper
+	// Called after the token was refreshed, use it to persist the new token. Not called when the provider sent the
+	// same token back
+	OnRefresh func(token *Token) error
+	// How long before its expiry the token is refreshed, defaults to ExpirySkew
+	ExpirySkew time.Duration
+	// set when the caller reports the requests to the observer itself
+	unobserved bool
 }
 
-func NewTokenTranport(t Token) *TokenTransport {
+// The transport updates the given token when refreshing it, requests are sent through base (tracing, retries, custom
+// TLS, ...) or http.DefaultTransport if nil
+func NewTokenTransport(t *Token, base http.RoundTripper) *TokenTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
 	return &TokenTransport{
-		token:     t,
-		transport: http.DefaultTransport,
+		token:      t,
+		transport:  base,
+		ExpirySkew: ExpirySkew,
+	}
+}
+
+// Deprecated: use NewTokenTransport, this one always uses http.DefaultTransport and refreshes a copy of the token
+func NewTokenTranport(t Token) *TokenTransport {
+	return NewTokenTransport(&t, nil)
+}
+
+// Same as NewTokenTransport but refreshed tokens are saved in the store under key
+func NewStoredTokenTransport(t *Token, store TokenStore, key string) *TokenTransport {
+	tt := NewTokenTransport(t, t.baseTransport())
+	tt.OnRefresh = func(token *Token) error {
+		return store.Save(key, token)
+	}
+	return tt
+}
+
+// Current value of the Authorization header, refresh the token first if it expired
+func (tt *TokenTransport) authorization(ctx context.Context) (string, error) {
+	if err := tt.refreshExpired(ctx); err != nil {
+		return "", err
+	}
+
+	return tt.token.authorizationHeader(), nil
+}
+
+func (tt *TokenTransport) refreshExpired(ctx context.Context) error {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	if tt.token.ExpiredWithin(tt.ExpirySkew) {
+		if !tt.token.IsRefreshable() {
+			return fmt.Errorf("%w, token for %s expired and cannot be refreshed", ErrReauthRequired, tt.token.Provider)
+		}
+
+		previous := tt.token.snapshot()
+		if err := tt.token.RefreshContext(ctx); err != nil {
+			return err
+		}
+
+		if tt.OnRefresh != nil && !previous.Equal(tt.token) {
+			if err := tt.OnRefresh(tt.token); err != nil {
+				return err
+			}
+		}
 	}
+
+	return nil
 }
 
-func (tt *TokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+// The token type is used as the auth scheme ("bearer" becomes "Bearer"), Bearer when the provider didn't send one
+func (t *Token) authorizationHeader() string {
+	state := t.state()
+	state.Lock()
+	defer state.Unlock()
+
+	if t.Type == "" {
+		return "Bearer " + t.Value
+	}
+	if strings.EqualFold(t.Type, oauth2.TokenTypeDPoP) {
+		return oauth2.TokenTypeDPoP + " " + t.Value
+	}
+	return strings.ToUpper(t.Type[:1]) + strings.ToLower(t.Type[1:]) + " " + t.Value
+}
+
+// Send the request with the token, the Observer of the Authy instance the token came from gets an OperationAPI
+// observation
+func (tt *TokenTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if !tt.unobserved {
+		done := tt.token.authy.observe(tt.token.Provider, OperationAPI)
+		defer func() { done(err) }()
+	}
+
+	return tt.roundTrip(req)
+}
+
+func (tt *TokenTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if tt.token.Version == 1 {
+		return tt.roundTripOAuth1(req)
+	}
+
+	authorization, err := tt.authorization(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
 	// make a copy of the request object (requested by RoundTripper interface)
 	newReq := *req
 
@@ -137,16 +552,55 @@ func (tt *TokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 		newReq.Header[name] = valCopy
 	}
 
-	if !tt.token.Expired() {
-		newReq.Header["Authorization"] = []string{"Bearer " + tt.token.Value}
-	}
+	newReq.Header["Authorization"] = []string{authorization}
 
 	return tt.transport.RoundTrip(&newReq)
 }
 
-// Return a http.Client to be used to query distant APIs
-func (t Token) Client() *http.Client {
+// OAuth1 tokens don't expire, each request is signed with the token credentials instead
+func (tt *TokenTransport) roundTripOAuth1(req *http.Request) (*http.Response, error) {
+	providerConfig, ok := tt.token.authy.providers[tt.token.Provider]
+	if ok != true {
+		return nil, fmt.Errorf("%w %s", ErrUnknownProvider, tt.token.Provider)
+	}
+
+	// signing may read the body, work on a copy of the request
+	newReq := req.Clone(req.Context())
+	if err := oauth1.Sign(newReq, providerConfig, oauth1.Token{Token: tt.token.Value, Secret: tt.token.Secret}); err != nil {
+		return nil, err
+	}
+
+	return tt.transport.RoundTrip(newReq)
+}
+
+// Send the requests of Client and StoredClient through the given transport instead of http.DefaultTransport, the
+// token transport wraps it to add the Authorization header
+func (t *Token) SetTransport(base http.RoundTripper) {
+	state := t.state()
+	state.Lock()
+	defer state.Unlock()
+
+	t.transport = base
+}
+
+func (t *Token) baseTransport() http.RoundTripper {
+	state := t.state()
+	state.Lock()
+	defer state.Unlock()
+
+	return t.transport
+}
+
+// Return a http.Client to be used to query distant APIs, the token is updated in place when refreshed
+func (t *Token) Client() *http.Client {
+	return &http.Client{
+		Transport: NewTokenTransport(t, t.baseTransport()),
+	}
+}
+
+// Same as Client but refreshed tokens are saved in the store under the given key
+func (t *Token) StoredClient(store TokenStore, key string) *http.Client {
 	return &http.Client{
-		Transport: NewTokenTranport(t),
+		Transport: NewStoredTokenTransport(t, store, key),
 	}
 }
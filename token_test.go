@@ -0,0 +1,667 @@
+package authy_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/authytest"
+	"github.com/christopherobin/authy/oauth2"
+	"github.com/christopherobin/authy/provider"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenRefresh(t *testing.T) {
+	Convey("Refresh a token whose consent was revoked", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		a, err := MockAuthy("revoking", server.URL+"/oauth2", server.URL+"/oauth2/revoked")
+		So(err, ShouldEqual, nil)
+
+		token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"revoking","value":"abc","refresh_token":"def"}`))
+		So(err, ShouldEqual, nil)
+
+		err = token.Refresh()
+		So(errors.Is(err, authy.ErrConsentRevoked), ShouldBeTrue)
+		So(errors.Is(err, authy.ErrReauthRequired), ShouldBeTrue)
+
+		var oauthErr oauth2.Error
+		So(errors.As(err, &oauthErr), ShouldBeTrue)
+		So(oauthErr.Code, ShouldEqual, "invalid_grant")
+	})
+
+	Convey("Keep the refresh token when the provider doesn't send a new one", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		a, err := MockAuthy("keeping", server.URL+"/oauth2", server.URL+"/oauth2")
+		So(err, ShouldEqual, nil)
+
+		token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"keeping","value":"abc","refresh_token":"def"}`))
+		So(err, ShouldEqual, nil)
+
+		So(token.Refresh(), ShouldEqual, nil)
+		So(token.Value, ShouldEqual, "fakeaccesstoken")
+		So(token.RefreshToken, ShouldEqual, "def")
+		So(token.IsRefreshable(), ShouldBeTrue)
+	})
+
+	Convey("Replace the refresh token on providers rotating them", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		a, err := MockAuthy("rotating", server.URL+"/oauth2", server.URL+"/oauth2/offline")
+		So(err, ShouldEqual, nil)
+
+		token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"rotating","value":"abc","refresh_token":"def"}`))
+		So(err, ShouldEqual, nil)
+
+		So(token.Refresh(), ShouldEqual, nil)
+		So(token.RefreshToken, ShouldEqual, "fakerefreshtoken")
+	})
+}
+
+func TestTokenVersions(t *testing.T) {
+	Convey("Refresh depends on the OAuth version of the token", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		a, err := MockAuthy("versions", server.URL+"/oauth2", server.URL+"/oauth2/offline")
+		So(err, ShouldEqual, nil)
+
+		Convey("OAuth2 tokens with a refresh token are refreshable", func() {
+			token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"versions","value":"abc","refresh_token":"def"}`))
+			So(err, ShouldEqual, nil)
+			So(token.IsRefreshable(), ShouldBeTrue)
+			So(token.Refresh(), ShouldEqual, nil)
+			So(token.Value, ShouldEqual, "fakeaccesstoken")
+
+			Convey("But not without one", func() {
+				token.RefreshToken = ""
+				So(token.IsRefreshable(), ShouldBeFalse)
+				So(token.Refresh(), ShouldNotEqual, nil)
+			})
+		})
+
+		Convey("OAuth1 tokens are never refreshable", func() {
+			token, err := a.TokenFromSerialized([]byte(`{"version":1,"provider":"versions","value":"abc","secret":"def","refresh_token":"ghi"}`))
+			So(err, ShouldEqual, nil)
+			So(token.IsRefreshable(), ShouldBeFalse)
+			So(errors.Is(token.Refresh(), authy.ErrRefreshNotSupported), ShouldBeTrue)
+		})
+
+		Convey("Unknown versions are rejected", func() {
+			token, err := a.TokenFromSerialized([]byte(`{"version":3,"provider":"versions","value":"abc","refresh_token":"def"}`))
+			So(err, ShouldEqual, nil)
+			So(token.IsRefreshable(), ShouldBeFalse)
+			So(errors.Is(token.Refresh(), authy.ErrNotImplemented), ShouldBeTrue)
+		})
+	})
+}
+
+func TestTokenString(t *testing.T) {
+	Convey("Printing a token or the config masks the secrets", t, func() {
+		a, err := authy.NewAuthy(config)
+		So(err, ShouldEqual, nil)
+
+		token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"github","value":"supersecretaccesstoken","refresh_token":"supersecretrefreshtoken"}`))
+		So(err, ShouldEqual, nil)
+
+		for _, printed := range []string{fmt.Sprint(token), fmt.Sprintf("%+v", *token), fmt.Sprintf("%#v", token)} {
+			So(printed, ShouldNotContainSubstring, "supersecretaccesstoken")
+			So(printed, ShouldNotContainSubstring, "supersecretrefreshtoken")
+			So(printed, ShouldContainSubstring, "supe***(22)")
+		}
+		So(token.RawValue(), ShouldEqual, "supersecretaccesstoken")
+
+		So(fmt.Sprintf("%+v", config), ShouldNotContainSubstring, "my-secret")
+
+		keyed := authy.Config{
+			StateKey:    "supersecretstatekey",
+			StateCookie: &authy.StateCookie{Key: "supersecretcookiekey0123456789abcdef"},
+		}
+		printed := fmt.Sprintf("%v %+v %#v %v %#v", keyed, keyed, keyed, keyed.StateCookie, *keyed.StateCookie)
+		So(printed, ShouldNotContainSubstring, "supersecretstatekey")
+		So(printed, ShouldNotContainSubstring, "supersecretcookiekey")
+		So(printed, ShouldContainSubstring, "supe***(36)")
+	})
+}
+
+func TestHasScope(t *testing.T) {
+	Convey("Check the granted scopes", t, func() {
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"github": provider.ProviderConfig{Key: "my-key", Secret: "my-secret"},
+				"google": provider.ProviderConfig{Key: "my-key", Secret: "my-secret"},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"github","value":"abc","scope":["repo","user:email"]}`))
+		So(err, ShouldEqual, nil)
+		So(token.HasScope("repo"), ShouldBeTrue)
+		So(token.HasScope("admin:org"), ShouldBeFalse)
+		So(token.HasAllScopes("repo", "user:email"), ShouldBeTrue)
+		So(token.HasAllScopes("repo", "admin:org"), ShouldBeFalse)
+
+		Convey("Google scopes have short names", func() {
+			token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"google","value":"abc","scope":["openid","https://www.googleapis.com/auth/userinfo.email"]}`))
+			So(err, ShouldEqual, nil)
+			So(token.HasAllScopes("openid", "email"), ShouldBeTrue)
+			So(token.HasScope("https://www.googleapis.com/auth/userinfo.email"), ShouldBeTrue)
+			So(token.HasScope("profile"), ShouldBeFalse)
+		})
+	})
+}
+
+func TestRevalidate(t *testing.T) {
+	Convey("Revalidate the token stored in session", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		session := authytest.NewSession()
+
+		Convey("Token is still valid", func() {
+			a, err := MockAuthy("revalidate", server.URL+"/oauth2", server.URL+"/oauth2")
+			So(err, ShouldEqual, nil)
+
+			session.Set("authy.token.revalidate", []byte(`{"version":2,"provider":"revalidate","value":"abc","refresh_token":"def"}`))
+
+			token, changed, err := a.Revalidate(session, "revalidate")
+			So(err, ShouldEqual, nil)
+			So(changed, ShouldBeFalse)
+			So(token.Value, ShouldEqual, "abc")
+		})
+
+		Convey("Token expired and is refreshed", func() {
+			a, err := MockAuthy("revalidate", server.URL+"/oauth2", server.URL+"/oauth2")
+			So(err, ShouldEqual, nil)
+
+			session.Set("authy.token.revalidate", []byte(`{"version":2,"provider":"revalidate","value":"abc","refresh_token":"def","expires":"2000-01-01T00:00:00Z"}`))
+
+			token, changed, err := a.Revalidate(session, "revalidate")
+			So(err, ShouldEqual, nil)
+			So(changed, ShouldBeTrue)
+			So(token.Value, ShouldEqual, "fakeaccesstoken")
+
+			stored, err := a.TokenFromSerialized(session.Get("authy.token.revalidate").([]byte))
+			So(err, ShouldEqual, nil)
+			So(stored.Value, ShouldEqual, "fakeaccesstoken")
+		})
+
+		Convey("Token expired and refresh fails", func() {
+			a, err := MockAuthy("revalidate", server.URL+"/oauth2", server.URL+"/oauth2/revoked")
+			So(err, ShouldEqual, nil)
+
+			session.Set("authy.token.revalidate", []byte(`{"version":2,"provider":"revalidate","value":"abc","refresh_token":"def","expires":"2000-01-01T00:00:00Z"}`))
+
+			token, changed, err := a.Revalidate(session, "revalidate")
+			So(errors.Is(err, authy.ErrConsentRevoked), ShouldBeTrue)
+			So(changed, ShouldBeFalse)
+			So(token, ShouldBeNil)
+		})
+
+		Convey("Token without value", func() {
+			a, err := MockAuthy("revalidate", server.URL+"/oauth2", server.URL+"/oauth2")
+			So(err, ShouldEqual, nil)
+
+			session.Set("authy.token.revalidate", []byte(`{"version":2,"provider":"revalidate","value":""}`))
+
+			token, _, err := a.Revalidate(session, "revalidate")
+			So(errors.Is(err, authy.ErrReauthRequired), ShouldBeTrue)
+			So(token, ShouldBeNil)
+		})
+
+		Convey("Token stored by an older version", func() {
+			a, err := MockAuthy("revalidate", server.URL+"/oauth2", server.URL+"/oauth2")
+			So(err, ShouldEqual, nil)
+
+			session.Set("authy.token", []byte(`{"version":2,"provider":"revalidate","value":"abc"}`))
+
+			token, _, err := a.Revalidate(session, "revalidate")
+			So(err, ShouldEqual, nil)
+			So(token.Value, ShouldEqual, "abc")
+			So(session.Get("authy.token"), ShouldBeNil)
+			So(session.Get("authy.token.revalidate"), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestRevalidateAll(t *testing.T) {
+	Convey("Keep a token per provider in session", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		provider.RegisterProvider(provider.New("linked", server.URL+"/oauth2", server.URL+"/oauth2"))
+		config := MockConfig("main", server.URL+"/oauth2", server.URL+"/oauth2")
+		config.Providers["linked"] = provider.ProviderConfig{Key: "my-key", Secret: "my-secret"}
+		a, err := authy.NewAuthy(config)
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		mainToken, _, err := MockLogin(a, "main", session)
+		So(err, ShouldEqual, nil)
+		So(a.SaveToken(session, mainToken), ShouldEqual, nil)
+		linkedToken, _, err := MockLogin(a, "linked", session)
+		So(err, ShouldEqual, nil)
+		So(a.SaveToken(session, linkedToken), ShouldEqual, nil)
+
+		tokens, changed := a.RevalidateAll(session)
+		So(changed, ShouldBeFalse)
+		So(tokens, ShouldHaveLength, 2)
+
+		token, ok := authy.PickToken(tokens)
+		So(ok, ShouldBeTrue)
+		So(token.Provider, ShouldEqual, "linked")
+
+		token, ok = authy.PickToken(tokens, "main", "linked")
+		So(ok, ShouldBeTrue)
+		So(token.Provider, ShouldEqual, "main")
+
+		_, ok = authy.PickToken(tokens, "main", "github")
+		So(ok, ShouldBeFalse)
+
+		// no refresh token was issued so the expired token cannot be used anymore
+		Convey("Unusable tokens are removed", func() {
+			linkedToken.Expires = &time.Time{}
+			So(a.SaveToken(session, linkedToken), ShouldEqual, nil)
+
+			tokens, changed := a.RevalidateAll(session)
+			So(changed, ShouldBeTrue)
+			So(tokens, ShouldHaveLength, 1)
+			So(tokens["main"], ShouldNotBeNil)
+			So(session.Get(authy.TokenSessionKey("linked")), ShouldBeNil)
+		})
+
+		Convey("Tokens are kept when the request is cancelled during a refresh", func() {
+			linkedToken.Expires = &time.Time{}
+			linkedToken.RefreshToken = "refresh"
+			So(a.SaveToken(session, linkedToken), ShouldEqual, nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			So(errors.Is(linkedToken.RefreshContext(ctx), context.Canceled), ShouldBeTrue)
+
+			tokens, _ := a.RevalidateAllContext(ctx, session)
+			So(tokens, ShouldHaveLength, 1)
+			So(session.Get(authy.TokenSessionKey("linked")), ShouldNotBeNil)
+		})
+
+		Convey("Tokens are only removed when the provider rejects the refresh", func() {
+			fake := authytest.NewServer()
+			Reset(fake.Close)
+
+			p := fake.Provider("fake")
+			a, err := authy.NewAuthy(authy.Config{
+				Providers: map[string]provider.ProviderConfig{
+					"fake": provider.ProviderConfig{Inline: &p, Key: "my-key", Secret: "my-secret"},
+				},
+			})
+			So(err, ShouldEqual, nil)
+
+			session := authytest.NewSession()
+			authorizeURL, err := a.Authorize("fake", session, MockHttpRequest("http://localhost:2000/authy/fake"))
+			So(err, ShouldEqual, nil)
+			callback, err := fake.Callback(authorizeURL)
+			So(err, ShouldEqual, nil)
+			token, _, err := a.Access("fake", session, callback)
+			So(err, ShouldEqual, nil)
+			token.Expires = &time.Time{}
+			So(a.SaveToken(session, token), ShouldEqual, nil)
+
+			fake.SetError(oauth2.CodeTemporarilyUnavailable, "down for maintenance")
+			tokens, _ := a.RevalidateAll(session)
+			So(tokens, ShouldBeEmpty)
+			So(session.Get(authy.TokenSessionKey("fake")), ShouldNotBeNil)
+
+			fake.SetError(oauth2.CodeInvalidGrant, "refresh token was revoked")
+			tokens, changed := a.RevalidateAll(session)
+			So(tokens, ShouldBeEmpty)
+			So(changed, ShouldBeTrue)
+			So(session.Get(authy.TokenSessionKey("fake")), ShouldBeNil)
+		})
+
+		Convey("Tokens are kept when the provider can't be reached", func() {
+			linkedToken.Expires = &time.Time{}
+			linkedToken.RefreshToken = "refresh"
+			So(a.SaveToken(session, linkedToken), ShouldEqual, nil)
+			server.Close()
+
+			tokens, _ := a.RevalidateAll(session)
+			So(tokens, ShouldHaveLength, 1)
+			So(session.Get(authy.TokenSessionKey("linked")), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestTokenFingerprint(t *testing.T) {
+	Convey("Fingerprint a token", t, func() {
+		a, err := authy.NewAuthy(config)
+		So(err, ShouldEqual, nil)
+
+		token, _ := a.TokenFromSerialized([]byte(`{"version":2,"provider":"github","value":"my-secret-token"}`))
+		sameToken, _ := a.TokenFromSerialized([]byte(`{"version":2,"provider":"github","value":"my-secret-token"}`))
+		otherToken, _ := a.TokenFromSerialized([]byte(`{"version":2,"provider":"github","value":"my-other-token"}`))
+
+		So(token.Fingerprint(), ShouldEqual, sameToken.Fingerprint())
+		So(token.Fingerprint(), ShouldNotEqual, otherToken.Fingerprint())
+		So(token.Fingerprint(), ShouldHaveLength, 32)
+		So(token.Fingerprint(), ShouldNotContainSubstring, "my-secret-token")
+	})
+}
+
+func TestTokenEqual(t *testing.T) {
+	Convey("Compare tokens by value", t, func() {
+		a, err := authy.NewAuthy(config)
+		So(err, ShouldEqual, nil)
+
+		serialized := `{"version":2,"provider":"github","value":"abc","refresh_token":"def","type":"bearer",` +
+			`"scope":["repo"],"expires":"2030-01-01T00:00:00Z"}`
+		token, _ := a.TokenFromSerialized([]byte(serialized))
+		sameToken, _ := a.TokenFromSerialized([]byte(serialized))
+		So(token.Equal(sameToken), ShouldBeTrue)
+		So(token.Equal(token), ShouldBeTrue)
+
+		Convey("Unexported and informative fields are ignored", func() {
+			sameToken.IDToken = "id"
+			sameToken.Extra = map[string]string{"X-Request-Id": "1"}
+			expires := token.Expires.In(time.FixedZone("CET", 3600))
+			sameToken.Expires = &expires
+			So(token.Equal(sameToken), ShouldBeTrue)
+			So(token.Equal(&authy.Token{Version: 2, Provider: "github", Value: "abc", RefreshToken: "def",
+				Type: "bearer", Scope: []string{"repo"}, Expires: token.Expires}), ShouldBeTrue)
+		})
+
+		Convey("Any compared field differs", func() {
+			otherToken := *sameToken
+			otherToken.Value = "abd"
+			So(token.Equal(&otherToken), ShouldBeFalse)
+
+			otherToken = *sameToken
+			otherToken.RefreshToken = ""
+			So(token.Equal(&otherToken), ShouldBeFalse)
+
+			otherToken = *sameToken
+			otherToken.Expires = nil
+			So(token.Equal(&otherToken), ShouldBeFalse)
+
+			otherToken = *sameToken
+			otherToken.Scope = []string{"repo", "user"}
+			So(token.Equal(&otherToken), ShouldBeFalse)
+
+			otherToken = *sameToken
+			otherToken.Provider = "gitlab"
+			So(token.Equal(&otherToken), ShouldBeFalse)
+		})
+
+		Convey("Nil tokens", func() {
+			var nilToken *authy.Token
+			So(token.Equal(nil), ShouldBeFalse)
+			So(nilToken.Equal(token), ShouldBeFalse)
+			So(nilToken.Equal(nil), ShouldBeTrue)
+		})
+	})
+}
+
+func TestStoredClient(t *testing.T) {
+	Convey("Refreshed tokens are saved in the token store", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		a, err := MockAuthy("stored", server.URL+"/oauth2", server.URL+"/oauth2")
+		So(err, ShouldEqual, nil)
+
+		token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"stored","value":"abc","refresh_token":"def","expires":"2000-01-01T00:00:00Z"}`))
+		So(err, ShouldEqual, nil)
+
+		store := &FakeTokenStore{
+			tokens: map[string]*authy.Token{},
+		}
+
+		resp, err := token.StoredClient(store, "user-1").Get(server.URL + "/api")
+		So(err, ShouldEqual, nil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		So(string(body), ShouldEqual, "Bearer fakeaccesstoken")
+
+		stored, err := store.Load("user-1")
+		So(err, ShouldEqual, nil)
+		So(stored.Value, ShouldEqual, "fakeaccesstoken")
+	})
+}
+
+func TestTokenTransport(t *testing.T) {
+	Convey("Refresh expired tokens before sending requests", t, func() {
+		server := MockOAuthServer(t)
+		Reset(server.Close)
+
+		Convey("Token is refreshed in place", func() {
+			a, err := MockAuthy("transport", server.URL+"/oauth2", server.URL+"/oauth2")
+			So(err, ShouldEqual, nil)
+
+			token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"transport","value":"abc","refresh_token":"def","expires":"2000-01-01T00:00:00Z"}`))
+			So(err, ShouldEqual, nil)
+
+			var refreshed *authy.Token
+			transport := authy.NewTokenTransport(token, nil)
+			transport.OnRefresh = func(t *authy.Token) error {
+				refreshed = t
+				return nil
+			}
+
+			resp, err := (&http.Client{Transport: transport}).Get(server.URL + "/api")
+			So(err, ShouldEqual, nil)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			So(string(body), ShouldEqual, "Bearer fakeaccesstoken")
+
+			So(token.Value, ShouldEqual, "fakeaccesstoken")
+			So(refreshed, ShouldEqual, token)
+		})
+
+		Convey("The deprecated constructor takes a copy of the token", func() {
+			a, err := MockAuthy("transport", server.URL+"/oauth2", server.URL+"/oauth2")
+			So(err, ShouldEqual, nil)
+
+			token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"transport","value":"abc","refresh_token":"def","expires":"2000-01-01T00:00:00Z"}`))
+			So(err, ShouldEqual, nil)
+
+			resp, err := (&http.Client{Transport: authy.NewTokenTranport(*token)}).Get(server.URL + "/api")
+			So(err, ShouldEqual, nil)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			So(string(body), ShouldEqual, "Bearer fakeaccesstoken")
+			So(token.Value, ShouldEqual, "abc")
+		})
+
+		Convey("Requests go through the inner transport", func() {
+			a, err := MockAuthy("transport", server.URL+"/oauth2", server.URL+"/oauth2")
+			So(err, ShouldEqual, nil)
+
+			token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"transport","value":"abc","refresh_token":"def","expires":"2000-01-01T00:00:00Z"}`))
+			So(err, ShouldEqual, nil)
+
+			var paths []string
+			var mu sync.Mutex
+			token.SetTransport(RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				mu.Lock()
+				paths = append(paths, r.URL.Path)
+				mu.Unlock()
+				return http.DefaultTransport.RoundTrip(r)
+			}))
+
+			resp, err := token.Client().Get(server.URL + "/api")
+			So(err, ShouldEqual, nil)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			So(string(body), ShouldEqual, "Bearer fakeaccesstoken")
+			So(paths, ShouldContain, "/api")
+
+			transport := authy.NewTokenTransport(token, RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				return nil, errors.New("offline")
+			}))
+			_, err = (&http.Client{Transport: transport}).Get(server.URL + "/api")
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "offline")
+		})
+
+		Convey("Token type is used as the auth scheme", func() {
+			a, err := MockAuthy("transport", server.URL+"/oauth2", server.URL+"/oauth2")
+			So(err, ShouldEqual, nil)
+
+			for tokenType, expected := range map[string]string{"bearer": "Bearer abc", "": "Bearer abc", "MAC": "Mac abc"} {
+				token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"transport","value":"abc","type":"` + tokenType + `"}`))
+				So(err, ShouldEqual, nil)
+
+				resp, err := token.Client().Get(server.URL + "/api")
+				So(err, ShouldEqual, nil)
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				So(string(body), ShouldEqual, expected)
+			}
+		})
+
+		Convey("Expired token without refresh token", func() {
+			a, err := MockAuthy("transport", server.URL+"/oauth2", server.URL+"/oauth2")
+			So(err, ShouldEqual, nil)
+
+			token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"transport","value":"abc","expires":"2000-01-01T00:00:00Z"}`))
+			So(err, ShouldEqual, nil)
+
+			_, err = token.Client().Get(server.URL + "/api")
+			So(errors.Is(err, authy.ErrReauthRequired), ShouldBeTrue)
+		})
+
+		Convey("Refresh fails", func() {
+			a, err := MockAuthy("transport", server.URL+"/oauth2", server.URL+"/oauth2/revoked")
+			So(err, ShouldEqual, nil)
+
+			token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"transport","value":"abc","refresh_token":"def","expires":"2000-01-01T00:00:00Z"}`))
+			So(err, ShouldEqual, nil)
+
+			_, err = token.Client().Get(server.URL + "/api")
+			So(errors.Is(err, authy.ErrConsentRevoked), ShouldBeTrue)
+			So(token.Value, ShouldEqual, "abc")
+		})
+	})
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	Convey("Refresh a token shared by several goroutines", t, func() {
+		var refreshes int32
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&refreshes, 1)
+			// give the other goroutines time to pile up behind this refresh
+			time.Sleep(100 * time.Millisecond)
+			rw.Write([]byte("access_token=fakeaccesstoken&refresh_token=newrefreshtoken&token_type=example"))
+		}))
+		Reset(server.Close)
+
+		a, err := MockAuthy("concurrent", server.URL+"/oauth2", server.URL+"/oauth2")
+		So(err, ShouldEqual, nil)
+
+		token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"concurrent","value":"abc","refresh_token":"def"}`))
+		So(err, ShouldEqual, nil)
+		// copies taken before the first refresh share its lock too
+		copied := *token
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for i := 0; i < 20; i++ {
+			shared := token
+			if i%2 == 1 {
+				shared = &copied
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- shared.Refresh()
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			So(err, ShouldEqual, nil)
+		}
+		So(atomic.LoadInt32(&refreshes), ShouldEqual, 1)
+		So(token.Value, ShouldEqual, "fakeaccesstoken")
+		So(token.RefreshToken, ShouldEqual, "newrefreshtoken")
+		So(copied.Value, ShouldEqual, "fakeaccesstoken")
+	})
+}
+
+func TestExpiredWithin(t *testing.T) {
+	Convey("Consider tokens about to expire as expired", t, func() {
+		expires := time.Now().Add(30 * time.Second)
+		token := authy.Token{Expires: &expires}
+
+		So(token.ExpiredWithin(0), ShouldBeFalse)
+		So(token.ExpiredWithin(time.Minute), ShouldBeTrue)
+
+		Convey("Expired uses the default skew", func() {
+			So(token.Expired(), ShouldBeTrue)
+
+			later := time.Now().Add(time.Hour)
+			token.Expires = &later
+			So(token.Expired(), ShouldBeFalse)
+		})
+
+		Convey("Tokens without expiry never expire", func() {
+			So((&authy.Token{}).ExpiredWithin(time.Hour), ShouldBeFalse)
+		})
+	})
+}
+
+func TestValid(t *testing.T) {
+	Convey("Tokens are valid when they have a value and are not expired", t, func() {
+		later := time.Now().Add(time.Hour)
+		So((&authy.Token{Value: "abc", Expires: &later}).Valid(), ShouldBeTrue)
+		So((&authy.Token{Value: "abc"}).Valid(), ShouldBeTrue)
+
+		expires := time.Now().Add(30 * time.Second)
+		So((&authy.Token{Value: "abc", Expires: &expires}).Valid(), ShouldBeFalse)
+		So((&authy.Token{Expires: &later}).Valid(), ShouldBeFalse)
+
+		Convey("Nil and zero value tokens are not valid", func() {
+			var token *authy.Token
+			So(token.Valid(), ShouldBeFalse)
+			So((&authy.Token{}).Valid(), ShouldBeFalse)
+		})
+	})
+}
+
+func TestTokenExpiresJSON(t *testing.T) {
+	Convey("Decode the expiry date of serialized tokens", t, func() {
+		a, err := authy.NewAuthy(config)
+		So(err, ShouldEqual, nil)
+
+		Convey("Current format", func() {
+			token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"github","value":"abc","expires":"2030-01-01T00:00:00Z"}`))
+			So(err, ShouldEqual, nil)
+			So(token.Expires.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)), ShouldBeTrue)
+
+			data, err := token.Serialize()
+			So(err, ShouldEqual, nil)
+			So(string(data), ShouldContainSubstring, `"expires":"2030-01-01T00:00:00Z"`)
+			So(string(data), ShouldNotContainSubstring, `"time"`)
+		})
+
+		Convey("Legacy format", func() {
+			token, err := a.TokenFromSerialized([]byte(`{"version":2,"provider":"github","value":"abc","time":"2030-01-01T00:00:00Z"}`))
+			So(err, ShouldEqual, nil)
+			So(token.Expires.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)), ShouldBeTrue)
+			So(token.Value, ShouldEqual, "abc")
+		})
+	})
+}
@@ -0,0 +1,123 @@
+package authy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/christopherobin/authy/oauth2"
+	"github.com/christopherobin/authy/provider"
+	"net/http"
+	"strings"
+)
+
+// Profile of the user as returned by the provider
+type UserInfo struct {
+	// Unique identifier of the user on the provider
+	ID    string
+	Name  string
+	Email string
+	// URL of the user's avatar
+	Picture string
+	// The whole response, for provider specific fields
+	Raw map[string]interface{}
+}
+
+// Fetch the profile of the user from the provider's UserInfoURL
+func (t *Token) UserInfo() (*UserInfo, error) {
+	providerConfig, ok := t.authy.providers[t.Provider]
+	if ok != true {
+		return nil, fmt.Errorf("%w %s", ErrUnknownProvider, t.Provider)
+	}
+
+	if providerConfig.Provider.UserInfoURL == "" {
+		return nil, errors.New(fmt.Sprintf("provider %s has no user info URL", t.Provider))
+	}
+
+	return t.UserInfoFrom(providerConfig.Provider.UserInfoURL)
+}
+
+// Same as UserInfo but query the given endpoint, for providers exposing the profile somewhere else
+func (t *Token) UserInfoFrom(endpoint string) (info *UserInfo, err error) {
+	done := t.authy.observe(t.Provider, OperationUserInfo)
+	defer func() { done(err) }()
+
+	resp, err := t.helperClient().Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("user info endpoint returned status %d", resp.StatusCode))
+	}
+
+	// keep numeric ids intact instead of turning them into floats
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	return &UserInfo{
+		ID:      firstField(raw, "sub", "id"),
+		Name:    firstField(raw, "name", "login", "username"),
+		Email:   firstField(raw, "email"),
+		Picture: firstField(raw, "picture", "avatar_url"),
+		Raw:     raw,
+	}, nil
+}
+
+// Same as Client but bounded by the client of the provider config, provider.HTTPClient by default
+func (t *Token) helperClient() *http.Client {
+	base := provider.HTTPClient
+	if providerConfig, ok := t.authy.providers[t.Provider]; ok == true {
+		base = providerConfig.Client()
+	}
+
+	transport := base.Transport
+	if transport == nil {
+		transport = t.baseTransport()
+	}
+	tokenTransport := NewTokenTransport(t, transport)
+	// UserInfoFrom reports its own observation
+	tokenTransport.unobserved = true
+	return &http.Client{Transport: tokenTransport, Timeout: base.Timeout}
+}
+
+// Parse the user JSON Sign in with Apple posts to the callback on the first login, its id is the sub of the id_token
+func callbackProfile(user string, token oauth2.Token) (*UserInfo, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(user), &raw); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid user in callback: %s", err))
+	}
+
+	profile := &UserInfo{
+		Email: firstField(raw, "email"),
+		Raw:   raw,
+	}
+	if name, ok := raw["name"].(map[string]interface{}); ok == true {
+		profile.Name = strings.TrimSpace(firstField(name, "firstName") + " " + firstField(name, "lastName"))
+	}
+	if claims, err := token.Claims(); err == nil {
+		profile.ID = firstField(claims, "sub")
+	}
+
+	return profile, nil
+}
+
+// value of the first of the given fields that is set, OpenID Connect names come first then the common non standard ones
+func firstField(raw map[string]interface{}, names ...string) string {
+	for _, name := range names {
+		switch value := raw[name].(type) {
+		case string:
+			if value != "" {
+				return value
+			}
+		case json.Number:
+			return value.String()
+		}
+	}
+	return ""
+}
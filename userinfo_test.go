@@ -0,0 +1,82 @@
+package authy_test
+
+import (
+	"github.com/christopherobin/authy"
+	"github.com/christopherobin/authy/authytest"
+	"github.com/christopherobin/authy/provider"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserInfo(t *testing.T) {
+	Convey("Fetch the profile of the user", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/oauth2" {
+				rw.Write([]byte("access_token=fakeaccesstoken&token_type=bearer"))
+				return
+			}
+
+			if r.Header.Get("Authorization") != "Bearer fakeaccesstoken" {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			rw.Header().Set("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/userinfo":
+				rw.Write([]byte(`{"sub":"1234","name":"John Doe","email":"john@example.com","picture":"https://example.com/john.png"}`))
+			case "/user":
+				rw.Write([]byte(`{"id":98765432101,"login":"johndoe","avatar_url":"https://example.com/johndoe.png"}`))
+			}
+		}))
+		Reset(server.Close)
+
+		provider.RegisterProvider(provider.New("profile", server.URL+"/oauth2", server.URL+"/oauth2", provider.WithUserInfoURL(server.URL+"/userinfo")))
+		provider.RegisterProvider(provider.New("noprofile", server.URL+"/oauth2", server.URL+"/oauth2"))
+
+		a, err := authy.NewAuthy(authy.Config{
+			Providers: map[string]provider.ProviderConfig{
+				"profile":   provider.ProviderConfig{Key: "my-key", Secret: "my-secret"},
+				"noprofile": provider.ProviderConfig{Key: "my-key", Secret: "my-secret"},
+			},
+		})
+		So(err, ShouldEqual, nil)
+
+		session := authytest.NewSession()
+
+		Convey("OpenID Connect userinfo endpoint", func() {
+			token, _, err := MockLogin(a, "profile", session)
+			So(err, ShouldEqual, nil)
+
+			userInfo, err := token.UserInfo()
+			So(err, ShouldEqual, nil)
+			So(userInfo.ID, ShouldEqual, "1234")
+			So(userInfo.Name, ShouldEqual, "John Doe")
+			So(userInfo.Email, ShouldEqual, "john@example.com")
+			So(userInfo.Picture, ShouldEqual, "https://example.com/john.png")
+		})
+
+		Convey("Provider specific profile endpoint", func() {
+			token, _, err := MockLogin(a, "noprofile", session)
+			So(err, ShouldEqual, nil)
+
+			_, err = token.UserInfo()
+			So(err, ShouldNotEqual, nil)
+
+			userInfo, err := token.UserInfoFrom(server.URL + "/user")
+			So(err, ShouldEqual, nil)
+			So(userInfo.ID, ShouldEqual, "98765432101")
+			So(userInfo.Name, ShouldEqual, "johndoe")
+			So(userInfo.Picture, ShouldEqual, "https://example.com/johndoe.png")
+			So(userInfo.Raw["login"], ShouldEqual, "johndoe")
+		})
+
+		Convey("Rejected token", func() {
+			token := authy.Token{Value: "invalid"}
+			_, err := token.UserInfoFrom(server.URL + "/userinfo")
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}